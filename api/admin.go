@@ -0,0 +1,158 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jeffpierce/cassabon/config"
+	"github.com/jeffpierce/cassabon/logging"
+)
+
+// rollupView describes one rollup definition of the effective configuration.
+type rollupView struct {
+	Expression string             `json:"expression"`
+	Method     string             `json:"method"`
+	Windows    []rollupTestWindow `json:"windows"`
+}
+
+// adminFlushHandler processes "POST /admin/flush", which has everything accumulated so far written now,
+// rather than when each window closes.
+func (api *CassabonAPI) adminFlushHandler(w http.ResponseWriter, r *http.Request) {
+
+	// Create the channel on which the response will be received.
+	ch := make(chan config.APIQueryResponse)
+
+	config.G.Log.System.LogInfo("Admin request from %s: flush", r.RemoteAddr)
+	q := config.MetricQuery{"FLUSH", nil, 0, 0, false, 0, "", "", false, false, "", requestID(r), ch}
+
+	// Forward the query.
+	select {
+	case config.G.Channels.MetricRequest <- q:
+	default:
+		config.G.Log.System.LogWarn(
+			"Flush request discarded, MetricRequest channel is full (max %d entries)",
+			config.G.Channels.MetricRequestChanLen)
+		logging.Statsd.Client.Inc("api.err.admin.flush", 1, 1.0)
+	}
+
+	// Send the response to the client.
+	api.sendResponse(w, ch, config.G.API.Timeouts.GetMetric)
+}
+
+// adminConfigHandler processes "GET /admin/config", which returns the configuration in effect, as loaded
+// at startup or at the last SIGHUP. API keys are secrets, so only their number is shown.
+func (api *CassabonAPI) adminConfigHandler(w http.ResponseWriter, r *http.Request) {
+
+	apiSettings := config.G.API
+	apiSettings.Keys = nil
+
+	resp := struct {
+		Version string `json:"version"`
+		Log     struct {
+			Logdir   string `json:"logdir"`
+			Loglevel string `json:"loglevel"`
+		} `json:"log"`
+		Statsd        config.StatsdSettings        `json:"statsd"`
+		Carbon        interface{}                  `json:"carbon"`
+		API           interface{}                  `json:"api"`
+		APIKeys       int                          `json:"apikeys"`
+		MetricManager interface{}                  `json:"metricmanager"`
+		Tenants       interface{}                  `json:"tenants"`
+		Index         interface{}                  `json:"index"`
+		Cassandra     config.CassandraSettings     `json:"cassandra"`
+		ElasticSearch config.ElasticSearchSettings `json:"elasticsearch"`
+		Rollups       []rollupView                 `json:"rollups"` // In order of priority
+	}{}
+	resp.Version = config.Version
+	resp.Log.Logdir = config.G.Log.Logdir
+	resp.Log.Loglevel = logging.SeverityToText(config.G.Log.System.GetLogLevel())
+	resp.Statsd = config.G.Statsd
+	resp.Carbon = config.G.Carbon
+	resp.API = apiSettings
+	resp.APIKeys = len(config.G.API.Keys)
+	resp.MetricManager = config.G.MetricManager
+	resp.Tenants = config.G.Tenants
+	resp.Index = config.G.Index
+	resp.Cassandra = *config.Cassandra()
+	resp.ElasticSearch = config.G.ElasticSearch
+	rs := config.Rollups()
+	resp.Rollups = make([]rollupView, 0, len(rs.Priority))
+	for _, expr := range rs.Priority {
+		def := rs.Defs[expr]
+		rv := rollupView{Expression: expr, Method: def.Method.String()}
+		for _, win := range def.Windows {
+			rv.Windows = append(rv.Windows, rollupTestWindow{win.Window.String(), win.Retention.String(), win.Table})
+		}
+		resp.Rollups = append(resp.Rollups, rv)
+	}
+
+	jsonText, err := json.Marshal(resp)
+	if err != nil {
+		api.sendErrorResponse(w, http.StatusInternalServerError, "internal error", err.Error())
+		return
+	}
+	w.Write(jsonText)
+}
+
+// adminResetStatsHandler processes "POST /admin/stats/reset", which sets the counters and timings served
+// to Prometheus back to zero. What has already been sent to statsd is unaffected.
+func (api *CassabonAPI) adminResetStatsHandler(w http.ResponseWriter, r *http.Request) {
+
+	config.G.Log.System.LogInfo("Admin request from %s: reset stats", r.RemoteAddr)
+	if err := logging.Statsd.ResetRecorded(); err != nil {
+		api.sendErrorResponse(w, http.StatusInternalServerError, "internal error", err.Error())
+		return
+	}
+	resp := struct {
+		Reset int64 `json:"reset"` // When the stats were reset, in seconds since the epoch
+	}{time.Now().Unix()}
+	jsonText, _ := json.Marshal(resp)
+	w.Write(jsonText)
+}
+
+// adminLogLevelHandler processes "GET /admin/loglevel", which returns the level of each log, and requests
+// like "PUT /admin/loglevel?level=debug&log=system", which change one with immediate effect. The log
+// defaults to "system", whose configured level is restored at the next SIGHUP.
+func (api *CassabonAPI) adminLogLevelHandler(w http.ResponseWriter, r *http.Request) {
+
+	loggers := map[string]*logging.FileLogger{
+		"system": config.G.Log.System,
+		"carbon": config.G.Log.Carbon,
+		"api":    config.G.Log.API,
+	}
+
+	if r.Method == "PUT" {
+		_ = r.ParseForm()
+		name := strings.ToLower(r.Form.Get("log"))
+		if name == "" {
+			name = "system"
+		}
+		logger, found := loggers[name]
+		if !found {
+			api.sendErrorResponse(w, http.StatusBadRequest, "bad request", fmt.Sprintf("unknown log %q", name))
+			return
+		}
+		if r.Form.Get("level") == "" {
+			api.sendErrorResponse(w, http.StatusBadRequest, "bad request", "no level specified")
+			return
+		}
+		sev, err := logging.TextToSeverity(r.Form.Get("level"))
+		if err != nil {
+			api.sendErrorResponse(w, http.StatusBadRequest, "bad request", err.Error())
+			return
+		}
+		config.G.Log.System.LogInfo("Admin request from %s: set %s log level to %s",
+			r.RemoteAddr, name, logging.SeverityToText(sev))
+		logger.SetLogLevel(sev)
+	}
+
+	levels := make(map[string]string, len(loggers))
+	for name, logger := range loggers {
+		levels[name] = logging.SeverityToText(logger.GetLogLevel())
+	}
+	jsonText, _ := json.Marshal(levels)
+	w.Write(jsonText)
+}
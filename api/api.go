@@ -2,10 +2,14 @@
 package api
 
 import (
+	"crypto/tls"
 	"encoding/json"
+	_ "expvar"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
+	_ "net/http/pprof"
 	"strconv"
 	"strings"
 	"sync"
@@ -16,17 +20,31 @@ import (
 
 	"github.com/jeffpierce/cassabon/config"
 	"github.com/jeffpierce/cassabon/logging"
+	"github.com/jeffpierce/cassabon/render"
 )
 
 type CassabonAPI struct {
 	wg       *sync.WaitGroup
 	server   *web.Mux
+	grpc     *http.Server // The gRPC service, if it is served
 	hostPort string
 }
 
 func (api *CassabonAPI) Start(wg *sync.WaitGroup) {
 	// Add to waitgroup and run go routine.
 	api.hostPort = config.G.API.Listen
+	if tlsConfigured() {
+		// A certificate that can't be loaded on SIGHUP leaves the one in use in place.
+		if err := loadCertificate(); err != nil {
+			if _, loaded := certificate.Load().(*tls.Certificate); !loaded {
+				config.G.Log.System.LogFatal("API unable to load its certificate: %s", err.Error())
+			}
+			config.G.Log.System.LogError("API unable to load its certificate: %s; keeping the certificate in use", err.Error())
+		}
+	}
+	if config.G.API.GRPCListen != "" {
+		api.grpc = api.newGRPCServer(config.G.API.GRPCListen)
+	}
 	api.wg = wg
 	api.wg.Add(1)
 	go api.run()
@@ -35,6 +53,9 @@ func (api *CassabonAPI) Start(wg *sync.WaitGroup) {
 func (api *CassabonAPI) Stop() {
 	config.G.Log.System.LogInfo("API received Stop command, gracefully shutting down.")
 	graceful.Shutdown()
+	if api.grpc != nil {
+		api.grpc.Close()
+	}
 	api.wg.Done()
 }
 
@@ -45,16 +66,99 @@ func (api *CassabonAPI) run() {
 	// Define routes
 	api.server.Get("/", api.rootHandler)
 	api.server.Get("/paths", api.getPathHandler)
+	api.server.Get("/paths/complete", api.completePathHandler)
+	api.server.Get("/paths/stats", api.pathStatsHandler)
 	api.server.Get("/metrics", api.getMetricHandler)
+	api.server.Get("/metrics/find", api.findHandler)
+	api.server.Get("/metrics/live", api.liveHandler)
+	api.server.Get("/render", api.renderHandler)
+	api.server.Get("/tags/autoComplete/tags", api.autoCompleteTagsHandler)
+	api.server.Get("/tags/autoComplete/values", api.autoCompleteValuesHandler)
+	api.server.Post("/metrics/backfill", api.backfillHandler)
+	api.server.Post("/api/v1/read", api.remoteReadHandler)
 	api.server.Get("/healthcheck", api.healthHandler)
+	api.server.Get("/healthz", api.livenessHandler)
+	api.server.Get("/readyz", api.readinessHandler)
+	api.server.Get("/prometheus/metrics", api.prometheusHandler)
+	api.server.Get("/events", api.eventsHandler)
+	api.server.Get("/events/", api.eventsHandler)
+	api.server.Get("/events/get_data", api.eventsHandler)
+	api.server.Post("/events", api.eventsHandler)
+	api.server.Post("/events/", api.eventsHandler)
+	api.server.Post("/search", api.grafanaSearchHandler)
+	api.server.Post("/query", api.grafanaQueryHandler)
+	api.server.Post("/annotations", api.grafanaAnnotationsHandler)
+	api.server.Get("/rollups", api.rulesHandler)
+	api.server.Get("/rollups/test", api.testRollupsHandler)
+	api.server.Post("/rollups/test", api.testRollupsHandler)
+	api.server.Get("/rollups/overrides", api.overridesHandler)
+	api.server.Put("/rollups/overrides", api.overridesHandler)
+	api.server.Delete("/rollups/overrides", api.overridesHandler)
 	api.server.Delete("/paths", api.deletePathHandler)
 	api.server.Delete("/metrics", api.deleteMetricHandler)
+	api.server.Post("/admin/flush", api.adminFlushHandler)
+	api.server.Get("/admin/config", api.adminConfigHandler)
+	api.server.Post("/admin/stats/reset", api.adminResetStatsHandler)
+	api.server.Get("/admin/loglevel", api.adminLogLevelHandler)
+	api.server.Put("/admin/loglevel", api.adminLogLevelHandler)
 	api.server.NotFound(api.notFoundHandler)
 
 	api.server.Use(requestLogger)
+	api.server.Use(crossOrigin)
+	api.server.Use(api.authenticate)
 
 	config.G.Log.System.LogInfo("API initialized, serving!")
-	graceful.ListenAndServe(api.hostPort, api.server)
+	if config.G.API.DebugListen != "" {
+		go api.serveDebug(config.G.API.DebugListen)
+	}
+	if api.grpc != nil {
+		go api.serveGRPC()
+	}
+	var err error
+	if tlsConfigured() {
+		if redirect := config.G.API.TLS.RedirectListen; redirect != "" {
+			go api.redirectToTLS(redirect)
+		}
+		err = api.serveTLS()
+	} else {
+		err = graceful.ListenAndServe(api.hostPort, api.server)
+	}
+	if err != nil {
+		config.G.Log.System.LogError("API unable to serve on %s: %s", api.hostPort, err.Error())
+	}
+}
+
+// redirectToTLS serves plain HTTP on an address, redirecting every request to the same URL over HTTPS.
+func (api *CassabonAPI) redirectToTLS(hostPort string) {
+	_, port, _ := net.SplitHostPort(api.hostPort)
+	redirect := func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		if port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+		status := http.StatusMovedPermanently
+		if r.Method != "GET" && r.Method != "HEAD" {
+			// Unlike a permanent redirect, a temporary one may not be resent as a GET.
+			status = http.StatusTemporaryRedirect
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), status)
+	}
+	if err := graceful.ListenAndServe(hostPort, http.HandlerFunc(redirect)); err != nil {
+		config.G.Log.System.LogError("API unable to redirect to HTTPS on %s: %s", hostPort, err.Error())
+	}
+}
+
+// serveDebug serves pprof, at "/debug/pprof/", and expvar, at "/debug/vars", on an address of their own,
+// so that performance may be profiled without exposing them on the API.
+func (api *CassabonAPI) serveDebug(hostPort string) {
+	config.G.Log.System.LogInfo("API serving pprof and expvar on %s", hostPort)
+	// Importing net/http/pprof and expvar registers their handlers with the default mux.
+	if err := graceful.ListenAndServe(hostPort, http.DefaultServeMux); err != nil {
+		config.G.Log.System.LogError("API unable to serve pprof and expvar on %s: %s", hostPort, err.Error())
+	}
 }
 
 // notFoundHandler is the global 404 handler, used by Goji.
@@ -65,19 +169,29 @@ func (api *CassabonAPI) notFoundHandler(w http.ResponseWriter, r *http.Request)
 // healthHandler responds with either ALIVE or DEAD, for use by the load balancer.
 func (api *CassabonAPI) healthHandler(w http.ResponseWriter, r *http.Request) {
 
-	// We are alive, unless the healthcheck file says we are dead.
-	var alive bool = true
+	if api.alive() {
+		fmt.Fprint(w, "ALIVE")
+	} else {
+		fmt.Fprint(w, "DEAD")
+	}
+}
 
+// alive reports whether we are alive, which we are unless the healthcheck file says we are dead.
+func (api *CassabonAPI) alive() bool {
 	if health, err := ioutil.ReadFile(config.G.API.HealthCheckFile); err == nil {
 		if strings.ToUpper(strings.TrimSpace(string(health))) == "DEAD" {
-			alive = false
+			return false
 		}
 	}
+	return true
+}
 
-	if alive {
-		fmt.Fprint(w, "ALIVE")
-	} else {
-		fmt.Fprint(w, "DEAD")
+// prometheusHandler serves the stats Cassabon reports to statsd, kept since it started, and its memory usage,
+// in the Prometheus text exposition format. It is not "/metrics", which queries the metrics stored.
+func (api *CassabonAPI) prometheusHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	if err := logging.Statsd.WritePrometheus(w); err != nil {
+		api.sendErrorResponse(w, http.StatusInternalServerError, "internal error", err.Error())
 	}
 }
 
@@ -96,7 +210,10 @@ func (api *CassabonAPI) rootHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write(jsonText)
 }
 
-// getPathHandler processes requests like "GET /paths?query=foo".
+// getPathHandler processes requests like "GET /paths?query=foo", and "GET /paths?query=foo&fuzzy=true",
+// which finds paths similar to the query when the index is kept in Elasticsearch. With "expand=true",
+// the branches matched by the leading nodes of the query are returned too, as for graphite-web's expand.
+// With "limit=N", results are returned a page at a time, along with the "offset" of the next page.
 func (api *CassabonAPI) getPathHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Create the channel on which the response will be received.
@@ -104,7 +221,16 @@ func (api *CassabonAPI) getPathHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Extract the query from the request URI.
 	_ = r.ParseForm()
-	q := config.IndexQuery{r.Method, r.Form.Get("query"), ch}
+	tenant, err := api.tenant(r)
+	if err != nil {
+		api.sendErrorResponse(w, http.StatusBadRequest, "bad request", err.Error())
+		return
+	}
+	fuzzy := strings.ToLower(r.Form.Get("fuzzy")) == "true"
+	expand := strings.ToLower(r.Form.Get("expand")) == "true"
+	limit, _ := strconv.Atoi(r.Form.Get("limit"))
+	offset, _ := strconv.Atoi(r.Form.Get("offset"))
+	q := config.IndexQuery{r.Method, r.Form.Get("query"), tenant, fuzzy, expand, limit, offset, "", "", nil, requestID(r), ch}
 	config.G.Log.System.LogDebug("Received paths query: %s %s", q.Method, q.Query)
 
 	// Forward the query.
@@ -121,6 +247,117 @@ func (api *CassabonAPI) getPathHandler(w http.ResponseWriter, r *http.Request) {
 	api.sendResponse(w, ch, config.G.API.Timeouts.GetIndex)
 }
 
+// completePathHandler processes requests like "GET /paths/complete?prefix=servers.web1.cp", returning
+// the nodes that complete the last node of the prefix, for typeahead. A prefix ending in '.' is
+// completed by every child of the branch it names. With "limit=N", the first N are returned as a page.
+func (api *CassabonAPI) completePathHandler(w http.ResponseWriter, r *http.Request) {
+
+	// Create the channel on which the response will be received.
+	ch := make(chan config.APIQueryResponse)
+
+	// Convert the prefix into a query for the nodes beginning with its last node.
+	_ = r.ParseForm()
+	tenant, err := api.tenant(r)
+	if err != nil {
+		api.sendErrorResponse(w, http.StatusBadRequest, "bad request", err.Error())
+		return
+	}
+	limit, _ := strconv.Atoi(r.Form.Get("limit"))
+	q := config.IndexQuery{r.Method, completionQuery(r.Form.Get("prefix")), tenant, false, false, limit, 0, "", "", nil, requestID(r), ch}
+	config.G.Log.System.LogDebug("Received paths completion: %s %s", q.Method, q.Query)
+
+	// Forward the query.
+	select {
+	case config.G.Channels.IndexRequest <- q:
+	default:
+		config.G.Log.System.LogWarn(
+			"Index completion discarded, IndexRequest channel is full (max %d entries)",
+			config.G.Channels.IndexRequestChanLen)
+		logging.Statsd.Client.Inc("api.err.path.complete", 1, 1.0)
+	}
+
+	// Send the response to the client.
+	api.sendResponse(w, ch, config.G.API.Timeouts.GetIndex)
+}
+
+// pathStatsHandler processes "GET /paths/stats", returning the number of leaf paths in the index,
+// by depth and by first node, to show which namespaces drive cardinality.
+func (api *CassabonAPI) pathStatsHandler(w http.ResponseWriter, r *http.Request) {
+
+	// Create the channel on which the response will be received.
+	ch := make(chan config.APIQueryResponse)
+
+	_ = r.ParseForm()
+	tenant, err := api.tenant(r)
+	if err != nil {
+		api.sendErrorResponse(w, http.StatusBadRequest, "bad request", err.Error())
+		return
+	}
+	q := config.IndexQuery{"stats", "", tenant, false, false, 0, 0, "", "", nil, requestID(r), ch}
+	config.G.Log.System.LogDebug("Received paths stats query")
+
+	// Forward the query.
+	select {
+	case config.G.Channels.IndexRequest <- q:
+	default:
+		config.G.Log.System.LogWarn(
+			"Index stats query discarded, IndexRequest channel is full (max %d entries)",
+			config.G.Channels.IndexRequestChanLen)
+		logging.Statsd.Client.Inc("api.err.path.stats", 1, 1.0)
+	}
+
+	// Send the response to the client.
+	api.sendResponse(w, ch, config.G.API.Timeouts.GetIndex)
+}
+
+// findHandler processes requests like "GET /metrics/find?query=foo.*", answering in the form graphite-web
+// does, so that tools written for it work as they are: "format=treejson" (the default), or "format=completer".
+func (api *CassabonAPI) findHandler(w http.ResponseWriter, r *http.Request) {
+
+	// Create the channel on which the response will be received.
+	ch := make(chan config.APIQueryResponse)
+
+	// Extract the query from the request URI.
+	_ = r.ParseForm()
+	tenant, err := api.tenant(r)
+	if err != nil {
+		api.sendErrorResponse(w, http.StatusBadRequest, "bad request", err.Error())
+		return
+	}
+	format := strings.ToLower(r.Form.Get("format"))
+	switch format {
+	case "":
+		format = config.FIND_TREEJSON
+	case config.FIND_TREEJSON, config.FIND_COMPLETER:
+	default:
+		api.sendErrorResponse(w, http.StatusBadRequest, "bad request", "unknown format "+format)
+		return
+	}
+	q := config.IndexQuery{r.Method, r.Form.Get("query"), tenant, false, false, 0, 0, format, "", nil, requestID(r), ch}
+	config.G.Log.System.LogDebug("Received find query: %s %s", q.Method, q.Query)
+
+	// Forward the query.
+	select {
+	case config.G.Channels.IndexRequest <- q:
+	default:
+		config.G.Log.System.LogWarn(
+			"Find query discarded, IndexRequest channel is full (max %d entries)",
+			config.G.Channels.IndexRequestChanLen)
+		logging.Statsd.Client.Inc("api.err.find", 1, 1.0)
+	}
+
+	// Send the response to the client.
+	api.sendResponse(w, ch, config.G.API.Timeouts.GetIndex)
+}
+
+// completionQuery returns the path query matching the nodes that complete a prefix. A '*', '?' or '['
+// in the prefix is matched literally, by enclosing it in a character class of its own.
+func completionQuery(prefix string) string {
+	return globEscaper.Replace(prefix) + "*"
+}
+
+var globEscaper = strings.NewReplacer("*", "[*]", "?", "[?]", "[", "[[]")
+
 // deletePathHandler removes paths from the index store.
 func (api *CassabonAPI) deletePathHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 
@@ -129,7 +366,12 @@ func (api *CassabonAPI) deletePathHandler(c web.C, w http.ResponseWriter, r *htt
 
 	// Extract the query from the request URI.
 	_ = r.ParseForm()
-	q := config.IndexQuery{r.Method, r.Form.Get("query"), ch}
+	tenant, err := api.tenant(r)
+	if err != nil {
+		api.sendErrorResponse(w, http.StatusBadRequest, "bad request", err.Error())
+		return
+	}
+	q := config.IndexQuery{r.Method, r.Form.Get("query"), tenant, false, false, 0, 0, "", "", nil, requestID(r), ch}
 	config.G.Log.System.LogDebug("Received paths query: %s %s", q.Method, q.Query)
 
 	// Forward the query.
@@ -146,7 +388,10 @@ func (api *CassabonAPI) deletePathHandler(c web.C, w http.ResponseWriter, r *htt
 	api.sendResponse(w, ch, config.G.API.Timeouts.DeleteIndex)
 }
 
-// getMetricHandler processes requests like "GET /metrics?query=foo".
+// getMetricHandler processes requests like "GET /metrics?query=foo"; with "format=csv", the series are
+// returned as CSV rows of path, timestamp and value, rather than JSON. With "explain=true", the response
+// also holds an "explain" object, recording the table, step and CQL chosen for each path, the rows read,
+// and how long each stage took.
 func (api *CassabonAPI) getMetricHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Create the channel on which the response will be received.
@@ -154,10 +399,33 @@ func (api *CassabonAPI) getMetricHandler(w http.ResponseWriter, r *http.Request)
 
 	// Extract the query from the request URI.
 	_ = r.ParseForm()
-	from, _ := strconv.Atoi(r.Form.Get("from"))
-	to, _ := strconv.Atoi(r.Form.Get("to"))
-	q := config.MetricQuery{r.Method, r.Form["path"], int64(from), int64(to), false, ch}
-	config.G.Log.System.LogDebug("Received metrics query: %s %v %d %d", q.Method, q.Query, q.From, q.To)
+	tenant, err := api.tenant(r)
+	if err != nil {
+		api.sendErrorResponse(w, http.StatusBadRequest, "bad request", err.Error())
+		return
+	}
+	from, to, err := timeRange(r)
+	if err != nil {
+		api.sendErrorResponse(w, http.StatusBadRequest, "bad request", err.Error())
+		return
+	}
+	maxDataPoints, _ := strconv.Atoi(r.Form.Get("maxDataPoints"))
+	consolidateBy := r.Form.Get("consolidateBy")
+	aggregate := strings.ToLower(r.Form.Get("aggregate"))
+	raw := strings.ToLower(r.Form.Get("raw")) == "true"
+	format := strings.ToLower(r.Form.Get("format"))
+	if format != "" && format != "json" && format != "csv" {
+		api.sendErrorResponse(w, http.StatusBadRequest, "bad request", "unknown format "+format)
+		return
+	}
+	explain := strings.ToLower(r.Form.Get("explain")) == "true"
+	if explain && format == "csv" {
+		api.sendErrorResponse(w, http.StatusBadRequest, "bad request", "an explained query can only be returned as JSON")
+		return
+	}
+	q := config.MetricQuery{r.Method, r.Form["path"], from, to, false, maxDataPoints, consolidateBy, aggregate, raw, explain, tenant, requestID(r), ch}
+	config.G.Log.System.LogDebug("Received metrics query: %s %v %d %d max=%d by=%q agg=%q raw=%v",
+		q.Method, q.Query, q.From, q.To, q.MaxDataPoints, q.ConsolidateBy, q.Aggregate, q.Raw)
 
 	// Forward the query.
 	select {
@@ -170,10 +438,38 @@ func (api *CassabonAPI) getMetricHandler(w http.ResponseWriter, r *http.Request)
 	}
 
 	// Send the response to the client.
-	api.sendResponse(w, ch, config.G.API.Timeouts.GetMetric)
+	if format == "csv" {
+		api.sendCSVResponse(w, ch)
+	} else {
+		api.sendResponse(w, ch, config.G.API.Timeouts.GetMetric)
+	}
+}
+
+// sendCSVResponse sends the series of a metric query's response as rows of path, timestamp and value,
+// as the render endpoint's "format=csv" does.
+func (api *CassabonAPI) sendCSVResponse(w http.ResponseWriter, ch chan config.APIQueryResponse) {
+	payload, err := api.receive(ch, config.G.API.Timeouts.GetMetric)
+	var list []*render.Series
+	if err == nil {
+		list, err = decodeSeries(payload, nil)
+	}
+	if err != nil {
+		if _, isTargetError := err.(*render.TargetError); isTargetError {
+			api.sendErrorResponse(w, http.StatusBadRequest, "bad request", err.Error())
+		} else {
+			api.sendErrorResponse(w, http.StatusInternalServerError, "internal error", err.Error())
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "text/csv")
+	w.Write(render.CSV(list))
 }
 
-// deleteMetricHandler removes data from the metrics store.
+// deleteMetricHandler processes requests like "DELETE /metrics?path=foo.bar&from=1450000000&to=1460000000",
+// which remove data from the metrics store. Unless "dryrun=false", nothing is deleted, and the response
+// reports how many rows would be, with a "confirm" value; to delete them, the request is repeated with
+// "dryrun=false&confirm=..." to the same instance within the next ten minutes. Every deletion, and dry
+// run, is audit logged.
 func (api *CassabonAPI) deleteMetricHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 
 	// Create the channel on which the response will be received.
@@ -181,15 +477,30 @@ func (api *CassabonAPI) deleteMetricHandler(c web.C, w http.ResponseWriter, r *h
 
 	// Extract the query from the request URI.
 	_ = r.ParseForm()
+	tenant, err := api.tenant(r)
+	if err != nil {
+		api.sendErrorResponse(w, http.StatusBadRequest, "bad request", err.Error())
+		return
+	}
 	metric := r.Form["path"]
-	from, _ := strconv.Atoi(r.Form.Get("from"))
-	to, _ := strconv.Atoi(r.Form.Get("to"))
+	from, to, err := timeRange(r)
+	if err != nil {
+		api.sendErrorResponse(w, http.StatusBadRequest, "bad request", err.Error())
+		return
+	}
 	dryrunText := r.Form.Get("dryrun")
 	dryrun := true
 	if strings.ToLower(dryrunText) == "false" || strings.ToLower(dryrunText) == "no" {
 		dryrun = false
 	}
-	q := config.MetricQuery{r.Method, metric, int64(from), int64(to), dryrun, ch}
+	if !dryrun && !deleteConfirmed(r.Form.Get("confirm"), tenant, metric, from, to) {
+		config.G.Log.System.LogWarn("Audit: unconfirmed metric delete by %s refused: tenant=%q paths=%v from=%d to=%d",
+			requester(r), tenant, metric, from, to)
+		api.sendErrorResponse(w, http.StatusConflict, "conflict",
+			"deletion not confirmed: make a dry run of it, and repeat it with the confirm value returned")
+		return
+	}
+	q := config.MetricQuery{r.Method, metric, from, to, dryrun, 0, "", "", false, false, tenant, requestID(r), ch}
 	config.G.Log.System.LogDebug("Received metrics query: %s %v %d %d %v", q.Method, q.Query, q.From, q.To, dryrun)
 
 	// Forward the query.
@@ -202,23 +513,119 @@ func (api *CassabonAPI) deleteMetricHandler(c web.C, w http.ResponseWriter, r *h
 		logging.Statsd.Client.Inc("api.err.metrics.delete", 1, 1.0)
 	}
 
-	// Send the response to the client.
-	api.sendResponse(w, ch, config.G.API.Timeouts.DeleteMetric)
+	// Record the outcome, and send it to the client, with the confirmation of a dry run.
+	payload, err := api.receive(ch, config.G.API.Timeouts.DeleteMetric)
+	if err != nil {
+		config.G.Log.System.LogWarn("Audit: metric delete by %s failed: tenant=%q paths=%v from=%d to=%d: %s",
+			requester(r), tenant, metric, from, to, err.Error())
+		if _, isTargetError := err.(*render.TargetError); isTargetError {
+			api.sendErrorResponse(w, http.StatusBadRequest, "bad request", err.Error())
+		} else {
+			api.sendErrorResponse(w, http.StatusInternalServerError, "internal error", err.Error())
+		}
+		return
+	}
+	auditDelete(r, tenant, metric, from, to, dryrun, payload)
+	if dryrun {
+		var resp map[string]interface{}
+		if err := json.Unmarshal(payload, &resp); err == nil {
+			resp["confirm"] = deleteConfirmation(tenant, metric, from, to, time.Now())
+			payload, _ = json.Marshal(resp)
+		}
+	}
+	w.Write(payload)
+}
+
+// tenant returns the tenant named by a request, in the "tenant" parameter or X-Cassabon-Tenant header.
+// When multi-tenant, every query must name a valid tenant; otherwise, none may.
+func (api *CassabonAPI) tenant(r *http.Request) (string, error) {
+	tenant := r.Form.Get("tenant")
+	if tenant == "" {
+		tenant = r.Header.Get("X-Cassabon-Tenant")
+	}
+	return checkTenant(tenant)
+}
+
+// checkTenant returns the tenant named, if it is valid, as tenant returns it from a request.
+func checkTenant(tenant string) (string, error) {
+	if !config.G.Tenants.Enabled {
+		if tenant != "" {
+			return "", fmt.Errorf("tenancy is not enabled")
+		}
+		return "", nil
+	}
+	if tenant == "" {
+		return "", fmt.Errorf("no tenant specified")
+	}
+	return tenant, config.ValidateTenant(tenant)
+}
+
+// timeRange returns the range of time a request's "from" and "to" parameters give, or with no "to", its
+// "until", in seconds since the epoch. Each may be given as graphite-web accepts them, such as "-1h", with
+// dates in the time zone of the "tz" parameter, or the local one. Each not given is 0.
+func timeRange(r *http.Request) (int64, int64, error) {
+	now := time.Now()
+	if tz := r.Form.Get("tz"); tz != "" {
+		loc, err := time.LoadLocation(tz)
+		if err != nil {
+			return 0, 0, fmt.Errorf("unknown time zone %q", tz)
+		}
+		now = now.In(loc)
+	}
+	var from, to int64
+	var err error
+	if s := r.Form.Get("from"); s != "" {
+		if from, err = render.ParseTime(s, now); err != nil {
+			return 0, 0, err
+		}
+	}
+	s := r.Form.Get("to")
+	if s == "" {
+		s = r.Form.Get("until")
+	}
+	if s != "" {
+		if to, err = render.ParseTime(s, now); err != nil {
+			return 0, 0, err
+		}
+	}
+	return from, to, nil
 }
 
 func (api *CassabonAPI) sendResponse(w http.ResponseWriter, ch chan config.APIQueryResponse, timeout time.Duration) {
 
-	// Read the response.
+	// Read the response. A large response arrives in parts, which are passed on to the client as they arrive.
 	var resp config.APIQueryResponse
-	select {
-	case resp = <-ch:
-		// Nothing, we have our response.
-	case <-time.After(timeout):
-		// The query died or wedged; simulate a timeout response.
-		resp = config.APIQueryResponse{config.AQS_ERROR, fmt.Sprintf("query timed out after %v", timeout), []byte{}}
+	var streamed bool
+	deadline := time.After(timeout)
+	for {
+		select {
+		case resp = <-ch:
+			// Nothing, we have our response.
+		case <-deadline:
+			// The query died or wedged; simulate a timeout response.
+			resp = config.APIQueryResponse{config.AQS_ERROR, fmt.Sprintf("query timed out after %v", timeout), []byte{}}
+		}
+		if resp.Status != config.AQS_PARTIAL {
+			break
+		}
+		w.Write(resp.Payload)
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+		streamed = true
 	}
 	close(ch)
 
+	// Once part of the response has been sent, the status can no longer be changed.
+	if streamed {
+		if resp.Status == config.AQS_OK {
+			w.Write(resp.Payload)
+		} else {
+			config.G.Log.System.LogError("Streamed response truncated: %s", resp.Message)
+		}
+		return
+	}
+
 	// Inspect the response status, and send appropriate response headers/data to client.
 	switch resp.Status {
 	case config.AQS_OK:
@@ -0,0 +1,21 @@
+package api
+
+import (
+	"testing"
+)
+
+func TestCompletionQuery(t *testing.T) {
+	tests := []struct {
+		prefix, query string
+	}{
+		{"servers.web1.cp", "servers.web1.cp*"},
+		{"servers.", "servers.*"},
+		{"servers.web*", "servers.web[*]*"},
+		{"what?.[a-z]", "what[?].[[]a-z]*"},
+	}
+	for _, test := range tests {
+		if query := completionQuery(test.prefix); query != test.query {
+			t.Errorf("Expected %q to be completed by %q, got %q", test.prefix, test.query, query)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package api
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/zenazn/goji/web"
+
+	"github.com/jeffpierce/cassabon/config"
+)
+
+// authenticate handler refuses requests that don't give an API key granting the permission they need,
+// once any keys are configured, or that name a tenant the key isn't granted. The key is given in the
+// X-Cassabon-Key header, or the "apikey" parameter.
+func (api *CassabonAPI) authenticate(c *web.C, h http.Handler) http.Handler {
+
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		needed := requiredPermission(r.Method, r.URL.Path)
+		if status, message := authorize(r, needed); status != http.StatusOK {
+			api.sendErrorResponse(w, status, strings.ToLower(http.StatusText(status)), message)
+			return
+		}
+		if needed != "" && config.G.Tenants.Enabled {
+			_ = r.ParseForm()
+			tenant := r.Form.Get("tenant")
+			if tenant == "" {
+				tenant = r.Header.Get("X-Cassabon-Tenant")
+			}
+			if message := authorizeTenant(r, tenant); message != "" {
+				api.sendErrorResponse(w, http.StatusForbidden, "forbidden", message)
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	}
+
+	return http.HandlerFunc(fn)
+}
+
+// authorize checks that a request gives an API key granting a permission, if any keys are configured and
+// the permission isn't "". If it doesn't, the HTTP status and message with which it is refused are returned.
+func authorize(r *http.Request, needed string) (int, string) {
+	if len(config.G.API.Keys) == 0 || needed == "" {
+		return http.StatusOK, ""
+	}
+
+	if givenKey(r) == "" {
+		return http.StatusUnauthorized, "no API key given"
+	}
+	granted := keyPermissions(r)
+	if granted == nil {
+		return http.StatusUnauthorized, "unknown API key"
+	}
+	if !granted[needed] && !granted[config.API_ADMIN] {
+		return http.StatusForbidden, "API key lacks the permission \"" + needed + "\""
+	}
+	return http.StatusOK, ""
+}
+
+// authorizeTenant checks that a request's API key is granted a tenant. A key granted any tenants may name
+// only those, while one granted none, or "admin", may name any; with no keys configured, tenants are just
+// namespaces. If the key isn't granted the tenant, the message with which the request is refused is returned.
+func authorizeTenant(r *http.Request, tenant string) string {
+	granted := keyPermissions(r)
+	if tenant == "" || granted[config.API_ADMIN] || granted[config.API_TENANT+tenant] {
+		return ""
+	}
+	for p := range granted {
+		if strings.HasPrefix(p, config.API_TENANT) {
+			return "API key isn't granted the tenant \"" + tenant + "\""
+		}
+	}
+	return ""
+}
+
+// givenKey returns the API key a request gives, if any.
+func givenKey(r *http.Request) string {
+	if given := r.Header.Get("X-Cassabon-Key"); given != "" {
+		return given
+	}
+	return r.URL.Query().Get("apikey")
+}
+
+// keyPermissions returns the permissions and tenants granted to the API key a request gives, or nil if it
+// gives none that is configured.
+func keyPermissions(r *http.Request) map[string]bool {
+	given := givenKey(r)
+	if given == "" {
+		return nil
+	}
+	var granted map[string]bool
+	for key, permissions := range config.G.API.Keys {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(given)) == 1 {
+			granted = permissions
+		}
+	}
+	return granted
+}
+
+// requiredPermission returns the permission a request needs, or "" if it needs none, as for the health checks.
+func requiredPermission(method, path string) string {
+	switch {
+	case path == "/" || path == "/healthcheck" || path == "/healthz" || path == "/readyz":
+		return ""
+	case strings.HasPrefix(path, "/admin/"):
+		return config.API_ADMIN
+	case path == "/rollups/overrides" && method != "GET" && method != "HEAD":
+		return config.API_ADMIN
+	case method == "DELETE":
+		return config.API_DELETE
+	case path == "/metrics/backfill" || strings.HasPrefix(path, "/events") && method == "POST":
+		return config.API_WRITE
+	}
+	return config.API_READ
+}
+
+// redactedURI returns the URI of a request, with any API key given in its parameters hidden, for logging.
+func redactedURI(r *http.Request) string {
+	q := r.URL.Query()
+	if q.Get("apikey") == "" {
+		return r.RequestURI
+	}
+	q.Set("apikey", "REDACTED")
+	u := *r.URL
+	u.RawQuery = q.Encode()
+	return u.RequestURI()
+}
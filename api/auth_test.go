@@ -0,0 +1,34 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/jeffpierce/cassabon/config"
+)
+
+func TestAuthorizeTenant(t *testing.T) {
+	defer func() { config.G.API.Keys = nil }()
+	config.G.API.Keys = map[string]map[string]bool{
+		"acme":     {config.API_READ: true, config.API_TENANT + "acme": true},
+		"operator": {config.API_READ: true},
+		"admin":    {config.API_ADMIN: true, config.API_TENANT + "acme": true},
+	}
+
+	tests := []struct {
+		key, tenant string
+		granted     bool
+	}{
+		{"acme", "acme", true},
+		{"acme", "other", false},
+		{"operator", "other", true}, // Granted no tenants, so may name any
+		{"admin", "other", true},
+		{"", "other", true}, // With no key, there is nothing to check it against
+	}
+	for _, test := range tests {
+		r, _ := http.NewRequest("GET", "/paths?apikey="+test.key, nil)
+		if granted := authorizeTenant(r, test.tenant) == ""; granted != test.granted {
+			t.Errorf("Key %q, tenant %q: granted = %v, expected %v", test.key, test.tenant, granted, test.granted)
+		}
+	}
+}
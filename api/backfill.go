@@ -0,0 +1,86 @@
+package api
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/jeffpierce/cassabon/config"
+	"github.com/jeffpierce/cassabon/logging"
+)
+
+// The largest body accepted by the backfill endpoint.
+const maxBackfillSize = 32 << 20
+
+// backfillHandler processes requests like "POST /metrics/backfill", whose body holds historical data
+// points in Carbon plaintext format, one "path value timestamp" per line. The points are rolled up and
+// written straight to the rollup tables, replacing what was stored for the windows they fall in.
+func (api *CassabonAPI) backfillHandler(w http.ResponseWriter, r *http.Request) {
+
+	// Create the channel on which the response will be received.
+	ch := make(chan config.APIQueryResponse)
+
+	// Extract the tenant from the request URI, and the data points from the body.
+	_ = r.ParseForm()
+	tenant, err := api.tenant(r)
+	if err != nil {
+		api.sendErrorResponse(w, http.StatusBadRequest, "bad request", err.Error())
+		return
+	}
+	metrics, err := parseBackfill(http.MaxBytesReader(w, r.Body, maxBackfillSize), tenant)
+	if err != nil {
+		api.sendErrorResponse(w, http.StatusBadRequest, "bad request", err.Error())
+		return
+	}
+	if len(metrics) == 0 {
+		api.sendErrorResponse(w, http.StatusBadRequest, "bad request", "no metrics supplied")
+		return
+	}
+	q := config.BackfillQuery{metrics, ch}
+	config.G.Log.System.LogDebug("Received backfill query: %d metrics", len(q.Metrics))
+
+	// Forward the query.
+	select {
+	case config.G.Channels.BackfillRequest <- q:
+	default:
+		config.G.Log.System.LogWarn(
+			"Backfill query discarded, BackfillRequest channel is full (max %d entries)",
+			config.G.Channels.MetricRequestChanLen)
+		logging.Statsd.Client.Inc("api.err.metrics.backfill", 1, 1.0)
+	}
+
+	// Send the response to the client.
+	api.sendResponse(w, ch, config.G.API.Timeouts.Backfill)
+}
+
+// parseBackfill reads Carbon plaintext lines, qualifying each path with the tenant.
+// Blank lines are ignored; any other malformed line rejects the whole request.
+func parseBackfill(body io.Reader, tenant string) ([]config.CarbonMetric, error) {
+	var metrics []config.CarbonMetric
+	scanner := bufio.NewScanner(body)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("line %d: expected 3 fields, found %d", line, len(fields))
+		}
+		val, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: cannot parse value as float: %q", line, fields[1])
+		}
+		ts, err := strconv.ParseFloat(fields[2], 64)
+		if err != nil || ts <= 0 {
+			return nil, fmt.Errorf("line %d: cannot parse timestamp as a positive float: %q", line, fields[2])
+		}
+		metrics = append(metrics, config.CarbonMetric{config.TenantPath(tenant, fields[0]), val, ts})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return metrics, nil
+}
@@ -0,0 +1,40 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/zenazn/goji/web"
+
+	"github.com/jeffpierce/cassabon/config"
+)
+
+// The methods the API serves, which pages from other origins may use.
+const corsMethods = "GET, POST, PUT, DELETE"
+
+// crossOrigin handler lets pages from the configured origins query the API from the browser. It answers their
+// preflight requests itself, so that they need no API key.
+func crossOrigin(c *web.C, h http.Handler) http.Handler {
+
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		allowed := config.G.API.CORS.AllowedOrigins
+		if origin == "" || !(allowed["*"] || allowed[origin]) {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Origin")
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		if r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Set("Access-Control-Allow-Methods", corsMethods)
+			w.Header().Set("Access-Control-Allow-Headers", strings.Join(config.G.API.CORS.AllowedHeaders, ", "))
+			w.Header().Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		h.ServeHTTP(w, r)
+	}
+
+	return http.HandlerFunc(fn)
+}
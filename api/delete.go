@@ -0,0 +1,85 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jeffpierce/cassabon/config"
+)
+
+// The interval in which a deletion's confirmation is issued; it is accepted in that interval and the next.
+const confirmInterval = 10 * time.Minute
+
+// The secret with which confirmations are signed, chosen afresh at startup, so a confirmation is only
+// accepted by the instance that issued it.
+var confirmSecret = func() []byte {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return b
+}()
+
+// deleteConfirmation returns the confirmation of a deletion, which a dry run reports, and the real deletion
+// must be given: it is bound to the tenant, paths and time range, and to when it was issued.
+func deleteConfirmation(tenant string, paths []string, from, to int64, issued time.Time) string {
+	sorted := append([]string{}, paths...)
+	sort.Strings(sorted)
+	mac := hmac.New(sha256.New, confirmSecret)
+	mac.Write([]byte(strings.Join([]string{tenant, strconv.FormatInt(from, 10), strconv.FormatInt(to, 10),
+		strconv.FormatInt(issued.Unix()/int64(confirmInterval/time.Second), 10)}, "\n")))
+	for _, p := range sorted {
+		mac.Write([]byte("\n" + p))
+	}
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// deleteConfirmed reports whether a deletion was given the confirmation of a recent dry run of it.
+func deleteConfirmed(confirm, tenant string, paths []string, from, to int64) bool {
+	now := time.Now()
+	for _, issued := range []time.Time{now, now.Add(-confirmInterval)} {
+		if hmac.Equal([]byte(confirm), []byte(deleteConfirmation(tenant, paths, from, to, issued))) {
+			return true
+		}
+	}
+	return false
+}
+
+// requester identifies who made a request, for the audit log: its address, and a fingerprint of its API
+// key, if it gave one, which can be matched to the key without revealing it.
+func requester(r *http.Request) string {
+	key := r.Header.Get("X-Cassabon-Key")
+	if key == "" {
+		key = r.URL.Query().Get("apikey")
+	}
+	if key == "" {
+		return r.RemoteAddr
+	}
+	sum := sha256.Sum256([]byte(key))
+	return r.RemoteAddr + " key=" + hex.EncodeToString(sum[:4])
+}
+
+// auditDelete records a metric deletion, or a dry run of one, and what it reported, in the system log.
+func auditDelete(r *http.Request, tenant string, paths []string, from, to int64, dryrun bool, payload []byte) {
+	var resp struct {
+		Paths map[string]struct {
+			Deleted uint64            `json:"approximate_total_deleted"`
+			Errors  map[string]string `json:"delete_errors"`
+		} `json:"paths"`
+	}
+	json.Unmarshal(payload, &resp)
+	var rows uint64
+	var failures int
+	for _, p := range resp.Paths {
+		rows += p.Deleted
+		failures += len(p.Errors)
+	}
+	config.G.Log.System.LogInfo("Audit: metric delete by %s: tenant=%q paths=%v from=%d to=%d dryrun=%v rows=%d errors=%d",
+		requester(r), tenant, paths, from, to, dryrun, rows, failures)
+}
@@ -0,0 +1,101 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jeffpierce/cassabon/config"
+	"github.com/jeffpierce/cassabon/logging"
+)
+
+// The largest body accepted for a new event.
+const maxEventSize = 64 << 10
+
+// The range of the events listed when none is given, as graphite-web lists them.
+const defaultEventRange = 24 * time.Hour
+
+// newEvent is the body of "POST /events/", as graphite-web accepts it. The tags may be a list,
+// or a string of space-separated tags.
+type newEvent struct {
+	What string          `json:"what"`
+	Tags json.RawMessage `json:"tags"`
+	When float64         `json:"when"` // Seconds since the epoch, or now if absent
+	Data string          `json:"data"`
+}
+
+// eventsHandler processes requests compatible with graphite-web's events API: "POST /events/" records the
+// event in its body, such as a deploy, and "GET /events/get_data?from=1450000000&until=1450086400&tags=deploy"
+// lists those recorded in a range of time. Events listed must have every tag given, or with
+// "set_operation=union", at least one of them.
+func (api *CassabonAPI) eventsHandler(w http.ResponseWriter, r *http.Request) {
+
+	// Create the channel on which the response will be received.
+	ch := make(chan config.APIQueryResponse)
+
+	// Extract the query from the request URI, or the event from the body.
+	_ = r.ParseForm()
+	tenant, err := api.tenant(r)
+	if err != nil {
+		api.sendErrorResponse(w, http.StatusBadRequest, "bad request", err.Error())
+		return
+	}
+	q := config.EventQuery{Method: r.Method, Tenant: tenant, Channel: ch}
+	if r.Method == "POST" {
+		var e newEvent
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxEventSize)).Decode(&e); err != nil {
+			api.sendErrorResponse(w, http.StatusBadRequest, "bad request", "invalid event: "+err.Error())
+			return
+		}
+		if q.Tags, err = parseEventTags(e.Tags); err != nil {
+			api.sendErrorResponse(w, http.StatusBadRequest, "bad request", err.Error())
+			return
+		}
+		q.What, q.When, q.Data = e.What, int64(e.When), e.Data
+	} else {
+		if q.From, q.To, err = timeRange(r); err != nil {
+			api.sendErrorResponse(w, http.StatusBadRequest, "bad request", err.Error())
+			return
+		}
+		if q.To <= 0 {
+			q.To = time.Now().Unix()
+		}
+		if q.From <= 0 {
+			q.From = q.To - int64(defaultEventRange/time.Second)
+		}
+		q.Tags = strings.Fields(strings.Join(r.Form["tags"], " "))
+		q.AnyTag = strings.ToLower(r.Form.Get("set_operation")) == "union"
+	}
+	config.G.Log.System.LogDebug("Received events query: %s %q %v %d %d", q.Method, q.What, q.Tags, q.From, q.To)
+
+	// Forward the query.
+	select {
+	case config.G.Channels.EventRequest <- q:
+	default:
+		config.G.Log.System.LogWarn(
+			"Events query discarded, EventRequest channel is full (max %d entries)",
+			config.G.Channels.MetricRequestChanLen)
+		logging.Statsd.Client.Inc("api.err.events", 1, 1.0)
+	}
+
+	// Send the response to the client.
+	api.sendResponse(w, ch, config.G.API.Timeouts.GetMetric)
+}
+
+// parseEventTags returns the tags of a new event, given as a list or as a string of space-separated tags.
+func parseEventTags(raw json.RawMessage) ([]string, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, nil
+	}
+	var list []string
+	if err := json.Unmarshal(raw, &list); err == nil {
+		return list, nil
+	}
+	var s string
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return nil, fmt.Errorf("tags must be a list, or a string of space-separated tags")
+	}
+	return strings.Fields(s), nil
+}
@@ -0,0 +1,257 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jeffpierce/cassabon/config"
+	"github.com/jeffpierce/cassabon/logging"
+	"github.com/jeffpierce/cassabon/render"
+)
+
+// The largest body accepted by the Grafana JSON datasource endpoints.
+const maxGrafanaRequestSize = 1 << 20
+
+// grafanaRange is the time range of a Grafana JSON datasource request.
+type grafanaRange struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+}
+
+// grafanaQuery is the body of "POST /query".
+type grafanaQuery struct {
+	Range   grafanaRange `json:"range"`
+	Targets []struct {
+		Target string `json:"target"`
+		Type   string `json:"type"` // "timeserie" or "table"
+	} `json:"targets"`
+	MaxDataPoints int `json:"maxDataPoints"`
+}
+
+// grafanaColumn describes a column of a table response.
+type grafanaColumn struct {
+	Text string `json:"text"`
+	Type string `json:"type"`
+}
+
+// grafanaAnnotation is one annotation of the response to "POST /annotations".
+type grafanaAnnotation struct {
+	Annotation json.RawMessage `json:"annotation"` // The annotation requested, as Grafana expects it back
+	Time       int64           `json:"time"`       // Milliseconds since the epoch
+	Title      string          `json:"title"`
+	Tags       []string        `json:"tags"`
+	Text       string          `json:"text"`
+}
+
+// decodeGrafanaRequest reads the JSON body of a Grafana JSON datasource request.
+func decodeGrafanaRequest(w http.ResponseWriter, r *http.Request, v interface{}) error {
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxGrafanaRequestSize)).Decode(v); err != nil {
+		return fmt.Errorf("invalid request: %s", err.Error())
+	}
+	return nil
+}
+
+// grafanaSearchHandler processes "POST /search" for Grafana's JSON datasource, whose body is like
+// {"target": "servers.*"}, returning the paths the target matches, or those at the top of the tree.
+func (api *CassabonAPI) grafanaSearchHandler(w http.ResponseWriter, r *http.Request) {
+
+	// Create the channel on which the response will be received.
+	ch := make(chan config.APIQueryResponse)
+
+	_ = r.ParseForm()
+	tenant, err := api.tenant(r)
+	if err != nil {
+		api.sendErrorResponse(w, http.StatusBadRequest, "bad request", err.Error())
+		return
+	}
+	var search struct {
+		Target string `json:"target"`
+	}
+	if err := decodeGrafanaRequest(w, r, &search); err != nil {
+		api.sendErrorResponse(w, http.StatusBadRequest, "bad request", err.Error())
+		return
+	}
+	if search.Target == "" {
+		search.Target = "*"
+	}
+	q := config.IndexQuery{"GET", search.Target, tenant, false, false, 0, 0, "", "", nil, requestID(r), ch}
+	config.G.Log.System.LogDebug("Received Grafana search query: %q", q.Query)
+
+	// Forward the query.
+	select {
+	case config.G.Channels.IndexRequest <- q:
+	default:
+		config.G.Log.System.LogWarn(
+			"Grafana search query discarded, IndexRequest channel is full (max %d entries)",
+			config.G.Channels.IndexRequestChanLen)
+		logging.Statsd.Client.Inc("api.err.grafana.search", 1, 1.0)
+	}
+
+	payload, err := api.receive(ch, config.G.API.Timeouts.GetIndex)
+	if err != nil {
+		api.sendQueryError(w, "api.err.grafana.search", err)
+		return
+	}
+	var nodes []struct {
+		Path string `json:"path"`
+	}
+	if err := json.Unmarshal(payload, &nodes); err != nil {
+		api.sendErrorResponse(w, http.StatusInternalServerError, "internal error", err.Error())
+		return
+	}
+	paths := []string{}
+	for _, node := range nodes {
+		paths = append(paths, node.Path)
+	}
+	jsonText, _ := json.Marshal(paths)
+	w.Write(jsonText)
+}
+
+// grafanaQueryHandler processes "POST /query" for Grafana's JSON datasource. Each target is evaluated as a
+// render target, and returned as a time series with its values paired with their times in milliseconds,
+// or for a "table" target, as rows of time, series and value.
+func (api *CassabonAPI) grafanaQueryHandler(w http.ResponseWriter, r *http.Request) {
+
+	_ = r.ParseForm()
+	tenant, err := api.tenant(r)
+	if err != nil {
+		api.sendErrorResponse(w, http.StatusBadRequest, "bad request", err.Error())
+		return
+	}
+	var query grafanaQuery
+	if err := decodeGrafanaRequest(w, r, &query); err != nil {
+		api.sendErrorResponse(w, http.StatusBadRequest, "bad request", err.Error())
+		return
+	}
+	from, to := query.Range.From.Unix(), query.Range.To.Unix()
+	if query.Range.To.IsZero() {
+		to = time.Now().Unix()
+	}
+	if query.Range.From.IsZero() {
+		from = to - int64(defaultRenderRange/time.Second)
+	}
+	config.G.Log.System.LogDebug("Received Grafana query: %d targets %d %d", len(query.Targets), from, to)
+
+	fetch := func(pathExpr string, from, to int64) ([]*render.Series, error) {
+		return api.fetchSeries(requestID(r), tenant, pathExpr, from, to, nil)
+	}
+	resp := []interface{}{}
+	for _, target := range query.Targets {
+		if target.Target == "" {
+			continue
+		}
+		list, err := render.Evaluate(target.Target, from, to, fetch)
+		if err != nil {
+			api.sendQueryError(w, "api.err.grafana.query", err)
+			return
+		}
+		if target.Type == "table" {
+			var rows [][]interface{}
+			for _, s := range list {
+				for i, v := range s.Values {
+					if !math.IsNaN(v) && !math.IsInf(v, 0) {
+						rows = append(rows, []interface{}{(s.Start + int64(i)*s.Step) * 1000, s.Name, v})
+					}
+				}
+			}
+			resp = append(resp, struct {
+				Type    string          `json:"type"`
+				Columns []grafanaColumn `json:"columns"`
+				Rows    [][]interface{} `json:"rows"`
+			}{"table", []grafanaColumn{{"Time", "time"}, {"Series", "string"}, {"Value", "number"}}, rows})
+			continue
+		}
+		for _, s := range list {
+			s = render.Consolidate(s, query.MaxDataPoints)
+			datapoints := make([][2]interface{}, len(s.Values))
+			for i, v := range s.Values {
+				datapoints[i][1] = (s.Start + int64(i)*s.Step) * 1000
+				if !math.IsNaN(v) && !math.IsInf(v, 0) {
+					datapoints[i][0] = v
+				}
+			}
+			resp = append(resp, struct {
+				Target     string           `json:"target"`
+				Datapoints [][2]interface{} `json:"datapoints"`
+			}{s.Name, datapoints})
+		}
+	}
+	jsonText, _ := json.Marshal(resp)
+	w.Write(jsonText)
+}
+
+// grafanaAnnotationsHandler processes "POST /annotations" for Grafana's JSON datasource, returning the events
+// recorded through "/events" in the time range. The annotation's query lists the tags the events must have,
+// separated by spaces; with none, every event is returned.
+func (api *CassabonAPI) grafanaAnnotationsHandler(w http.ResponseWriter, r *http.Request) {
+
+	// Create the channel on which the response will be received.
+	ch := make(chan config.APIQueryResponse)
+
+	_ = r.ParseForm()
+	tenant, err := api.tenant(r)
+	if err != nil {
+		api.sendErrorResponse(w, http.StatusBadRequest, "bad request", err.Error())
+		return
+	}
+	var req struct {
+		Range      grafanaRange    `json:"range"`
+		Annotation json.RawMessage `json:"annotation"`
+	}
+	if err := decodeGrafanaRequest(w, r, &req); err != nil {
+		api.sendErrorResponse(w, http.StatusBadRequest, "bad request", err.Error())
+		return
+	}
+	var annotation struct {
+		Query string `json:"query"`
+	}
+	if len(req.Annotation) == 0 {
+		req.Annotation = json.RawMessage("null")
+	}
+	_ = json.Unmarshal(req.Annotation, &annotation)
+	q := config.EventQuery{Method: "GET", Tags: strings.Fields(annotation.Query),
+		From: req.Range.From.Unix(), To: req.Range.To.Unix(), Tenant: tenant, Channel: ch}
+	if req.Range.To.IsZero() {
+		q.To = time.Now().Unix()
+	}
+	if req.Range.From.IsZero() {
+		q.From = q.To - int64(defaultEventRange/time.Second)
+	}
+	config.G.Log.System.LogDebug("Received Grafana annotations query: %v %d %d", q.Tags, q.From, q.To)
+
+	// Forward the query.
+	select {
+	case config.G.Channels.EventRequest <- q:
+	default:
+		config.G.Log.System.LogWarn(
+			"Grafana annotations query discarded, EventRequest channel is full (max %d entries)",
+			config.G.Channels.MetricRequestChanLen)
+		logging.Statsd.Client.Inc("api.err.grafana.annotations", 1, 1.0)
+	}
+
+	payload, err := api.receive(ch, config.G.API.Timeouts.GetMetric)
+	if err != nil {
+		api.sendQueryError(w, "api.err.grafana.annotations", err)
+		return
+	}
+	var events []struct {
+		What string   `json:"what"`
+		When float64  `json:"when"`
+		Tags []string `json:"tags"`
+		Data string   `json:"data"`
+	}
+	if err := json.Unmarshal(payload, &events); err != nil {
+		api.sendErrorResponse(w, http.StatusInternalServerError, "internal error", err.Error())
+		return
+	}
+	list := []grafanaAnnotation{}
+	for _, e := range events {
+		list = append(list, grafanaAnnotation{req.Annotation, int64(e.When * 1000), e.What, e.Tags, e.Data})
+	}
+	jsonText, _ := json.Marshal(list)
+	w.Write(jsonText)
+}
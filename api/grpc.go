@@ -0,0 +1,383 @@
+package api
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jeffpierce/cassabon/config"
+	"github.com/jeffpierce/cassabon/logging"
+	"github.com/jeffpierce/cassabon/render"
+)
+
+// The path of each method of the gRPC service, described by cassabon.proto, is this and the method's name.
+const grpcServicePrefix = "/cassabon.Cassabon/"
+
+// The largest request message accepted by the gRPC service.
+const maxGRPCMessageSize = 1 << 20
+
+// The gRPC status codes with which calls end.
+const (
+	grpcOK                 = 0
+	grpcInvalidArgument    = 3
+	grpcPermissionDenied   = 7
+	grpcResourceExhausted  = 8
+	grpcFailedPrecondition = 9
+	grpcUnimplemented      = 12
+	grpcInternal           = 13
+	grpcUnauthenticated    = 16
+)
+
+// grpcError is the status with which a gRPC call failed.
+type grpcError struct {
+	code    int
+	message string
+}
+
+func (e *grpcError) Error() string {
+	return e.message
+}
+
+// newGRPCServer returns the server of the gRPC service, which speaks only HTTP/2, in the clear or over TLS.
+func (api *CassabonAPI) newGRPCServer(hostPort string) *http.Server {
+	protocols := new(http.Protocols)
+	protocols.SetHTTP2(true)
+	protocols.SetUnencryptedHTTP2(true)
+	return &http.Server{Addr: hostPort, Handler: requestLogger(nil, http.HandlerFunc(api.grpcHandler)), Protocols: protocols}
+}
+
+// serveGRPC serves the gRPC service until the API is stopped, over TLS if the API is served over HTTPS.
+func (api *CassabonAPI) serveGRPC() {
+	config.G.Log.System.LogInfo("API serving gRPC on %s", api.grpc.Addr)
+	var err error
+	if tlsConfigured() {
+		api.grpc.TLSConfig = &tls.Config{GetCertificate: getCertificate}
+		err = api.grpc.ListenAndServeTLS("", "")
+	} else {
+		err = api.grpc.ListenAndServe()
+	}
+	if err != nil && err != http.ErrServerClosed {
+		config.G.Log.System.LogError("API unable to serve gRPC on %s: %s", api.grpc.Addr, err.Error())
+	}
+}
+
+// grpcHandler serves each call of the gRPC service, which is a POST to the method's path with its request
+// message as the body. Its response messages are streamed as the body, and its status sent in the trailers.
+func (api *CassabonAPI) grpcHandler(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "POST" || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		http.Error(w, "only gRPC is served here", http.StatusUnsupportedMediaType)
+		return
+	}
+	w.Header().Set("Content-Type", "application/grpc")
+
+	code, message := grpcOK, ""
+	if err := api.grpcCall(w, r); err != nil {
+		if ge, ok := err.(*grpcError); ok {
+			code, message = ge.code, ge.message
+		} else {
+			code, message = grpcInternal, err.Error()
+		}
+	}
+	w.Header().Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(code))
+	if message != "" {
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", grpcEncodeMessage(message))
+	}
+}
+
+// grpcCall carries out a call of the gRPC service, once it is known to have the permission it needs.
+func (api *CassabonAPI) grpcCall(w http.ResponseWriter, r *http.Request) error {
+
+	var call func(w http.ResponseWriter, r *http.Request, msg []byte) error
+	var needed string
+	switch strings.TrimPrefix(r.URL.Path, grpcServicePrefix) {
+	case "Find":
+		call, needed = api.grpcFind, config.API_READ
+	case "Render":
+		call, needed = api.grpcRender, config.API_READ
+	case "Delete":
+		call, needed = api.grpcDelete, config.API_DELETE
+	default:
+		return &grpcError{grpcUnimplemented, "unknown method " + r.URL.Path}
+	}
+	if status, message := authorize(r, needed); status != http.StatusOK {
+		if status == http.StatusUnauthorized {
+			return &grpcError{grpcUnauthenticated, message}
+		}
+		return &grpcError{grpcPermissionDenied, message}
+	}
+
+	msg, err := readGRPCMessage(r.Body)
+	if err != nil {
+		return err
+	}
+	return call(w, r, msg)
+}
+
+// grpcFind serves Find, streaming a Node for each node the index finds.
+func (api *CassabonAPI) grpcFind(w http.ResponseWriter, r *http.Request, msg []byte) error {
+
+	var query, tenant string
+	err := protoFields(msg, func(field int, v uint64, data []byte) error {
+		switch field {
+		case 1:
+			query = string(data)
+		case 2:
+			tenant = string(data)
+		}
+		return nil
+	})
+	if err != nil {
+		return &grpcError{grpcInvalidArgument, err.Error()}
+	}
+	if tenant, err = grpcTenant(r, tenant); err != nil {
+		return err
+	}
+	config.G.Log.System.LogDebug("Received gRPC find query: %s", query)
+
+	nodes, err := api.find(requestID(r), tenant, query)
+	if err != nil {
+		return grpcQueryError("api.err.grpc.find", err)
+	}
+	for _, node := range nodes {
+		b := appendString(nil, 1, node.Path)
+		if node.Leaf {
+			b = appendVarintField(b, 2, 1)
+		}
+		if err := writeGRPCMessage(w, b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// grpcRender serves Render, streaming a Series for each series of each target, once the target is evaluated.
+func (api *CassabonAPI) grpcRender(w http.ResponseWriter, r *http.Request, msg []byte) error {
+
+	var targets []string
+	var from, to int64
+	var tenant string
+	err := protoFields(msg, func(field int, v uint64, data []byte) error {
+		switch field {
+		case 1:
+			targets = append(targets, string(data))
+		case 2:
+			from = int64(v)
+		case 3:
+			to = int64(v)
+		case 4:
+			tenant = string(data)
+		}
+		return nil
+	})
+	if err != nil {
+		return &grpcError{grpcInvalidArgument, err.Error()}
+	}
+	if tenant, err = grpcTenant(r, tenant); err != nil {
+		return err
+	}
+	if len(targets) == 0 {
+		return &grpcError{grpcInvalidArgument, "no target specified"}
+	}
+	if to <= 0 {
+		to = time.Now().Unix()
+	}
+	if from <= 0 {
+		from = to - int64(defaultRenderRange/time.Second)
+	}
+	config.G.Log.System.LogDebug("Received gRPC render query: %v %d %d", targets, from, to)
+
+	fetch := func(pathExpr string, from, to int64) ([]*render.Series, error) {
+		return api.fetchSeries(requestID(r), tenant, pathExpr, from, to, nil)
+	}
+	for _, target := range targets {
+		list, err := render.Evaluate(target, from, to, fetch)
+		if err != nil {
+			return grpcQueryError("api.err.grpc.render", err)
+		}
+		for _, s := range list {
+			b := appendString(nil, 1, s.Name)
+			b = appendVarintField(b, 2, uint64(s.Start))
+			b = appendVarintField(b, 3, uint64(s.Step))
+			b = appendPackedDoubles(b, 4, s.Values)
+			if err := writeGRPCMessage(w, b); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// grpcDelete serves Delete, which is confirmed and audit logged as "DELETE /metrics" is.
+func (api *CassabonAPI) grpcDelete(w http.ResponseWriter, r *http.Request, msg []byte) error {
+
+	var paths []string
+	var from, to int64
+	var execute bool
+	var confirm, tenant string
+	err := protoFields(msg, func(field int, v uint64, data []byte) error {
+		switch field {
+		case 1:
+			paths = append(paths, string(data))
+		case 2:
+			from = int64(v)
+		case 3:
+			to = int64(v)
+		case 4:
+			execute = v != 0
+		case 5:
+			confirm = string(data)
+		case 6:
+			tenant = string(data)
+		}
+		return nil
+	})
+	if err != nil {
+		return &grpcError{grpcInvalidArgument, err.Error()}
+	}
+	if tenant, err = grpcTenant(r, tenant); err != nil {
+		return err
+	}
+	if execute && !deleteConfirmed(confirm, tenant, paths, from, to) {
+		config.G.Log.System.LogWarn("Audit: unconfirmed gRPC metric delete by %s refused: tenant=%q paths=%v from=%d to=%d",
+			requester(r), tenant, paths, from, to)
+		return &grpcError{grpcFailedPrecondition,
+			"deletion not confirmed: make a dry run of it, and repeat it with the confirm value returned"}
+	}
+
+	ch := make(chan config.APIQueryResponse)
+	q := config.MetricQuery{"DELETE", paths, from, to, !execute, 0, "", "", false, false, tenant, requestID(r), ch}
+	config.G.Log.System.LogDebug("Received gRPC metrics query: %s %v %d %d %v", q.Method, q.Query, q.From, q.To, q.DryRun)
+	select {
+	case config.G.Channels.MetricRequest <- q:
+	default:
+		config.G.Log.System.LogWarn(
+			"gRPC metric DELETE query discarded, MetricRequest channel is full (max %d entries)",
+			config.G.Channels.MetricRequestChanLen)
+		logging.Statsd.Client.Inc("api.err.grpc.delete", 1, 1.0)
+	}
+	payload, err := api.receive(ch, config.G.API.Timeouts.DeleteMetric)
+	if err != nil {
+		config.G.Log.System.LogWarn("Audit: gRPC metric delete by %s failed: tenant=%q paths=%v from=%d to=%d: %s",
+			requester(r), tenant, paths, from, to, err.Error())
+		return grpcQueryError("api.err.grpc.delete", err)
+	}
+	auditDelete(r, tenant, paths, from, to, !execute, payload)
+
+	// Convert the JSON response of the MetricManager.
+	var resp struct {
+		Paths map[string]struct {
+			Deleted uint64            `json:"approximate_total_deleted"`
+			ByTable map[string]uint64 `json:"approximate_total_by_table"`
+			Errors  map[string]string `json:"delete_errors"`
+		} `json:"paths"`
+	}
+	if err := json.Unmarshal(payload, &resp); err != nil {
+		return err
+	}
+	var b []byte
+	for _, path := range paths {
+		details, found := resp.Paths[path]
+		if !found {
+			continue
+		}
+		delete(resp.Paths, path) // A path may be listed more than once
+		pd := appendVarintField(appendString(nil, 1, path), 2, details.Deleted)
+		tables := make([]string, 0, len(details.ByTable))
+		for table := range details.ByTable {
+			tables = append(tables, table)
+		}
+		sort.Strings(tables)
+		for _, table := range tables {
+			pd = appendMessage(pd, 3, appendVarintField(appendString(nil, 1, table), 2, details.ByTable[table]))
+			if message, failed := details.Errors[table]; failed {
+				pd = appendMessage(pd, 4, appendString(appendString(nil, 1, table), 2, message))
+			}
+		}
+		b = appendMessage(b, 1, pd)
+	}
+	if !execute {
+		b = appendString(b, 2, deleteConfirmation(tenant, paths, from, to, time.Now()))
+	}
+	return writeGRPCMessage(w, b)
+}
+
+// grpcTenant returns the tenant of a call: the one its request names, or failing that, its metadata. The
+// call's API key must be granted it.
+func grpcTenant(r *http.Request, tenant string) (string, error) {
+	if tenant == "" {
+		tenant = r.Header.Get("X-Cassabon-Tenant")
+	}
+	tenant, err := checkTenant(tenant)
+	if err != nil {
+		return "", &grpcError{grpcInvalidArgument, err.Error()}
+	}
+	if message := authorizeTenant(r, tenant); message != "" {
+		return "", &grpcError{grpcPermissionDenied, message}
+	}
+	return tenant, nil
+}
+
+// grpcQueryError returns the status of a call whose query failed, as sendQueryError does: invalid if it couldn't
+// be carried out as written, and otherwise an internal error.
+func grpcQueryError(stat string, err error) error {
+	logging.Statsd.Client.Inc(stat, 1, 1.0)
+	if _, ok := err.(*render.TargetError); ok {
+		return &grpcError{grpcInvalidArgument, err.Error()}
+	}
+	return &grpcError{grpcInternal, err.Error()}
+}
+
+// readGRPCMessage reads the single request message of a call, which is prefixed by a flag saying whether
+// it is compressed, and its length, in 4 bytes.
+func readGRPCMessage(body io.Reader) ([]byte, error) {
+	var prefix [5]byte
+	if _, err := io.ReadFull(body, prefix[:]); err != nil {
+		return nil, &grpcError{grpcInvalidArgument, "no request message"}
+	}
+	if prefix[0] != 0 {
+		return nil, &grpcError{grpcUnimplemented, "compressed messages are not supported"}
+	}
+	length := binary.BigEndian.Uint32(prefix[1:])
+	if length > maxGRPCMessageSize {
+		return nil, &grpcError{grpcResourceExhausted, fmt.Sprintf("request message is larger than %d bytes", maxGRPCMessageSize)}
+	}
+	msg := make([]byte, length)
+	if _, err := io.ReadFull(body, msg); err != nil {
+		return nil, &grpcError{grpcInvalidArgument, "request message is truncated"}
+	}
+	return msg, nil
+}
+
+// writeGRPCMessage sends a response message, uncompressed, so the client has it before the call ends.
+func writeGRPCMessage(w http.ResponseWriter, msg []byte) error {
+	b := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(b[1:], uint32(len(msg)))
+	if _, err := w.Write(append(b, msg...)); err != nil {
+		return err
+	}
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
+
+// grpcEncodeMessage percent-encodes a status message, as the grpc-message trailer must be.
+func grpcEncodeMessage(s string) string {
+	var b []byte
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c >= ' ' && c <= '~' && c != '%' {
+			b = append(b, c)
+		} else {
+			b = append(b, fmt.Sprintf("%%%02X", c)...)
+		}
+	}
+	return string(b)
+}
@@ -0,0 +1,129 @@
+package api
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/jeffpierce/cassabon/config"
+	"github.com/jeffpierce/cassabon/logging"
+)
+
+// grpcTestServer serves the gRPC service in the clear, answering index queries with the supplied nodes.
+func grpcTestServer(nodes string) (*httptest.Server, func()) {
+	config.G.Log.System = logging.NewLogger("system")
+	config.G.Log.API = logging.NewLogger("api")
+	logging.Statsd.Open("", "", "cassabon")
+	config.G.API.Timeouts.GetIndex = time.Second
+	requests := make(chan config.IndexQuery, 1)
+	config.G.Channels.IndexRequest = requests
+
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case q := <-requests:
+				q.Channel <- config.APIQueryResponse{config.AQS_OK, "", []byte(nodes)}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	api := new(CassabonAPI)
+	ts := httptest.NewUnstartedServer(nil)
+	ts.Config = api.newGRPCServer("")
+	ts.Start()
+	return ts, func() {
+		ts.Close()
+		close(done)
+	}
+}
+
+// grpcTestCall makes a call over HTTP/2 in the clear, returning its response messages and status.
+func grpcTestCall(t *testing.T, url, method string, msg []byte, header http.Header) ([][]byte, string) {
+	protocols := new(http.Protocols)
+	protocols.SetUnencryptedHTTP2(true)
+	client := &http.Client{Transport: &http.Transport{Protocols: protocols}}
+
+	body := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(body[1:], uint32(len(msg)))
+	req, _ := http.NewRequest("POST", url+grpcServicePrefix+method, bytes.NewReader(append(body, msg...)))
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("Call failed: %s", err.Error())
+	}
+	defer resp.Body.Close()
+	if resp.ProtoMajor != 2 {
+		t.Errorf("Expected HTTP/2, got %s", resp.Proto)
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	var msgs [][]byte
+	for len(b) >= 5 {
+		length := int(binary.BigEndian.Uint32(b[1:5]))
+		msgs = append(msgs, b[5:5+length])
+		b = b[5+length:]
+	}
+	return msgs, resp.Trailer.Get("Grpc-Status")
+}
+
+func TestGRPCFind(t *testing.T) {
+	ts, stop := grpcTestServer(`[{"path":"foo.bar","leaf":true},{"path":"foo.baz","leaf":false}]`)
+	defer stop()
+
+	msgs, status := grpcTestCall(t, ts.URL, "Find", appendString(nil, 1, "foo.*"), nil)
+	if status != "0" {
+		t.Fatalf("Expected status 0, got %q", status)
+	}
+	if len(msgs) != 2 {
+		t.Fatalf("Expected a message for each node, got %d", len(msgs))
+	}
+	expected := [][]byte{appendVarintField(appendString(nil, 1, "foo.bar"), 2, 1), appendString(nil, 1, "foo.baz")}
+	for i, msg := range msgs {
+		if !bytes.Equal(msg, expected[i]) {
+			t.Errorf("Wrong node %d: got %x, expected %x", i, msg, expected[i])
+		}
+	}
+}
+
+func TestGRPCRefused(t *testing.T) {
+	ts, stop := grpcTestServer(`[]`)
+	defer stop()
+	defer func() { config.G.API.Keys, config.G.Tenants.Enabled = nil, false }()
+	config.G.API.Keys = map[string]map[string]bool{
+		"reader": {config.API_READ: true},
+		"acme":   {config.API_READ: true, config.API_TENANT + "acme": true},
+	}
+	config.G.Tenants.Enabled = true
+
+	tests := []struct {
+		method, key, status string
+	}{
+		{"Find", "", "16"},        // No key
+		{"Find", "unknown", "16"}, // Unknown key
+		{"Delete", "reader", "7"}, // Key lacking the permission
+		{"Lookup", "reader", "12"},
+		{"Find", "acme", "7"}, // Key lacking the tenant
+		{"Find", "reader", "0"},
+	}
+	for _, test := range tests {
+		header := http.Header{"X-Cassabon-Key": {test.key}, "X-Cassabon-Tenant": {"other"}}
+		if _, status := grpcTestCall(t, ts.URL, test.method, nil, header); status != test.status {
+			t.Errorf("%s with key %q: expected status %s, got %q", test.method, test.key, test.status, status)
+		}
+	}
+}
+
+func TestGRPCEncodeMessage(t *testing.T) {
+	if s := grpcEncodeMessage("50% done\nnow"); s != "50%25 done%0Anow" {
+		t.Errorf("Wrong encoding: %q", s)
+	}
+}
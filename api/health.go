@@ -0,0 +1,102 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/jeffpierce/cassabon/config"
+)
+
+// The fraction of the metric queue that may be full before we are no longer ready for more.
+const readyQueueFill = 0.9
+
+// readiness is returned by "GET /readyz".
+type readiness struct {
+	Ready        bool   `json:"ready"`
+	Alive        bool   `json:"alive"`        // Whether the healthcheck file leaves us alive
+	Cassandra    string `json:"cassandra"`    // "ok", or why Cassandra couldn't be queried
+	BreakerOpen  bool   `json:"breakeropen"`  // Whether writes to Cassandra are paused after repeated failures
+	Index        string `json:"index"`        // "ok", or why the index couldn't be queried
+	Queued       int    `json:"queued"`       // Metrics received, waiting to be accumulated
+	QueueSize    int    `json:"queuesize"`    // The most metrics that may wait
+	Writes       int    `json:"writes"`       // Batches waiting to be written to Cassandra
+	LastWrite    int64  `json:"lastwrite"`    // When a batch was last written, in seconds since the epoch, or 0 if never
+	LastWriteAge int64  `json:"lastwriteage"` // Seconds since then, or -1 if never
+}
+
+// livenessHandler processes "GET /healthz", for liveness probes: as long as we can answer, we are live,
+// unless the healthcheck file says we are dead.
+func (api *CassabonAPI) livenessHandler(w http.ResponseWriter, r *http.Request) {
+	if api.alive() {
+		fmt.Fprint(w, "ok")
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprint(w, "dead")
+	}
+}
+
+// readinessHandler processes "GET /readyz", for readiness probes and load balancers. We are ready if we are
+// alive, Cassandra and the index answer, writes to Cassandra aren't paused, and the queue of metrics received
+// isn't nearly full. When a batch was last written is reported, but doesn't affect readiness, as there may
+// be nothing to write. Whether ready or not, the state of each is returned; if not, the status is 503.
+func (api *CassabonAPI) readinessHandler(w http.ResponseWriter, r *http.Request) {
+
+	var rd readiness
+	rd.Alive = api.alive()
+
+	// Ask the MetricManager, and the IndexManager, how they are.
+	var mh struct {
+		Cassandra   string `json:"cassandra"`
+		BreakerOpen bool   `json:"breakeropen"`
+		Writes      int    `json:"writes"`
+		LastWrite   int64  `json:"lastwrite"`
+	}
+	ch := make(chan config.APIQueryResponse)
+	mq := config.MetricQuery{"HEALTH", nil, 0, 0, false, 0, "", "", false, false, "", requestID(r), ch}
+	select {
+	case config.G.Channels.MetricRequest <- mq:
+		if payload, err := api.receive(ch, config.G.API.Timeouts.GetMetric); err != nil {
+			rd.Cassandra = err.Error()
+		} else if err = json.Unmarshal(payload, &mh); err != nil {
+			rd.Cassandra = err.Error()
+		} else {
+			rd.Cassandra = mh.Cassandra
+		}
+	default:
+		rd.Cassandra = fmt.Sprintf("MetricRequest channel is full (max %d entries)", config.G.Channels.MetricRequestChanLen)
+	}
+	var ih struct {
+		Index string `json:"index"`
+	}
+	ch = make(chan config.APIQueryResponse)
+	iq := config.IndexQuery{"health", "", "", false, false, 0, 0, "", "", nil, requestID(r), ch}
+	select {
+	case config.G.Channels.IndexRequest <- iq:
+		if payload, err := api.receive(ch, config.G.API.Timeouts.GetIndex); err != nil {
+			rd.Index = err.Error()
+		} else if err = json.Unmarshal(payload, &ih); err != nil {
+			rd.Index = err.Error()
+		} else {
+			rd.Index = ih.Index
+		}
+	default:
+		rd.Index = fmt.Sprintf("IndexRequest channel is full (max %d entries)", config.G.Channels.IndexRequestChanLen)
+	}
+
+	rd.BreakerOpen, rd.Writes, rd.LastWrite = mh.BreakerOpen, mh.Writes, mh.LastWrite
+	rd.Queued, rd.QueueSize = len(config.G.Channels.MetricStore), cap(config.G.Channels.MetricStore)
+	rd.LastWriteAge = -1
+	if rd.LastWrite > 0 {
+		rd.LastWriteAge = time.Now().Unix() - rd.LastWrite
+	}
+	rd.Ready = rd.Alive && rd.Cassandra == "ok" && rd.Index == "ok" && !rd.BreakerOpen &&
+		float64(rd.Queued) < readyQueueFill*float64(rd.QueueSize)
+
+	jsonText, _ := json.Marshal(rd)
+	if !rd.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	w.Write(jsonText)
+}
@@ -0,0 +1,91 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/jeffpierce/cassabon/config"
+	"github.com/jeffpierce/cassabon/logging"
+)
+
+// The WebSocket close status sent when the server is terminating.
+const wsStatusGoingAway = 1001
+
+// liveHandler processes requests like "GET /metrics/live?pattern=foo.*.bar", made as WebSocket handshakes,
+// so that dashboards can follow metrics as they arrive without polling. Each node of the pattern is matched
+// as in a path query. Once connected, the client is sent a JSON message every so often, listing the
+// "datapoints" received since the last whose paths match, each with its path, value and timestamp, and the
+// number "dropped" because the client fell behind. Nothing is read from Cassandra, so only data points
+// arriving from then on are sent.
+func (api *CassabonAPI) liveHandler(w http.ResponseWriter, r *http.Request) {
+
+	// Create the channel on which the data points will be received.
+	ch := make(chan config.APIQueryResponse)
+
+	// Extract the pattern from the request URI.
+	_ = r.ParseForm()
+	tenant, err := api.tenant(r)
+	if err != nil {
+		api.sendErrorResponse(w, http.StatusBadRequest, "bad request", err.Error())
+		return
+	}
+	q := config.MetricQuery{"SUBSCRIBE", []string{r.Form.Get("pattern")}, 0, 0, false, 0, "", "", false, false, tenant, requestID(r), ch}
+	config.G.Log.System.LogDebug("Received live subscription: %v", q.Query)
+
+	// Forward the query.
+	select {
+	case config.G.Channels.MetricRequest <- q:
+	default:
+		config.G.Log.System.LogWarn(
+			"Live subscription discarded, MetricRequest channel is full (max %d entries)",
+			config.G.Channels.MetricRequestChanLen)
+		logging.Statsd.Client.Inc("api.err.metrics.live", 1, 1.0)
+	}
+
+	// The subscription is acknowledged before the connection is upgraded, so a bad pattern is refused plainly.
+	var resp config.APIQueryResponse
+	select {
+	case resp = <-ch:
+	case <-time.After(config.G.API.Timeouts.GetMetric):
+		resp = config.APIQueryResponse{config.AQS_ERROR,
+			fmt.Sprintf("query timed out after %v", config.G.API.Timeouts.GetMetric), []byte{}}
+	}
+	if resp.Status != config.AQS_PARTIAL {
+		close(ch)
+		if resp.Status == config.AQS_BADREQUEST {
+			api.sendErrorResponse(w, http.StatusBadRequest, "bad request", resp.Message)
+		} else {
+			api.sendErrorResponse(w, http.StatusServiceUnavailable, "service unavailable", resp.Message)
+		}
+		return
+	}
+	conn, err := upgradeWebsocket(w, r)
+	if err != nil {
+		close(ch)
+		api.sendErrorResponse(w, http.StatusBadRequest, "bad request", err.Error())
+		return
+	}
+	defer close(ch)
+
+	// Pass on each batch, until the client goes, or the MetricManager ends the subscription on termination.
+	done := make(chan struct{})
+	go conn.serveControl(done)
+	for {
+		if resp.Status != config.AQS_PARTIAL {
+			conn.close(wsStatusGoingAway, "shutting down")
+			return
+		}
+		if err := conn.writeMessage(wsText, resp.Payload); err != nil {
+			conn.conn.Close()
+			return
+		}
+		select {
+		case resp = <-ch:
+		case <-done:
+			// The client's close has been answered, or the connection has failed.
+			conn.conn.Close()
+			return
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package api
+
+import (
+	"fmt"
+	"math"
+)
+
+// protoFields calls fn for each field of an encoded protocol buffer message, with its value if it is a
+// number, or its bytes if it is length-delimited, in which case data isn't nil.
+func protoFields(b []byte, fn func(field int, v uint64, data []byte) error) error {
+	for len(b) > 0 {
+		key, n := uvarint(b)
+		if n <= 0 {
+			return fmt.Errorf("malformed protocol buffer")
+		}
+		b = b[n:]
+		field := int(key >> 3)
+		var v uint64
+		var data []byte
+		switch key & 7 {
+		case 0: // Varint
+			if v, n = uvarint(b); n <= 0 {
+				return fmt.Errorf("malformed protocol buffer")
+			}
+		case 1: // 64 bits
+			if n = 8; len(b) < n {
+				return fmt.Errorf("malformed protocol buffer")
+			}
+			for i := 7; i >= 0; i-- {
+				v = v<<8 | uint64(b[i])
+			}
+		case 2: // Length-delimited
+			length, m := uvarint(b)
+			if m <= 0 || uint64(len(b)-m) < length {
+				return fmt.Errorf("malformed protocol buffer")
+			}
+			data, n = b[m:m+int(length)], m+int(length)
+			if data == nil {
+				data = []byte{}
+			}
+		case 5: // 32 bits
+			if n = 4; len(b) < n {
+				return fmt.Errorf("malformed protocol buffer")
+			}
+			for i := 3; i >= 0; i-- {
+				v = v<<8 | uint64(b[i])
+			}
+		default:
+			return fmt.Errorf("unsupported protocol buffer wire type %d", key&7)
+		}
+		b = b[n:]
+		if err := fn(field, v, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// uvarint decodes a varint, returning it and the number of bytes read, or 0 if it is incomplete.
+func uvarint(b []byte) (uint64, int) {
+	var v uint64
+	for i := 0; i < len(b) && i < 10; i++ {
+		v |= uint64(b[i]&0x7f) << (7 * uint(i))
+		if b[i] < 0x80 {
+			return v, i + 1
+		}
+	}
+	return 0, 0
+}
+
+// appendVarint encodes a varint.
+func appendVarint(b []byte, v uint64) []byte {
+	for v >= 0x80 {
+		b = append(b, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(b, byte(v))
+}
+
+// appendVarintField encodes a numeric field.
+func appendVarintField(b []byte, field int, v uint64) []byte {
+	return appendVarint(appendVarint(b, uint64(field)<<3), v)
+}
+
+// appendDouble encodes a double field.
+func appendDouble(b []byte, field int, f float64) []byte {
+	b = appendVarint(b, uint64(field)<<3|1)
+	v := math.Float64bits(f)
+	for i := 0; i < 8; i++ {
+		b = append(b, byte(v>>(8*uint(i))))
+	}
+	return b
+}
+
+// appendMessage encodes a length-delimited field holding an encoded message.
+func appendMessage(b []byte, field int, msg []byte) []byte {
+	return append(appendVarint(appendVarint(b, uint64(field)<<3|2), uint64(len(msg))), msg...)
+}
+
+// appendPackedDoubles encodes a repeated double field, packed, as proto3 encodes it.
+func appendPackedDoubles(b []byte, field int, values []float64) []byte {
+	b = appendVarint(appendVarint(b, uint64(field)<<3|2), uint64(8*len(values)))
+	for _, f := range values {
+		v := math.Float64bits(f)
+		for i := 0; i < 8; i++ {
+			b = append(b, byte(v>>(8*uint(i))))
+		}
+	}
+	return b
+}
+
+// appendString encodes a string field.
+func appendString(b []byte, field int, s string) []byte {
+	return appendMessage(b, field, []byte(s))
+}
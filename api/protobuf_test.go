@@ -0,0 +1,71 @@
+package api
+
+import (
+	"math"
+	"testing"
+)
+
+func TestVarint(t *testing.T) {
+	for _, v := range []uint64{0, 1, 127, 128, 300, 1<<32 + 5, math.MaxUint64} {
+		b := appendVarint(nil, v)
+		if got, n := uvarint(b); got != v || n != len(b) {
+			t.Errorf("Varint %d decoded as %d from %d of %d bytes", v, got, n, len(b))
+		}
+	}
+	if b := appendVarint(nil, 300); len(b) != 2 || b[0] != 0xac || b[1] != 0x02 {
+		t.Errorf("Wrong encoding of 300: %x", b)
+	}
+	if _, n := uvarint([]byte{0x80, 0x80}); n != 0 {
+		t.Errorf("Expected an incomplete varint to be refused")
+	}
+}
+
+func TestProtoFields(t *testing.T) {
+	msg := appendVarintField(nil, 1, 150)
+	msg = appendDouble(msg, 2, -2.5)
+	msg = appendString(msg, 3, "testing")
+	msg = appendString(msg, 4, "")
+	msg = appendPackedDoubles(msg, 5, []float64{1, math.NaN()})
+
+	var fields []int
+	err := protoFields(msg, func(field int, v uint64, data []byte) error {
+		fields = append(fields, field)
+		switch field {
+		case 1:
+			if v != 150 || data != nil {
+				t.Errorf("Wrong varint field: %d %v", v, data)
+			}
+		case 2:
+			if math.Float64frombits(v) != -2.5 {
+				t.Errorf("Wrong double field: %v", math.Float64frombits(v))
+			}
+		case 3:
+			if string(data) != "testing" {
+				t.Errorf("Wrong string field: %q", data)
+			}
+		case 4:
+			if data == nil || len(data) != 0 {
+				t.Errorf("Expected an empty, but not nil, string field: %v", data)
+			}
+		case 5:
+			if len(data) != 16 || math.Float64frombits(uint64(data[0])|uint64(data[6])<<48|uint64(data[7])<<56) != 1 {
+				t.Errorf("Wrong packed doubles: %x", data)
+			}
+		}
+		return nil
+	})
+	if err != nil || len(fields) != 5 {
+		t.Errorf("Expected 5 fields, got %v %v", fields, err)
+	}
+
+	// The encoding of 150 in field 1 is the example of the protocol buffer documentation.
+	if b := appendVarintField(nil, 1, 150); len(b) != 3 || b[0] != 0x08 || b[1] != 0x96 || b[2] != 0x01 {
+		t.Errorf("Wrong encoding of 150: %x", b)
+	}
+
+	for _, bad := range [][]byte{{0x0a, 0x05, 'a'}, {0x09, 0x01}, {0x0b}, {0x80}} {
+		if err := protoFields(bad, func(int, uint64, []byte) error { return nil }); err == nil {
+			t.Errorf("Expected %x to be refused", bad)
+		}
+	}
+}
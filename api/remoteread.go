@@ -0,0 +1,272 @@
+package api
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/golang/snappy"
+
+	"github.com/jeffpierce/cassabon/logging"
+	"github.com/jeffpierce/cassabon/render"
+)
+
+// The largest compressed body accepted by the remote_read endpoint.
+const maxRemoteReadSize = 1 << 20
+
+// The label a series' path is presented in, and the prefix of the labels its nodes are presented in.
+const (
+	pathLabel       = "path"
+	nodeLabelPrefix = "node"
+)
+
+// The types of a Prometheus label matcher.
+const (
+	matchEqual = iota
+	matchNotEqual
+	matchRegexp
+	matchNotRegexp
+)
+
+// labelMatcher is a Prometheus label matcher, which a series' label must satisfy for it to be returned.
+type labelMatcher struct {
+	kind  int
+	name  string
+	value string
+	re    *regexp.Regexp // For the regexp types, the value anchored at both ends
+}
+
+// readQuery is one query of a Prometheus remote_read request.
+type readQuery struct {
+	start    int64 // Milliseconds since the epoch
+	end      int64
+	matchers []labelMatcher
+}
+
+// remoteReadHandler serves the Prometheus remote_read protocol, "POST /api/v1/read", so that Prometheus
+// can query what Cassabon stores. Each path is a series with its path in the "path" label, each node in
+// "node0", "node1" and so on, and a "__name__" made of the path with every character Prometheus doesn't
+// allow in a name replaced by '_'. A query must match the path, or some of its nodes, with equality:
+// these make the path expression the index is asked for, and every matcher filters what it finds. The
+// path may be matched by a path expression, such as "servers.*.cpu"; every other label is matched exactly.
+func (api *CassabonAPI) remoteReadHandler(w http.ResponseWriter, r *http.Request) {
+
+	_ = r.ParseForm()
+	tenant, err := api.tenant(r)
+	if err != nil {
+		api.sendErrorResponse(w, http.StatusBadRequest, "bad request", err.Error())
+		return
+	}
+	compressed, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxRemoteReadSize))
+	if err != nil {
+		api.sendErrorResponse(w, http.StatusBadRequest, "bad request", err.Error())
+		return
+	}
+	body, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		api.sendErrorResponse(w, http.StatusBadRequest, "bad request", "invalid snappy encoding: "+err.Error())
+		return
+	}
+	queries, err := parseReadRequest(body)
+	if err != nil {
+		api.sendErrorResponse(w, http.StatusBadRequest, "bad request", err.Error())
+		return
+	}
+
+	// Each query has a result, which lists its series.
+	var resp []byte
+	for _, q := range queries {
+		pathExpr, err := q.pathExpression()
+		if err != nil {
+			api.sendErrorResponse(w, http.StatusBadRequest, "bad request", err.Error())
+			return
+		}
+		list, err := api.fetchSeries(requestID(r), tenant, pathExpr, q.start/1000, q.end/1000, nil)
+		if err != nil {
+			logging.Statsd.Client.Inc("api.err.remoteread", 1, 1.0)
+			api.sendErrorResponse(w, http.StatusInternalServerError, "internal error", err.Error())
+			return
+		}
+		var result []byte
+		for _, s := range list {
+			labels := seriesLabels(s.Name)
+			if !q.matches(labels) {
+				continue
+			}
+			result = appendMessage(result, 1, q.timeSeries(labels, s))
+		}
+		resp = appendMessage(resp, 1, result)
+	}
+
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	w.Header().Set("Content-Encoding", "snappy")
+	w.Write(snappy.Encode(nil, resp))
+}
+
+// timeSeries encodes a Prometheus TimeSeries protocol buffer, holding the labels of a series, and those of
+// its values that are within the range of the query.
+func (q readQuery) timeSeries(labels [][2]string, s *render.Series) []byte {
+	var ts []byte
+	for _, l := range labels {
+		ts = appendMessage(ts, 1, appendString(appendString(nil, 1, l[0]), 2, l[1]))
+	}
+	for i, v := range s.Values {
+		t := (s.Start + int64(i)*s.Step) * 1000
+		if math.IsNaN(v) || t < q.start || t > q.end {
+			continue
+		}
+		ts = appendMessage(ts, 2, appendVarintField(appendDouble(nil, 1, v), 2, uint64(t)))
+	}
+	return ts
+}
+
+// seriesLabels returns the labels of the series of a path, as name and value pairs, sorted by name.
+func seriesLabels(path string) [][2]string {
+	name := []byte(path)
+	for i, c := range name {
+		if !(c == '_' || c == ':' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' && i > 0) {
+			name[i] = '_'
+		}
+	}
+	labels := [][2]string{{"__name__", string(name)}, {pathLabel, path}}
+	for i, node := range strings.Split(path, ".") {
+		labels = append(labels, [2]string{nodeLabelPrefix + strconv.Itoa(i), node})
+	}
+	sort.Sort(byLabelName(labels))
+	return labels
+}
+
+// byLabelName sorts labels by name, as Prometheus expects them.
+type byLabelName [][2]string
+
+func (l byLabelName) Len() int           { return len(l) }
+func (l byLabelName) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+func (l byLabelName) Less(i, j int) bool { return l[i][0] < l[j][0] }
+
+// pathExpression returns the path expression that finds the paths a query may match. With no equality
+// matcher on the path, it is as deep as the deepest node matched for equality, and any other node is a wildcard.
+func (q readQuery) pathExpression() (string, error) {
+	var nodes []string
+	for _, m := range q.matchers {
+		if m.kind != matchEqual {
+			continue
+		}
+		if m.name == pathLabel && m.value != "" {
+			return m.value, nil
+		}
+		if !strings.HasPrefix(m.name, nodeLabelPrefix) {
+			continue
+		}
+		i, err := strconv.Atoi(strings.TrimPrefix(m.name, nodeLabelPrefix))
+		if err != nil || i < 0 || i > 255 || m.value == "" {
+			continue
+		}
+		for len(nodes) <= i {
+			nodes = append(nodes, "*")
+		}
+		nodes[i] = m.value
+	}
+	if len(nodes) == 0 {
+		return "", fmt.Errorf("a query must match %q, or a %q label, for equality", pathLabel, nodeLabelPrefix+"N")
+	}
+	return strings.Join(nodes, "."), nil
+}
+
+// matches reports whether a series' labels satisfy every matcher of a query. A label a series doesn't have
+// is empty, as Prometheus treats it.
+func (q readQuery) matches(labels [][2]string) bool {
+	for _, m := range q.matchers {
+		value := ""
+		for _, l := range labels {
+			if l[0] == m.name {
+				value = l[1]
+				break
+			}
+		}
+		var ok bool
+		switch m.kind {
+		case matchEqual:
+			// The path may be matched by a path expression, which the index has applied.
+			ok = value == m.value || m.name == pathLabel
+		case matchNotEqual:
+			ok = value != m.value
+		case matchRegexp:
+			ok = m.re.MatchString(value)
+		case matchNotRegexp:
+			ok = !m.re.MatchString(value)
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// parseReadRequest decodes a Prometheus ReadRequest protocol buffer into its queries.
+func parseReadRequest(body []byte) ([]readQuery, error) {
+	var queries []readQuery
+	err := protoFields(body, func(field int, v uint64, data []byte) error {
+		if field != 1 || data == nil {
+			return nil
+		}
+		var q readQuery
+		err := protoFields(data, func(field int, v uint64, data []byte) error {
+			switch field {
+			case 1:
+				q.start = int64(v)
+			case 2:
+				q.end = int64(v)
+			case 3:
+				m, err := parseLabelMatcher(data)
+				if err != nil {
+					return err
+				}
+				q.matchers = append(q.matchers, m)
+			}
+			return nil
+		})
+		queries = append(queries, q)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(queries) == 0 {
+		return nil, fmt.Errorf("no queries specified")
+	}
+	return queries, nil
+}
+
+// parseLabelMatcher decodes a Prometheus LabelMatcher protocol buffer.
+func parseLabelMatcher(data []byte) (labelMatcher, error) {
+	var m labelMatcher
+	err := protoFields(data, func(field int, v uint64, data []byte) error {
+		switch field {
+		case 1:
+			m.kind = int(v)
+		case 2:
+			m.name = string(data)
+		case 3:
+			m.value = string(data)
+		}
+		return nil
+	})
+	if err != nil {
+		return m, err
+	}
+	switch m.kind {
+	case matchEqual, matchNotEqual:
+	case matchRegexp, matchNotRegexp:
+		if m.re, err = regexp.Compile("^(?:" + m.value + ")$"); err != nil {
+			return m, fmt.Errorf("invalid regexp for label %q: %s", m.name, err.Error())
+		}
+	default:
+		return m, fmt.Errorf("unknown matcher type %d for label %q", m.kind, m.name)
+	}
+	return m, nil
+}
@@ -0,0 +1,118 @@
+package api
+
+import (
+	"bytes"
+	"encoding/hex"
+	"math"
+	"testing"
+
+	"github.com/jeffpierce/cassabon/render"
+)
+
+// A Prometheus ReadRequest, as Prometheus encodes it, with one query: from 1000 to 2000 ms, where
+// __name__="foo", node1=~"b.*", and hints of a 15s step. The equality matcher's type is left out,
+// as it is zero.
+const readRequestHex = "0a2c" + // queries
+	"08e807" + "10d00f" + // start_timestamp_ms, end_timestamp_ms
+	"1a0f" + "12085f5f6e616d655f5f" + "1a03666f6f" + // matchers: name, value
+	"1a0e" + "0802" + "12056e6f646531" + "1a03622e2a" + // matchers: type, name, value
+	"2203" + "089875" // hints: step_ms
+
+func TestParseReadRequest(t *testing.T) {
+	body, _ := hex.DecodeString(readRequestHex)
+	queries, err := parseReadRequest(body)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if len(queries) != 1 {
+		t.Fatalf("Expected 1 query, got %d", len(queries))
+	}
+	q := queries[0]
+	if q.start != 1000 || q.end != 2000 || len(q.matchers) != 2 {
+		t.Fatalf("Wrong query: %+v", q)
+	}
+	if m := q.matchers[0]; m.kind != matchEqual || m.name != "__name__" || m.value != "foo" {
+		t.Errorf("Wrong equality matcher: %+v", m)
+	}
+	if m := q.matchers[1]; m.kind != matchRegexp || m.name != "node1" || m.value != "b.*" || !m.re.MatchString("bar") {
+		t.Errorf("Wrong regexp matcher: %+v", m)
+	}
+
+	// Truncated messages, and those with no queries, are refused.
+	for _, bad := range []string{readRequestHex[:len(readRequestHex)-2], "0a", "", "1a0f"} {
+		body, _ := hex.DecodeString(bad)
+		if _, err := parseReadRequest(body); err == nil {
+			t.Errorf("Expected %q to be refused", bad)
+		}
+	}
+}
+
+func TestTimeSeries(t *testing.T) {
+
+	// A Prometheus TimeSeries, as Prometheus encodes it, with two labels, and a sample of 1.5 at 1000 ms.
+	expected, _ := hex.DecodeString("0a0f" + "0a085f5f6e616d655f5f" + "1203615f62" + // labels: name, value
+		"0a0b" + "0a0470617468" + "1203612e62" + // labels: name, value
+		"120c" + "09000000000000f83f" + "10e807") // samples: value, timestamp
+
+	// Only the values within the range, and not NaN, are encoded.
+	labels := [][2]string{{"__name__", "a_b"}, {"path", "a.b"}}
+	q := readQuery{start: 1000, end: 2000}
+	s := &render.Series{Name: "a.b", Start: 0, Step: 1, Values: []float64{9, 1.5, math.NaN(), 9}}
+	if ts := q.timeSeries(labels, s); !bytes.Equal(ts, expected) {
+		t.Errorf("Wrong encoding: got %x, expected %x", ts, expected)
+	}
+
+	// The encoding decodes to what was encoded.
+	s.Values = []float64{1, 2, 3}
+	q = readQuery{start: 0, end: 5000}
+	var decoded [][2]string
+	var values []float64
+	var times []int64
+	err := protoFields(q.timeSeries(labels, s), func(field int, v uint64, data []byte) error {
+		var label [2]string
+		err := protoFields(data, func(f int, v uint64, d []byte) error {
+			switch {
+			case field == 1:
+				label[f-1] = string(d)
+			case field == 2 && f == 1:
+				values = append(values, math.Float64frombits(v))
+			case field == 2 && f == 2:
+				times = append(times, int64(v))
+			}
+			return nil
+		})
+		if field == 1 {
+			decoded = append(decoded, label)
+		}
+		return err
+	})
+	if err != nil || len(decoded) != 2 || decoded[0] != labels[0] || decoded[1] != labels[1] {
+		t.Errorf("Wrong labels decoded: %v %v", decoded, err)
+	}
+	if len(values) != 3 || values[2] != 3 || len(times) != 3 || times[2] != 2000 {
+		t.Errorf("Wrong samples decoded: %v at %v", values, times)
+	}
+}
+
+func TestReadQueryMatches(t *testing.T) {
+	labels := seriesLabels("servers.web1.cpu")
+	eq := func(name, value string) labelMatcher {
+		return labelMatcher{kind: matchEqual, name: name, value: value}
+	}
+	tests := []struct {
+		matchers []labelMatcher
+		matches  bool
+	}{
+		{[]labelMatcher{eq("path", "servers.*.cpu")}, true},                       // The index applied the expression
+		{[]labelMatcher{eq("path", "servers.*.cpu"), eq("node1", "web1")}, true},  // Node matched exactly
+		{[]labelMatcher{eq("path", "servers.*.cpu"), eq("node1", "web2")}, false}, // Node not matched
+		{[]labelMatcher{eq("path", "servers.*.cpu"), eq("nodes", "x")}, false},    // No such label
+		{[]labelMatcher{eq("node0", "servers"), eq("node3", "")}, true},           // Missing label is empty
+		{[]labelMatcher{{kind: matchNotEqual, name: "node2", value: "cpu"}}, false},
+	}
+	for i, test := range tests {
+		if matches := (readQuery{matchers: test.matchers}).matches(labels); matches != test.matches {
+			t.Errorf("Test %d: expected %v, got %v", i, test.matches, matches)
+		}
+	}
+}
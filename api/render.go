@@ -0,0 +1,265 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jeffpierce/cassabon/config"
+	"github.com/jeffpierce/cassabon/logging"
+	"github.com/jeffpierce/cassabon/render"
+)
+
+// The time range rendered when the request doesn't give one.
+const defaultRenderRange = 24 * time.Hour
+
+// fetchTrace records how the series of one path expression were fetched, when a render is explained.
+type fetchTrace struct {
+	PathExpression string          `json:"pathExpression"`
+	From           int64           `json:"from"`
+	To             int64           `json:"to"`
+	Paths          []string        `json:"paths"`             // The leaf paths the index found
+	IndexElapsed   float64         `json:"indexelapsed"`      // Seconds taken to find them
+	Metrics        json.RawMessage `json:"metrics,omitempty"` // How the MetricManager read their series
+	Elapsed        float64         `json:"elapsed"`           // Seconds taken in all
+}
+
+// renderHandler processes requests like "GET /render?target=alias(foo.*.bar,'bars')&from=1450000000",
+// which evaluate graphite-web render targets. Each target is a path expression, or functions applied to
+// the series of one, and the response lists the series of them all, in graphite-web's JSON format. With
+// "format=csv", "format=pickle" or "format=msgpack", they are listed in graphite-web's format of that name instead.
+// With "explain=true", the JSON response is an object holding the "series", and an "explain" list recording
+// the index lookup and metric query made for each path expression, to show why a graph is slow or empty.
+func (api *CassabonAPI) renderHandler(w http.ResponseWriter, r *http.Request) {
+
+	_ = r.ParseForm()
+	tenant, err := api.tenant(r)
+	if err != nil {
+		api.sendErrorResponse(w, http.StatusBadRequest, "bad request", err.Error())
+		return
+	}
+	if len(r.Form["target"]) == 0 {
+		api.sendErrorResponse(w, http.StatusBadRequest, "bad request", "no target specified")
+		return
+	}
+	from, to, err := timeRange(r)
+	if err != nil {
+		api.sendErrorResponse(w, http.StatusBadRequest, "bad request", err.Error())
+		return
+	}
+	if to <= 0 {
+		to = time.Now().Unix()
+	}
+	if from <= 0 {
+		from = to - int64(defaultRenderRange/time.Second)
+	}
+	format := strings.ToLower(r.Form.Get("format"))
+	switch format {
+	case "", "json", "csv", "pickle", "msgpack":
+	default:
+		api.sendErrorResponse(w, http.StatusBadRequest, "bad request", fmt.Sprintf("unknown format %q", format))
+		return
+	}
+	explain := strings.ToLower(r.Form.Get("explain")) == "true"
+	if explain && format != "" && format != "json" {
+		api.sendErrorResponse(w, http.StatusBadRequest, "bad request", "an explained render can only be returned as JSON")
+		return
+	}
+	config.G.Log.System.LogDebug("Received render query: %v %d %d %s", r.Form["target"], from, to, format)
+
+	traces := []*fetchTrace{}
+	fetch := func(pathExpr string, from, to int64) ([]*render.Series, error) {
+		if !explain {
+			return api.fetchSeries(requestID(r), tenant, pathExpr, from, to, nil)
+		}
+		trace := &fetchTrace{PathExpression: pathExpr, From: from, To: to}
+		traces = append(traces, trace)
+		return api.fetchSeries(requestID(r), tenant, pathExpr, from, to, trace)
+	}
+	list := []*render.Series{}
+	for _, target := range r.Form["target"] {
+		series, err := render.Evaluate(target, from, to, fetch)
+		if err != nil {
+			api.sendQueryError(w, "api.err.render", err)
+			return
+		}
+		list = append(list, series...)
+	}
+	switch format {
+	case "pickle":
+		w.Header().Set("Content-Type", "application/pickle")
+		w.Write(render.Pickle(list))
+	case "msgpack":
+		w.Header().Set("Content-Type", "application/x-msgpack")
+		w.Write(render.Msgpack(list))
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv")
+		w.Write(render.CSV(list))
+	default:
+		var jsonText []byte
+		if explain {
+			jsonText, _ = json.Marshal(struct {
+				Series  []*render.Series `json:"series"`
+				Explain []*fetchTrace    `json:"explain"`
+			}{list, traces})
+		} else {
+			jsonText, _ = json.Marshal(list)
+		}
+		w.Write(jsonText)
+	}
+}
+
+// sendQueryError reports a query that failed: as a bad request if it couldn't be carried out as written,
+// and otherwise as an internal error.
+func (api *CassabonAPI) sendQueryError(w http.ResponseWriter, stat string, err error) {
+	logging.Statsd.Client.Inc(stat, 1, 1.0)
+	if _, ok := err.(*render.TargetError); ok {
+		api.sendErrorResponse(w, http.StatusBadRequest, "bad request", err.Error())
+	} else {
+		api.sendErrorResponse(w, http.StatusInternalServerError, "internal error", err.Error())
+	}
+}
+
+// fetchSeries returns the series of the leaf paths matched by a path expression, in the order the index
+// lists them, which the MetricManager reads once the IndexManager has found them. If a trace is supplied,
+// what was done is recorded in it.
+func (api *CassabonAPI) fetchSeries(reqID, tenant, pathExpr string, from, to int64, trace *fetchTrace) ([]*render.Series, error) {
+
+	// Find the paths.
+	start := time.Now()
+	if trace != nil {
+		defer func() { trace.Elapsed = time.Since(start).Seconds() }()
+	}
+	nodes, err := api.find(reqID, tenant, pathExpr)
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, node := range nodes {
+		if node.Leaf {
+			paths = append(paths, node.Path)
+		}
+	}
+	if trace != nil {
+		trace.Paths, trace.IndexElapsed = append([]string{}, paths...), time.Since(start).Seconds()
+	}
+	if len(paths) == 0 {
+		return nil, nil
+	}
+
+	// Read their series.
+	ch := make(chan config.APIQueryResponse)
+	mq := config.MetricQuery{"GET", paths, from, to, false, 0, "", "", false, trace != nil, tenant, reqID, ch}
+	select {
+	case config.G.Channels.MetricRequest <- mq:
+	default:
+		return nil, fmt.Errorf("MetricRequest channel is full (max %d entries)", config.G.Channels.MetricRequestChanLen)
+	}
+	payload, err := api.receive(ch, config.G.API.Timeouts.GetMetric)
+	if err != nil {
+		return nil, err
+	}
+	if trace != nil {
+		var explained struct {
+			Explain json.RawMessage `json:"explain"`
+		}
+		if err := json.Unmarshal(payload, &explained); err == nil {
+			trace.Metrics = explained.Explain
+		}
+	}
+	return decodeSeries(payload, paths)
+}
+
+// indexNode is a node the index finds for a path expression, as it lists them.
+type indexNode struct {
+	Path string `json:"path"`
+	Leaf bool   `json:"leaf"`
+}
+
+// find returns the nodes the index finds for a path expression.
+func (api *CassabonAPI) find(reqID, tenant, pathExpr string) ([]indexNode, error) {
+	ch := make(chan config.APIQueryResponse)
+	iq := config.IndexQuery{"GET", pathExpr, tenant, false, false, 0, 0, "", "", nil, reqID, ch}
+	select {
+	case config.G.Channels.IndexRequest <- iq:
+	default:
+		return nil, fmt.Errorf("IndexRequest channel is full (max %d entries)", config.G.Channels.IndexRequestChanLen)
+	}
+	payload, err := api.receive(ch, config.G.API.Timeouts.GetIndex)
+	if err != nil {
+		return nil, err
+	}
+	var nodes []indexNode
+	if err := json.Unmarshal(payload, &nodes); err != nil {
+		return nil, err
+	}
+	return nodes, nil
+}
+
+// decodeSeries returns the series of a metric query's response, in the order of the paths listed, or in
+// the order of their paths if none are.
+func decodeSeries(payload []byte, paths []string) ([]*render.Series, error) {
+	var resp struct {
+		Series  map[string][]*float64 `json:"series"`
+		Targets map[string]struct {
+			From int64 `json:"from"`
+			Step int64 `json:"step"`
+		} `json:"targets"`
+	}
+	if err := json.Unmarshal(payload, &resp); err != nil {
+		return nil, err
+	}
+	if paths == nil {
+		for path := range resp.Series {
+			paths = append(paths, path)
+		}
+		sort.Strings(paths)
+	}
+	list := make([]*render.Series, 0, len(paths))
+	for _, path := range paths {
+		values, found := resp.Series[path]
+		if !found {
+			continue
+		}
+		s := &render.Series{Name: path, Start: resp.Targets[path].From, Step: resp.Targets[path].Step}
+		s.Values = make([]float64, len(values))
+		for i, v := range values {
+			if v == nil {
+				s.Values[i] = math.NaN()
+			} else {
+				s.Values[i] = *v
+			}
+		}
+		list = append(list, s)
+	}
+	return list, nil
+}
+
+// receive reads the response to a query, reassembling one that arrives in parts, and returns its payload.
+func (api *CassabonAPI) receive(ch chan config.APIQueryResponse, timeout time.Duration) ([]byte, error) {
+	defer close(ch)
+	var payload []byte
+	deadline := time.After(timeout)
+	for {
+		select {
+		case resp := <-ch:
+			payload = append(payload, resp.Payload...)
+			switch resp.Status {
+			case config.AQS_PARTIAL:
+				continue
+			case config.AQS_OK:
+				return payload, nil
+			case config.AQS_BADREQUEST:
+				return nil, &render.TargetError{Message: resp.Message}
+			default:
+				return nil, fmt.Errorf("%s", resp.Message)
+			}
+		case <-deadline:
+			return nil, fmt.Errorf("query timed out after %v", timeout)
+		}
+	}
+}
@@ -1,7 +1,11 @@
 package api
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"net/http"
+	"path"
+	"regexp"
 	"strings"
 	"time"
 
@@ -12,23 +16,53 @@ import (
 	"github.com/jeffpierce/cassabon/logging"
 )
 
-// requestLogger handler emits access and trace log entries.
+// The header holding the ID of a request, which is echoed in the response.
+const requestIDHeader = "X-Request-Id"
+
+// A request ID given by the client, as by a proxy in front of us, is kept if it looks like one.
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// newRequestID returns a random request ID.
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// requestID returns the ID of a request, as assigned by requestLogger, to be passed on with its queries.
+func requestID(r *http.Request) string {
+	return r.Header.Get(requestIDHeader)
+}
+
+// requestLogger handler emits access and trace log entries. Each request is given an ID, which is echoed in
+// the X-Request-Id response header, and logged by the MetricManager and IndexManager with its queries.
 func requestLogger(c *web.C, h http.Handler) http.Handler {
 
 	fn := func(w http.ResponseWriter, r *http.Request) {
 
+		// Identify the request.
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID.MatchString(id) {
+			id = newRequestID()
+			r.Header.Set(requestIDHeader, id)
+		}
+		w.Header().Set(requestIDHeader, id)
+
 		// Instrument the ResponseWriter with a wrapper, and time the rest of the handler chain.
 		lw := mutil.WrapWriter(w)
 		t1 := time.Now()
 		h.ServeHTTP(lw, r)
 		t2 := time.Now()
-		if lw.Status() == 0 {
-			lw.WriteHeader(http.StatusOK)
-		}
 
-		// Assemble the data for the access log entry.
+		// Assemble the data for the access log entry. No status is recorded for a connection taken over by
+		// a WebSocket, which wrote its own 101, or for an empty response, which is sent with a 200.
 		remoteHost := strings.Split(r.RemoteAddr, ":")[0]
 		status := lw.Status()
+		if status == 0 && headerHasToken(r.Header, "Upgrade", "websocket") {
+			status = http.StatusSwitchingProtocols
+		} else if status == 0 {
+			status = http.StatusOK
+		}
 		size := lw.BytesWritten()
 		duration := t2.Sub(t1)
 
@@ -43,9 +77,11 @@ func requestLogger(c *web.C, h http.Handler) http.Handler {
 		// Write the stats entry.
 		logging.Statsd.Client.TimingDuration(strings.Join(stats, "."), duration, 1.0)
 
-		// Write the log entry to the access log.
-		config.G.Log.API.LogInfo("%s %s %s %s status=%d size=%d dur=%d",
-			remoteHost, r.Method, r.Proto, r.RequestURI, status, size, duration.Nanoseconds()/1000)
+		// Write the log entry to the access log. The target is the path without its parameters, cleaned up,
+		// so that requests for the same endpoint may be counted together.
+		config.G.Log.API.LogInfo("%s %s %s %s target=%s status=%d size=%d dur=%d req=%s",
+			remoteHost, r.Method, r.Proto, redactedURI(r), path.Clean("/"+r.URL.Path), status, size,
+			duration.Nanoseconds()/1000, id)
 	}
 
 	return http.HandlerFunc(fn)
@@ -0,0 +1,220 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jeffpierce/cassabon/config"
+	"github.com/jeffpierce/cassabon/logging"
+)
+
+// The longest time for which incoming metrics may be sampled, and the largest proposed configuration.
+const (
+	maxRollupSample   = 60
+	maxRollupFileSize = 1 << 20
+)
+
+// rollupTestWindow describes one window that a path would be rolled up into.
+type rollupTestWindow struct {
+	Window    string `json:"window"`
+	Retention string `json:"retention"`
+	Table     string `json:"table"`
+}
+
+// rollupTestPath describes how a path would be rolled up.
+type rollupTestPath struct {
+	Expression string             `json:"expression"`
+	Method     string             `json:"method"`
+	Windows    []rollupTestWindow `json:"windows"`
+	Changed    bool               `json:"changed"` // Whether this differs from the rollups in effect
+}
+
+// rollupTestResponse is the report returned by the rollup test endpoint.
+type rollupTestResponse struct {
+	Proposed  bool                      `json:"proposed"` // Whether a proposed configuration was tested
+	Clean     bool                      `json:"clean"`    // Whether the configuration parsed without warnings
+	Warnings  []string                  `json:"warnings"`
+	Tables    []string                  `json:"tables"`
+	NewTables []string                  `json:"new_tables"` // Tables that would have to be created
+	Paths     map[string]rollupTestPath `json:"paths"`
+}
+
+// rulesHandler processes "GET /rollups", which lists the rollup rules the MetricManager is applying: each
+// expression in order of priority, with its method, windows, retentions and tables, and the overrides in force.
+func (api *CassabonAPI) rulesHandler(w http.ResponseWriter, r *http.Request) {
+
+	// Create the channel on which the response will be received.
+	ch := make(chan config.APIQueryResponse)
+
+	q := config.MetricQuery{"RULES", nil, 0, 0, false, 0, "", "", false, false, "", requestID(r), ch}
+
+	// Forward the query.
+	select {
+	case config.G.Channels.MetricRequest <- q:
+	default:
+		config.G.Log.System.LogWarn(
+			"Rollups query discarded, MetricRequest channel is full (max %d entries)",
+			config.G.Channels.MetricRequestChanLen)
+		logging.Statsd.Client.Inc("api.err.rollups", 1, 1.0)
+	}
+
+	// Send the response to the client.
+	api.sendResponse(w, ch, config.G.API.Timeouts.GetMetric)
+}
+
+// testRollupsHandler processes requests like "GET /rollups/test?path=foo&sample=10", reporting the
+// expression, windows and tables to which each path maps. The paths are those named in the request,
+// plus those of the metrics received during the sample period, if any. A proposed configuration
+// file may be sent as the body of a POST, to be tested instead of the rollups in effect.
+func (api *CassabonAPI) testRollupsHandler(w http.ResponseWriter, r *http.Request) {
+
+	// Read the proposed configuration before parsing parameters, which might consume the body.
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxRollupFileSize))
+	if err != nil {
+		api.sendErrorResponse(w, http.StatusBadRequest, "bad request", err.Error())
+		return
+	}
+	params := r.URL.Query()
+
+	resp := rollupTestResponse{Warnings: []string{}, Paths: map[string]rollupTestPath{}}
+
+	// Use the proposed rollups if supplied, or else those in effect.
+	current := config.Rollups()
+	priority, rollup, tables := current.Priority, current.Defs, current.Tables
+	resp.Clean = true
+	if len(body) > 0 {
+		warn := func(format string, a ...interface{}) {
+			resp.Warnings = append(resp.Warnings, fmt.Sprintf(format, a...))
+		}
+		resp.Proposed = true
+		if priority, rollup, tables, resp.Clean, err = config.ParseProposedRollups(body, warn); err != nil {
+			api.sendErrorResponse(w, http.StatusBadRequest, "bad request", err.Error())
+			return
+		}
+	}
+	resp.Tables = tables
+	resp.NewTables = []string{}
+	for _, table := range tables {
+		found := false
+		for _, v := range current.Tables {
+			if table == v {
+				found = true
+				break
+			}
+		}
+		if !found {
+			resp.NewTables = append(resp.NewTables, table)
+		}
+	}
+
+	// Collect the paths to be tested.
+	paths := params["path"]
+	if sampleText := params.Get("sample"); sampleText != "" {
+		sample, err := strconv.Atoi(sampleText)
+		if err != nil || sample <= 0 || sample > maxRollupSample {
+			api.sendErrorResponse(w, http.StatusBadRequest, "bad request",
+				fmt.Sprintf("sample must be from 1 to %d seconds", maxRollupSample))
+			return
+		}
+		sampled, err := api.sampleMetricPaths(requestID(r), sample)
+		if err != nil {
+			api.sendErrorResponse(w, http.StatusInternalServerError, "internal error", err.Error())
+			return
+		}
+		paths = append(paths, sampled...)
+	}
+	if len(paths) == 0 {
+		api.sendErrorResponse(w, http.StatusBadRequest, "bad request", "no path or sample specified")
+		return
+	}
+
+	// Report on each path, and whether its treatment changes.
+	for _, path := range paths {
+		expr := config.MatchRollup(priority, rollup, path)
+		def := rollup[expr]
+		tp := rollupTestPath{expr, def.Method.String(), []rollupTestWindow{}, false}
+		for _, v := range def.Windows {
+			tp.Windows = append(tp.Windows, rollupTestWindow{v.Window.String(), v.Retention.String(), v.Table})
+		}
+		currentExpr := config.MatchRollup(current.Priority, current.Defs, path)
+		tp.Changed = currentExpr != expr || !config.RollupDefsEqual(current.Defs[currentExpr], def)
+		resp.Paths[path] = tp
+	}
+
+	jsonText, _ := json.Marshal(resp)
+	w.Write(jsonText)
+}
+
+// sampleMetricPaths returns the distinct paths of the metrics received in the next few seconds.
+func (api *CassabonAPI) sampleMetricPaths(reqID string, seconds int) ([]string, error) {
+
+	// Create the channel on which the response will be received.
+	ch := make(chan config.APIQueryResponse)
+	defer close(ch)
+
+	now := time.Now().Unix()
+	q := config.MetricQuery{"TAP", nil, now, now + int64(seconds), false, 0, "", "", false, false, "", reqID, ch}
+	config.G.Log.System.LogDebug("Sampling metric paths for %d seconds", seconds)
+
+	// Forward the query.
+	select {
+	case config.G.Channels.MetricRequest <- q:
+	default:
+		logging.Statsd.Client.Inc("api.err.rollups.test", 1, 1.0)
+		return nil, fmt.Errorf("MetricRequest channel is full (max %d entries)", config.G.Channels.MetricRequestChanLen)
+	}
+
+	// Read the response.
+	timeout := time.Duration(seconds)*time.Second + config.G.API.Timeouts.GetMetric
+	var resp config.APIQueryResponse
+	select {
+	case resp = <-ch:
+	case <-time.After(timeout):
+		return nil, fmt.Errorf("sample timed out after %v", timeout)
+	}
+	if resp.Status != config.AQS_OK {
+		return nil, fmt.Errorf("%s", resp.Message)
+	}
+	var paths []string
+	if err := json.Unmarshal(resp.Payload, &paths); err != nil {
+		return nil, err
+	}
+	return paths, nil
+}
+
+// overridesHandler processes requests like "PUT /rollups/overrides?path=foo.&prefix=true&expression=^foo.*",
+// which pin a path, or every path with a prefix, to a configured rollup expression. DELETE removes
+// the override for a path, and GET lists them all.
+func (api *CassabonAPI) overridesHandler(w http.ResponseWriter, r *http.Request) {
+
+	// Create the channel on which the response will be received.
+	ch := make(chan config.APIQueryResponse)
+
+	// Extract the query from the request URI.
+	_ = r.ParseForm()
+	tenant, err := api.tenant(r)
+	if err != nil {
+		api.sendErrorResponse(w, http.StatusBadRequest, "bad request", err.Error())
+		return
+	}
+	prefix, _ := strconv.ParseBool(r.Form.Get("prefix"))
+	q := config.OverrideQuery{r.Method, r.Form.Get("path"), prefix, r.Form.Get("expression"), tenant, ch}
+	config.G.Log.System.LogDebug("Received overrides query: %s %q prefix=%v %q", q.Method, q.Path, q.Prefix, q.Expression)
+
+	// Forward the query.
+	select {
+	case config.G.Channels.OverrideRequest <- q:
+	default:
+		config.G.Log.System.LogWarn(
+			"Overrides query discarded, OverrideRequest channel is full (max %d entries)",
+			config.G.Channels.MetricRequestChanLen)
+		logging.Statsd.Client.Inc("api.err.rollups.overrides", 1, 1.0)
+	}
+
+	// Send the response to the client.
+	api.sendResponse(w, ch, config.G.API.Timeouts.GetMetric)
+}
@@ -0,0 +1,54 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/jeffpierce/cassabon/config"
+	"github.com/jeffpierce/cassabon/logging"
+)
+
+// autoCompleteTagsHandler processes requests like "GET /tags/autoComplete/tags?tagPrefix=d&expr=name=disk.used",
+// as graphite-web does, returning the tags beginning with the prefix of the tagged series that match every
+// expression. Tagged series are those whose paths are in graphite's "name;tag=value" form.
+func (api *CassabonAPI) autoCompleteTagsHandler(w http.ResponseWriter, r *http.Request) {
+	_ = r.ParseForm()
+	api.autoComplete(w, r, "tags", r.Form.Get("tagPrefix"))
+}
+
+// autoCompleteValuesHandler processes requests like "GET /tags/autoComplete/values?tag=dc&valuePrefix=e",
+// as graphite-web does, returning the values of the tag beginning with the prefix.
+func (api *CassabonAPI) autoCompleteValuesHandler(w http.ResponseWriter, r *http.Request) {
+	_ = r.ParseForm()
+	api.autoComplete(w, r, "values", r.Form.Get("valuePrefix"))
+}
+
+// autoComplete asks the index to complete tags or values.
+func (api *CassabonAPI) autoComplete(w http.ResponseWriter, r *http.Request, method, prefix string) {
+
+	// Create the channel on which the response will be received.
+	ch := make(chan config.APIQueryResponse)
+
+	tenant, err := api.tenant(r)
+	if err != nil {
+		api.sendErrorResponse(w, http.StatusBadRequest, "bad request", err.Error())
+		return
+	}
+	exprs := append(r.Form["expr"], r.Form["expr[]"]...)
+	limit, _ := strconv.Atoi(r.Form.Get("limit"))
+	q := config.IndexQuery{method, prefix, tenant, false, false, limit, 0, "", r.Form.Get("tag"), exprs, requestID(r), ch}
+	config.G.Log.System.LogDebug("Received tag autocomplete query: %s %q %q %v", method, q.Tag, prefix, exprs)
+
+	// Forward the query.
+	select {
+	case config.G.Channels.IndexRequest <- q:
+	default:
+		config.G.Log.System.LogWarn(
+			"Tag autocomplete query discarded, IndexRequest channel is full (max %d entries)",
+			config.G.Channels.IndexRequestChanLen)
+		logging.Statsd.Client.Inc("api.err.tags.autocomplete", 1, 1.0)
+	}
+
+	// Send the response to the client.
+	api.sendResponse(w, ch, config.G.API.Timeouts.GetIndex)
+}
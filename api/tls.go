@@ -0,0 +1,54 @@
+package api
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sync/atomic"
+
+	"github.com/zenazn/goji/graceful"
+
+	"github.com/jeffpierce/cassabon/config"
+)
+
+// certificate holds the *tls.Certificate the API is served with. It is loaded again as the API starts after
+// each SIGHUP, so that a renewed certificate is taken up without a restart.
+var certificate atomic.Value
+
+// tlsConfigured reports whether the API is to be served over HTTPS.
+func tlsConfigured() bool {
+	return config.G.API.TLS.CertFile != "" || config.G.API.TLS.KeyFile != ""
+}
+
+// loadCertificate loads the configured certificate and its key. If they can't be loaded, the certificate in
+// use, if any, is kept.
+func loadCertificate() error {
+	tlsConfig := config.G.API.TLS
+	if tlsConfig.CertFile == "" || tlsConfig.KeyFile == "" {
+		return fmt.Errorf("API TLS requires both a certfile and a keyfile")
+	}
+	cert, err := tls.LoadX509KeyPair(tlsConfig.CertFile, tlsConfig.KeyFile)
+	if err != nil {
+		return err
+	}
+	certificate.Store(&cert)
+	return nil
+}
+
+// getCertificate returns the certificate the API is served with, for each TLS handshake.
+func getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cert, ok := certificate.Load().(*tls.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("no certificate loaded")
+	}
+	return cert, nil
+}
+
+// serveTLS serves the API over HTTPS until it is stopped.
+func (api *CassabonAPI) serveTLS() error {
+	ln, err := net.Listen("tcp", api.hostPort)
+	if err != nil {
+		return err
+	}
+	return graceful.Serve(tls.NewListener(ln, &tls.Config{GetCertificate: getCertificate}), api.server)
+}
@@ -0,0 +1,82 @@
+package api
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jeffpierce/cassabon/config"
+)
+
+// writeCertificate writes a self-signed certificate and its key to files in a directory.
+func writeCertificate(t *testing.T, dir, name string) (string, string) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Unable to create certificate: %s", err.Error())
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	certFile, keyFile := filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	return certFile, keyFile
+}
+
+// servedName returns the common name of the certificate the API is served with.
+func servedName(t *testing.T) string {
+	cert, err := getCertificate(nil)
+	if err != nil {
+		t.Fatalf("No certificate: %s", err.Error())
+	}
+	leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+	return leaf.Subject.CommonName
+}
+
+func TestLoadCertificate(t *testing.T) {
+	saved := config.G.API.TLS
+	defer func() { config.G.API.TLS = saved }()
+	dir := t.TempDir()
+	firstCert, firstKey := writeCertificate(t, dir, "first")
+	renewedCert, renewedKey := writeCertificate(t, dir, "renewed")
+
+	config.G.API.TLS.CertFile, config.G.API.TLS.KeyFile = firstCert, firstKey
+	if err := loadCertificate(); err != nil {
+		t.Fatalf("loadCertificate failed: %s", err.Error())
+	}
+	if name := servedName(t); name != "first" {
+		t.Errorf("Expected the first certificate, got %q", name)
+	}
+
+	// A pair that can't be loaded leaves the certificate in use in place.
+	for _, files := range [][2]string{{firstCert, renewedKey}, {renewedCert, ""}, {filepath.Join(dir, "missing.crt"), renewedKey}} {
+		config.G.API.TLS.CertFile, config.G.API.TLS.KeyFile = files[0], files[1]
+		if err := loadCertificate(); err == nil {
+			t.Errorf("Expected an error loading %v", files)
+		}
+		if name := servedName(t); name != "first" {
+			t.Errorf("Expected the first certificate to be kept, got %q", name)
+		}
+	}
+
+	config.G.API.TLS.CertFile, config.G.API.TLS.KeyFile = renewedCert, renewedKey
+	if err := loadCertificate(); err != nil {
+		t.Fatalf("loadCertificate failed: %s", err.Error())
+	}
+	if name := servedName(t); name != "renewed" {
+		t.Errorf("Expected the renewed certificate, got %q", name)
+	}
+}
@@ -0,0 +1,183 @@
+package api
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/jeffpierce/cassabon/config"
+)
+
+// The GUID the WebSocket handshake appends to the client's key, and the largest frame accepted from a client.
+const (
+	websocketGUID     = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	maxWebsocketFrame = 1 << 16
+)
+
+// The WebSocket opcodes used.
+const (
+	wsText  = 0x1
+	wsClose = 0x8
+	wsPing  = 0x9
+	wsPong  = 0xa
+)
+
+// websocketConn is the server's end of a WebSocket connection, as defined by RFC 6455. Only what the API
+// needs is supported: the server sends unfragmented messages, and reads only control frames.
+type websocketConn struct {
+	conn net.Conn
+	rw   *bufio.ReadWriter
+	m    sync.Mutex // Serializes writes, as pings are answered while messages are being sent
+}
+
+// upgradeWebsocket completes the WebSocket handshake for a request, and takes over its connection. Pages may
+// only connect from the API's own origin, or from those allowed to query it with CORS.
+func upgradeWebsocket(w http.ResponseWriter, r *http.Request) (*websocketConn, error) {
+	if r.Method != "GET" || !headerHasToken(r.Header, "Connection", "upgrade") || !headerHasToken(r.Header, "Upgrade", "websocket") {
+		return nil, fmt.Errorf("not a WebSocket handshake")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		return nil, fmt.Errorf("unsupported WebSocket version %q", r.Header.Get("Sec-WebSocket-Version"))
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		return nil, fmt.Errorf("no Sec-WebSocket-Key given")
+	}
+	if origin := r.Header.Get("Origin"); origin != "" {
+		u, err := url.Parse(origin)
+		allowed := config.G.API.CORS.AllowedOrigins
+		if err != nil || !(u.Host == r.Host || allowed["*"] || allowed[origin]) {
+			return nil, fmt.Errorf("origin %q not allowed", origin)
+		}
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, fmt.Errorf("connection can't be taken over")
+	}
+
+	sum := sha1.Sum([]byte(key + websocketGUID))
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n",
+		base64.StdEncoding.EncodeToString(sum[:]))
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &websocketConn{conn: conn, rw: rw}, nil
+}
+
+// headerHasToken reports whether a header lists a token, ignoring case.
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, v := range h[http.CanonicalHeaderKey(name)] {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// writeMessage sends a message in a single frame.
+func (c *websocketConn) writeMessage(opcode byte, payload []byte) error {
+	c.m.Lock()
+	defer c.m.Unlock()
+	header := []byte{0x80 | opcode} // FIN
+	switch n := len(payload); {
+	case n < 126:
+		header = append(header, byte(n))
+	case n < 1<<16:
+		header = append(header, 126, byte(n>>8), byte(n))
+	default:
+		header = append(header, 127)
+		var b [8]byte
+		binary.BigEndian.PutUint64(b[:], uint64(n))
+		header = append(header, b[:]...)
+	}
+	c.rw.Write(header)
+	c.rw.Write(payload)
+	return c.rw.Flush()
+}
+
+// readFrame reads a frame sent by the client, which must be masked, and returns its opcode and payload.
+func (c *websocketConn) readFrame() (byte, []byte, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(c.rw, header[:]); err != nil {
+		return 0, nil, err
+	}
+	opcode := header[0] & 0x0f
+	if header[1]&0x80 == 0 {
+		return 0, nil, fmt.Errorf("unmasked frame from client")
+	}
+	n := uint64(header[1] & 0x7f)
+	switch n {
+	case 126:
+		var b [2]byte
+		if _, err := io.ReadFull(c.rw, b[:]); err != nil {
+			return 0, nil, err
+		}
+		n = uint64(binary.BigEndian.Uint16(b[:]))
+	case 127:
+		var b [8]byte
+		if _, err := io.ReadFull(c.rw, b[:]); err != nil {
+			return 0, nil, err
+		}
+		n = binary.BigEndian.Uint64(b[:])
+	}
+	if n > maxWebsocketFrame {
+		return 0, nil, fmt.Errorf("frame of %d bytes is too large", n)
+	}
+	var mask [4]byte
+	if _, err := io.ReadFull(c.rw, mask[:]); err != nil {
+		return 0, nil, err
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(c.rw, payload); err != nil {
+		return 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return opcode, payload, nil
+}
+
+// serveControl reads what the client sends, answering its pings, until it closes the connection or the
+// connection fails, and then closes the done channel. Anything else the client sends is ignored.
+func (c *websocketConn) serveControl(done chan struct{}) {
+	defer close(done)
+	for {
+		opcode, payload, err := c.readFrame()
+		if err != nil {
+			return
+		}
+		switch opcode {
+		case wsPing:
+			if c.writeMessage(wsPong, payload) != nil {
+				return
+			}
+		case wsClose:
+			c.writeMessage(wsClose, payload)
+			return
+		}
+	}
+}
+
+// close closes the connection, telling the client why, if it is still listening. The reason must be short,
+// to fit in a control frame.
+func (c *websocketConn) close(status uint16, reason string) {
+	payload := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, status)
+	c.writeMessage(wsClose, append(payload, reason...))
+	c.conn.Close()
+}
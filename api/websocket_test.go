@@ -0,0 +1,161 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// maskedFrame returns a frame as a client sends it, masked.
+func maskedFrame(opcode byte, payload []byte) []byte {
+	frame := []byte{0x80 | opcode}
+	switch n := len(payload); {
+	case n < 126:
+		frame = append(frame, 0x80|byte(n))
+	default:
+		frame = append(frame, 0x80|126, byte(n>>8), byte(n))
+	}
+	mask := []byte{0x37, 0xfa, 0x21, 0x3d}
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	return frame
+}
+
+// readServerFrame reads an unfragmented, unmasked frame sent by the server.
+func readServerFrame(t *testing.T, r io.Reader) (byte, []byte) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		t.Fatalf("Unable to read frame: %s", err.Error())
+	}
+	if header[0]&0x80 == 0 || header[1]&0x80 != 0 {
+		t.Fatalf("Expected a final, unmasked frame, got header %x", header)
+	}
+	payload := make([]byte, header[1]&0x7f)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		t.Fatalf("Unable to read frame: %s", err.Error())
+	}
+	return header[0] & 0x0f, payload
+}
+
+func TestWebsocketHandshake(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := upgradeWebsocket(w, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		c.writeMessage(wsText, []byte("hello"))
+		done := make(chan struct{})
+		go c.serveControl(done)
+		<-done
+		c.conn.Close()
+	}))
+	defer ts.Close()
+
+	conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Unable to connect: %s", err.Error())
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// The sample handshake of RFC 6455.
+	req, _ := http.NewRequest("GET", ts.URL+"/live", nil)
+	req.Header.Set("Connection", "keep-alive, Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	req.Header.Set("Origin", ts.URL)
+	req.Write(conn)
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		t.Fatalf("Unable to read handshake: %s", err.Error())
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Expected status 101, got %s", resp.Status)
+	}
+	if accept := resp.Header.Get("Sec-WebSocket-Accept"); accept != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("Wrong Sec-WebSocket-Accept: %q", accept)
+	}
+
+	if opcode, payload := readServerFrame(t, br); opcode != wsText || string(payload) != "hello" {
+		t.Errorf("Expected a text message \"hello\", got opcode %d %q", opcode, payload)
+	}
+
+	// Pings are answered with the same payload, and a close is echoed before the server hangs up.
+	conn.Write(maskedFrame(wsPing, []byte("are you there")))
+	if opcode, payload := readServerFrame(t, br); opcode != wsPong || string(payload) != "are you there" {
+		t.Errorf("Expected a pong, got opcode %d %q", opcode, payload)
+	}
+	closing := []byte{0x03, 0xe8} // 1000, a normal closure
+	conn.Write(maskedFrame(wsClose, closing))
+	if opcode, payload := readServerFrame(t, br); opcode != wsClose || !bytes.Equal(payload, closing) {
+		t.Errorf("Expected the close to be echoed, got opcode %d %x", opcode, payload)
+	}
+	if _, err := br.ReadByte(); err != io.EOF {
+		t.Errorf("Expected the server to hang up, got %v", err)
+	}
+}
+
+func TestWebsocketRefused(t *testing.T) {
+	tests := []struct {
+		name, value string // The header changed from a valid handshake
+	}{
+		{"Upgrade", "h2c"},
+		{"Connection", "keep-alive"},
+		{"Sec-WebSocket-Version", "8"},
+		{"Sec-WebSocket-Key", ""},
+		{"Origin", "http://elsewhere.example.com"},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "http://cassabon.example.com/live", nil)
+		r.Header.Set("Connection", "Upgrade")
+		r.Header.Set("Upgrade", "websocket")
+		r.Header.Set("Sec-WebSocket-Version", "13")
+		r.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+		r.Header.Set(test.name, test.value)
+		if _, err := upgradeWebsocket(httptest.NewRecorder(), r); err == nil {
+			t.Errorf("Expected a handshake with %s %q to be refused", test.name, test.value)
+		}
+	}
+}
+
+func TestWebsocketReadFrame(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	c := &websocketConn{conn: server, rw: bufio.NewReadWriter(bufio.NewReader(server), bufio.NewWriter(server))}
+	defer server.Close()
+
+	long := bytes.Repeat([]byte("0123456789"), 20)
+	unmasked := []byte{0x80 | wsText, 2, 'h', 'i'}
+	tooLarge := []byte{0x80 | wsText, 0x80 | 127, 0, 0, 0, 0, 0, 2, 0, 0}
+	go func() {
+		client.Write(maskedFrame(wsText, []byte("short")))
+		client.Write(maskedFrame(wsText, long))
+		client.Write(unmasked)
+		client.Write(tooLarge)
+	}()
+
+	if opcode, payload, err := c.readFrame(); err != nil || opcode != wsText || string(payload) != "short" {
+		t.Errorf("Expected \"short\", got opcode %d %q (%v)", opcode, payload, err)
+	}
+	if _, payload, err := c.readFrame(); err != nil || !bytes.Equal(payload, long) {
+		t.Errorf("Expected a payload of %d bytes, got %d (%v)", len(long), len(payload), err)
+	}
+	if _, _, err := c.readFrame(); err == nil {
+		t.Errorf("Expected an unmasked frame to be refused")
+	}
+	c.rw.Reader.Discard(2)
+	if _, _, err := c.readFrame(); err == nil {
+		t.Errorf("Expected a frame of %d bytes to be refused", binary.BigEndian.Uint64(tooLarge[2:]))
+	}
+}
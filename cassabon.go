@@ -2,9 +2,11 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strings"
 	"sync"
 	"syscall"
 
@@ -22,7 +24,7 @@ func main() {
 
 	// The name of the YAML configuration file.
 	var confFile, loglevel string
-	var strict, bootstrap bool
+	var strict, bootstrap, example, check, convertCarbon bool
 
 	// The WaitGroups for managing orderly goroutine reloads and termination.
 	var onReload1WG sync.WaitGroup // Wait on this if you receive external inputs
@@ -30,12 +32,52 @@ func main() {
 	var onExitWG sync.WaitGroup    // Wait on this for final program termination
 
 	// Get options provided on the command line.
-	flag.StringVar(&confFile, "conf", "config/cassabon.yaml", "Location of YAML configuration file")
+	flag.StringVar(&confFile, "conf", "config/cassabon.yaml", "Location of YAML configuration file, or its key as consul://host:port/key or etcd://host:port/key; \"\" for none")
 	flag.StringVar(&loglevel, "loglevel", "", "logging level, to override configuration until SIGHUP")
-	flag.BoolVar(&strict, "strict", true, "rollup configuration warnings are fatal")
+	flag.BoolVar(&strict, "strict", true, "configuration problems and rollup warnings are fatal")
 	flag.BoolVar(&bootstrap, "bootstrap", false, "performs bootstrap on ElasticSearch index.  Run only once.")
+	flag.BoolVar(&example, "example-config", false, "print a complete example configuration, with every default, and exit")
+	flag.BoolVar(&check, "check-config", false, "check the configuration and its endpoints, print its rollups, and exit; non-zero on any problem")
+	flag.BoolVar(&convertCarbon, "convert-carbon", false, "print the rollups equivalent to the carbon storage-schemas.conf and storage-aggregation.conf given as arguments, and exit")
+	config.RegisterFlags(flag.CommandLine) // A flag for every setting, overriding the file and the environment
 	flag.Parse()
 
+	// Print the example configuration before any is read.
+	if example {
+		os.Stdout.Write(config.ExampleConfiguration())
+		return
+	}
+
+	// Convert the schemas and aggregation methods of carbon, for migrating from Graphite.
+	if convertCarbon {
+		if flag.NArg() < 1 || flag.NArg() > 2 {
+			fmt.Fprintf(os.Stderr, "Usage: cassabon -convert-carbon <storage-schemas.conf> [storage-aggregation.conf]\n")
+			os.Exit(2)
+		}
+		text, warnings, err := config.ConvertCarbonConfig(flag.Arg(0), flag.Arg(1))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to convert carbon configuration: %s\n", err.Error())
+			os.Exit(1)
+		}
+		for _, s := range warnings {
+			fmt.Fprintf(os.Stderr, "Warning: %s\n", s)
+		}
+		os.Stdout.Write(text)
+		return
+	}
+
+	// Check the configuration without starting anything, for CI and pre-deploy checks.
+	if check {
+		if err := config.ReadConfigurationFile(confFile); err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to load configuration: %s\n", err.Error())
+			os.Exit(1)
+		}
+		if !config.CheckConfiguration(os.Stdout) {
+			os.Exit(1)
+		}
+		return
+	}
+
 	// Create the loggers.
 	config.G.Log.System = logging.NewLogger("system")
 	config.G.Log.Carbon = logging.NewLogger("carbon")
@@ -45,6 +87,11 @@ func main() {
 	if err := config.ReadConfigurationFile(confFile); err != nil {
 		config.G.Log.System.LogFatal("Unable to load configuration: %s", err.Error())
 	}
+	// Report every problem in the configuration before any of it is used.
+	problems := config.ValidateConfiguration()
+	if len(problems) > 0 && strict {
+		config.G.Log.System.LogFatal("Invalid configuration in %s:\n  %s", confFile, strings.Join(problems, "\n  "))
+	}
 	// Populate the global config with values used only once.
 	config.LoadStartupValues()
 
@@ -67,6 +114,9 @@ func main() {
 	defer config.G.Log.System.Close()
 	defer config.G.Log.Carbon.Close()
 	defer config.G.Log.API.Close()
+	for _, s := range problems {
+		config.G.Log.System.LogWarn("Configuration problem: %s", s)
+	}
 
 	// Announce the application startup in the logs.
 	config.G.Log.System.LogInfo("Startup in progress")
@@ -78,10 +128,18 @@ func main() {
 	// Now that we have a logger to report warnings, populate the remainder of the global config.
 	config.G.Log.System.LogInfo("Reading configuration file %s", confFile)
 	config.LoadRefreshableValues()
+	logging.SetRotation(config.G.Log.MaxSize, config.G.Log.MaxBackups)
 	if !config.LoadRollups() && strict {
 		config.G.Log.System.LogFatal("Errors encountered while loading configuration")
 	}
 
+	// Run a one-shot administrative command instead of the daemon, if one was given.
+	if flag.NArg() > 0 {
+		runCommand(flag.Arg(0), flag.Args()[1:])
+		config.G.Log.System.LogInfo("Command %q complete", flag.Arg(0))
+		return
+	}
+
 	// Set up reload and termination signal handlers.
 	var sighup = make(chan os.Signal, 1)
 	signal.Notify(sighup, syscall.SIGHUP)
@@ -105,11 +163,26 @@ func main() {
 	config.G.OnPeerChange = make(chan struct{}, 1)
 	config.G.OnPeerChangeReq = make(chan struct{}, 1)
 	config.G.OnPeerChangeRsp = make(chan struct{}, 1)
+	config.G.OnRollupChangeReq = make(chan struct{}, 1)
+	config.G.OnRollupChangeRsp = make(chan struct{}, 1)
+	config.G.OnStoreChangeReq = make(chan struct{}, 1)
+	config.G.OnStoreChangeRsp = make(chan struct{}, 1)
 	config.G.OnExit = make(chan struct{}, 1)
 	config.G.Channels.MetricStore = make(chan config.CarbonMetric, config.G.Channels.MetricStoreChanLen)
 	config.G.Channels.MetricRequest = make(chan config.MetricQuery, config.G.Channels.MetricRequestChanLen)
 	config.G.Channels.IndexStore = make(chan config.CarbonMetric, config.G.Channels.IndexStoreChanLen)
 	config.G.Channels.IndexRequest = make(chan config.IndexQuery, config.G.Channels.IndexRequestChanLen)
+	config.G.Channels.OverrideRequest = make(chan config.OverrideQuery, config.G.Channels.MetricRequestChanLen)
+	config.G.Channels.BackfillRequest = make(chan config.BackfillQuery, config.G.Channels.MetricRequestChanLen)
+	config.G.Channels.EventRequest = make(chan config.EventQuery, config.G.Channels.MetricRequestChanLen)
+
+	// A configuration kept in Consul or etcd is reloaded as on SIGHUP whenever it changes after it was read.
+	go config.WatchConfiguration(confFile, config.ConfigurationIndex(), func() {
+		select {
+		case sighup <- syscall.SIGHUP:
+		default: // A reload is already pending
+		}
+	}, config.G.OnExit)
 
 	// Create and initialize the internal modules.
 	metricManager := new(datastore.MetricManager)
@@ -136,13 +209,40 @@ func main() {
 			config.G.Log.System.LogInfo("Reading configuration file %s", confFile)
 			if err := config.ReadConfigurationFile(confFile); err != nil {
 				config.G.Log.System.LogError("Unable to load configuration: %s", err.Error())
+			} else if problems := config.ValidateConfiguration(); len(problems) > 0 && strict {
+				for _, s := range problems {
+					config.G.Log.System.LogError("Configuration problem: %s", s)
+				}
+				config.G.Log.System.LogError("Invalid configuration; previous configuration retained")
 			} else {
+				for _, s := range problems {
+					config.G.Log.System.LogWarn("Configuration problem: %s", s)
+				}
+				cassandraChanged, elasticSearchChanged, restart := config.ReloadStartupValues()
+				for _, name := range restart {
+					config.G.Log.System.LogWarn("Configuration of %s changed, and takes effect only on restart", name)
+				}
 				config.LoadRefreshableValues()
 				if sev, err := logging.TextToSeverity(config.G.Log.Loglevel); err == nil {
 					config.G.Log.System.SetLogLevel(sev)
 				} else {
 					config.G.Log.System.LogWarn("Configuration error: %s", err.Error())
 				}
+				logging.SetRotation(config.G.Log.MaxSize, config.G.Log.MaxBackups)
+				if cassandraChanged {
+					// Connection settings changed; reconnect the data store, and block until done.
+					config.G.OnStoreChangeReq <- struct{}{} // Signal the data store
+					<-config.G.OnStoreChangeRsp             // Wait for data store to signal it is done
+				}
+				if (cassandraChanged && config.G.Index.Backend == config.INDEX_CASSANDRA) ||
+					(elasticSearchChanged && config.G.Index.Backend == config.INDEX_ELASTICSEARCH) {
+					indexManager.Reopen() // Stopped until started again below
+				}
+				if config.ReloadRollups(strict) {
+					// Rollups changed; flush and re-match the accumulators, and block until done.
+					config.G.OnRollupChangeReq <- struct{}{} // Signal the data store
+					<-config.G.OnRollupChangeRsp             // Wait for data store to signal it is done
+				}
 			}
 		}
 
@@ -193,3 +293,82 @@ func main() {
 	// Final cleanup.
 	config.G.Log.System.LogInfo("Termination complete")
 }
+
+// runCommand performs an administrative task named on the command line, and returns when done.
+func runCommand(command string, args []string) {
+
+	config.G.Log.System.LogInfo("Running command %q %v", command, args)
+
+	// Commands don't report to statsd, but share code with the daemon that does.
+	logging.Statsd.Open("", "", "cassabon")
+	defer logging.Statsd.Close()
+
+	switch command {
+
+	case "replay-deadletter":
+		// Re-insert rows that were abandoned after exhausting their write retries.
+		filename := config.Cassandra().DeadLetterFile
+		if len(args) > 0 {
+			filename = args[0]
+		}
+		if filename == "" {
+			config.G.Log.System.LogFatal("No dead-letter file configured or specified")
+		}
+		replayed, failed, err := datastore.ReplayDeadLetters(filename)
+		config.G.Log.System.LogInfo("Replayed %d rows from %s, %d failed", replayed, filename, failed)
+		if err != nil {
+			config.G.Log.System.LogFatal("Dead-letter replay failed: %s", err.Error())
+		}
+
+	case "upgrade-schema":
+		// Convert legacy COMPACT STORAGE tables before switching to the modern schema mode.
+		upgraded, err := datastore.UpgradeSchema()
+		config.G.Log.System.LogInfo("Upgraded %d tables", upgraded)
+		if err != nil {
+			config.G.Log.System.LogFatal("Schema upgrade failed: %s", err.Error())
+		}
+
+	case "rebuild-index":
+		// Index every path found in the tables, after the index has been lost or corrupted.
+		paths, err := datastore.RebuildIndex()
+		config.G.Log.System.LogInfo("Indexed %d paths", paths)
+		if err != nil {
+			config.G.Log.System.LogFatal("Index rebuild failed: %s", err.Error())
+		}
+
+	case "import-whisper":
+		// Load a tree of Graphite whisper files, optionally under a path prefix.
+		if len(args) < 1 {
+			config.G.Log.System.LogFatal("Usage: import-whisper <directory> [prefix]")
+		}
+		var prefix string
+		if len(args) > 1 {
+			prefix = args[1]
+		}
+		files, rows, failed, err := datastore.ImportWhisper(args[0], prefix)
+		config.G.Log.System.LogInfo("Imported %d files from %s into %d rows, %d failed", files, args[0], rows, failed)
+		if err != nil {
+			config.G.Log.System.LogFatal("Whisper import failed: %s", err.Error())
+		}
+
+	case "export":
+		// Dump stored data for paths or path queries, for archival or offline analysis.
+		fs := flag.NewFlagSet("export", flag.ExitOnError)
+		format := fs.String("format", "csv", "output format: csv or whisper")
+		out := fs.String("out", "", "output file for csv (default stdout), or directory for whisper")
+		from := fs.Int64("from", 0, "start of the time range, in seconds since the epoch")
+		to := fs.Int64("to", 0, "end of the time range, in seconds since the epoch (default now)")
+		fs.Parse(args)
+		if fs.NArg() < 1 {
+			config.G.Log.System.LogFatal("Usage: export [-format csv|whisper] [-out name] [-from ts] [-to ts] <path>...")
+		}
+		paths, rows, err := datastore.Export(*format, *out, *from, *to, fs.Args())
+		config.G.Log.System.LogInfo("Exported %d rows of %d paths", rows, paths)
+		if err != nil {
+			config.G.Log.System.LogFatal("Export failed: %s", err.Error())
+		}
+
+	default:
+		config.G.Log.System.LogFatal("Unknown command %q", command)
+	}
+}
@@ -0,0 +1,444 @@
+package config
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The rollup carbon gives paths matching no schema, as its 60:10080, and the aggregation it gives paths
+// matching no aggregation section.
+const (
+	carbonDefaultRetention   = "1m:7d"
+	carbonDefaultAggregation = "average"
+)
+
+// carbonSection is a section of storage-schemas.conf or storage-aggregation.conf, with its settings by
+// lower-cased name.
+type carbonSection struct {
+	name     string
+	settings map[string]string
+}
+
+// carbonRule is a rollup converted from a schema, an aggregation section, or a pair of them.
+type carbonRule struct {
+	expression string
+	settings   RollupSettings
+	source     string // The sections converted, for a comment
+	group      int    // 0 for a schema, 1 for an aggregation section, 2 for a pair of them
+	rank       []int  // The index of each section converted, in carbon's order of matching
+}
+
+// ConvertCarbonConfig returns the rollups section of a configuration that rolls paths up as carbon's
+// storage-schemas.conf and storage-aggregation.conf store them, and warnings of what could not be converted
+// exactly. Without an aggregation file, every path is averaged, as carbon would average it.
+func ConvertCarbonConfig(schemasFile, aggregationFile string) ([]byte, []string, error) {
+	schemas, err := ioutil.ReadFile(schemasFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	var aggregation []byte
+	if aggregationFile != "" {
+		if aggregation, err = ioutil.ReadFile(aggregationFile); err != nil {
+			return nil, nil, err
+		}
+	}
+	return convertCarbon(schemas, aggregation)
+}
+
+// convertCarbon converts the text of storage-schemas.conf and storage-aggregation.conf.
+//
+// Carbon matches a path against the schemas, and separately against the aggregation sections, in the order of
+// each file, where cassabon gives a path the rollup of the longest expression it matches. So each schema and each
+// aggregation section becomes an expression, and where a schema and an aggregation section are anchored at
+// opposite ends of the path, so that both can match, the pair becomes a longer expression taking precedence.
+func convertCarbon(schemaText, aggregationText []byte) ([]byte, []string, error) {
+
+	var warnings []string
+	warn := func(format string, a ...interface{}) {
+		warnings = append(warnings, fmt.Sprintf(format, a...))
+	}
+
+	schemaSections, err := parseCarbonConf(schemaText)
+	if err != nil {
+		return nil, nil, fmt.Errorf("storage-schemas: %s", err.Error())
+	}
+	aggregationSections, err := parseCarbonConf(aggregationText)
+	if err != nil {
+		return nil, nil, fmt.Errorf("storage-aggregation: %s", err.Error())
+	}
+
+	// The schemas, up to the first that matches every path, which becomes the default.
+	var schemas []carbonSection
+	var schemaRetention = make(map[string][]string)
+	var defaultSchema = carbonSection{name: "carbon's default"}
+	var defaultRetention = []string{carbonDefaultRetention}
+	for _, s := range filterCarbonSections("storage-schemas", schemaSections, warn) {
+		retention, err := convertCarbonRetentions(s.settings["retentions"])
+		if err != nil {
+			warn("storage-schemas [%s]: %s; skipped", s.name, err.Error())
+			continue
+		}
+		if matchesAllPaths(s.settings["pattern"]) {
+			defaultSchema, defaultRetention = s, retention
+			break
+		}
+		schemas = append(schemas, s)
+		schemaRetention[s.name] = retention
+	}
+
+	// The aggregation sections likewise.
+	var aggregations []carbonSection
+	var aggregationMethod = make(map[string]string)
+	var defaultAggregation = carbonSection{name: "carbon's default"}
+	var defaultMethod = carbonDefaultAggregation
+	xFilesFactor := false
+	for _, s := range filterCarbonSections("storage-aggregation", aggregationSections, warn) {
+		method := carbonDefaultAggregation
+		if name, found := s.settings["aggregationmethod"]; found {
+			if m, err := ParseRollupMethod(name); err == nil {
+				method = m.String()
+			} else {
+				warn("storage-aggregation [%s]: no aggregation method like %q; using %s", s.name, name, method)
+			}
+		}
+		if _, found := s.settings["xfilesfactor"]; found {
+			xFilesFactor = true
+		}
+		if matchesAllPaths(s.settings["pattern"]) {
+			defaultAggregation, defaultMethod = s, method
+			break
+		}
+		aggregations = append(aggregations, s)
+		aggregationMethod[s.name] = method
+	}
+	if xFilesFactor {
+		warn("storage-aggregation: rollups have no xFilesFactor; it is ignored")
+	}
+
+	// The pairs of a schema and an aggregation section first, so that a pair with the same pattern takes the place of both.
+	var rules []carbonRule
+	var byExpression = make(map[string]int)
+	add := func(r carbonRule) {
+		if i, found := byExpression[r.expression]; found {
+			if rules[i].group != 2 {
+				warn("%s: the expression %q is given by %s; skipped", r.source, r.expression, rules[i].source)
+			}
+			return
+		}
+		byExpression[r.expression] = len(rules)
+		rules = append(rules, r)
+	}
+	for i, s := range schemas {
+		for j, a := range aggregations {
+			source := fmt.Sprintf("storage-schemas [%s] and storage-aggregation [%s]", s.name, a.name)
+			expression, ok := combineCarbonPatterns(s.settings["pattern"], a.settings["pattern"])
+			if !ok {
+				first := s.settings["pattern"]
+				if ByPriority([]string{a.settings["pattern"], first}).Less(0, 1) {
+					first = a.settings["pattern"]
+				}
+				warn("%s: paths matching both can't be given both; they are rolled up as %q is", source, first)
+				continue
+			}
+			add(carbonRule{expression, RollupSettings{schemaRetention[s.name], aggregationMethod[a.name]}, source, 2, []int{i, j}})
+		}
+	}
+	for i, s := range schemas {
+		source := fmt.Sprintf("storage-schemas [%s] and storage-aggregation [%s]", s.name, defaultAggregation.name)
+		add(carbonRule{s.settings["pattern"], RollupSettings{schemaRetention[s.name], defaultMethod}, source, 0, []int{i}})
+	}
+	for j, a := range aggregations {
+		source := fmt.Sprintf("storage-schemas [%s] and storage-aggregation [%s]", defaultSchema.name, a.name)
+		add(carbonRule{a.settings["pattern"], RollupSettings{defaultRetention, aggregationMethod[a.name]}, source, 1, []int{j}})
+	}
+	add(carbonRule{ROLLUP_CATCHALL, RollupSettings{defaultRetention, defaultMethod},
+		fmt.Sprintf("storage-schemas [%s] and storage-aggregation [%s]", defaultSchema.name, defaultAggregation.name), 3, nil})
+
+	// Cassabon's order of matching, against carbon's.
+	priority := make([]string, 0, len(rules))
+	settings := make(map[string]RollupSettings)
+	for _, r := range rules {
+		priority = append(priority, r.expression)
+		settings[r.expression] = r.settings
+	}
+	sort.Sort(ByPriority(priority))
+	position := make(map[string]int)
+	for i, expression := range priority {
+		position[expression] = i
+	}
+	for _, r := range rules {
+		for _, other := range rules {
+			if r.group == other.group && lessRank(r.rank, other.rank) && position[other.expression] < position[r.expression] &&
+				!disjointPatterns(r.expression, other.expression) {
+				warn("%q is matched before %q, where carbon matches %s first; paths matching both are rolled up differently",
+					other.expression, r.expression, r.source)
+			}
+		}
+	}
+
+	// Problems with the rollups as cassabon reads them, such as retentions that aren't a whole number of minutes.
+	ParseRollups(settings, warn)
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "# Rollups converted from carbon's storage-schemas.conf and storage-aggregation.conf.\n")
+	fmt.Fprintf(&b, "# The longest expression a path matches gives its rollup, and \"default\" any other.\n")
+	fmt.Fprintf(&b, "rollups:\n")
+	for _, expression := range priority {
+		r := rules[byExpression[expression]]
+		key := expression
+		if key != ROLLUP_CATCHALL {
+			key = "'" + strings.Replace(key, "'", "''", -1) + "'"
+		}
+		fmt.Fprintf(&b, "    # From %s\n    %s:\n        retention:\n", r.source, key)
+		for _, v := range r.settings.Retention {
+			fmt.Fprintf(&b, "            - %s\n", v)
+		}
+		fmt.Fprintf(&b, "        aggregation: %s\n", r.settings.Aggregation)
+	}
+	return b.Bytes(), warnings, nil
+}
+
+// parseCarbonConf returns the sections of a carbon configuration file, in the order of the file.
+func parseCarbonConf(text []byte) ([]carbonSection, error) {
+	var sections []carbonSection
+	scanner := bufio.NewScanner(bytes.NewReader(text))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			sections = append(sections, carbonSection{strings.TrimSpace(line[1 : len(line)-1]), make(map[string]string)})
+			continue
+		}
+		i := strings.IndexAny(line, "=:")
+		if i < 0 {
+			return nil, fmt.Errorf("line %d: not a setting or a section: %s", n, line)
+		}
+		if len(sections) == 0 {
+			return nil, fmt.Errorf("line %d: setting before the first section: %s", n, line)
+		}
+		key := strings.ToLower(strings.TrimSpace(line[:i]))
+		sections[len(sections)-1].settings[key] = strings.TrimSpace(line[i+1:])
+	}
+	return sections, scanner.Err()
+}
+
+// filterCarbonSections returns the sections that carbon could match a path against: those with a valid
+// pattern, different from every earlier pattern, and not following a pattern that matches every path.
+func filterCarbonSections(file string, sections []carbonSection, warn func(format string, a ...interface{})) []carbonSection {
+	var filtered []carbonSection
+	var seen = make(map[string]string)
+	var catchAll string
+	for _, s := range sections {
+		pattern, found := s.settings["pattern"]
+		if !found {
+			warn("%s [%s]: no pattern; skipped", file, s.name)
+			continue
+		}
+		if _, err := regexp.Compile(pattern); err != nil {
+			warn("%s [%s]: %s; skipped", file, s.name, err.Error())
+			continue
+		}
+		if catchAll != "" {
+			warn("%s [%s]: follows [%s], which matches every path; skipped", file, s.name, catchAll)
+			continue
+		}
+		if earlier, found := seen[pattern]; found {
+			warn("%s [%s]: has the pattern of [%s]; skipped", file, s.name, earlier)
+			continue
+		}
+		seen[pattern] = s.name
+		if matchesAllPaths(pattern) {
+			catchAll = s.name
+		}
+		filtered = append(filtered, s)
+	}
+	return filtered
+}
+
+// matchesAllPaths reports whether a pattern is one of those commonly used to match every path.
+func matchesAllPaths(pattern string) bool {
+	switch pattern {
+	case "", ".", ".*", "^.*", ".*$", "^.*$":
+		return true
+	}
+	return false
+}
+
+// combineCarbonPatterns returns an expression matching the paths that both patterns match, when one is anchored
+// at the start of the path and the other at the end.
+func combineCarbonPatterns(schema, aggregation string) (string, bool) {
+	if schema == aggregation {
+		return schema, true
+	}
+	for _, pair := range [][2]string{{schema, aggregation}, {aggregation, schema}} {
+		start, end := pair[0], pair[1]
+		if strings.HasPrefix(start, "^") && !strings.HasSuffix(start, "$") && strings.HasSuffix(end, "$") && !strings.HasPrefix(end, "^") {
+			expression := strings.TrimSuffix(start, ".*") + ".*" + strings.TrimPrefix(end, ".*")
+			if _, err := regexp.Compile(expression); err == nil {
+				return expression, true
+			}
+		}
+	}
+	return "", false
+}
+
+// disjointPatterns reports whether no path can match both patterns, because they are anchored at the same end of
+// the path by different literals, like "^carbon\." and "^stats\.", or "\.min$" and "\.max$".
+func disjointPatterns(a, b string) bool {
+	aStart, aPrefix, aEnd, aSuffix := literalAnchors(a)
+	bStart, bPrefix, bEnd, bSuffix := literalAnchors(b)
+	if aStart && bStart && !strings.HasPrefix(aPrefix, bPrefix) && !strings.HasPrefix(bPrefix, aPrefix) {
+		return true
+	}
+	return aEnd && bEnd && !strings.HasSuffix(aSuffix, bSuffix) && !strings.HasSuffix(bSuffix, aSuffix)
+}
+
+// literalAnchors returns the literal text that every match of a pattern anchored at the start of the path begins
+// with, and that of a pattern anchored at the end ends with. An alternation anchors neither.
+func literalAnchors(pattern string) (start bool, prefix string, end bool, suffix string) {
+	if strings.Contains(pattern, "|") {
+		return
+	}
+	// Each character of the pattern, as a literal or as a metacharacter.
+	type token struct {
+		r       rune
+		literal bool
+	}
+	var tokens []token
+	runes := []rune(pattern)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case r == '\\' && i+1 < len(runes):
+			i++
+			n := runes[i]
+			literal := !(n >= 'a' && n <= 'z' || n >= 'A' && n <= 'Z' || n >= '0' && n <= '9')
+			tokens = append(tokens, token{n, literal})
+		case strings.ContainsRune(".+*?()[]{}^$", r):
+			tokens = append(tokens, token{r, false})
+		default:
+			tokens = append(tokens, token{r, true})
+		}
+	}
+	if len(tokens) > 0 && !tokens[0].literal && tokens[0].r == '^' {
+		start = true
+		i := 1
+		for ; i < len(tokens) && tokens[i].literal; i++ {
+		}
+		// A literal that a quantifier follows may not appear.
+		if i < len(tokens) && strings.ContainsRune("*?{", tokens[i].r) {
+			i--
+		}
+		for _, t := range tokens[1:i] {
+			prefix += string(t.r)
+		}
+	}
+	if n := len(tokens); n > 0 && !tokens[n-1].literal && tokens[n-1].r == '$' {
+		end = true
+		i := n - 1
+		for ; i > 0 && tokens[i-1].literal; i-- {
+		}
+		for _, t := range tokens[i : n-1] {
+			suffix += string(t.r)
+		}
+	}
+	return
+}
+
+// lessRank reports whether carbon matches the sections of one rank before those of another.
+func lessRank(a, b []int) bool {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] != b[i] {
+			return a[i] < b[i]
+		}
+	}
+	return len(a) < len(b)
+}
+
+// convertCarbonRetentions converts carbon's retentions, like "10s:6h,1m:7d" or "60:1440", to rollup retentions.
+func convertCarbonRetentions(retentions string) ([]string, error) {
+	if strings.TrimSpace(retentions) == "" {
+		return nil, fmt.Errorf("no retentions")
+	}
+	var converted []string
+	for _, def := range strings.Split(retentions, ",") {
+		parts := strings.Split(strings.TrimSpace(def), ":")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("malformed retention %q", def)
+		}
+		precision, err := parseCarbonDuration(parts[0])
+		if err != nil {
+			return nil, err
+		}
+		// A retention without a unit is a number of points.
+		var retention time.Duration
+		if points, err := strconv.ParseInt(parts[1], 10, 64); err == nil {
+			retention = precision * time.Duration(points)
+		} else if retention, err = parseCarbonDuration(parts[1]); err != nil {
+			return nil, err
+		}
+		if retention%time.Minute != 0 {
+			return nil, fmt.Errorf("retention %q is not a whole number of minutes", def)
+		}
+		converted = append(converted, formatUnits(precision, []string{"h", "m", "s"})+":"+
+			formatUnits(retention, []string{"y", "w", "d", "h", "m"}))
+	}
+	return converted, nil
+}
+
+// The units of carbon's durations, which it recognizes by any prefix of their names.
+var carbonUnits = []struct {
+	name     string
+	duration time.Duration
+}{
+	{"seconds", time.Second},
+	{"minutes", time.Minute},
+	{"hours", time.Hour},
+	{"days", 24 * time.Hour},
+	{"weeks", 7 * 24 * time.Hour},
+	{"years", 365 * 24 * time.Hour},
+}
+
+// parseCarbonDuration parses a duration like "10s", "1min" or "60", which is in seconds.
+func parseCarbonDuration(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	i := strings.IndexFunc(s, func(r rune) bool { return r < '0' || r > '9' })
+	if i < 0 {
+		i = len(s)
+	}
+	n, err := strconv.ParseInt(s[:i], 10, 64)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("malformed duration %q", s)
+	}
+	unit := strings.ToLower(s[i:])
+	if unit == "" {
+		return time.Duration(n) * time.Second, nil
+	}
+	for _, u := range carbonUnits {
+		if strings.HasPrefix(u.name, unit) {
+			return time.Duration(n) * u.duration, nil
+		}
+	}
+	return 0, fmt.Errorf("malformed duration %q", s)
+}
+
+// formatUnits returns a duration in the largest of the units that it is a whole number of.
+func formatUnits(d time.Duration, units []string) string {
+	for _, suffix := range units {
+		for _, u := range carbonUnits {
+			if u.name[:1] == suffix && d%u.duration == 0 {
+				return fmt.Sprintf("%d%s", d/u.duration, suffix)
+			}
+		}
+	}
+	return d.String()
+}
@@ -0,0 +1,85 @@
+package config
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// CheckConfiguration reports on the configuration last read, for checking it before it is deployed: the
+// problems ValidateConfiguration finds in it, whether the hosts of the endpoints it names can be resolved,
+// and the rollups that would be in effect. It returns whether no problems were found.
+func CheckConfiguration(w io.Writer) bool {
+
+	ok := true
+	problems := ValidateConfiguration()
+	for _, s := range problems {
+		fmt.Fprintf(w, "problem: %s\n", s)
+		ok = false
+	}
+	if rawCassabonConfig == nil {
+		return false
+	}
+	cfg := rawCassabonConfig
+
+	// The endpoints, which need only be resolvable here; nothing is connected to.
+	fmt.Fprintf(w, "endpoints:\n")
+	resolve := func(path, host string) {
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		addrs, err := net.LookupHost(host)
+		if err != nil {
+			fmt.Fprintf(w, "    %s: %s: %s\n", path, host, err.Error())
+			ok = false
+			return
+		}
+		fmt.Fprintf(w, "    %s: %s resolves to %s\n", path, host, strings.Join(addrs, ", "))
+	}
+	engine, backend := strings.ToLower(cfg.MetricManager.Engine), strings.ToLower(cfg.Index.Backend)
+	if engine != ENGINE_MEMORY || backend == INDEX_CASSANDRA {
+		for i, host := range cfg.Cassandra.Hosts {
+			resolve(fmt.Sprintf("cassandra.hosts[%d]", i), host)
+		}
+	}
+	if backend != INDEX_CASSANDRA && cfg.ElasticSearch.BaseURL != "" {
+		if u, err := url.Parse(cfg.ElasticSearch.BaseURL); err != nil || u.Host == "" {
+			fmt.Fprintf(w, "    elasticsearch.baseurl: not a URL: %q\n", cfg.ElasticSearch.BaseURL)
+			ok = false
+		} else {
+			resolve("elasticsearch.baseurl", u.Host)
+		}
+	}
+	if cfg.Statsd.Host != "" {
+		resolve("statsd.host", cfg.Statsd.Host)
+	}
+	for _, name := range sortedKeys(cfg.Carbon.Peers) {
+		resolve("carbon.peers."+name, cfg.Carbon.Peers[name])
+	}
+
+	// The rollups, in the order in which paths are matched against them.
+	priority, rollup, tables, _ := ParseRollups(cfg.Rollups, func(format string, a ...interface{}) {})
+	fmt.Fprintf(w, "rollups:\n")
+	for _, expression := range priority {
+		def := rollup[expression]
+		var windows []string
+		for _, v := range def.Windows {
+			windows = append(windows, fmt.Sprintf("%s:%s (%s)", formatDuration(v.Window), formatDuration(v.Retention), v.Table))
+		}
+		fmt.Fprintf(w, "    %q: %s %s\n", expression, def.Method, strings.Join(windows, ", "))
+	}
+	fmt.Fprintf(w, "tables: %s\n", strings.Join(tables, ", "))
+
+	if ok {
+		fmt.Fprintf(w, "configuration OK\n")
+	}
+	return ok
+}
+
+// formatDuration returns a duration in the largest unit of a rollup definition that it is a whole number of.
+func formatDuration(d time.Duration) string {
+	return formatUnits(d, []string{"y", "w", "d", "h", "m", "s"})
+}
@@ -2,8 +2,11 @@ package config
 
 import (
 	"fmt"
-	"io/ioutil"
 	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
 	"regexp"
 	"sort"
 	"strconv"
@@ -16,8 +19,10 @@ import (
 // Define Application Settings Structure
 type CassabonConfig struct {
 	Logging struct {
-		Logdir   string // Log Directory
-		Loglevel string // Level to log at.
+		Logdir     string // Log Directory
+		Loglevel   string // Level to log at.
+		MaxSize    int    // Size in megabytes at which a log file is rotated; 0 never rotates
+		MaxBackups int    // Number of rotated log files kept, as system.log.1 (the newest) and on
 	}
 	Statsd   StatsdSettings
 	Channels struct {
@@ -43,10 +48,51 @@ type CassabonConfig struct {
 			DeleteIndex  uint
 			GetMetric    uint
 			DeleteMetric uint
+			Backfill     uint
 		}
+		Keys map[string][]string // Permissions by API key: "read", "write", "delete" or "admin"
+		TLS  struct {
+			CertFile       string // Server certificate; with its key, the API is served over HTTPS
+			KeyFile        string // Key of the server certificate
+			RedirectListen string // Address:port on which plain HTTP is redirected to HTTPS, if set
+		}
+		CORS struct {
+			AllowedOrigins []string // Origins of the pages that may query the API, or "*" for all
+			AllowedHeaders []string // Request headers those pages may send, beyond the API's own
+		}
+		DebugListen string // Address:port on which pprof and expvar are served, if set
+		GRPCListen  string // Address:port on which the gRPC API is served over HTTP/2, if set
+	}
+	MetricManager struct {
+		Shards            int    // Number of goroutines across which rollup accumulation is spread
+		Writers           int    // Number of goroutines writing batches to Cassandra
+		CleanupInterval   int    // Hours between removals of paths with no stored data; 0 disables
+		CleanupPartitions bool   // Whether cleanup also deletes the partitions of the paths it removes
+		QueryCacheTTL     int    // Seconds for which query responses are cached; 0 disables
+		QueryCacheSize    int    // The most query responses that are cached
+		MaxQueries        int    // The most metric queries that may read from Cassandra at once
+		RawRetention      int    // Hours for which raw data points are also stored; 0 disables
+		FlushSpread       int    // Seconds over which the writes of windows closing together are spread; 0 disables
+		FlushParallelism  int    // Number of windows closing together whose rollups are written at once
+		StateFile         string // File in which accumulation is saved on termination, and restored from on start
+		Engine            string // Where metrics are stored: "cassandra", or "memory" for development and tests
+	}
+	Tenants struct {
+		Enabled bool // Whether the first node of each path names its tenant
+	}
+	Index struct {
+		Backend         string // Where the path index is kept: "elasticsearch" or "cassandra"
+		Memory          bool   // Whether finds are answered from a copy of the index kept in memory
+		SnapshotFile    string // File to which the copy in memory is saved, and loaded from on start
+		RefreshInterval int    // Seconds between refreshes of the copy in memory from the index
+		TTL             int    // Hours after which paths not indexed again are removed from the index; 0 disables
+		MaxResults      int    // The most paths a query may match; 0 is unlimited
+		LiteralNodes    int    // The number of leading nodes of a query in which wildcards are refused
+		KnownPaths      int    // The most paths remembered as indexed, so as not to index them again; 0 disables
 	}
 	Cassandra     CassandraSettings
 	ElasticSearch ElasticSearchSettings
+	RollupFiles   []string                  // Files of further rollups; relative paths are to this file's directory
 	Rollups       map[string]RollupSettings // Map of regex and rollups
 }
 
@@ -61,9 +107,188 @@ type CassandraSettings struct {
 	Hosts      []string // List of hostnames or IP addresses of Cassandra ring
 	Port       string   // Cassandra port
 	Keyspace   string   // Name of the Cassandra keyspace
+	LocalDC    string   // Datacenter whose hosts coordinate queries when they can; "" prefers none
 	Strategy   string   // Replication class of the keyspace
-	CreateOpts string   // CQL text for the strategy options
-	BatchSize  int      // The maximum number of insert statements to use in a batch
+	CreateOpts string   // CQL text for the strategy options; superseded by Replication
+	BatchSize  int      // The maximum number of insert statements handed to a writer at once
+
+	Replication ReplicationSettings // Replicas of the keyspace, overall or in each datacenter
+
+	Timeout      int    // Milliseconds a connection may take to open, and a query to be answered
+	NumConns     int    // Number of connections held open to each host
+	QueryRetries int    // Times a failed query is retried by the driver before failing
+	Compression  string // Compression of the frames exchanged with Cassandra: "snappy", or "" for none
+	ProtoVersion int    // Native protocol version spoken to Cassandra, from 1 to 4; 0 uses the driver's
+	CQLVersion   string // CQL version requested of Cassandra; "" uses the driver's
+	Consistency  string // Consistency level of writes, such as "one" or "local_quorum"
+
+	Reads CassandraReadSettings // Settings of the separate session used by queries
+
+	HealthInterval int // Seconds between checks that the sessions can query Cassandra
+	RebuildAfter   int // Consecutive failed checks after which the sessions are opened anew
+
+	WriteRetries    int // Number of attempts at each write before it is abandoned
+	WriteBackoff    int // Milliseconds before the first retry, doubling for each subsequent retry
+	BreakerFailures int // Consecutive write failures after which all writes are paused
+	BreakerPause    int // Seconds for which writes are paused before trying again
+	SlowWrite       int // Milliseconds a batch may take before batches are shrunk; 0 disables
+	MaxQueuedRows   int // Rows waiting to be written beyond which ingestion is held back
+
+	DeadLetterFile string // Rows that could not be written are saved here, if set
+
+	Schema     string                   // "legacy" for COMPACT STORAGE tables, or "modern" for Cassandra 4.x/ScyllaDB
+	Aggregates bool                     // Whether to store min, max, sum and count alongside each stat
+	Tables     map[string]TableSettings // Table creation options, by table name or "default"
+}
+
+// CassandraReadSettings are those of the session used to answer queries, kept apart from the one used for
+// writes so that heavy reads can't take the connections writes need. Any left unset is that of writes.
+type CassandraReadSettings struct {
+	LocalDC      string // Datacenter whose hosts coordinate queries when they can
+	Consistency  string // Consistency level of reads
+	Timeout      int    // Milliseconds a connection may take to open, and a query to be answered
+	NumConns     int    // Number of connections held open to each host
+	QueryRetries int    // Times a failed query is retried by the driver before failing
+}
+
+// The valid schema modes.
+const (
+	SCHEMA_LEGACY = "legacy"
+	SCHEMA_MODERN = "modern"
+)
+
+// The valid path index backends.
+const (
+	INDEX_ELASTICSEARCH = "elasticsearch"
+	INDEX_CASSANDRA     = "cassandra"
+)
+
+// The valid storage engines for metrics.
+const (
+	ENGINE_CASSANDRA = "cassandra"
+	ENGINE_MEMORY    = "memory"
+)
+
+// ReplicationSettings are the replicas with which the keyspace is created: a factor for SimpleStrategy, or the
+// factor in each datacenter for NetworkTopologyStrategy.
+type ReplicationSettings struct {
+	Factor      int            // Replicas of each row, for SimpleStrategy
+	Datacenters map[string]int // Replicas of each row in each datacenter, for NetworkTopologyStrategy
+}
+
+// The replication strategies with which the keyspace may be created.
+const (
+	STRATEGY_SIMPLE           = "SimpleStrategy"
+	STRATEGY_NETWORK_TOPOLOGY = "NetworkTopologyStrategy"
+)
+
+// KeyspaceReplication returns the CQL map literal of the keyspace's replication, validating the strategy and
+// its replicas. Without structured replication settings, the strategy options are taken as written, as they
+// always have been.
+func (cs CassandraSettings) KeyspaceReplication() (string, error) {
+
+	strategy := cs.Strategy
+	if i := strings.LastIndex(strategy, "."); i >= 0 {
+		strategy = strategy[i+1:] // "org.apache.cassandra.locator.SimpleStrategy"
+	}
+	if cs.Replication.Factor == 0 && len(cs.Replication.Datacenters) == 0 {
+		if strings.TrimSpace(cs.CreateOpts) == "" {
+			return "", fmt.Errorf("no replication configured for strategy %q", cs.Strategy)
+		}
+		return fmt.Sprintf("{'class':'%s',%s}", cs.Strategy, cs.CreateOpts), nil
+	}
+
+	switch strategy {
+	case STRATEGY_SIMPLE:
+		if len(cs.Replication.Datacenters) > 0 {
+			return "", fmt.Errorf("%s replicates by factor, not by datacenter", STRATEGY_SIMPLE)
+		}
+		if cs.Replication.Factor < 1 {
+			return "", fmt.Errorf("invalid replication factor %d", cs.Replication.Factor)
+		}
+		return fmt.Sprintf("{'class': '%s', 'replication_factor': '%d'}", STRATEGY_SIMPLE, cs.Replication.Factor), nil
+
+	case STRATEGY_NETWORK_TOPOLOGY:
+		if cs.Replication.Factor != 0 {
+			return "", fmt.Errorf("%s replicates by datacenter, not by factor", STRATEGY_NETWORK_TOPOLOGY)
+		}
+		if len(cs.Replication.Datacenters) == 0 {
+			return "", fmt.Errorf("%s requires the replicas in each datacenter", STRATEGY_NETWORK_TOPOLOGY)
+		}
+		names := make([]string, 0, len(cs.Replication.Datacenters))
+		for name, factor := range cs.Replication.Datacenters {
+			if name == "" || strings.ContainsAny(name, "'\"") {
+				return "", fmt.Errorf("invalid datacenter name %q", name)
+			}
+			if factor < 1 {
+				return "", fmt.Errorf("invalid replication factor %d for datacenter %q", factor, name)
+			}
+			names = append(names, name)
+		}
+		if _, found := cs.Replication.Datacenters[cs.LocalDC]; cs.LocalDC != "" && !found {
+			return "", fmt.Errorf("local datacenter %q has no replicas", cs.LocalDC)
+		}
+		sort.Strings(names)
+		pairs := []string{fmt.Sprintf("'class': '%s'", STRATEGY_NETWORK_TOPOLOGY)}
+		for _, name := range names {
+			pairs = append(pairs, fmt.Sprintf("'%s': '%d'", name, cs.Replication.Datacenters[name]))
+		}
+		return "{" + strings.Join(pairs, ", ") + "}", nil
+	}
+	return "", fmt.Errorf("unknown replication strategy %q", cs.Strategy)
+}
+
+// TableSettings are the options with which a rollup table is created.
+// Any option left unset takes its value from the "default" entry, or the built-in default.
+type TableSettings struct {
+	Compaction              map[string]string // Compaction strategy class and its options
+	Compression             map[string]string // Compression class and its options
+	GCGraceSeconds          *int              // Seconds before tombstones may be purged
+	ReadRepairChance        *float64          // Probability of a cross-datacenter read repair
+	DCLocalReadRepairChance *float64          // Probability of a local datacenter read repair
+}
+
+// TableOptions returns the creation options for a table, with all defaults applied.
+func (cs CassandraSettings) TableOptions(table string) TableSettings {
+
+	gcGrace := 864000
+	readRepair := 0.0
+	dcLocalReadRepair := 0.1
+	ts := TableSettings{
+		map[string]string{"class": "org.apache.cassandra.db.compaction.DateTieredCompactionStrategy"},
+		map[string]string{"sstable_compression": "org.apache.cassandra.io.compress.LZ4Compressor"},
+		&gcGrace, &readRepair, &dcLocalReadRepair,
+	}
+
+	// Cassandra 4.x has removed DTCS, the old compression syntax, and read repair chances.
+	if cs.Schema == SCHEMA_MODERN {
+		ts.Compaction = map[string]string{"class": "TimeWindowCompactionStrategy"}
+		ts.Compression = map[string]string{"class": "LZ4Compressor"}
+		ts.ReadRepairChance = nil
+		ts.DCLocalReadRepairChance = nil
+	}
+
+	// Overlay the configured default, then the table-specific values.
+	for _, name := range []string{ROLLUP_CATCHALL, table} {
+		if override, found := cs.Tables[name]; found {
+			if len(override.Compaction) > 0 {
+				ts.Compaction = override.Compaction
+			}
+			if len(override.Compression) > 0 {
+				ts.Compression = override.Compression
+			}
+			if override.GCGraceSeconds != nil {
+				ts.GCGraceSeconds = override.GCGraceSeconds
+			}
+			if override.ReadRepairChance != nil {
+				ts.ReadRepairChance = override.ReadRepairChance
+			}
+			if override.DCLocalReadRepairChance != nil {
+				ts.DCLocalReadRepairChance = override.DCLocalReadRepairChance
+			}
+		}
+	}
+	return ts
 }
 
 // ElasticSearchSettings struct for ES connection information
@@ -71,9 +296,23 @@ type ElasticSearchSettings struct {
 	BaseURL   string // URL/Port of ElasticSearch REST API
 	Index     string // ElasticSearch Index
 	PutURL    string // URL for indexing paths
+	BulkURL   string // URL for indexing paths in batches
 	SearchURL string // URL for searching paths.
 	CountURL  string // URL for getting a count for the search path
 	MapURL    string // URL for ElasticSearch mapping.
+
+	PoolSize    int // The most idle connections kept open to ElasticSearch
+	DialTimeout int // Milliseconds a connection may take to open
+	ReadTimeout int // Milliseconds ElasticSearch may take to begin its response
+	Timeout     int // Milliseconds a request may take in all
+	Retries     int // Number of further attempts at a request that fails to connect or times out
+
+	TLS struct {
+		CAFile             string // CA certificates that the server's certificate must be signed by
+		CertFile           string // Client certificate, presented to the server if set
+		KeyFile            string // Key of the client certificate
+		InsecureSkipVerify bool   // Whether to accept any server certificate
+	}
 }
 
 type StatsdSettings struct {
@@ -94,20 +333,47 @@ type StatsdSettings struct {
 // rawCassabonConfig is the decoded YAML from the configuration file.
 var rawCassabonConfig *CassabonConfig
 
-// ReadConfigurationFile reads the contents of the specified file from disk, and unmarshals it.
+// ReadConfigurationFile reads the contents of the specified file from disk, or of the key in Consul
+// or etcd it names, and unmarshals it, along with the rollup files it includes. Settings in the file
+// are overridden by CASSABON_* environment variables, and those by command-line flags. With no file
+// named, the settings come only from the environment and the flags.
 func ReadConfigurationFile(configFile string) error {
 
-	// Read the configuration file.
-	yamlConfig, err := ioutil.ReadFile(configFile)
+	// Read the configuration file. Rollup files included by a remote configuration are local.
+	yamlConfig, index, err := readConfigurationText(configFile)
+	includeDir := filepath.Dir(configFile)
+	if _, remote := parseRemoteSource(configFile); remote {
+		includeDir = "."
+	}
 	if err == nil {
-		// Unmarshal config file contents into raw config struct.
-		err = yaml.Unmarshal(yamlConfig, &rawCassabonConfig)
+		// Unmarshal config file contents into a fresh raw config struct, so that
+		// entries removed from the file don't survive in maps from the last read.
+		var raw *CassabonConfig
+		if err = yaml.Unmarshal(yamlConfig, &raw); err == nil {
+			if raw == nil {
+				raw = new(CassabonConfig)
+			}
+			if err = applyEnvironment(raw, os.Environ()); err == nil {
+				if err = applyFlags(raw); err == nil {
+					var files []rollupFile
+					if files, err = includeRollups(raw, includeDir); err == nil {
+						rawCassabonConfig, rawConfigText, rawRollupFiles, configIndex = raw, yamlConfig, files, index
+					}
+				}
+			}
+		}
 	}
 	return err
 }
 
 // LoadStartupValues populates the global config object with values that are used only once.
 func LoadStartupValues() {
+	SetCassandra(loadStartupValues())
+}
+
+// loadStartupValues populates the global config object with values that are used only once, but for the
+// Cassandra settings, which it returns, for the caller to put into effect.
+func loadStartupValues() CassandraSettings {
 
 	// Copy in the logging configuration.
 	G.Log.Logdir = rawCassabonConfig.Logging.Logdir
@@ -117,21 +383,131 @@ func LoadStartupValues() {
 	G.Statsd = rawCassabonConfig.Statsd
 
 	// Copy in the Cassandra database connection values.
-	G.Cassandra = rawCassabonConfig.Cassandra
-	if G.Cassandra.Keyspace == "" {
-		G.Cassandra.Keyspace = "cassabon"
+	cs := rawCassabonConfig.Cassandra
+	if cs.Keyspace == "" {
+		cs.Keyspace = "cassabon"
+	}
+	switch strings.ToLower(cs.Schema) {
+	case SCHEMA_MODERN:
+		cs.Schema = SCHEMA_MODERN
+	default:
+		cs.Schema = SCHEMA_LEGACY
+	}
+	if cs.Schema != SCHEMA_MODERN {
+		// COMPACT STORAGE tables can have only one column besides the primary key.
+		cs.Aggregates = false
+	}
+	if cs.BatchSize < 1 {
+		cs.BatchSize = 1
+	}
+	if cs.Timeout < 1 {
+		cs.Timeout = 1000
+	}
+	if cs.NumConns < 1 {
+		cs.NumConns = 2
+	}
+	if cs.QueryRetries < 0 {
+		cs.QueryRetries = 0
+	}
+	cs.Compression = strings.ToLower(cs.Compression)
+	if cs.Consistency == "" {
+		cs.Consistency = "one"
+	}
+	if cs.Reads.LocalDC == "" {
+		cs.Reads.LocalDC = cs.LocalDC
+	}
+	if cs.Reads.Consistency == "" {
+		cs.Reads.Consistency = cs.Consistency
+	}
+	if cs.Reads.Timeout < 1 {
+		cs.Reads.Timeout = cs.Timeout
+	}
+	if cs.Reads.NumConns < 1 {
+		cs.Reads.NumConns = cs.NumConns
+	}
+	if cs.Reads.QueryRetries < 1 {
+		cs.Reads.QueryRetries = cs.QueryRetries
+	}
+	if cs.HealthInterval < 1 {
+		cs.HealthInterval = 10
+	}
+	if cs.RebuildAfter < 1 {
+		cs.RebuildAfter = 6
+	}
+	if cs.WriteRetries < 1 {
+		cs.WriteRetries = 5
+	}
+	if cs.WriteBackoff < 1 {
+		cs.WriteBackoff = 100
+	}
+	if cs.BreakerFailures < 1 {
+		cs.BreakerFailures = 10
+	}
+	if cs.BreakerPause < 1 {
+		cs.BreakerPause = 10
+	}
+	if cs.SlowWrite < 0 {
+		cs.SlowWrite = 0
+	}
+	if cs.MaxQueuedRows < 1 {
+		cs.MaxQueuedRows = 1000000
+	}
+
+	// Copy in the choice of index backend; ElasticSearch unless otherwise specified.
+	switch strings.ToLower(rawCassabonConfig.Index.Backend) {
+	case INDEX_CASSANDRA:
+		G.Index.Backend = INDEX_CASSANDRA
+	default:
+		G.Index.Backend = INDEX_ELASTICSEARCH
+	}
+	G.Index.Memory = rawCassabonConfig.Index.Memory
+	G.Index.SnapshotFile = rawCassabonConfig.Index.SnapshotFile
+	if rawCassabonConfig.Index.RefreshInterval < 1 {
+		rawCassabonConfig.Index.RefreshInterval = 300
+	}
+	G.Index.RefreshInterval = time.Duration(rawCassabonConfig.Index.RefreshInterval) * time.Second
+	if rawCassabonConfig.Index.TTL > 0 {
+		G.Index.TTL = time.Duration(rawCassabonConfig.Index.TTL) * time.Hour
+	}
+	G.Index.MaxResults = rawCassabonConfig.Index.MaxResults
+	if G.Index.MaxResults < 0 {
+		G.Index.MaxResults = 0
+	}
+	G.Index.LiteralNodes = rawCassabonConfig.Index.LiteralNodes
+	if G.Index.LiteralNodes < 0 {
+		G.Index.LiteralNodes = 0
+	}
+	G.Index.KnownPaths = rawCassabonConfig.Index.KnownPaths
+	if G.Index.KnownPaths < 0 {
+		G.Index.KnownPaths = 0
 	}
 
 	// Copy in the ElasticSearch connection values and generate URLs from BaseURL
 	G.ElasticSearch = rawCassabonConfig.ElasticSearch
-	if G.ElasticSearch.BaseURL == "" {
+	if G.ElasticSearch.BaseURL == "" && G.Index.Backend == INDEX_ELASTICSEARCH {
 		panic("No ElasticSearch URL provided, aborting.")
 	}
 	if G.ElasticSearch.Index == "" {
 		G.ElasticSearch.Index = "cassabon"
 	}
+	if G.ElasticSearch.PoolSize < 1 {
+		G.ElasticSearch.PoolSize = 10
+	}
+	if G.ElasticSearch.DialTimeout < 1 {
+		G.ElasticSearch.DialTimeout = 1000
+	}
+	if G.ElasticSearch.Timeout < 1 {
+		G.ElasticSearch.Timeout = 15000
+	}
+	if G.ElasticSearch.ReadTimeout < 1 || G.ElasticSearch.ReadTimeout > G.ElasticSearch.Timeout {
+		G.ElasticSearch.ReadTimeout = G.ElasticSearch.Timeout
+	}
+	if G.ElasticSearch.Retries < 0 {
+		G.ElasticSearch.Retries = 0
+	}
 	G.ElasticSearch.MapURL = strings.Join([]string{G.ElasticSearch.BaseURL, G.ElasticSearch.Index}, "/")
 	G.ElasticSearch.PutURL = strings.Join([]string{G.ElasticSearch.MapURL, "path"}, "/")
+	G.ElasticSearch.BulkURL = strings.Join([]string{G.ElasticSearch.PutURL, "_bulk"}, "/")
 	G.ElasticSearch.SearchURL = strings.Join([]string{G.ElasticSearch.PutURL, "_search"}, "/")
 	G.ElasticSearch.CountURL = strings.Join([]string{G.ElasticSearch.SearchURL, "search_type=count"}, "?")
 
@@ -164,6 +540,133 @@ func LoadStartupValues() {
 	if G.Channels.IndexRequestChanLen > 1000 {
 		G.Channels.IndexRequestChanLen = 1000
 	}
+
+	// Copy in and sanitize the number of accumulator shards.
+	G.MetricManager.Shards = rawCassabonConfig.MetricManager.Shards
+	if G.MetricManager.Shards < 1 {
+		G.MetricManager.Shards = 1
+	}
+	if G.MetricManager.Shards > 64 {
+		G.MetricManager.Shards = 64
+	}
+
+	// Copy in and sanitize the number of database writers.
+	G.MetricManager.Writers = rawCassabonConfig.MetricManager.Writers
+	if G.MetricManager.Writers < 1 {
+		G.MetricManager.Writers = 4
+	}
+	if G.MetricManager.Writers > 64 {
+		G.MetricManager.Writers = 64
+	}
+
+	// Copy in the stale path cleanup schedule.
+	if rawCassabonConfig.MetricManager.CleanupInterval > 0 {
+		G.MetricManager.CleanupInterval = time.Duration(rawCassabonConfig.MetricManager.CleanupInterval) * time.Hour
+	}
+	G.MetricManager.CleanupPartitions = rawCassabonConfig.MetricManager.CleanupPartitions
+
+	// Copy in and sanitize the query cache settings.
+	if rawCassabonConfig.MetricManager.QueryCacheTTL > 0 {
+		G.MetricManager.QueryCacheTTL = time.Duration(rawCassabonConfig.MetricManager.QueryCacheTTL) * time.Second
+	}
+	G.MetricManager.QueryCacheSize = rawCassabonConfig.MetricManager.QueryCacheSize
+	if G.MetricManager.QueryCacheSize < 1 {
+		G.MetricManager.QueryCacheSize = 1000
+	}
+
+	// Copy in and sanitize the number of concurrent metric queries.
+	G.MetricManager.MaxQueries = rawCassabonConfig.MetricManager.MaxQueries
+	if G.MetricManager.MaxQueries < 1 {
+		G.MetricManager.MaxQueries = 20
+	}
+	if G.MetricManager.MaxQueries > 1000 {
+		G.MetricManager.MaxQueries = 1000
+	}
+
+	// Copy in the time over which flushes are spread.
+	if rawCassabonConfig.MetricManager.FlushSpread > 0 {
+		G.MetricManager.FlushSpread = time.Duration(rawCassabonConfig.MetricManager.FlushSpread) * time.Second
+	}
+
+	// Copy in and sanitize the number of windows flushed at once.
+	G.MetricManager.FlushParallelism = rawCassabonConfig.MetricManager.FlushParallelism
+	if G.MetricManager.FlushParallelism < 1 {
+		G.MetricManager.FlushParallelism = 1
+	}
+	if G.MetricManager.FlushParallelism > 64 {
+		G.MetricManager.FlushParallelism = 64
+	}
+
+	// Copy in the location of the saved accumulation state.
+	G.MetricManager.StateFile = rawCassabonConfig.MetricManager.StateFile
+
+	// Copy in the storage engine; Cassandra unless otherwise specified.
+	switch strings.ToLower(rawCassabonConfig.MetricManager.Engine) {
+	case ENGINE_MEMORY:
+		G.MetricManager.Engine = ENGINE_MEMORY
+	default:
+		G.MetricManager.Engine = ENGINE_CASSANDRA
+	}
+
+	// Copy in the raw data point retention, which names the table they are stored in.
+	if rawCassabonConfig.MetricManager.RawRetention > 0 {
+		G.MetricManager.RawRetention = time.Duration(rawCassabonConfig.MetricManager.RawRetention) * time.Hour
+		G.MetricManager.RawTable = fmt.Sprintf("raw_%09d", uint64(G.MetricManager.RawRetention.Seconds()))
+	}
+
+	// Copy in the tenancy configuration, which determines how paths are stored.
+	G.Tenants.Enabled = rawCassabonConfig.Tenants.Enabled
+
+	return cs
+}
+
+// ReloadStartupValues re-populates the settings of the connections to Cassandra and ElasticSearch after the
+// configuration file is re-read on SIGHUP, and reports whether they changed. The other settings used only
+// once keep the values they started with; the names of those that differ from the file are returned, as
+// taking effect only on restart.
+func ReloadStartupValues() (cassandraChanged, elasticSearchChanged bool, restart []string) {
+
+	// Save the values in effect, which loadStartupValues replaces.
+	cassandra, elasticSearch := *Cassandra(), G.ElasticSearch
+	logdir, statsd, channels := G.Log.Logdir, G.Statsd, G.Channels
+	metricManager, tenants, index := G.MetricManager, G.Tenants, G.Index
+	reloaded := loadStartupValues()
+
+	// The keyspace and its tables are prepared only as the metric manager starts. The settings are replaced
+	// whole, as the metric manager goes on using them.
+	if reloaded.Keyspace != cassandra.Keyspace || reloaded.Schema != cassandra.Schema ||
+		reloaded.Aggregates != cassandra.Aggregates {
+		restart = append(restart, "cassandra.keyspace, schema and aggregates")
+		reloaded.Keyspace, reloaded.Schema, reloaded.Aggregates =
+			cassandra.Keyspace, cassandra.Schema, cassandra.Aggregates
+	}
+	cassandraChanged = !reflect.DeepEqual(reloaded, cassandra)
+	SetCassandra(reloaded)
+	elasticSearchChanged = !reflect.DeepEqual(G.ElasticSearch, elasticSearch)
+
+	// Everything else sizes or shapes what was created at startup.
+	if G.Log.Logdir != logdir {
+		restart = append(restart, "logging.logdir")
+	}
+	if !reflect.DeepEqual(G.Statsd, statsd) {
+		restart = append(restart, "statsd")
+	}
+	if !reflect.DeepEqual(G.Channels, channels) {
+		restart = append(restart, "channels")
+	}
+	if !reflect.DeepEqual(G.MetricManager, metricManager) {
+		restart = append(restart, "metricmanager")
+	}
+	if G.Tenants != tenants {
+		restart = append(restart, "tenants")
+	}
+	if G.Index != index {
+		restart = append(restart, "index")
+	}
+	G.Log.Logdir, G.Statsd, G.Channels = logdir, statsd, channels
+	G.MetricManager, G.Tenants, G.Index = metricManager, tenants, index
+
+	return
 }
 
 // ValidatePeerList ensures addresses are valid, and that the local address is in the peer list.
@@ -191,8 +694,13 @@ func ValidatePeerList(localHostPort string, peers map[string]string) error {
 // take effect again on receipt of a SIGHUP.
 func LoadRefreshableValues() {
 
-	// Copy in the logging level (can be changed while running).
+	// Copy in the logging level and rotation (can be changed while running).
 	G.Log.Loglevel = rawCassabonConfig.Logging.Loglevel
+	if rawCassabonConfig.Logging.MaxBackups < 1 {
+		rawCassabonConfig.Logging.MaxBackups = 5
+	}
+	G.Log.MaxSize = int64(rawCassabonConfig.Logging.MaxSize) * 1024 * 1024
+	G.Log.MaxBackups = rawCassabonConfig.Logging.MaxBackups
 
 	// If the listen address is "0.0.0.0", replace it with the address of
 	// the first non-localhost, non-IPv6 address found for this machine.
@@ -223,7 +731,7 @@ func LoadRefreshableValues() {
 
 	// Ensure addresses are valid, and that the local address:port is in the peer list.
 	if err := ValidatePeerList(G.Carbon.Listen, G.Carbon.Peers); err != nil {
-		G.Log.System.LogFatal(err.Error())
+		G.Log.System.LogFatal("%s", err.Error())
 	}
 
 	// Copy in and sanitize the Carbon TCP listener timeout.
@@ -259,22 +767,186 @@ func LoadRefreshableValues() {
 	if rawCassabonConfig.API.Timeouts.DeleteMetric < 1 {
 		rawCassabonConfig.API.Timeouts.DeleteMetric = 1
 	}
+	if rawCassabonConfig.API.Timeouts.Backfill < 1 {
+		rawCassabonConfig.API.Timeouts.Backfill = 1
+	}
 	G.API.Timeouts.GetIndex = time.Duration(time.Duration(rawCassabonConfig.API.Timeouts.GetIndex) * time.Second)
 	G.API.Timeouts.DeleteIndex = time.Duration(time.Duration(rawCassabonConfig.API.Timeouts.DeleteIndex) * time.Second)
 	G.API.Timeouts.GetMetric = time.Duration(time.Duration(rawCassabonConfig.API.Timeouts.GetMetric) * time.Second)
 	G.API.Timeouts.DeleteMetric = time.Duration(time.Duration(rawCassabonConfig.API.Timeouts.DeleteMetric) * time.Second)
+	G.API.Timeouts.Backfill = time.Duration(time.Duration(rawCassabonConfig.API.Timeouts.Backfill) * time.Second)
+
+	// Copy in the API keys. A permission that isn't known, or a tenant that isn't valid, is not granted.
+	keys := make(map[string]map[string]bool)
+	for key, permissions := range rawCassabonConfig.API.Keys {
+		if key == "" {
+			continue
+		}
+		keys[key] = make(map[string]bool)
+		for _, p := range permissions {
+			if strings.HasPrefix(strings.ToLower(p), API_TENANT) {
+				tenant := p[len(API_TENANT):]
+				if err := ValidateTenant(tenant); err != nil {
+					G.Log.System.LogWarn("Ignoring API key tenant: %s", err.Error())
+					continue
+				}
+				keys[key][API_TENANT+tenant] = true
+				continue
+			}
+			switch p = strings.ToLower(p); p {
+			case API_READ, API_WRITE, API_DELETE, API_ADMIN:
+				keys[key][p] = true
+			default:
+				G.Log.System.LogWarn("Ignoring unknown API key permission %q", p)
+			}
+		}
+	}
+	G.API.Keys = keys
+
+	// Copy in the API's TLS configuration. The certificate and its key are loaded as the API starts.
+	G.API.TLS = rawCassabonConfig.API.TLS
+	if G.API.TLS.CertFile == "" && G.API.TLS.KeyFile == "" && G.API.TLS.RedirectListen != "" {
+		G.Log.System.LogWarn("API TLS redirectlisten ignored, as there is no certfile")
+		G.API.TLS.RedirectListen = ""
+	}
+
+	// Copy in the CORS configuration. The API's own headers may always be sent.
+	G.API.CORS.AllowedOrigins = make(map[string]bool)
+	for _, origin := range rawCassabonConfig.API.CORS.AllowedOrigins {
+		G.API.CORS.AllowedOrigins[strings.TrimRight(origin, "/")] = true
+	}
+	G.API.CORS.AllowedHeaders = []string{"Content-Type", "X-Cassabon-Key", "X-Cassabon-Tenant"}
+	for _, header := range rawCassabonConfig.API.CORS.AllowedHeaders {
+		G.API.CORS.AllowedHeaders = append(G.API.CORS.AllowedHeaders, http.CanonicalHeaderKey(header))
+	}
+
+	// Copy in the address of the gRPC API, which is served with the same keys and certificate.
+	G.API.GRPCListen = rawCassabonConfig.API.GRPCListen
+
+	// Copy in the address for profiling, which is unauthenticated, so is best kept to the loopback interface.
+	G.API.DebugListen = rawCassabonConfig.API.DebugListen
+	if host, _, err := net.SplitHostPort(G.API.DebugListen); err == nil {
+		if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+			G.Log.System.LogWarn("API debuglisten %s is not a loopback address; pprof and expvar are not authenticated",
+				G.API.DebugListen)
+		}
+	}
+}
+
+// ParseRollupMethod converts the name of a rollup method to its value, ignoring case.
+func ParseRollupMethod(name string) (RollupMethod, error) {
+	switch strings.ToLower(name) {
+	case "average", "avg":
+		return AVERAGE, nil
+	case "max":
+		return MAX, nil
+	case "min":
+		return MIN, nil
+	case "sum":
+		return SUM, nil
+	case "last":
+		return LAST, nil
+	case "counter":
+		return COUNTER, nil
+	}
+	return AVERAGE, fmt.Errorf("\"%s\" is not a valid rollup method", name)
 }
 
-// LoadRollups populates the global config object with the rollup definitions,
-// which should only happen when there are no accumulated stats.
+// String returns the configuration file name of a rollup method.
+func (m RollupMethod) String() string {
+	switch m {
+	case AVERAGE:
+		return "average"
+	case MAX:
+		return "max"
+	case MIN:
+		return "min"
+	case SUM:
+		return "sum"
+	case LAST:
+		return "last"
+	case COUNTER:
+		return "counter"
+	}
+	return fmt.Sprintf("RollupMethod(%d)", int(m))
+}
+
+// ParseProposedRollups extracts and validates the rollup settings from the text of a
+// configuration file, without affecting the configuration in effect. Rollup files it
+// includes are not read; only the rollups in the text itself are parsed.
+func ParseProposedRollups(yamlText []byte, warn func(format string, a ...interface{})) (
+	priority []string, rollup map[string]RollupDef, tables []string, configIsClean bool, err error) {
+
+	var raw CassabonConfig
+	if err = yaml.Unmarshal(yamlText, &raw); err != nil {
+		return
+	}
+	if len(raw.Rollups) == 0 {
+		err = fmt.Errorf("no rollups found")
+		return
+	}
+	priority, rollup, tables, configIsClean = ParseRollups(raw.Rollups, warn)
+	return
+}
+
+// MatchRollup returns the first expression in priority order that matches the supplied path.
+func MatchRollup(priority []string, rollup map[string]RollupDef, path string) string {
+	var expr string
+	for _, expr = range priority {
+		if expr != ROLLUP_CATCHALL {
+			if rollup[expr].Expression.MatchString(path) {
+				break
+			}
+		}
+		// Catchall always appears last, and is therefore the default value.
+	}
+	return expr
+}
+
+// LoadRollups puts the rollup definitions into effect, which should only happen when there are no
+// accumulated stats.
 func LoadRollups() bool {
+	rs, configIsClean := loadRollups()
+	SetRollups(rs)
+	return configIsClean
+}
+
+// loadRollups returns the rollup definitions of the configuration, for the caller to put into effect.
+func loadRollups() (RollupSet, bool) {
+
+	priority, rollup, tables, configIsClean := ParseRollups(rawCassabonConfig.Rollups, G.Log.System.LogWarn)
+	rs := RollupSet{priority, rollup, append([]string{}, Rollups().Tables...)}
+
+	// Record the table names in the master list of table names.
+	for _, table := range tables {
+		found := false
+		for _, v := range rs.Tables {
+			if table == v {
+				found = true
+				break
+			}
+		}
+		if !found {
+			rs.Tables = append(rs.Tables, table)
+		}
+	}
+	sort.Strings(rs.Tables)
+
+	return rs, configIsClean
+}
+
+// ParseRollups validates and normalizes rollup settings, calling warn to report each problem.
+// It returns the definitions, their priority order, the sorted names of the tables they use,
+// and whether there were no problems. Problem definitions are rejected; a default is supplied.
+func ParseRollups(settings map[string]RollupSettings, warn func(format string, a ...interface{})) (
+	priority []string, rollup map[string]RollupDef, tables []string, configIsClean bool) {
 
 	// Return success if there were no parse or configuration errors.
-	var configIsClean bool = true
+	configIsClean = true
 
-	// Validate, copy in and normalize the rollup definitions.
-	G.RollupPriority = make([]string, 0, len(rawCassabonConfig.Rollups))
-	G.Rollup = make(map[string]RollupDef)
+	// Validate and normalize the rollup definitions.
+	priority = make([]string, 0, len(settings))
+	rollup = make(map[string]RollupDef)
 
 	var method RollupMethod
 	var window, retention time.Duration
@@ -289,22 +961,11 @@ func LoadRollups() bool {
 
 	// Inspect each rollup found in the configuration.
 	// Note: YAML decode has already folded duplicate path expressions.
-	for expression, v := range rawCassabonConfig.Rollups {
+	for expression, v := range settings {
 
 		// Validate and decode the aggregation method.
-		switch strings.ToLower(v.Aggregation) {
-		case "average":
-			method = AVERAGE
-		case "max":
-			method = MAX
-		case "min":
-			method = MIN
-		case "sum":
-			method = SUM
-		case "last":
-			method = LAST
-		default:
-			G.Log.System.LogWarn("Invalid aggregation method for \"%s\": %s", expression, v.Aggregation)
+		if method, err = ParseRollupMethod(v.Aggregation); err != nil {
+			warn("Invalid aggregation method for \"%s\": %s", expression, v.Aggregation)
 			configIsClean = false
 			continue
 		}
@@ -317,7 +978,7 @@ func LoadRollups() bool {
 			if re, err := regexp.Compile(expression); err == nil {
 				rd.Expression = re
 			} else {
-				G.Log.System.LogWarn("Malformed regular expression for \"%s\": %s", expression, err.Error())
+				warn("Malformed regular expression for \"%s\": %s", expression, err.Error())
 				configIsClean = false
 				continue
 			}
@@ -329,21 +990,21 @@ func LoadRollups() bool {
 			// Split the value on the colon between the parts.
 			couplet := strings.Split(s, ":")
 			if len(couplet) != 2 {
-				G.Log.System.LogWarn("Malformed definition for \"%s\": %s", expression, s)
+				warn("Malformed definition for \"%s\": %s", expression, s)
 				configIsClean = false
 				continue
 			}
 
 			// Convert the window to a time.Duration.
 			if window, err = time.ParseDuration(couplet[0]); err != nil {
-				G.Log.System.LogWarn("Malformed window for \"%s\": %s %s", expression, s, couplet[0])
+				warn("Malformed window for \"%s\": %s %s", expression, s, couplet[0])
 				configIsClean = false
 				continue
 			}
 
 			// Don't permit windows shorter than 1 second.
 			if window < time.Second {
-				G.Log.System.LogWarn("Duration less than minimum 1 second for \"%s\": %v", expression, window)
+				warn("Duration less than minimum 1 second for \"%s\": %v", expression, window)
 				configIsClean = false
 				continue
 			}
@@ -352,12 +1013,12 @@ func LoadRollups() bool {
 			// ParseDuration doesn't handle anything longer than hours, so do it manually.
 			matches := reDuration.FindStringSubmatch(couplet[1]) // "1d" -> [ 1d 1 d ]
 			if len(matches) != 3 {
-				G.Log.System.LogWarn("Malformed retention for \"%s\": %s %s", expression, s, couplet[1])
+				warn("Malformed retention for \"%s\": %s %s", expression, s, couplet[1])
 				configIsClean = false
 				continue
 			}
 			if intRetention, err = strconv.ParseInt(matches[1], 10, 64); err != nil {
-				G.Log.System.LogWarn("Malformed retention for \"%s\": %s %s", expression, s, couplet[1])
+				warn("Malformed retention for \"%s\": %s %s", expression, s, couplet[1])
 				configIsClean = false
 				continue
 			}
@@ -373,7 +1034,14 @@ func LoadRollups() bool {
 			case "y":
 				retention = time.Hour * 24 * 365 * time.Duration(intRetention)
 			default:
-				G.Log.System.LogWarn("Malformed retention for \"%s\": %s %s", expression, s, couplet[1])
+				warn("Malformed retention for \"%s\": %s %s", expression, s, couplet[1])
+				configIsClean = false
+				continue
+			}
+
+			// The retention must be a whole number of windows.
+			if retention%window != 0 {
+				warn("Window does not evenly divide retention for \"%s\": %s", expression, s)
 				configIsClean = false
 				continue
 			}
@@ -381,14 +1049,14 @@ func LoadRollups() bool {
 			// Record this table name in the master list of table names.
 			table := retentionToTablename(retention)
 			found := false
-			for _, v := range G.RollupTables {
+			for _, v := range tables {
 				if table == v {
 					found = true
 					break
 				}
 			}
 			if !found {
-				G.RollupTables = append(G.RollupTables, table)
+				tables = append(tables, table)
 			}
 
 			// Append to the rollups for this expression.
@@ -402,21 +1070,21 @@ func LoadRollups() bool {
 			sort.Sort(ByWindow(rd.Windows))
 			shortestDuration := rd.Windows[0].Window
 			expressionOK := true
-			var tables = make(map[string]string)
+			var windowTables = make(map[string]string)
 			for i, v := range rd.Windows {
 				if i > 0 {
 					remainder := v.Window % shortestDuration
 					if remainder != 0 {
-						G.Log.System.LogWarn(
+						warn(
 							"Next duration is not a multiple for \"%s\": %v %% %v remainder is %v",
 							expression, v.Window, shortestDuration, remainder)
 						expressionOK = false
 					}
 				}
-				if _, found := tables[v.Table]; !found {
-					tables[v.Table] = ""
+				if _, found := windowTables[v.Table]; !found {
+					windowTables[v.Table] = ""
 				} else {
-					G.Log.System.LogWarn(
+					warn(
 						"Next retention is duplicate for \"%s\": %v %v table %s",
 						expression, v.Window, v.Retention, v.Table)
 					expressionOK = false
@@ -425,17 +1093,17 @@ func LoadRollups() bool {
 
 			// If all durations are exact multiples of the shortest duration, save this expression.
 			if expressionOK {
-				G.Rollup[expression] = *rd
-				G.RollupPriority = append(G.RollupPriority, expression)
+				rollup[expression] = *rd
+				priority = append(priority, expression)
 			} else {
 				configIsClean = false
-				G.Log.System.LogWarn("Rollup expression rejected due to previous errors: \"%s\"", expression)
+				warn("Rollup expression rejected due to previous errors: \"%s\"", expression)
 			}
 		}
 	}
 
 	// If no default has been defined (or it was rejected), create one.
-	if _, found := G.Rollup[ROLLUP_CATCHALL]; !found {
+	if _, found := rollup[ROLLUP_CATCHALL]; !found {
 		// Default rollup method is "average".
 		rd = new(RollupDef)
 		rd.Method = AVERAGE
@@ -448,17 +1116,78 @@ func LoadRollups() bool {
 		retention = time.Hour * 24 * 30
 		table = retentionToTablename(retention)
 		rd.Windows = append(rd.Windows, RollupWindow{time.Minute, retention, table})
+		// Record the default's tables, unless another expression already uses them.
+		for _, w := range rd.Windows {
+			found := false
+			for _, v := range tables {
+				if w.Table == v {
+					found = true
+					break
+				}
+			}
+			if !found {
+				tables = append(tables, w.Table)
+			}
+		}
 		// Append to rollup list.
-		G.Rollup[ROLLUP_CATCHALL] = *rd
-		G.RollupPriority = append(G.RollupPriority, ROLLUP_CATCHALL)
-		G.Log.System.LogWarn("Default rollup missing or rejected, using \"10s:1h | 1m:30d | average\"")
+		rollup[ROLLUP_CATCHALL] = *rd
+		priority = append(priority, ROLLUP_CATCHALL)
+		warn("Default rollup missing or rejected, using \"10s:1h | 1m:30d | average\"")
 	}
 
 	// Sort the path expressions into priority order.
-	sort.Sort(ByPriority(G.RollupPriority))
+	sort.Sort(ByPriority(priority))
 
 	// Sort the table names.
-	sort.Strings(G.RollupTables)
+	sort.Strings(tables)
 
-	return configIsClean
+	return
+}
+
+// ReloadRollups re-processes the rollup definitions after the configuration file is re-read,
+// and reports whether they differ from those in effect. If strict, and errors are encountered,
+// the definitions in effect are retained. Table names are never removed, because the data
+// already written to them remains queryable until it expires.
+func ReloadRollups(strict bool) bool {
+
+	// The definitions in effect are replaced whole, and only if they change.
+	current := Rollups()
+	reloaded, configIsClean := loadRollups()
+	if !configIsClean && strict {
+		G.Log.System.LogError("Errors encountered while reloading rollups; previous rollups retained")
+		return false
+	}
+
+	if rollupsEqual(current.Priority, current.Defs, reloaded.Priority, reloaded.Defs) {
+		return false
+	}
+	SetRollups(reloaded)
+	G.Log.System.LogInfo("Rollup definitions changed")
+	return true
+}
+
+// rollupsEqual reports whether two sets of rollup definitions would process paths identically.
+func rollupsEqual(priorityA []string, rollupA map[string]RollupDef, priorityB []string, rollupB map[string]RollupDef) bool {
+	if len(priorityA) != len(priorityB) {
+		return false
+	}
+	for i, expr := range priorityA {
+		if priorityB[i] != expr || !RollupDefsEqual(rollupA[expr], rollupB[expr]) {
+			return false
+		}
+	}
+	return true
+}
+
+// RollupDefsEqual reports whether two rollup definitions have the same method and windows.
+func RollupDefsEqual(a, b RollupDef) bool {
+	if a.Method != b.Method || len(a.Windows) != len(b.Windows) {
+		return false
+	}
+	for i := range a.Windows {
+		if a.Windows[i] != b.Windows[i] {
+			return false
+		}
+	}
+	return true
 }
@@ -2,8 +2,24 @@ package config
 
 import (
 	//"fmt"
-	//"reflect"
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/jeffpierce/cassabon/logging"
 )
 
 func TestParseConfig(t *testing.T) {
@@ -24,3 +40,584 @@ func TestParseConfig(t *testing.T) {
 		}
 	*/
 }
+
+func TestRollupsEqual(t *testing.T) {
+	windows := []RollupWindow{{10e9, 3600e9, "rollup_000003600"}}
+	a := map[string]RollupDef{ROLLUP_CATCHALL: {AVERAGE, nil, windows}}
+	b := map[string]RollupDef{ROLLUP_CATCHALL: {AVERAGE, nil, []RollupWindow{windows[0]}}}
+	priority := []string{ROLLUP_CATCHALL}
+
+	if !rollupsEqual(priority, a, priority, b) {
+		t.Errorf("Identical rollups reported as different")
+	}
+	b[ROLLUP_CATCHALL] = RollupDef{MAX, nil, windows}
+	if rollupsEqual(priority, a, priority, b) {
+		t.Errorf("Rollups with different methods reported as equal")
+	}
+	b[ROLLUP_CATCHALL] = RollupDef{AVERAGE, nil, append(windows, RollupWindow{60e9, 86400e9, "rollup_000086400"})}
+	if rollupsEqual(priority, a, priority, b) {
+		t.Errorf("Rollups with different windows reported as equal")
+	}
+}
+
+func TestParseProposedRollups(t *testing.T) {
+	var warnings []string
+	warn := func(format string, a ...interface{}) { warnings = append(warnings, format) }
+
+	yamlText := []byte("rollups:\n  ^foo.*:\n    retention:\n      - 10s:1h\n    aggregation: max\n")
+	priority, rollup, tables, clean, err := ParseProposedRollups(yamlText, warn)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	// The missing default is supplied, with a warning, but isn't an error.
+	if !clean || len(warnings) != 1 {
+		t.Errorf("Expected one warning, got %v", warnings)
+	}
+	if expr := MatchRollup(priority, rollup, "foo.bar"); expr != "^foo.*" || rollup[expr].Method != MAX {
+		t.Errorf("foo.bar matched %q", expr)
+	}
+	if expr := MatchRollup(priority, rollup, "bar.foo"); expr != ROLLUP_CATCHALL {
+		t.Errorf("bar.foo matched %q", expr)
+	}
+	if len(tables) != 2 {
+		t.Errorf("Expected the tables of both expressions, got %v", tables)
+	}
+
+	if _, _, _, _, err := ParseProposedRollups([]byte("carbon:\n  listen: x\n"), warn); err == nil {
+		t.Errorf("Expected an error for a configuration without rollups")
+	}
+}
+
+func TestTenantPaths(t *testing.T) {
+	if tenant, path, err := SplitTenant("acme.servers.web1"); err != nil || tenant != "acme" || path != "servers.web1" {
+		t.Errorf("SplitTenant returned %q %q %v", tenant, path, err)
+	}
+	for _, bad := range []string{"acme", "acme.", "ac|me.servers", ".servers"} {
+		if _, _, err := SplitTenant(bad); err == nil {
+			t.Errorf("SplitTenant accepted %q", bad)
+		}
+	}
+	if path := TenantPath("acme", "servers.web1"); path != "acme.servers.web1" {
+		t.Errorf("TenantPath returned %q", path)
+	}
+	if path := TenantPath("", "servers.web1"); path != "servers.web1" {
+		t.Errorf("TenantPath without tenant returned %q", path)
+	}
+}
+
+func TestKeyspaceReplication(t *testing.T) {
+	for _, c := range []struct {
+		settings CassandraSettings
+		expected string // "" for an error
+	}{
+		{CassandraSettings{Strategy: "SimpleStrategy", CreateOpts: "'replication_factor':1"},
+			"{'class':'SimpleStrategy','replication_factor':1}"},
+		{CassandraSettings{Strategy: "SimpleStrategy", Replication: ReplicationSettings{Factor: 2}},
+			"{'class': 'SimpleStrategy', 'replication_factor': '2'}"},
+		{CassandraSettings{Strategy: "NetworkTopologyStrategy", LocalDC: "west",
+			Replication: ReplicationSettings{Datacenters: map[string]int{"west": 3, "east": 2}}},
+			"{'class': 'NetworkTopologyStrategy', 'east': '2', 'west': '3'}"},
+		{CassandraSettings{Strategy: "SimpleStrategy"}, ""},
+		{CassandraSettings{Strategy: "SimpleStrategy", Replication: ReplicationSettings{Datacenters: map[string]int{"east": 3}}}, ""},
+		{CassandraSettings{Strategy: "NetworkTopologyStrategy", Replication: ReplicationSettings{Factor: 3}}, ""},
+		{CassandraSettings{Strategy: "NetworkTopologyStrategy", Replication: ReplicationSettings{Datacenters: map[string]int{"east": 0}}}, ""},
+		{CassandraSettings{Strategy: "NetworkTopologyStrategy", LocalDC: "west",
+			Replication: ReplicationSettings{Datacenters: map[string]int{"east": 3}}}, ""},
+		{CassandraSettings{Strategy: "OldNetworkTopologyStrategy", Replication: ReplicationSettings{Factor: 3}}, ""},
+	} {
+		replication, err := c.settings.KeyspaceReplication()
+		if c.expected == "" {
+			if err == nil {
+				t.Errorf("Expected an error for %+v, got %s", c.settings, replication)
+			}
+			continue
+		}
+		if err != nil || replication != c.expected {
+			t.Errorf("Expected %s for %+v, got %s %v", c.expected, c.settings, replication, err)
+		}
+	}
+}
+
+func TestApplyEnvironment(t *testing.T) {
+	var cfg CassabonConfig
+	cfg.Cassandra.Hosts = []string{"127.0.0.1"}
+	cfg.Cassandra.Port = "9042"
+	err := applyEnvironment(&cfg, []string{
+		"CASSABON_CASSANDRA_HOSTS=10.0.0.1, 10.0.0.2",
+		"CASSABON_CASSANDRA_BATCHSIZE=50",
+		"CASSABON_CASSANDRA_AGGREGATES=true",
+		"CASSABON_API_KEYS={secret: [read, write]}",
+		"CASSABON_LOGGING_LOGLEVEL=info",
+		"HOME=/root",
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if len(cfg.Cassandra.Hosts) != 2 || cfg.Cassandra.Hosts[1] != "10.0.0.2" {
+		t.Errorf("Expected two hosts, got %v", cfg.Cassandra.Hosts)
+	}
+	if cfg.Cassandra.Port != "9042" || cfg.Cassandra.BatchSize != 50 || !cfg.Cassandra.Aggregates {
+		t.Errorf("Unexpected Cassandra settings: %+v", cfg.Cassandra)
+	}
+	if len(cfg.API.Keys["secret"]) != 2 || cfg.Logging.Loglevel != "info" {
+		t.Errorf("Unexpected settings: %v %q", cfg.API.Keys, cfg.Logging.Loglevel)
+	}
+
+	if err := applyEnvironment(&cfg, []string{"CASSABON_CASSANDRA_BATCHSIZE=many"}); err == nil {
+		t.Errorf("Expected an error for a malformed number")
+	}
+}
+
+func TestValidateConfiguration(t *testing.T) {
+	yamlText := []byte(`
+carbon:
+    listen: "127.0.0.1:2003"
+    protocol: "tcp"
+    peers:
+        "0": "127.0.0.1:2003"
+api:
+    listen: "127.0.0.1:8080"
+    timeouts:
+        getindx: 5
+cassandra:
+    hosts:
+        - "127.0.0.1"
+    tables:
+        rollup_000000060:
+            gcgraceseconds: 60
+elasticsearch:
+    baseurl: "http://localhost:9200"
+rollups:
+    default:
+        retention:
+            - 10s:1h
+            - 7s:1d
+        aggregation: average
+    ^foo.*:
+        retention:
+            - 1m:1h
+            - 2m:1h
+        aggregation: sum
+    ^bar.*:
+        retention:
+            - 1m:1h
+        aggregation: median
+`)
+	var cfg CassabonConfig
+	if err := yaml.Unmarshal(yamlText, &cfg); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	problems := validateConfiguration(yamlText, nil, &cfg)
+	for _, prefix := range []string{
+		"api.timeouts.getindx: unknown setting",
+		"cassandra.tables.rollup_000000060:",
+		"rollups: Window does not evenly divide retention for \"default\"",
+		"rollups: Next retention is duplicate for \"^foo.*\"",
+		"rollups: Invalid aggregation method for \"^bar.*\"",
+	} {
+		found := false
+		for _, s := range problems {
+			found = found || strings.HasPrefix(s, prefix)
+		}
+		if !found {
+			t.Errorf("Expected a problem beginning %q, got %q", prefix, problems)
+		}
+	}
+
+	var empty CassabonConfig
+	problems = validateConfiguration([]byte{}, nil, &empty)
+	for _, path := range []string{"carbon.listen", "carbon.peers", "api.listen", "cassandra.hosts", "elasticsearch.baseurl"} {
+		found := false
+		for _, s := range problems {
+			found = found || strings.HasPrefix(s, path+": required")
+		}
+		if !found {
+			t.Errorf("Expected %s to be required, got %q", path, problems)
+		}
+	}
+
+	// The template validates as it is.
+	if err := ReadConfigurationFile("cassabon.yaml.template"); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if problems := ValidateConfiguration(); len(problems) > 0 {
+		t.Errorf("Unexpected problems in the template: %q", problems)
+	}
+}
+
+func TestIncludeRollups(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cassabon")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	os.Mkdir(filepath.Join(dir, "rollups.d"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "rollups.d", "foo.yaml"), []byte("^foo.*:\n  retention:\n    - 1m:1d\n  aggregation: sum\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "rollups.d", "bar.yaml"), []byte("^bar.*:\n  retention:\n    - 1m:1d\n  aggregtion: max\n"), 0644)
+
+	var cfg CassabonConfig
+	cfg.RollupFiles = []string{"rollups.d/*.yaml"}
+	cfg.Rollups = map[string]RollupSettings{ROLLUP_CATCHALL: {[]string{"1m:1d"}, "average"}}
+	files, err := includeRollups(&cfg, dir)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if len(files) != 2 || len(cfg.Rollups) != 3 || cfg.Rollups["^foo.*"].Aggregation != "sum" {
+		t.Errorf("Expected the rollups of both files, got %d files %+v", len(files), cfg.Rollups)
+	}
+	problems := validateConfiguration([]byte{}, files, &cfg)
+	found := false
+	for _, s := range problems {
+		found = found || strings.HasSuffix(s, "bar.yaml: rollups.^bar.*.aggregtion: unknown setting")
+	}
+	if !found {
+		t.Errorf("Expected the misspelled setting to be reported, got %q", problems)
+	}
+
+	// An expression may be defined only once, and a file that isn't a pattern must exist.
+	cfg.RollupFiles = []string{"rollups.d/foo.yaml"}
+	if _, err := includeRollups(&cfg, dir); err == nil {
+		t.Errorf("Expected an error for a rollup defined twice")
+	}
+	cfg.Rollups = nil
+	cfg.RollupFiles = []string{"missing.yaml"}
+	if _, err := includeRollups(&cfg, dir); err == nil {
+		t.Errorf("Expected an error for a missing file")
+	}
+}
+
+func TestReloadStartupValues(t *testing.T) {
+	saved, savedG, savedCassandra := rawCassabonConfig, G, *Cassandra()
+	defer func() { rawCassabonConfig, G = saved, savedG; SetCassandra(savedCassandra) }()
+
+	rawCassabonConfig = new(CassabonConfig)
+	rawCassabonConfig.Cassandra.Hosts = []string{"10.0.0.1"}
+	rawCassabonConfig.ElasticSearch.BaseURL = "http://localhost:9200"
+	rawCassabonConfig.MetricManager.Shards = 4
+	LoadStartupValues()
+
+	if cassandraChanged, elasticSearchChanged, restart := ReloadStartupValues(); cassandraChanged || elasticSearchChanged || len(restart) > 0 {
+		t.Errorf("Expected nothing to change, got %v %v %v", cassandraChanged, elasticSearchChanged, restart)
+	}
+
+	// The settings are replaced, rather than changed under those using them.
+	before := Cassandra()
+	rawCassabonConfig.Cassandra.Hosts = []string{"10.0.0.2"}
+	rawCassabonConfig.Cassandra.Keyspace = "other"
+	rawCassabonConfig.MetricManager.Shards = 8
+	cassandraChanged, elasticSearchChanged, restart := ReloadStartupValues()
+	if before.Hosts[0] != "10.0.0.1" {
+		t.Errorf("Expected the settings in use to be left as they were, got %v", before.Hosts)
+	}
+	if !cassandraChanged || elasticSearchChanged || len(restart) != 2 {
+		t.Errorf("Expected Cassandra to change and two restarts, got %v %v %v", cassandraChanged, elasticSearchChanged, restart)
+	}
+	if cs := Cassandra(); cs.Hosts[0] != "10.0.0.2" || cs.Keyspace != "cassabon" || G.MetricManager.Shards != 4 {
+		t.Errorf("Unexpected settings after reload: %v %q %d", cs.Hosts, cs.Keyspace, G.MetricManager.Shards)
+	}
+}
+
+func TestReloadRollups(t *testing.T) {
+	saved, savedLog, savedRollups := rawCassabonConfig, G.Log.System, *Rollups()
+	defer func() { rawCassabonConfig, G.Log.System = saved, savedLog; SetRollups(savedRollups) }()
+	G.Log.System = logging.NewLogger("system")
+
+	rawCassabonConfig = new(CassabonConfig)
+	rawCassabonConfig.Rollups = map[string]RollupSettings{ROLLUP_CATCHALL: {[]string{"1m:1d"}, "average"}}
+	SetRollups(RollupSet{})
+	if !LoadRollups() || ReloadRollups(true) {
+		t.Errorf("Expected the rollups to load, and to be unchanged on reload")
+	}
+
+	// The definitions are replaced, rather than changed under those using them, and tables are kept.
+	before := Rollups()
+	rawCassabonConfig.Rollups = map[string]RollupSettings{ROLLUP_CATCHALL: {[]string{"1h:30d"}, "max"}}
+	if !ReloadRollups(true) {
+		t.Errorf("Expected the rollups to change")
+	}
+	if before.Defs[ROLLUP_CATCHALL].Method != AVERAGE || len(before.Tables) != 1 {
+		t.Errorf("Expected the rollups in use to be left as they were, got %+v", before)
+	}
+	if rs := Rollups(); rs.Defs[ROLLUP_CATCHALL].Method != MAX || len(rs.Tables) != 2 {
+		t.Errorf("Unexpected rollups after reload: %+v", rs)
+	}
+
+	// Rollups with errors are refused when strict.
+	before = Rollups()
+	rawCassabonConfig.Rollups = map[string]RollupSettings{ROLLUP_CATCHALL: {[]string{"bad"}, "max"}}
+	if ReloadRollups(true) || Rollups() != before {
+		t.Errorf("Expected the rollups in effect to be retained")
+	}
+}
+
+func TestRemoteConfiguration(t *testing.T) {
+	yamlText := "logging:\n    loglevel: info\n"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/kv/cassabon/config":
+			w.Header().Set("X-Consul-Index", "42")
+			w.Write([]byte(yamlText))
+		case "/v3/kv/range":
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"header": map[string]string{"revision": "9"},
+				"kvs":    []map[string]interface{}{{"value": []byte(yamlText), "mod_revision": "7"}},
+			})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	addr := strings.TrimPrefix(server.URL, "http://")
+
+	if _, remote := parseRemoteSource("config/cassabon.yaml"); remote {
+		t.Errorf("Expected a file name not to be a remote source")
+	}
+	for _, c := range []struct {
+		name  string
+		index uint64
+	}{
+		{"consul://" + addr + "/cassabon/config", 42},
+		{"etcd://" + addr + "/cassabon/config/", 9}, // The store's revision, not the key's
+	} {
+		rs, remote := parseRemoteSource(c.name)
+		if !remote || rs.key != "cassabon/config" {
+			t.Errorf("Unexpected source for %s: %+v", c.name, rs)
+			continue
+		}
+		text, index, err := rs.read(context.Background(), http.DefaultClient, 0)
+		if err != nil || string(text) != yamlText || index != c.index {
+			t.Errorf("Expected the configuration at %d from %s, got %q %d %v", c.index, c.name, text, index, err)
+		}
+	}
+
+	rs, _ := parseRemoteSource("consul://" + addr + "/cassabon/missing")
+	if _, _, err := rs.read(context.Background(), http.DefaultClient, 0); err == nil {
+		t.Errorf("Expected an error for a missing key")
+	}
+}
+
+func TestWatchEtcd(t *testing.T) {
+	G.Log.System = logging.NewLogger("system")
+	starts := make(chan string, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			CreateRequest struct {
+				StartRevision string `json:"start_revision"`
+			} `json:"create_request"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		starts <- req.CreateRequest.StartRevision
+
+		// The first watch sees a change at revision 12; the next waits until it is stopped.
+		w.Write([]byte(`{"result":{"header":{"revision":"11"},"created":true}}` + "\n"))
+		w.(http.Flusher).Flush()
+		if req.CreateRequest.StartRevision == "10" {
+			w.Write([]byte(`{"result":{"header":{"revision":"12"},"events":[{"type":"PUT"}]}}` + "\n"))
+			return
+		}
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	changed := make(chan struct{}, 10)
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		WatchConfiguration("etcd://"+strings.TrimPrefix(server.URL, "http://")+"/cassabon/config", 9, func() {
+			changed <- struct{}{}
+		}, stop)
+		close(done)
+	}()
+
+	// The watch begins after the revision at which the configuration was read, and then after each change.
+	for _, expected := range []string{"10", "13"} {
+		select {
+		case start := <-starts:
+			if start != expected {
+				t.Errorf("Expected a watch from revision %s, got %s", expected, start)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for a watch from revision %s", expected)
+		}
+	}
+	if len(changed) != 1 {
+		t.Errorf("Expected one change, got %d", len(changed))
+	}
+
+	// Stopping the watch ends the request in progress.
+	close(stop)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for the watch to stop")
+	}
+}
+
+func TestEtcdTLS(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"header":{"revision":"3"},"kvs":[{"value":"bG9nZ2luZzoge30K"}]}`))
+	}))
+	defer server.Close()
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0644)
+	t.Setenv("ETCDCTL_CACERT", caFile)
+
+	text, index, err := readConfigurationText("etcd://" + strings.TrimPrefix(server.URL, "https://") + "/cassabon/config")
+	if err != nil || string(text) != "logging: {}\n" || index != 3 {
+		t.Errorf("Expected the configuration at 3 over TLS, got %q %d %v", text, index, err)
+	}
+}
+
+func TestExampleConfiguration(t *testing.T) {
+	text := ExampleConfiguration()
+	var cfg CassabonConfig
+	if err := yaml.Unmarshal(text, &cfg); err != nil {
+		t.Fatalf("Unexpected error: %s\n%s", err.Error(), text)
+	}
+	if problems := validateConfiguration(text, nil, &cfg); len(problems) > 0 {
+		t.Errorf("Unexpected problems in the example: %q", problems)
+	}
+	if cfg.Cassandra.Timeout != 1000 || cfg.Cassandra.Keyspace != "cassabon" || cfg.MetricManager.Engine != ENGINE_CASSANDRA {
+		t.Errorf("Expected the defaults in the example, got %+v", cfg.Cassandra)
+	}
+
+	// Every setting must be described, as settings.go is generated; run "go generate" in config if not.
+	var walk func(t reflect.Type, path string)
+	walk = func(typ reflect.Type, path string) {
+		for i := 0; i < typ.NumField(); i++ {
+			f := typ.Field(i)
+			p := joinPath(path, strings.ToLower(f.Name))
+			if _, found := settingDocs[p]; !found {
+				t.Errorf("No description of %s in settings.go", p)
+			}
+			if f.Type.Kind() == reflect.Struct {
+				walk(f.Type, p)
+			}
+		}
+	}
+	walk(reflect.TypeOf(cfg), "")
+}
+
+func TestSettingFlags(t *testing.T) {
+	defer func() { flagSettings = make(map[string]string) }()
+
+	fs := flag.NewFlagSet("cassabon", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	RegisterFlags(fs)
+	if err := fs.Parse([]string{"-cassandra.hosts=10.0.0.1,10.0.0.2", "-carbon.listen", "127.0.0.1:2103", "-cassandra.reads.timeout=50"}); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if err := fs.Parse([]string{"-cassandra.batchsize=many"}); err == nil {
+		t.Errorf("Expected an error for a malformed number")
+	}
+
+	// Flags override the file and the environment.
+	var cfg CassabonConfig
+	cfg.Carbon.Listen = "127.0.0.1:2003"
+	cfg.Carbon.Protocol = "tcp"
+	applyEnvironment(&cfg, []string{"CASSABON_CARBON_LISTEN=127.0.0.1:2203", "CASSABON_CARBON_PROTOCOL=udp"})
+	if err := applyFlags(&cfg); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if cfg.Carbon.Listen != "127.0.0.1:2103" || cfg.Carbon.Protocol != "udp" || len(cfg.Cassandra.Hosts) != 2 || cfg.Cassandra.Reads.Timeout != 50 {
+		t.Errorf("Unexpected settings: %+v %+v", cfg.Carbon, cfg.Cassandra)
+	}
+}
+
+func TestCheckConfiguration(t *testing.T) {
+	if err := ReadConfigurationFile("cassabon.yaml.template"); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	var b bytes.Buffer
+	if !CheckConfiguration(&b) {
+		t.Errorf("Unexpected problems in the template:\n%s", b.String())
+	}
+	for _, s := range []string{"cassandra.hosts[0]: 127.0.0.1 resolves to 127.0.0.1", `"default": average 15s:1d (rollup_000086400)`, "configuration OK"} {
+		if !strings.Contains(b.String(), s) {
+			t.Errorf("Expected %q in the report:\n%s", s, b.String())
+		}
+	}
+
+	// Any problem fails the check.
+	rawCassabonConfig.ElasticSearch.BaseURL = "localhost:9200"
+	b.Reset()
+	if CheckConfiguration(&b) || strings.Contains(b.String(), "configuration OK") {
+		t.Errorf("Expected the check to fail:\n%s", b.String())
+	}
+
+	for d, s := range map[time.Duration]string{10 * time.Second: "10s", 90 * time.Second: "90s", 30 * 24 * time.Hour: "30d", 14 * 24 * time.Hour: "2w", 1500 * time.Millisecond: "1.5s"} {
+		if formatDuration(d) != s {
+			t.Errorf("Expected %s for %v, got %s", s, d, formatDuration(d))
+		}
+	}
+}
+
+func TestConvertCarbon(t *testing.T) {
+	schemas := []byte(`
+# First match wins.
+[carbon]
+pattern = ^carbon\.
+retentions = 60:90d
+
+[stats]
+pattern = ^stats\.
+retentions = 10s:6h,1min:7d,10m:5y
+
+[again]
+pattern = ^carbon\.
+retentions = 1s:1h
+
+[default_1min_for_1day]
+pattern = .*
+retentions = 60s:1d,5m:30d
+`)
+	aggregation := []byte(`
+[min]
+pattern = \.min$
+xFilesFactor = 0.1
+aggregationMethod = min
+
+[p50]
+pattern = \.p50\.
+aggregationMethod = median
+`)
+	text, warnings, err := convertCarbon(schemas, aggregation)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	var cfg CassabonConfig
+	if err := yaml.Unmarshal(text, &cfg); err != nil {
+		t.Fatalf("Unexpected error: %s\n%s", err.Error(), text)
+	}
+	expected := map[string]RollupSettings{
+		`^carbon\.`:         {[]string{"1m:90d"}, "average"},
+		`^carbon\..*\.min$`: {[]string{"1m:90d"}, "min"},
+		`^stats\.`:          {[]string{"10s:6h", "1m:1w", "10m:5y"}, "average"},
+		`^stats\..*\.min$`:  {[]string{"10s:6h", "1m:1w", "10m:5y"}, "min"},
+		`\.min$`:            {[]string{"1m:1d", "5m:30d"}, "min"},
+		`\.p50\.`:           {[]string{"1m:1d", "5m:30d"}, "average"},
+		ROLLUP_CATCHALL:     {[]string{"1m:1d", "5m:30d"}, "average"},
+	}
+	if !reflect.DeepEqual(cfg.Rollups, expected) {
+		t.Errorf("Unexpected rollups:\n%s", text)
+	}
+	for _, s := range []string{"[again]: has the pattern of [carbon]", `like "median"`, "xFilesFactor", `matched before "\\.min$"`} {
+		found := false
+		for _, w := range warnings {
+			found = found || strings.Contains(w, s)
+		}
+		if !found {
+			t.Errorf("Expected a warning containing %q, got %q", s, warnings)
+		}
+	}
+	if len(warnings) != 6 {
+		t.Errorf("Unexpected warnings: %q", warnings)
+	}
+
+	if _, _, err := convertCarbon([]byte("pattern = .*\n"), nil); err == nil {
+		t.Errorf("Expected an error for a setting outside a section")
+	}
+	if !disjointPatterns(`^carbon\.`, `^stats\.`) || !disjointPatterns(`\.min$`, `^x.*\.max$`) || disjointPatterns(`^carbon\.`, `^carbon\.agents\.`) || disjointPatterns(`^ab?c`, `^ac`) {
+		t.Errorf("Unexpected disjointPatterns")
+	}
+}
@@ -0,0 +1,79 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// The prefix of the environment variables that override settings from the configuration file.
+const envPrefix = "CASSABON"
+
+// applyEnvironment overrides settings from the configuration file with environment variables named for their
+// place in it, such as CASSABON_CASSANDRA_HOSTS for "hosts" in the "cassandra" section. A string is taken as
+// it is, and a list of strings may be separated by commas; anything else, including a whole section or map
+// such as CASSABON_ROLLUPS, is read as YAML.
+func applyEnvironment(cfg *CassabonConfig, environ []string) error {
+	values := make(map[string]string)
+	for _, kv := range environ {
+		if i := strings.Index(kv, "="); i > 0 && strings.HasPrefix(kv, envPrefix+"_") {
+			// Field names have no underscores, so each separates the names of a setting's path.
+			path := strings.ToLower(strings.Replace(strings.TrimPrefix(kv[:i], envPrefix+"_"), "_", ".", -1))
+			values[path] = kv[i+1:]
+		}
+	}
+	return applySettings(cfg, values, envName)
+}
+
+// envName returns the name of the environment variable of a setting's path.
+func envName(path string) string {
+	return envPrefix + "_" + strings.ToUpper(strings.Replace(path, ".", "_", -1))
+}
+
+// applySettings sets the settings named by the paths of their places in the configuration file, such as
+// "cassandra.hosts". The name of a setting's source is given by name, for reporting malformed values.
+func applySettings(cfg *CassabonConfig, values map[string]string, name func(path string) string) error {
+	if len(values) == 0 {
+		return nil
+	}
+	return applySettingsTo(reflect.ValueOf(cfg).Elem(), "", values, name)
+}
+
+// applySettingsTo sets a value from the setting of its path, if there is one, then the fields of a struct
+// from theirs.
+func applySettingsTo(v reflect.Value, path string, values map[string]string, name func(path string) string) error {
+	if s, found := values[path]; found && path != "" {
+		switch {
+		case v.Kind() == reflect.String:
+			v.SetString(s)
+		case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.String && !strings.HasPrefix(strings.TrimSpace(s), "["):
+			list := reflect.MakeSlice(v.Type(), 0, 0)
+			for _, item := range strings.Split(s, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					list = reflect.Append(list, reflect.ValueOf(item).Convert(v.Type().Elem()))
+				}
+			}
+			v.Set(list)
+		default:
+			target := reflect.New(v.Type())
+			if err := yaml.Unmarshal([]byte(s), target.Interface()); err != nil {
+				return fmt.Errorf("invalid value of %s: %s", name(path), err.Error())
+			}
+			v.Set(target.Elem())
+		}
+	}
+	if v.Kind() == reflect.Struct {
+		for i := 0; i < v.NumField(); i++ {
+			field := v.Type().Field(i)
+			if field.PkgPath != "" {
+				continue // Unexported, so not configurable
+			}
+			if err := applySettingsTo(v.Field(i), joinPath(path, strings.ToLower(field.Name)), values, name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+//go:generate go run gen_settings.go
+
+// settingDoc describes a setting of the configuration file, as gen_settings.go finds it in config_parser.go.
+type settingDoc struct {
+	comment  string // The comment of the setting's field
+	fallback string // The default substituted when the setting is left unset, as a YAML value; "" if none
+}
+
+// exampleValues are the values the example configuration gives to settings that have no default, but that a
+// working configuration needs, or for which a value other than their zero value is typical.
+var exampleValues = map[string]string{
+	"logging.loglevel":             `"info"`,
+	"statsd.port":                  `"8125"`,
+	"carbon.listen":                `"127.0.0.1:2003"`,
+	"carbon.protocol":              `"both"`,
+	"carbon.peers":                 `{"A": "127.0.0.1:2003"}`,
+	"api.listen":                   `"127.0.0.1:8080"`,
+	"cassandra.hosts":              `["127.0.0.1"]`,
+	"cassandra.port":               `"9042"`,
+	"cassandra.strategy":           `"` + STRATEGY_SIMPLE + `"`,
+	"cassandra.replication.factor": `1`,
+	"elasticsearch.baseurl":        `"http://localhost:9200"`,
+}
+
+// exampleRollups are the rollups of the example configuration, indented as the "rollups" section's.
+const exampleRollups = `    ^servers\..*\.bytes\..*:
+        # Counters store the increase in each window of an ever-increasing input.
+        retention:
+            - 10s:1h
+            - 1m:30d
+        aggregation: counter
+    ^servers\..*:
+        retention:
+            - 10s:6h
+            - 1m:7d
+            - 1h:1y
+        aggregation: average
+    default:
+        # Any path matching none of the expressions above is rolled up as the default is.
+        retention:
+            - 10s:1h
+            - 1m:30d
+        aggregation: average
+`
+
+// ExampleConfiguration returns a complete configuration file, with every setting described by the comment of its
+// field and given its default, or an example value where it has none.
+func ExampleConfiguration() []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "# Cassabon configuration, generated by cassabon %s -example-config\n", Version)
+	fmt.Fprintf(&b, "#\n# Settings left at zero, or unset, take the defaults shown.\n#\n")
+	writeExample(&b, reflect.TypeOf(CassabonConfig{}), "", "")
+	return b.Bytes()
+}
+
+// writeExample writes the settings of a struct type, beneath a path, at an indent.
+func writeExample(b *bytes.Buffer, t reflect.Type, path, indent string) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		key := strings.ToLower(f.Name)
+		p := joinPath(path, key)
+		if doc := settingDocs[p]; doc.comment != "" {
+			fmt.Fprintf(b, "%s# %s\n", indent, doc.comment)
+		}
+		switch {
+		case p == "rollups":
+			fmt.Fprintf(b, "%s%s:\n%s", indent, key, exampleRollups)
+		case f.Type.Kind() == reflect.Struct:
+			fmt.Fprintf(b, "%s%s:\n", indent, key)
+			writeExample(b, f.Type, p, indent+"    ")
+		default:
+			fmt.Fprintf(b, "%s%s: %s\n", indent, key, exampleValue(p, f.Type))
+		}
+	}
+}
+
+// exampleValue returns the value given to a setting in the example configuration.
+func exampleValue(path string, t reflect.Type) string {
+	if v, found := exampleValues[path]; found {
+		return v
+	}
+	if v := settingDocs[path].fallback; v != "" {
+		return v
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return `""`
+	case reflect.Bool:
+		return "false"
+	case reflect.Slice:
+		return "[]"
+	case reflect.Map:
+		return "{}"
+	case reflect.Float32, reflect.Float64:
+		return "0.0"
+	}
+	return "0"
+}
@@ -0,0 +1,65 @@
+package config
+
+import (
+	"flag"
+	"reflect"
+	"strings"
+)
+
+// flagSettings are the settings given on the command line, by their paths. They override those of the
+// configuration file and the environment, and are applied again each time the configuration is re-read.
+var flagSettings = make(map[string]string)
+
+// settingFlag is the flag of a setting, named for its path.
+type settingFlag string
+
+func (f settingFlag) String() string {
+	return flagSettings[string(f)]
+}
+
+// Set records the value of the setting, once it is known to suit the setting.
+func (f settingFlag) Set(s string) error {
+	var scratch CassabonConfig
+	if err := applySettings(&scratch, map[string]string{string(f): s}, flagName); err != nil {
+		return err
+	}
+	flagSettings[string(f)] = s
+	return nil
+}
+
+// flagName returns the name of the flag of a setting's path.
+func flagName(path string) string {
+	return "-" + path
+}
+
+// RegisterFlags defines a flag for each setting of the configuration file, named for its path, such as
+// -cassandra.hosts or -carbon.listen, with the comment of its field as its usage. Values are given as in the
+// environment: a string as it is, a list of strings separated by commas, and anything else as YAML.
+func RegisterFlags(fs *flag.FlagSet) {
+	registerFlags(fs, reflect.TypeOf(CassabonConfig{}), "")
+}
+
+// registerFlags defines the flags of the settings of a struct type, beneath a path.
+func registerFlags(fs *flag.FlagSet, t reflect.Type, path string) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		p := joinPath(path, strings.ToLower(field.Name))
+		if field.Type.Kind() == reflect.Struct {
+			registerFlags(fs, field.Type, p)
+			continue
+		}
+		usage := settingDocs[p].comment
+		if usage == "" {
+			usage = "the " + p + " setting"
+		}
+		fs.Var(settingFlag(p), p, usage)
+	}
+}
+
+// applyFlags overrides settings with those given on the command line.
+func applyFlags(cfg *CassabonConfig) error {
+	return applySettings(cfg, flagSettings, flagName)
+}
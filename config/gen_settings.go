@@ -0,0 +1,200 @@
+//go:build ignore
+// +build ignore
+
+// gen_settings writes settings.go, describing each setting of the configuration file from the structs
+// of config_parser.go: the comment of its field, and the default its load functions substitute when
+// it is left unset, if that is a literal or a constant.
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"log"
+	"sort"
+	"strings"
+)
+
+// The file whose structs and load functions are described.
+const source = "config_parser.go"
+
+type settingDoc struct {
+	comment  string
+	fallback string
+}
+
+var (
+	types    = make(map[string]*ast.StructType) // Struct types declared in the source, by name
+	consts   = make(map[string]string)          // Constants declared in the source, by name
+	settings = make(map[string]*settingDoc)     // The settings, by path
+)
+
+func main() {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, source, nil, parser.ParseComments)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for _, decl := range f.Decls {
+		if gd, ok := decl.(*ast.GenDecl); ok {
+			for _, spec := range gd.Specs {
+				switch s := spec.(type) {
+				case *ast.TypeSpec:
+					if st, ok := s.Type.(*ast.StructType); ok {
+						types[s.Name.Name] = st
+					}
+				case *ast.ValueSpec:
+					if gd.Tok == token.CONST && len(s.Values) == len(s.Names) {
+						for i, name := range s.Names {
+							if lit, ok := s.Values[i].(*ast.BasicLit); ok {
+								consts[name.Name] = lit.Value
+							}
+						}
+					}
+				}
+			}
+		}
+	}
+	describe(types["CassabonConfig"], "")
+
+	for _, decl := range f.Decls {
+		if fd, ok := decl.(*ast.FuncDecl); ok && strings.HasPrefix(strings.ToLower(fd.Name.Name), "load") && fd.Body != nil {
+			ast.Inspect(fd.Body, findDefaults)
+		}
+	}
+
+	var paths []string
+	for path := range settings {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "// Code generated by gen_settings.go from %s; DO NOT EDIT.\n\npackage config\n\n", source)
+	fmt.Fprintf(&b, "// settingDocs describes each setting of the configuration file, by its path.\n")
+	fmt.Fprintf(&b, "var settingDocs = map[string]settingDoc{\n")
+	for _, path := range paths {
+		fmt.Fprintf(&b, "\t%q: {%q, %q},\n", path, settings[path].comment, settings[path].fallback)
+	}
+	fmt.Fprintf(&b, "}\n")
+	text, err := format.Source(b.Bytes())
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := ioutil.WriteFile("settings.go", text, 0644); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// describe records the settings of a struct's fields, as yaml.v2 names them, beneath a path.
+func describe(st *ast.StructType, path string) {
+	for _, field := range st.Fields.List {
+		comment := strings.TrimSpace(field.Comment.Text())
+		if comment == "" {
+			comment = strings.TrimSpace(field.Doc.Text())
+		}
+		for _, name := range field.Names {
+			if !name.IsExported() {
+				continue
+			}
+			p := strings.ToLower(name.Name)
+			if path != "" {
+				p = path + "." + p
+			}
+			settings[p] = &settingDoc{comment: strings.Replace(comment, "\n", " ", -1)}
+			describeType(field.Type, p)
+		}
+	}
+}
+
+// describeType records the settings within a field's type; those in the values of a map are beneath "*".
+func describeType(expr ast.Expr, path string) {
+	switch t := expr.(type) {
+	case *ast.StructType:
+		describe(t, path)
+	case *ast.Ident:
+		if st, found := types[t.Name]; found {
+			describe(st, path)
+		}
+	case *ast.MapType:
+		describeType(t.Value, path+".*")
+	}
+}
+
+// findDefaults records the defaults of "if G.X.Y < 1 { G.X.Y = 10 }" and of the default of a switch that
+// sets a setting.
+func findDefaults(n ast.Node) bool {
+	switch s := n.(type) {
+	case *ast.IfStmt:
+		cond, ok := s.Cond.(*ast.BinaryExpr)
+		if !ok || (cond.Op != token.LSS && cond.Op != token.EQL && cond.Op != token.LEQ) || len(s.Body.List) != 1 {
+			return true
+		}
+		if path, value, ok := literalAssignment(s.Body.List[0]); ok && path == settingPath(cond.X) {
+			setDefault(path, value)
+		}
+	case *ast.SwitchStmt:
+		for _, stmt := range s.Body.List {
+			if cc, ok := stmt.(*ast.CaseClause); ok && cc.List == nil && len(cc.Body) == 1 {
+				if path, value, ok := literalAssignment(cc.Body[0]); ok {
+					setDefault(path, value)
+				}
+			}
+		}
+	}
+	return true
+}
+
+// literalAssignment returns the setting assigned, and the literal or constant assigned to it.
+func literalAssignment(stmt ast.Stmt) (string, string, bool) {
+	as, ok := stmt.(*ast.AssignStmt)
+	if !ok || len(as.Lhs) != 1 || len(as.Rhs) != 1 {
+		return "", "", false
+	}
+	var value string
+	switch v := as.Rhs[0].(type) {
+	case *ast.BasicLit:
+		value = v.Value
+	case *ast.Ident:
+		if value, ok = consts[v.Name]; !ok {
+			return "", "", false
+		}
+	default:
+		return "", "", false
+	}
+	path := settingPath(as.Lhs[0])
+	return path, value, path != ""
+}
+
+// settingPath returns the path of a setting given as G.X.Y or rawCassabonConfig.X.Y, or as cs.Y for the
+// Cassandra settings loadStartupValues builds in cs, or "".
+func settingPath(expr ast.Expr) string {
+	var names []string
+	for {
+		switch e := expr.(type) {
+		case *ast.SelectorExpr:
+			names = append([]string{strings.ToLower(e.Sel.Name)}, names...)
+			expr = e.X
+			continue
+		case *ast.Ident:
+			if e.Name == "G" || e.Name == "rawCassabonConfig" {
+				return strings.Join(names, ".")
+			}
+			if e.Name == "cs" {
+				return strings.Join(append([]string{"cassandra"}, names...), ".")
+			}
+		}
+		return ""
+	}
+}
+
+// setDefault records the default of a setting, if it is one, and its first default found.
+func setDefault(path, value string) {
+	if s, found := settings[path]; found && s.fallback == "" {
+		s.fallback = value
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"regexp"
+	"sync/atomic"
 	"time"
 
 	"github.com/jeffpierce/cassabon/logging"
@@ -23,20 +24,85 @@ const (
 	AQS_NOTFOUND
 	AQS_BADREQUEST
 	AQS_ERROR
+	AQS_PARTIAL // Part of an AQS_OK payload; more parts follow, ending with one whose status is final
 )
 
+// The graphite-web find formats in which an index query can be answered.
+const (
+	FIND_TREEJSON  = "treejson"
+	FIND_COMPLETER = "completer"
+)
+
+// The permissions that may be granted to an API key. API_ADMIN grants all the others too.
+const (
+	API_READ   = "read"   // Querying paths and metrics
+	API_WRITE  = "write"  // Backfilling metrics
+	API_DELETE = "delete" // Deleting paths and metrics
+	API_ADMIN  = "admin"  // Changing rollup overrides, and runtime operations
+)
+
+// API_TENANT prefixes a tenant's name to grant an API key that tenant, as "tenant:acme". A key granted
+// any tenants may name only those; one granted none, or API_ADMIN, may name any.
+const API_TENANT = "tenant:"
+
 type IndexQuery struct {
-	Method  string                // The HTTP method from the request
-	Query   string                // Query
-	Channel chan APIQueryResponse // Channel to send response back on.
+	Method    string                // The HTTP method from the request, "stats" for the index's statistics, "health", "tags" or "values"
+	Query     string                // Query, or the prefix of the tags or values completed
+	Tenant    string                // The tenant whose paths are queried, or "" if tenancy is disabled
+	Fuzzy     bool                  // Whether to find paths similar to the query, rather than match its wildcards
+	Expand    bool                  // Whether to also return the branches matched by the query on the way down
+	Limit     int                   // The most paths to return, from Offset on; 0 returns them all
+	Offset    int                   // The number of paths to skip, when Limit is set
+	Format    string                // The form of the response: "" for Cassabon's own, or a graphite-web find format
+	Tag       string                // For "values", the tag whose values are completed
+	Exprs     []string              // For "tags" and "values", the tag expressions the series completed from must match
+	RequestID string                // The ID of the API request, identifying its log lines
+	Channel   chan APIQueryResponse // Channel to send response back on.
 }
 
 type MetricQuery struct {
+	Method        string                // The HTTP method from the request, "TAP" to sample paths, "SUBSCRIBE", "HEALTH", "FLUSH" or "RULES"
+	Query         []string              // Query
+	From          int64                 // Start of time window for metrics range
+	To            int64                 // End of time window for metrics range
+	DryRun        bool                  // For deletions, whether to actually delete
+	MaxDataPoints int                   // Upper limit on returned points per series, or 0 for no limit
+	ConsolidateBy string                // Method for combining points to meet MaxDataPoints, or "" for the rollup method
+	Aggregate     string                // The stored aggregate to return instead of the stat, or "" for the stat
+	Raw           bool                  // Whether to roll up the stored raw data points, rather than read the rollups
+	Explain       bool                  // Whether to report how the query was answered, along with its series
+	Tenant        string                // The tenant whose paths are queried, or "" if tenancy is disabled
+	RequestID     string                // The ID of the API request, identifying its log lines
+	Channel       chan APIQueryResponse // Channel to send response back on.
+}
+
+// OverrideQuery lists, sets or removes a rollup override, which pins a path or prefix to an expression.
+type OverrideQuery struct {
+	Method     string                // The HTTP method from the request
+	Path       string                // The path, or path prefix, that is pinned
+	Prefix     bool                  // Whether Path is a prefix, matching every path that starts with it
+	Expression string                // The rollup expression to which the path is pinned
+	Tenant     string                // The tenant whose paths are pinned, or "" if tenancy is disabled
+	Channel    chan APIQueryResponse // Channel to send response back on.
+}
+
+// EventQuery records an event, such as a deploy, or lists those recorded, to annotate graphs.
+type EventQuery struct {
 	Method  string                // The HTTP method from the request
-	Query   []string              // Query
-	From    int64                 // Start of time window for metrics range
-	To      int64                 // End of time window for metrics range
-	DryRun  bool                  // For deletions, whether to actually delete
+	What    string                // What happened, for a new event
+	Tags    []string              // The tags of a new event, or those the events listed must have
+	AnyTag  bool                  // Whether the events listed need only have one of the tags, rather than all of them
+	Data    string                // Text describing a new event
+	When    int64                 // When a new event happened, in seconds since the epoch
+	From    int64                 // The range of the events listed, in seconds since the epoch
+	To      int64                 //
+	Tenant  string                // The tenant whose events these are, or "" if tenancy is disabled
+	Channel chan APIQueryResponse // Channel to send response back on.
+}
+
+// BackfillQuery writes historical data points directly into the rollup tables.
+type BackfillQuery struct {
+	Metrics []CarbonMetric        // The data points, with tenant-qualified paths
 	Channel chan APIQueryResponse // Channel to send response back on.
 }
 
@@ -56,6 +122,7 @@ const (
 	MIN
 	SUM
 	LAST
+	COUNTER // Per-window increase of a monotonically increasing input
 )
 
 // The string that represents the catchall rollup.
@@ -84,12 +151,16 @@ type Globals struct {
 	// Goroutine management.
 	// Note: Anything that accepts input should shut down first, so it should
 	// monitor OnReload1. Everything else should monitor OnReload2.
-	OnPeerChange    chan struct{}
-	OnPeerChangeReq chan struct{}
-	OnPeerChangeRsp chan struct{}
-	OnReload1       chan struct{}
-	OnReload2       chan struct{}
-	OnExit          chan struct{}
+	OnPeerChange      chan struct{}
+	OnPeerChangeReq   chan struct{}
+	OnPeerChangeRsp   chan struct{}
+	OnRollupChangeReq chan struct{}
+	OnRollupChangeRsp chan struct{}
+	OnStoreChangeReq  chan struct{}
+	OnStoreChangeRsp  chan struct{}
+	OnReload1         chan struct{}
+	OnReload2         chan struct{}
+	OnExit            chan struct{}
 
 	// Channels for communicating between modules.
 	Channels struct {
@@ -101,15 +172,20 @@ type Globals struct {
 		IndexStoreChanLen    int
 		IndexRequest         chan IndexQuery
 		IndexRequestChanLen  int
+		OverrideRequest      chan OverrideQuery
+		BackfillRequest      chan BackfillQuery
+		EventRequest         chan EventQuery
 	}
 
 	// Logger configuration and runtime properties.
 	Log struct {
-		Logdir   string // Log Directory
-		Loglevel string // Level to log at.
-		System   *logging.FileLogger
-		Carbon   *logging.FileLogger
-		API      *logging.FileLogger
+		Logdir     string // Log Directory
+		Loglevel   string // Level to log at.
+		MaxSize    int64  // Size in bytes at which a log file is rotated; 0 never rotates
+		MaxBackups int    // Number of rotated log files kept
+		System     *logging.FileLogger
+		Carbon     *logging.FileLogger
+		API        *logging.FileLogger
 	}
 
 	// Statsd configuration.
@@ -135,17 +211,99 @@ type Globals struct {
 			DeleteIndex  time.Duration
 			GetMetric    time.Duration
 			DeleteMetric time.Duration
+			Backfill     time.Duration
+		}
+		Keys map[string]map[string]bool // Permissions and tenants by API key; with none, the API is open
+		TLS  struct {
+			CertFile       string // Server certificate; with its key, the API is served over HTTPS
+			KeyFile        string // Key of the server certificate
+			RedirectListen string // Address:port on which plain HTTP is redirected to HTTPS, if set
+		}
+		CORS struct {
+			AllowedOrigins map[string]bool // Origins of the pages that may query the API, or "*" for all
+			AllowedHeaders []string        // Request headers those pages may send
 		}
+		DebugListen string // Address:port on which pprof and expvar are served, if set
+		GRPCListen  string // Address:port on which the gRPC API is served over HTTP/2, if set
 	}
 
-	Cassandra CassandraSettings
+	// Configuration of the metric store.
+	MetricManager struct {
+		Shards            int           // Number of goroutines across which rollup accumulation is spread
+		Writers           int           // Number of goroutines writing batches to Cassandra
+		CleanupInterval   time.Duration // Time between removals of paths with no stored data; 0 disables
+		CleanupPartitions bool          // Whether cleanup also deletes the partitions of the paths it removes
+		QueryCacheTTL     time.Duration // Time for which query responses are cached; 0 disables
+		QueryCacheSize    int           // The most query responses that are cached
+		MaxQueries        int           // The most metric queries that may read from Cassandra at once
+		RawRetention      time.Duration // Time for which raw data points are also stored; 0 disables
+		RawTable          string        // The Cassandra table holding the raw data points, if stored
+		FlushSpread       time.Duration // Time over which the writes of windows closing together are spread; 0 disables
+		FlushParallelism  int           // Number of windows closing together whose rollups are written at once
+		StateFile         string        // File in which accumulation is saved on termination, and restored from on start
+		Engine            string        // Where metrics are stored: ENGINE_CASSANDRA or ENGINE_MEMORY
+	}
+
+	// Configuration of multi-tenancy.
+	Tenants struct {
+		Enabled bool // Whether the first node of each path names its tenant
+	}
+
+	// Configuration of the path index.
+	Index struct {
+		Backend         string        // Where the path index is kept: INDEX_ELASTICSEARCH or INDEX_CASSANDRA
+		Memory          bool          // Whether finds are answered from a copy of the index kept in memory
+		SnapshotFile    string        // File to which the copy in memory is saved, and loaded from on start
+		RefreshInterval time.Duration // Interval between refreshes of the copy in memory from the index
+		TTL             time.Duration // Age after which paths not indexed again are removed from the index; 0 disables
+		MaxResults      int           // The most paths a query may match; 0 is unlimited
+		LiteralNodes    int           // The number of leading nodes of a query in which wildcards are refused
+		KnownPaths      int           // The most paths remembered as indexed, so as not to index them again; 0 disables
+	}
 
 	ElasticSearch ElasticSearchSettings
+}
+
+// cassandra holds the *CassandraSettings in effect. They are replaced whole on SIGHUP, while the MetricManager
+// goes on using them, so are only read through Cassandra.
+var cassandra atomic.Value
+
+// Cassandra returns the Cassandra settings in effect, which must not be modified. Settings that must agree
+// with one another are taken from a single call.
+func Cassandra() *CassandraSettings {
+	if cs, ok := cassandra.Load().(*CassandraSettings); ok {
+		return cs
+	}
+	return new(CassandraSettings)
+}
+
+// SetCassandra puts Cassandra settings into effect.
+func SetCassandra(cs CassandraSettings) {
+	cassandra.Store(&cs)
+}
+
+// RollupSet is the configuration of data rollups.
+type RollupSet struct {
+	Priority []string             // First matched expression wins
+	Defs     map[string]RollupDef // Rollup processing definitions by path expression
+	Tables   []string             // The Cassandra table names derived from extant durations
+}
+
+// rollups holds the *RollupSet in effect. It is replaced whole on SIGHUP, while the API goes on reading it,
+// so is only read through Rollups.
+var rollups atomic.Value
+
+// Rollups returns the rollup definitions in effect, which must not be modified.
+func Rollups() *RollupSet {
+	if rs, ok := rollups.Load().(*RollupSet); ok {
+		return rs
+	}
+	return new(RollupSet)
+}
 
-	// Configuration of data rollups.
-	RollupPriority []string             // First matched expression wins
-	Rollup         map[string]RollupDef // Rollup processing definitions by path expression
-	RollupTables   []string             // The Cassandra table names derived from extant durations
+// SetRollups puts rollup definitions into effect.
+func SetRollups(rs RollupSet) {
+	rollups.Store(&rs)
 }
 
 func (g *Globals) OnPanic() {
@@ -0,0 +1,71 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// rollupFile is a file of rollup definitions included by the configuration file.
+type rollupFile struct {
+	name string // The file's path, as found
+	text []byte // The YAML text of the file
+}
+
+// rawRollupFiles are the rollup files included by the configuration file last read.
+var rawRollupFiles []rollupFile
+
+// includeRollups merges the rollup definitions of the files named by the configuration into its own, and
+// returns the files read. Each file holds definitions as the "rollups" section does, a map of path expressions
+// to their retentions and aggregation. A name may be a glob pattern, and unless absolute, is relative to dir,
+// the directory of the configuration file. A path expression may be defined only once across all the files.
+func includeRollups(cfg *CassabonConfig, dir string) ([]rollupFile, error) {
+
+	var files []rollupFile
+	if len(cfg.RollupFiles) == 0 {
+		return files, nil
+	}
+	if cfg.Rollups == nil {
+		cfg.Rollups = make(map[string]RollupSettings)
+	}
+	definedIn := make(map[string]string)
+	for expression := range cfg.Rollups {
+		definedIn[expression] = "the configuration file"
+	}
+
+	for _, pattern := range cfg.RollupFiles {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(dir, pattern)
+		}
+		names, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rollup file pattern %q: %s", pattern, err.Error())
+		}
+		if len(names) == 0 && !strings.ContainsAny(pattern, "*?[") {
+			// A name that isn't a pattern must name a file; reading it reports why it doesn't.
+			names = []string{pattern}
+		}
+		for _, name := range names {
+			text, err := ioutil.ReadFile(name)
+			if err != nil {
+				return nil, err
+			}
+			var settings map[string]RollupSettings
+			if err := yaml.Unmarshal(text, &settings); err != nil {
+				return nil, fmt.Errorf("%s: %s", name, err.Error())
+			}
+			for expression, v := range settings {
+				if where, found := definedIn[expression]; found {
+					return nil, fmt.Errorf("%s: rollup \"%s\" is already defined in %s", name, expression, where)
+				}
+				definedIn[expression] = name
+				cfg.Rollups[expression] = v
+			}
+			files = append(files, rollupFile{name, text})
+		}
+	}
+	return files, nil
+}
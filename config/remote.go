@@ -0,0 +1,315 @@
+package config
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The schemes of configurations kept in Consul and etcd, rather than in a file.
+const (
+	SOURCE_CONSUL = "consul"
+	SOURCE_ETCD   = "etcd"
+)
+
+// How long a Consul watch waits for a change before asking again, and the pause after a failed watch.
+const (
+	remoteWatchWait  = 5 * time.Minute
+	remoteRetryPause = 10 * time.Second
+)
+
+// configIndex is the index in Consul, or revision in etcd, at which the configuration last read was read.
+var configIndex uint64
+
+// ConfigurationIndex returns the index at which the configuration last read was read from Consul or etcd,
+// from which to watch it for changes, or 0 for a file.
+func ConfigurationIndex() uint64 {
+	return configIndex
+}
+
+// remoteSource is a configuration kept under a key in Consul or etcd, named like "consul://127.0.0.1:8500/cassabon/config"
+// or "etcd://127.0.0.1:2379/cassabon/config". Consul is read through its HTTP API, and etcd through the JSON gateway of
+// its v3 API. A Consul ACL token is taken from CONSUL_HTTP_TOKEN, as the consul command takes it, and etcd is
+// reached over TLS when ETCDCTL_CACERT, or ETCDCTL_CERT and ETCDCTL_KEY, name certificates, as etcdctl takes them.
+type remoteSource struct {
+	scheme string // SOURCE_CONSUL or SOURCE_ETCD
+	addr   string // The host:port of the agent or server
+	key    string // The key holding the YAML, without a leading slash
+}
+
+// parseRemoteSource returns the remote source a configuration name gives, or false if it names a file.
+func parseRemoteSource(name string) (remoteSource, bool) {
+	for _, scheme := range []string{SOURCE_CONSUL, SOURCE_ETCD} {
+		if strings.HasPrefix(name, scheme+"://") {
+			rest := strings.TrimPrefix(name, scheme+"://")
+			addr, key := rest, ""
+			if i := strings.Index(rest, "/"); i >= 0 {
+				addr, key = rest[:i], strings.Trim(rest[i+1:], "/")
+			}
+			return remoteSource{scheme, addr, key}, true
+		}
+	}
+	return remoteSource{}, false
+}
+
+// readConfigurationText returns the YAML text of the configuration, from a file or a remote source, and for
+// a remote source, the index at which it was read; or none if no name is given.
+func readConfigurationText(name string) ([]byte, uint64, error) {
+	if name == "" {
+		return []byte{}, 0, nil
+	}
+	rs, remote := parseRemoteSource(name)
+	if !remote {
+		text, err := ioutil.ReadFile(name)
+		return text, 0, err
+	}
+	client, err := rs.client(10 * time.Second)
+	if err != nil {
+		return nil, 0, err
+	}
+	return rs.read(context.Background(), client, 0)
+}
+
+// client returns an HTTP client for the source, with a timeout unless it is 0.
+func (rs remoteSource) client(timeout time.Duration) (*http.Client, error) {
+	client := &http.Client{Timeout: timeout}
+	if rs.scheme != SOURCE_ETCD {
+		return client, nil
+	}
+	tlsConfig, err := etcdTLS()
+	if err != nil || tlsConfig == nil {
+		return client, err
+	}
+	client.Transport = &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: tlsConfig}
+	return client, nil
+}
+
+// url returns the URL of a path on the source's agent or server.
+func (rs remoteSource) url(path string) string {
+	if rs.scheme == SOURCE_ETCD && (os.Getenv("ETCDCTL_CACERT") != "" || os.Getenv("ETCDCTL_CERT") != "") {
+		return "https://" + rs.addr + path
+	}
+	return "http://" + rs.addr + path
+}
+
+// etcdTLS returns the TLS configuration for etcd that ETCDCTL_CACERT, ETCDCTL_CERT and ETCDCTL_KEY give, or
+// nil if they are unset.
+func etcdTLS() (*tls.Config, error) {
+	caFile, certFile, keyFile := os.Getenv("ETCDCTL_CACERT"), os.Getenv("ETCDCTL_CERT"), os.Getenv("ETCDCTL_KEY")
+	if caFile == "" && certFile == "" {
+		return nil, nil
+	}
+	tlsConfig := new(tls.Config)
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// read returns the value of the key, and the index at which it was read: for Consul, the index at which it was
+// last changed, and for etcd, the revision of the store. For Consul, a non-zero index makes the read wait until
+// the key changes after that index, or the watch wait passes.
+func (rs remoteSource) read(ctx context.Context, client *http.Client, index uint64) ([]byte, uint64, error) {
+	if rs.key == "" {
+		return nil, 0, fmt.Errorf("no key given for the configuration in %s", rs.scheme)
+	}
+	if rs.scheme == SOURCE_ETCD {
+		return rs.readEtcd(ctx, client)
+	}
+
+	url := rs.url("/v1/kv/" + rs.key + "?raw")
+	if index > 0 {
+		url += fmt.Sprintf("&index=%d&wait=%ds", index, int(remoteWatchWait/time.Second))
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if token := os.Getenv("CONSUL_HTTP_TOKEN"); token != "" {
+		req.Header.Set("X-Consul-Token", token)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, 0, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("reading %s from Consul at %s: %s", rs.key, rs.addr, resp.Status)
+	}
+	modified, _ := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	return body, modified, nil
+}
+
+// postEtcd makes a request of etcd's JSON gateway.
+func (rs remoteSource) postEtcd(ctx context.Context, client *http.Client, path string, body interface{}) (*http.Response, error) {
+	reqBody, _ := json.Marshal(body)
+	req, err := http.NewRequestWithContext(ctx, "POST", rs.url(path), bytes.NewReader(reqBody))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return client.Do(req)
+}
+
+// etcdRangeResponse is the part of the response to an etcd range request that is used.
+type etcdRangeResponse struct {
+	Header struct {
+		Revision string `json:"revision"` // int64 values are strings in the JSON
+	} `json:"header"`
+	Kvs []struct {
+		Value []byte `json:"value"` // Base64 in the JSON, which the decoder undoes
+	} `json:"kvs"`
+}
+
+// readEtcd returns the value of the key in etcd, and the revision of the store when it was read. Watching
+// from the next revision sees every later change, whereas the key's own revision may have been compacted.
+func (rs remoteSource) readEtcd(ctx context.Context, client *http.Client) ([]byte, uint64, error) {
+	resp, err := rs.postEtcd(ctx, client, "/v3/kv/range", map[string]string{"key": base64.StdEncoding.EncodeToString([]byte(rs.key))})
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("reading %s from etcd at %s: %s", rs.key, rs.addr, resp.Status)
+	}
+	var r etcdRangeResponse
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return nil, 0, fmt.Errorf("reading %s from etcd at %s: %s", rs.key, rs.addr, err.Error())
+	}
+	if len(r.Kvs) == 0 {
+		return nil, 0, fmt.Errorf("no key %s in etcd at %s", rs.key, rs.addr)
+	}
+	revision, _ := strconv.ParseUint(r.Header.Revision, 10, 64)
+	return r.Kvs[0].Value, revision, nil
+}
+
+// watchEtcd waits for the key in etcd to change after a revision, and returns the revision of the change.
+func (rs remoteSource) watchEtcd(ctx context.Context, client *http.Client, revision uint64) (uint64, error) {
+	resp, err := rs.postEtcd(ctx, client, "/v3/watch", map[string]map[string]string{"create_request": {
+		"key":            base64.StdEncoding.EncodeToString([]byte(rs.key)),
+		"start_revision": strconv.FormatUint(revision+1, 10),
+	}})
+	if err != nil {
+		return revision, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return revision, fmt.Errorf("watching %s in etcd at %s: %s", rs.key, rs.addr, resp.Status)
+	}
+
+	// The watch streams a message as it is created, then one for each batch of changes.
+	decoder := json.NewDecoder(bufio.NewReader(resp.Body))
+	for {
+		var msg struct {
+			Result struct {
+				Header struct {
+					Revision string `json:"revision"`
+				} `json:"header"`
+				Events       []json.RawMessage `json:"events"`
+				Canceled     bool              `json:"canceled"`
+				CancelReason string            `json:"cancel_reason"`
+			} `json:"result"`
+		}
+		if err := decoder.Decode(&msg); err != nil {
+			return revision, fmt.Errorf("watching %s in etcd at %s: %s", rs.key, rs.addr, err.Error())
+		}
+		if msg.Result.Canceled {
+			return revision, fmt.Errorf("watch of %s in etcd at %s canceled: %s", rs.key, rs.addr, msg.Result.CancelReason)
+		}
+		if len(msg.Result.Events) > 0 {
+			changed, _ := strconv.ParseUint(msg.Result.Header.Revision, 10, 64)
+			return changed, nil
+		}
+	}
+}
+
+// WatchConfiguration watches a configuration kept in Consul or etcd, and calls changed each time it is modified
+// after the index at which it was read, until stop is closed. A configuration file isn't watched, so it returns
+// at once.
+func WatchConfiguration(name string, index uint64, changed func(), stop <-chan struct{}) {
+
+	rs, remote := parseRemoteSource(name)
+	if !remote {
+		return
+	}
+	// Watches wait for changes, so they run without the usual timeout of a request, until stopped.
+	var timeout time.Duration
+	if rs.scheme == SOURCE_CONSUL {
+		timeout = remoteWatchWait + time.Minute
+	}
+	client, err := rs.client(timeout)
+	if err != nil {
+		G.Log.System.LogError("Unable to watch configuration %s: %s", name, err.Error())
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	for {
+		var next uint64
+		var err error
+		if index == 0 || rs.scheme == SOURCE_CONSUL {
+			_, next, err = rs.read(ctx, client, index)
+		} else {
+			next, err = rs.watchEtcd(ctx, client, index)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if err == nil && next == 0 {
+			err = fmt.Errorf("no index of the change in the response")
+		}
+		if err != nil {
+			G.Log.System.LogWarn("Unable to watch configuration %s: %s", name, err.Error())
+			select {
+			case <-stop:
+				return
+			case <-time.After(remoteRetryPause):
+			}
+			continue
+		}
+
+		// Without an index to begin from, the first read only finds one; Consul also returns when its wait passes.
+		if index != 0 && next != index {
+			G.Log.System.LogInfo("Configuration %s changed", name)
+			changed()
+		}
+		index = next
+	}
+}
@@ -0,0 +1,40 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Tenant names are restricted, so they can be embedded in paths and index queries without escaping.
+var reTenant = regexp.MustCompile("^[A-Za-z0-9_-]+$")
+
+// ValidateTenant reports whether the supplied tenant name may be used.
+func ValidateTenant(tenant string) error {
+	if !reTenant.MatchString(tenant) {
+		return fmt.Errorf("invalid tenant %q: only letters, digits, '_' and '-' are permitted", tenant)
+	}
+	return nil
+}
+
+// SplitTenant separates a stored path into its tenant and the path as seen by that tenant.
+func SplitTenant(path string) (tenant, tenantPath string, err error) {
+	parts := strings.SplitN(path, ".", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		err = fmt.Errorf("path %q has no tenant", path)
+		return
+	}
+	if err = ValidateTenant(parts[0]); err != nil {
+		return
+	}
+	return parts[0], parts[1], nil
+}
+
+// TenantPath returns the stored path for a path as seen by a tenant.
+// If tenancy is disabled, the tenant is empty, and the path is returned unchanged.
+func TenantPath(tenant, path string) string {
+	if tenant == "" {
+		return path
+	}
+	return tenant + "." + path
+}
@@ -0,0 +1,218 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// rawConfigText is the YAML text of the configuration file last read.
+var rawConfigText []byte
+
+// ValidateConfiguration checks the configuration last read, and returns every problem found in it, each
+// prefixed by the path of the setting concerned, such as "cassandra.hosts". It reports keys that aren't
+// settings, required settings left unset, settings with values that aren't among those accepted, and rollup
+// definitions that would be rejected.
+func ValidateConfiguration() []string {
+	if rawCassabonConfig == nil {
+		return []string{"no configuration has been read"}
+	}
+	return validateConfiguration(rawConfigText, rawRollupFiles, rawCassabonConfig)
+}
+
+// validateConfiguration returns the problems in a configuration, given its YAML text, the rollup files it
+// includes, and the settings decoded from them.
+func validateConfiguration(yamlText []byte, files []rollupFile, cfg *CassabonConfig) []string {
+	var problems []string
+	problem := func(path, format string, a ...interface{}) {
+		problems = append(problems, path+": "+fmt.Sprintf(format, a...))
+	}
+
+	// Keys that aren't settings, which are otherwise silently ignored.
+	var tree interface{}
+	if err := yaml.Unmarshal(yamlText, &tree); err != nil {
+		problem("(file)", "%s", err.Error())
+	} else {
+		problems = append(problems, unknownKeys(tree, reflect.TypeOf(*cfg), "")...)
+	}
+	for _, f := range files {
+		tree = nil
+		if err := yaml.Unmarshal(f.text, &tree); err == nil {
+			for _, s := range unknownKeys(tree, reflect.TypeOf(cfg.Rollups), "rollups") {
+				problems = append(problems, f.name+": "+s)
+			}
+		}
+	}
+
+	// Carbon and the API.
+	if cfg.Carbon.Listen == "" {
+		problem("carbon.listen", "required, as the ip:port on which to listen for Carbon stats")
+	} else if _, _, err := net.SplitHostPort(cfg.Carbon.Listen); err != nil {
+		problem("carbon.listen", "%s", err.Error())
+	}
+	switch cfg.Carbon.Protocol {
+	case "", "tcp", "udp", "both":
+	default:
+		problem("carbon.protocol", "must be \"tcp\", \"udp\" or \"both\", not %q", cfg.Carbon.Protocol)
+	}
+	if len(cfg.Carbon.Peers) == 0 {
+		problem("carbon.peers", "required, listing every server in the array, including this one")
+	}
+	for _, name := range sortedKeys(cfg.Carbon.Peers) {
+		if _, err := net.ResolveTCPAddr("tcp4", cfg.Carbon.Peers[name]); err != nil {
+			problem("carbon.peers."+name, "invalid host:port %q: %s", cfg.Carbon.Peers[name], err.Error())
+		}
+	}
+	if cfg.API.Listen == "" {
+		problem("api.listen", "required, as the address:port on which the HTTP API listens")
+	}
+	for _, key := range sortedKeys(cfg.API.Keys) {
+		for _, perm := range cfg.API.Keys[key] {
+			switch perm {
+			case "read", "write", "delete", "admin":
+			default:
+				problem("api.keys."+key, "unknown permission %q", perm)
+			}
+		}
+	}
+
+	// Storage and the index.
+	engine := strings.ToLower(cfg.MetricManager.Engine)
+	switch engine {
+	case "", ENGINE_CASSANDRA, ENGINE_MEMORY:
+	default:
+		problem("metricmanager.engine", "must be %q or %q, not %q", ENGINE_CASSANDRA, ENGINE_MEMORY, cfg.MetricManager.Engine)
+	}
+	backend := strings.ToLower(cfg.Index.Backend)
+	switch backend {
+	case "", INDEX_ELASTICSEARCH, INDEX_CASSANDRA:
+	default:
+		problem("index.backend", "must be %q or %q, not %q", INDEX_ELASTICSEARCH, INDEX_CASSANDRA, cfg.Index.Backend)
+	}
+	if backend != INDEX_CASSANDRA && cfg.ElasticSearch.BaseURL == "" {
+		problem("elasticsearch.baseurl", "required when the index is kept in ElasticSearch")
+	}
+	if len(cfg.Cassandra.Hosts) == 0 && (engine != ENGINE_MEMORY || backend == INDEX_CASSANDRA) {
+		problem("cassandra.hosts", "required, listing at least one host of the Cassandra ring")
+	}
+	switch strings.ToLower(cfg.Cassandra.Schema) {
+	case "", SCHEMA_LEGACY, SCHEMA_MODERN:
+	default:
+		problem("cassandra.schema", "must be %q or %q, not %q", SCHEMA_LEGACY, SCHEMA_MODERN, cfg.Cassandra.Schema)
+	}
+	switch strings.ToLower(cfg.Cassandra.Compression) {
+	case "", "snappy":
+	default:
+		problem("cassandra.compression", "must be \"snappy\" or empty, not %q", cfg.Cassandra.Compression)
+	}
+	if cfg.Cassandra.ProtoVersion < 0 || cfg.Cassandra.ProtoVersion > 4 {
+		problem("cassandra.protoversion", "must be from 1 to 4, or 0 for the driver's, not %d", cfg.Cassandra.ProtoVersion)
+	}
+	if _, err := cfg.Cassandra.KeyspaceReplication(); err != nil {
+		problem("cassandra.replication", "%s", err.Error())
+	}
+
+	// Rollups, and the options of the tables they use.
+	var rollupProblems []string
+	_, _, tables, _ := ParseRollups(cfg.Rollups, func(format string, a ...interface{}) {
+		rollupProblems = append(rollupProblems, fmt.Sprintf(format, a...))
+	})
+	for _, s := range rollupProblems {
+		// A missing default is supplied, and a rejected one is reported already.
+		if !strings.HasPrefix(s, "Default rollup missing") {
+			problem("rollups", "%s", s)
+		}
+	}
+	for _, table := range sortedKeys(cfg.Cassandra.Tables) {
+		if table == ROLLUP_CATCHALL {
+			continue
+		}
+		used := false
+		for _, v := range tables {
+			if v == table {
+				used = true
+				break
+			}
+		}
+		if !used {
+			problem("cassandra.tables."+table, "no rollup retention is stored in this table")
+		}
+	}
+
+	return problems
+}
+
+// unknownKeys returns a problem for each key of a decoded YAML tree that isn't a setting of the type it is
+// decoded into, as yaml.v2 names settings: the name of the field, lowercased.
+func unknownKeys(node interface{}, t reflect.Type, path string) []string {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	var problems []string
+	switch t.Kind() {
+	case reflect.Struct:
+		m, ok := node.(map[interface{}]interface{})
+		if !ok {
+			return nil
+		}
+		fields := make(map[string]reflect.Type)
+		for i := 0; i < t.NumField(); i++ {
+			if f := t.Field(i); f.PkgPath == "" {
+				fields[strings.ToLower(f.Name)] = f.Type
+			}
+		}
+		for _, key := range sortedNodeKeys(m) {
+			if ft, found := fields[key]; found {
+				problems = append(problems, unknownKeys(m[key], ft, joinPath(path, key))...)
+			} else {
+				problems = append(problems, joinPath(path, key)+": unknown setting")
+			}
+		}
+	case reflect.Map:
+		if m, ok := node.(map[interface{}]interface{}); ok {
+			for _, key := range sortedNodeKeys(m) {
+				problems = append(problems, unknownKeys(m[key], t.Elem(), joinPath(path, key))...)
+			}
+		}
+	case reflect.Slice:
+		if list, ok := node.([]interface{}); ok {
+			for i, v := range list {
+				problems = append(problems, unknownKeys(v, t.Elem(), fmt.Sprintf("%s[%d]", path, i))...)
+			}
+		}
+	}
+	return problems
+}
+
+// joinPath appends a key to the path of a setting.
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// sortedNodeKeys returns the keys of a decoded YAML mapping as strings, in order.
+func sortedNodeKeys(m map[interface{}]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, fmt.Sprint(k))
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// sortedKeys returns the keys of a map with string keys, in order.
+func sortedKeys(m interface{}) []string {
+	v := reflect.ValueOf(m)
+	keys := make([]string, 0, v.Len())
+	for _, k := range v.MapKeys() {
+		keys = append(keys, k.String())
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,187 @@
+package datastore
+
+import (
+	"sort"
+	"time"
+
+	"github.com/jeffpierce/cassabon/config"
+)
+
+// backfillBucket is the rollup of the historical data points that fall in one window of a path.
+type backfillBucket struct {
+	method config.RollupMethod
+	value  float64
+	count  uint64
+	agg    aggregate
+}
+
+// stat returns the value of the bucket as it is written to the database.
+func (b *backfillBucket) stat() float64 {
+	if b.method == config.AVERAGE {
+		return b.value / float64(b.count)
+	}
+	return b.value
+}
+
+// backfillTable holds the buckets to be written to one rollup table, by path and window end time.
+type backfillTable struct {
+	retention time.Duration
+	paths     map[string]map[int64]*backfillBucket
+}
+
+// backfillResponse reports the outcome of a backfill.
+type backfillResponse struct {
+	Metrics int `json:"metrics"` // The number of data points received
+	Rows    int `json:"rows"`    // The number of rows written, across all rollup tables
+	Skipped int `json:"skipped"` // Rows not written, because the window is still open or has expired
+}
+
+// byTimestamp sorts metrics into time order.
+type byTimestamp []config.CarbonMetric
+
+// Implementation of sort.Interface.
+func (m byTimestamp) Len() int {
+	return len(m)
+}
+func (m byTimestamp) Swap(i, j int) {
+	m[i], m[j] = m[j], m[i]
+}
+func (m byTimestamp) Less(i, j int) bool {
+	return m[i].Timestamp < m[j].Timestamp
+}
+
+// backfillTables holds the buckets to be written, by table.
+type backfillTables map[string]*backfillTable
+
+// add rolls up a path's data points, in time order, into one of the windows of its expression.
+func (tables backfillTables) add(path string, method config.RollupMethod, w config.RollupWindow, points []config.CarbonMetric) {
+	tbl, found := tables[w.Table]
+	if !found {
+		tbl = &backfillTable{w.Retention, make(map[string]map[int64]*backfillBucket)}
+		tables[w.Table] = tbl
+	}
+	buckets, found := tbl.paths[path]
+	if !found {
+		buckets = make(map[int64]*backfillBucket)
+		tbl.paths[path] = buckets
+	}
+	var previous float64
+	for i, m := range points {
+
+		// Counters record the increase since the previous value; the first only sets the baseline.
+		value := m.Value
+		if method == config.COUNTER {
+			value, previous = counterDelta(previous, m.Value), m.Value
+			if i == 0 {
+				continue
+			}
+		}
+
+		ts := time.Unix(0, int64(m.Timestamp*float64(time.Second)))
+		end := nextTimeBoundary(ts, w.Window).Unix()
+		b, found := buckets[end]
+		if !found {
+			b = &backfillBucket{method: method}
+			buckets[end] = b
+		}
+		b.value = applyMethod(method, b.value, value, b.count)
+		b.agg.add(value, b.count)
+		b.count++
+	}
+}
+
+// put sets the bucket of a path written to a table with the supplied window end time.
+func (tables backfillTables) put(path, table string, end int64, b *backfillBucket) {
+	tbl, found := tables[table]
+	if !found {
+		tbl = &backfillTable{tableRetention(table), make(map[string]map[int64]*backfillBucket)}
+		tables[table] = tbl
+	}
+	if tbl.paths[path] == nil {
+		tbl.paths[path] = make(map[int64]*backfillBucket)
+	}
+	tbl.paths[path][end] = b
+}
+
+// rollupBackfill rolls up historical data points into the windows of the expressions their paths match,
+// as accumulation would have done had they arrived in real time.
+func rollupBackfill(rules *rollupRules, metrics []config.CarbonMetric) backfillTables {
+
+	// Group the points by path, in time order, so that counters can be converted to deltas.
+	byPath := make(map[string][]config.CarbonMetric)
+	for _, m := range metrics {
+		byPath[m.Path] = append(byPath[m.Path], m)
+	}
+
+	tables := make(backfillTables)
+	for path, points := range byPath {
+		sort.Stable(byTimestamp(points))
+		def := rules.defs[rules.getExpression(path)]
+		for _, w := range def.Windows {
+			tables.add(path, def.Method, w, points)
+		}
+	}
+	return tables
+}
+
+// writeBackfill writes the rolled-up buckets through the writers, and returns how many rows were
+// written, and how many were skipped because their window is still open or has expired. While the
+// writers are backlogged, it waits for them, unless abort is closed.
+func (mm *MetricManager) writeBackfill(tables backfillTables, abort <-chan struct{}) (rows, skipped int) {
+
+	cs := config.Cassandra()
+	bw := batchWriter{}
+	bw.Init(mm.currentRules().stmts, mm.throttle.batchSize(cs.BatchSize), cs.Aggregates, mm.insert)
+	bw.abort = abort
+
+	now := time.Now()
+	for table, tbl := range tables {
+		bw.Prepare(table, tbl.retention)
+		for path, buckets := range tbl.paths {
+			for end, b := range buckets {
+				ts := time.Unix(end, 0)
+				if !ts.Before(now) || rowTTL(tbl.retention, now.Sub(ts)) < 1 {
+					skipped++
+					continue
+				}
+				if bw.aggregates {
+					bw.AppendAggregate(path, ts, b.stat(), b.agg, b.count)
+				} else {
+					bw.Append(path, ts, b.stat())
+				}
+				rows++
+			}
+		}
+		if bw.Size() > 0 {
+			bw.Write()
+		}
+	}
+	if rows > 0 {
+		mm.dataChanged()
+	}
+	return
+}
+
+// backfill writes historical data points directly into the rollup tables, bypassing accumulation.
+// Each row is computed from the supplied points alone, so it replaces any row already written for
+// its window. Windows that are still open are left to accumulation, and expired ones are dropped.
+func (mm *MetricManager) backfill(q config.BackfillQuery) {
+
+	config.G.Log.System.LogDebug("MetricManager::backfill %d metrics", len(q.Metrics))
+
+	resp := backfillResponse{Metrics: len(q.Metrics)}
+	resp.Rows, resp.Skipped = mm.writeBackfill(rollupBackfill(mm.currentRules(), q.Metrics), nil)
+
+	// Make the paths visible to queries, as accumulation does for a new path.
+	indexed := make(map[string]struct{})
+	for _, m := range q.Metrics {
+		if _, found := indexed[m.Path]; !found {
+			indexed[m.Path] = struct{}{}
+			config.G.Channels.IndexStore <- config.CarbonMetric{Path: m.Path}
+		}
+	}
+	config.G.Log.System.LogInfo("Backfilled %d metrics into %d rows, %d skipped", resp.Metrics, resp.Rows, resp.Skipped)
+
+	// Send the response payload.
+	mm.sendResponse(q.Channel, resp)
+}
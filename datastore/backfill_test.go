@@ -0,0 +1,43 @@
+package datastore
+
+import (
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/jeffpierce/cassabon/config"
+)
+
+func TestRollupBackfill(t *testing.T) {
+	windows := []config.RollupWindow{{time.Minute, time.Hour, "rollup_3600"}}
+	rules := &rollupRules{
+		priority: []string{"^net.*", config.ROLLUP_CATCHALL},
+		defs: map[string]config.RollupDef{
+			"^net.*":               {config.COUNTER, regexp.MustCompile("^net.*"), windows},
+			config.ROLLUP_CATCHALL: {config.AVERAGE, nil, windows},
+		},
+		exact: map[string]string{},
+		stmts: newStatementSet("cassabon", nil),
+	}
+
+	// Supplied out of order, to show that counters are taken in time order.
+	tables := rollupBackfill(rules, []config.CarbonMetric{
+		{"cpu", 4, 70},
+		{"cpu", 2, 65},
+		{"cpu", 9, 130},
+		{"net.rx", 150, 70},
+		{"net.rx", 100, 61},
+		{"net.rx", 175, 110},
+	})
+	buckets := tables["rollup_3600"].paths
+
+	if b := buckets["cpu"][120]; b == nil || b.stat() != 3 || b.count != 2 || b.agg.max != 4 {
+		t.Errorf("Expected the average of two points in the window ending at 120, got %+v", b)
+	}
+	if b := buckets["cpu"][180]; b == nil || b.stat() != 9 {
+		t.Errorf("Expected one point in the window ending at 180, got %+v", b)
+	}
+	if b := buckets["net.rx"][120]; b == nil || b.stat() != 75 || b.count != 2 {
+		t.Errorf("Expected the increase after the baseline in the window ending at 120, got %+v", b)
+	}
+}
@@ -1,28 +1,64 @@
 package datastore
 
 import (
-	"fmt"
+	"sync"
 	"time"
 
 	"github.com/gocql/gocql"
 )
 
+// partitionWrite holds the values for all rows being written to a single partition.
+type partitionWrite struct {
+	path string          // The partition key
+	rows [][]interface{} // The bound values (path, time, stat, [min, max, sum, count,] ttl) for each INSERT
+}
+
+// tableWrite is the unit of work handed to the writers: up to batchSize rows for one table.
+// Each partition is written separately, since multi-partition batches overload the coordinator, but several
+// are written at once, so that a batch isn't as many round trips in turn.
+type tableWrite struct {
+	table      string            // The name of the table
+	stmt       string            // The INSERT statement for the table
+	partitions []*partitionWrite // The rows to be written, grouped by partition
+	size       int               // The total number of rows across all partitions
+}
+
 type batchWriter struct {
-	dbClient  *gocql.Session
-	keyspace  string
-	batchSize int
-	insert    chan *gocql.Batch
+	stmts      *statementSet
+	batchSize  int
+	aggregates bool
+	abort      <-chan struct{} // Closed to stop Write waiting for backlogged writers; nil waits indefinitely
+	hold       bool            // Whether Write holds batches back in held, rather than sending them to the writers
+	held       []*tableWrite
+	insert     chan *tableWrite
 
-	batch     *gocql.Batch
+	write     *tableWrite
+	partition map[string]*partitionWrite
 	stmtCount int
+	table     string
 	stmt      string
+	retention time.Duration
+}
+
+// The largest TTL that Cassandra accepts, in seconds (20 years).
+const maxTTL = 630720000
+
+// rowTTL returns the time to live, in seconds, of a row of the supplied age, so that it expires
+// when its retention period has passed, with the same margin as the table's default_time_to_live.
+// A result less than 1 means that the row has already expired.
+func rowTTL(retention, age time.Duration) int {
+	ttl := int(retention.Seconds()*1.1 - age.Seconds())
+	if ttl > maxTTL {
+		ttl = maxTTL
+	}
+	return ttl
 }
 
 // Init
-func (bw *batchWriter) Init(dbClient *gocql.Session, keyspace string, batchSize int, insert chan *gocql.Batch) {
-	bw.dbClient = dbClient
-	bw.keyspace = keyspace
+func (bw *batchWriter) Init(stmts *statementSet, batchSize int, aggregates bool, insert chan *tableWrite) {
+	bw.stmts = stmts
 	bw.batchSize = batchSize
+	bw.aggregates = aggregates
 	bw.insert = insert
 }
 
@@ -32,19 +68,48 @@ func (bw *batchWriter) Size() int {
 }
 
 // Prepare
-func (bw *batchWriter) Prepare(table string) {
-	bw.batch = nil
+func (bw *batchWriter) Prepare(table string, retention time.Duration) {
+	bw.write = nil
+	bw.partition = nil
 	bw.stmtCount = 0
-	bw.stmt = fmt.Sprintf(
-		`INSERT INTO %s.%s (path, time, stat) VALUES (?, ?, ?)`, bw.keyspace, table)
+	bw.table = table
+	bw.stmt = bw.stmts.get(table).insertRow(bw.aggregates)
+	bw.retention = retention
+}
+
+// ttl returns the time to live of a row with the supplied timestamp, so that it expires with its retention.
+func (bw *batchWriter) ttl(ts time.Time) int {
+	age := time.Since(ts)
+	if age < 0 {
+		age = 0
+	}
+	return rowTTL(bw.retention, age)
 }
 
 // Append
 func (bw *batchWriter) Append(path string, ts time.Time, value float64) {
-	if bw.batch == nil {
-		bw.batch = gocql.NewBatch(gocql.UnloggedBatch)
+	bw.appendRow(path, []interface{}{path, ts, value, bw.ttl(ts)})
+}
+
+// AppendAggregate
+func (bw *batchWriter) AppendAggregate(path string, ts time.Time, value float64, agg aggregate, count uint64) {
+	bw.appendRow(path, []interface{}{path, ts, value, agg.min, agg.max, agg.sum, int64(count), bw.ttl(ts)})
+}
+
+// appendRow adds the bound values for one INSERT, and writes the batch when it is full.
+func (bw *batchWriter) appendRow(path string, row []interface{}) {
+	if bw.write == nil {
+		bw.write = &tableWrite{table: bw.table, stmt: bw.stmt}
+		bw.partition = make(map[string]*partitionWrite)
+	}
+	pw, found := bw.partition[path]
+	if !found {
+		pw = &partitionWrite{path: path}
+		bw.partition[path] = pw
+		bw.write.partitions = append(bw.write.partitions, pw)
 	}
-	bw.batch.Query(bw.stmt, path, ts, value)
+	pw.rows = append(pw.rows, row)
+	bw.write.size++
 	bw.stmtCount++
 	if bw.stmtCount >= bw.batchSize {
 		bw.Write()
@@ -53,16 +118,66 @@ func (bw *batchWriter) Append(path string, ts time.Time, value float64) {
 
 // Write
 func (bw *batchWriter) Write() {
-	if bw.stmtCount > 0 && bw.batch != nil {
-		batch := bw.batch
+	if bw.stmtCount > 0 && bw.write != nil {
+		write := bw.write
 		bw.stmtCount = 0
-		bw.batch = nil
-		select {
-		case bw.insert <- batch:
-			// Sent.
-		default:
-			// Don't block.
-			// Shouldn't happen, but just in case, don't hang on termination.
+		bw.write = nil
+		bw.partition = nil
+		if bw.hold {
+			bw.held = append(bw.held, write)
+			return
+		}
+		submit(bw.insert, write, bw.abort)
+	}
+}
+
+// The most partitions of a tableWrite written at once.
+const maxPartitionWrites = 32
+
+// execute writes every partition in a tableWrite, and returns those that failed.
+func (tw *tableWrite) execute(dbClient *gocql.Session) ([]*partitionWrite, error) {
+	return tw.executeEach(maxPartitionWrites, func(pw *partitionWrite) error {
+		if len(pw.rows) == 1 {
+			// A single row needs no batch.
+			return dbClient.Query(tw.stmt, pw.rows[0]...).Exec()
+		}
+		// All rows share a partition key, so an unlogged batch is applied atomically.
+		batch := gocql.NewBatch(gocql.UnloggedBatch)
+		for _, row := range pw.rows {
+			batch.Query(tw.stmt, row...)
+		}
+		return dbClient.ExecuteBatch(batch)
+	})
+}
+
+// executeEach writes the partitions concurrently, up to limit at a time, since each is a round trip of its
+// own, and returns those that failed, in order, with the error of the last of them.
+func (tw *tableWrite) executeEach(limit int, exec func(pw *partitionWrite) error) ([]*partitionWrite, error) {
+	errs := make([]error, len(tw.partitions))
+	if len(tw.partitions) == 1 {
+		errs[0] = exec(tw.partitions[0])
+	} else {
+		var wg sync.WaitGroup
+		slots := make(chan struct{}, limit)
+		for i, pw := range tw.partitions {
+			slots <- struct{}{}
+			wg.Add(1)
+			go func(i int, pw *partitionWrite) {
+				defer wg.Done()
+				errs[i] = exec(pw)
+				<-slots
+			}(i, pw)
+		}
+		wg.Wait()
+	}
+
+	var failed []*partitionWrite
+	var lastErr error
+	for i, err := range errs {
+		if err != nil {
+			failed = append(failed, tw.partitions[i])
+			lastErr = err
 		}
 	}
+	return failed, lastErr
 }
@@ -0,0 +1,81 @@
+package datastore
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRowTTL(t *testing.T) {
+	if ttl := rowTTL(time.Hour, 0); ttl != 3960 {
+		t.Errorf("Expected a margin of 10%% over an hour, got %d", ttl)
+	}
+	if ttl := rowTTL(time.Hour, 30*time.Minute); ttl != 2160 {
+		t.Errorf("Expected the age to be deducted, got %d", ttl)
+	}
+	if ttl := rowTTL(time.Hour, 2*time.Hour); ttl >= 1 {
+		t.Errorf("Expected an expired row, got %d", ttl)
+	}
+	if ttl := rowTTL(100*365*24*time.Hour, 0); ttl != maxTTL {
+		t.Errorf("Expected a century to be capped at %d, got %d", maxTTL, ttl)
+	}
+	if retention := tableRetention("rollup_000003600"); retention != time.Hour {
+		t.Errorf("Expected an hour, got %v", retention)
+	}
+}
+
+func TestExecuteEach(t *testing.T) {
+	tw := &tableWrite{table: "rollup_3600"}
+	for _, path := range []string{"a", "b", "c", "d", "e", "f", "g", "h"} {
+		tw.partitions = append(tw.partitions, &partitionWrite{path: path})
+	}
+
+	// The partitions are written at once, up to the limit, and those that fail are returned in order.
+	var m sync.Mutex
+	var running, most int
+	start := time.Now()
+	failed, err := tw.executeEach(4, func(pw *partitionWrite) error {
+		m.Lock()
+		running++
+		if running > most {
+			most = running
+		}
+		m.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		m.Lock()
+		running--
+		m.Unlock()
+		if pw.path == "b" || pw.path == "g" {
+			return fmt.Errorf("%s timed out", pw.path)
+		}
+		return nil
+	})
+	if most < 2 || most > 4 {
+		t.Errorf("Expected from 2 to 4 partitions written at once, got %d", most)
+	}
+	if elapsed := time.Since(start); elapsed >= 8*20*time.Millisecond {
+		t.Errorf("Expected the partitions to overlap, took %v", elapsed)
+	}
+	if len(failed) != 2 || failed[0].path != "b" || failed[1].path != "g" || err == nil || err.Error() != "g timed out" {
+		t.Errorf("Expected b and g to fail, got %v %v", failed, err)
+	}
+}
+
+func BenchmarkExecuteEach(b *testing.B) {
+	tw := &tableWrite{table: "rollup_3600"}
+	for i := 0; i < 100; i++ {
+		tw.partitions = append(tw.partitions, &partitionWrite{path: fmt.Sprintf("path.%d", i)})
+	}
+	roundTrip := func(*partitionWrite) error {
+		time.Sleep(time.Millisecond)
+		return nil
+	}
+	for _, limit := range []int{1, maxPartitionWrites} {
+		b.Run(fmt.Sprintf("limit=%d", limit), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				tw.executeEach(limit, roundTrip)
+			}
+		})
+	}
+}
@@ -0,0 +1,295 @@
+package datastore
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gocql/gocql"
+
+	"github.com/jeffpierce/cassabon/config"
+	"github.com/jeffpierce/cassabon/logging"
+)
+
+// createPathIndexTable creates the table in which the path index is kept, when stored in Cassandra.
+// Each node is stored in the partition of its parent, so the children of a branch are read together.
+func createPathIndexTable(dbClient *gocql.Session) error {
+	query := fmt.Sprintf(
+		`CREATE TABLE IF NOT EXISTS %s.path_index
+            (parent text, path text, depth int, tenant text, leaf boolean, PRIMARY KEY (parent, path))`,
+		config.Cassandra().Keyspace)
+	config.G.Log.System.LogDebug(query)
+	return dbClient.Query(query).Exec()
+}
+
+// addPathIndexUpdated adds the time each node was last indexed to the path index table.
+func addPathIndexUpdated(dbClient *gocql.Session) error {
+	ksmd, err := dbClient.KeyspaceMetadata(config.Cassandra().Keyspace)
+	if err != nil {
+		return err
+	}
+	if table, found := ksmd.Tables["path_index"]; !found || table.Columns["updated"] != nil {
+		return nil
+	}
+	query := fmt.Sprintf(`ALTER TABLE %s.path_index ADD updated bigint`, config.Cassandra().Keyspace)
+	config.G.Log.System.LogDebug(query)
+	return dbClient.Query(query).Exec()
+}
+
+// cassandraIndex keeps the path index in Cassandra, so that no other service is needed for it.
+// The table is created by a schema migration, when the MetricManager starts.
+type cassandraIndex struct {
+	dbClient *gocql.Session
+}
+
+// parentOf returns the path of a node's parent, or "" for a node at the top.
+func parentOf(path string) string {
+	if i := strings.LastIndexByte(path, '.'); i >= 0 {
+		return path[:i]
+	}
+	return ""
+}
+
+// childOf returns the path of a child of a node, where "" is the top.
+func childOf(parent, node string) string {
+	if parent == "" {
+		return node
+	}
+	return parent + "." + node
+}
+
+// init opens the connection to Cassandra used for the index.
+func (ci *cassandraIndex) init(bootstrap bool) {
+	var err error
+	ci.dbClient, err = cassandraSession()
+	if err != nil {
+		config.G.Log.System.LogFatal("IndexManager unable to connect to Cassandra at %v, port %s: %s",
+			config.Cassandra().Hosts, config.Cassandra().Port, err.Error())
+	}
+}
+
+// reopen replaces the connection with one of the configured settings, closing the one replaced once
+// queries begun on it have had time to finish.
+func (ci *cassandraIndex) reopen() error {
+	dbClient, err := cassandraSession()
+	if err != nil {
+		return fmt.Errorf("unable to connect to Cassandra at %v, port %s: %s",
+			config.Cassandra().Hosts, config.Cassandra().Port, err.Error())
+	}
+	old := ci.dbClient
+	ci.dbClient = dbClient
+	time.AfterFunc(sessionCloseDelay, old.Close)
+	return nil
+}
+
+// put indexes one node.
+func (ci *cassandraIndex) put(node IndexResponse) error {
+	err := ci.dbClient.Query(fmt.Sprintf(
+		`INSERT INTO %s.path_index (parent, path, depth, tenant, leaf, updated) VALUES (?, ?, ?, ?, ?, ?)`,
+		config.Cassandra().Keyspace),
+		parentOf(node.Path), node.Path, node.Depth, node.Tenant, node.Leaf, node.Updated).Exec()
+	if err != nil {
+		logging.Statsd.Client.Inc("indexmgr.db.err.put", 1, 1.0)
+	}
+	return err
+}
+
+// putBatch indexes many nodes, in unlogged batches of the configured size, since their partitions differ.
+func (ci *cassandraIndex) putBatch(nodes []IndexResponse) error {
+	query := fmt.Sprintf(
+		`INSERT INTO %s.path_index (parent, path, depth, tenant, leaf, updated) VALUES (?, ?, ?, ?, ?, ?)`,
+		config.Cassandra().Keyspace)
+	batchSize := config.Cassandra().BatchSize
+	for len(nodes) > 0 {
+		n := len(nodes)
+		if n > batchSize {
+			n = batchSize
+		}
+		batch := ci.dbClient.NewBatch(gocql.UnloggedBatch)
+		for _, node := range nodes[:n] {
+			batch.Query(query, parentOf(node.Path), node.Path, node.Depth, node.Tenant, node.Leaf, node.Updated)
+		}
+		if err := ci.dbClient.ExecuteBatch(batch); err != nil {
+			logging.Statsd.Client.Inc("indexmgr.db.err.put", 1, 1.0)
+			return err
+		}
+		nodes = nodes[n:]
+	}
+	return nil
+}
+
+// remove deletes one node from the index.
+func (ci *cassandraIndex) remove(path string) error {
+	err := ci.dbClient.Query(fmt.Sprintf(`DELETE FROM %s.path_index WHERE parent = ? AND path = ?`,
+		config.Cassandra().Keyspace), parentOf(path), path).Exec()
+	if err != nil {
+		logging.Statsd.Client.Inc("indexmgr.db.err.delete", 1, 1.0)
+	}
+	return err
+}
+
+// hasChildren reports whether any nodes are indexed immediately beneath a branch.
+func (ci *cassandraIndex) hasChildren(branch string) bool {
+	var path string
+	err := ci.dbClient.Query(fmt.Sprintf(`SELECT path FROM %s.path_index WHERE parent = ? LIMIT 1`,
+		config.Cassandra().Keyspace), branch).Scan(&path)
+	if err == gocql.ErrNotFound {
+		return false
+	}
+	// Assume the worst on error, so that a branch isn't removed from under its children.
+	return true
+}
+
+// leaves reads the whole index for its leaf nodes.
+func (ci *cassandraIndex) leaves() ([]string, error) {
+	var pathList []string
+	var path string
+	var leaf bool
+	iter := ci.dbClient.Query(fmt.Sprintf(`SELECT path, leaf FROM %s.path_index`, config.Cassandra().Keyspace)).Iter()
+	for iter.Scan(&path, &leaf) {
+		if leaf {
+			pathList = append(pathList, path)
+		}
+	}
+	if err := iter.Close(); err != nil {
+		logging.Statsd.Client.Inc("indexmgr.db.err.get", 1, 1.0)
+		return pathList, err
+	}
+	sort.Strings(pathList)
+	return pathList, nil
+}
+
+// stale reads the whole index for the leaf nodes last indexed before a time. Nodes indexed before
+// the time was recorded are left alone.
+func (ci *cassandraIndex) stale(before int64) ([]string, error) {
+	var pathList []string
+	var path string
+	var leaf bool
+	var updated int64
+	iter := ci.dbClient.Query(fmt.Sprintf(`SELECT path, leaf, updated FROM %s.path_index`,
+		config.Cassandra().Keyspace)).Iter()
+	for iter.Scan(&path, &leaf, &updated) {
+		if leaf && updated > 0 && updated < before {
+			pathList = append(pathList, path)
+		}
+	}
+	if err := iter.Close(); err != nil {
+		logging.Statsd.Client.Inc("indexmgr.db.err.get", 1, 1.0)
+		return pathList, err
+	}
+	sort.Strings(pathList)
+	return pathList, nil
+}
+
+// find walks down the index one node of each query at a time, reading the children of the branches
+// matched so far. Nodes without wildcards are looked up directly.
+func (ci *cassandraIndex) find(queries []string, tenant string, limit int) ([]IndexResponse, error) {
+	found := make(map[string]IndexResponse)
+	for _, query := range queries {
+		nodes := strings.Split(query, ".")
+
+		// A tenant's own node is not indexed, so the walk begins beneath it.
+		parents := []string{""}
+		if tenant != "" {
+			parents, nodes = []string{tenant}, nodes[1:]
+		}
+		for i, node := range nodes {
+			var matched []IndexResponse
+			for _, parent := range parents {
+				children, err := ci.children(parent, node)
+				if err != nil {
+					return nil, err
+				}
+				matched = append(matched, children...)
+			}
+			if len(matched) == 0 {
+				break
+			}
+			// Walking down beneath too many branches is as costly as returning them.
+			if limit > 0 && len(matched) > limit {
+				return nil, tooManyPaths(limit)
+			}
+			if i == len(nodes)-1 {
+				for _, ir := range matched {
+					found[ir.Path] = ir
+				}
+				break
+			}
+			parents = parents[:0]
+			for _, ir := range matched {
+				parents = append(parents, ir.Path)
+			}
+		}
+	}
+
+	if limit > 0 && len(found) > limit {
+		return nil, tooManyPaths(limit)
+	}
+
+	// Present them in order, as the other index does.
+	list := make([]IndexResponse, 0, len(found))
+	for _, ir := range found {
+		list = append(list, ir)
+	}
+	sort.Sort(byIndexPath(list))
+	return list, nil
+}
+
+// children returns the children of a branch matched by one node of a query.
+func (ci *cassandraIndex) children(parent, node string) ([]IndexResponse, error) {
+	var err error
+	var children []IndexResponse
+	var ir IndexResponse
+	if !strings.ContainsAny(node, "*?[") {
+		err = ci.dbClient.Query(fmt.Sprintf(
+			`SELECT path, depth, tenant, leaf, updated FROM %s.path_index WHERE parent = ? AND path = ?`,
+			config.Cassandra().Keyspace), parent, childOf(parent, node)).Scan(&ir.Path, &ir.Depth, &ir.Tenant, &ir.Leaf, &ir.Updated)
+		switch err {
+		case nil:
+			return []IndexResponse{ir}, nil
+		case gocql.ErrNotFound:
+			return nil, nil
+		}
+		logging.Statsd.Client.Inc("indexmgr.db.err.get", 1, 1.0)
+		return nil, err
+	}
+
+	// The regexp is valid Go as well as for Elasticsearch, but Go's must be anchored.
+	re, err := regexp.Compile("^" + globToRegexp(node) + "$")
+	if err != nil {
+		return nil, err
+	}
+	iter := ci.dbClient.Query(fmt.Sprintf(`SELECT path, depth, tenant, leaf, updated FROM %s.path_index WHERE parent = ?`,
+		config.Cassandra().Keyspace), parent).Iter()
+	for iter.Scan(&ir.Path, &ir.Depth, &ir.Tenant, &ir.Leaf, &ir.Updated) {
+		if re.MatchString(nodeOf(ir.Path)) {
+			children = append(children, ir)
+		}
+	}
+	if err = iter.Close(); err != nil {
+		logging.Statsd.Client.Inc("indexmgr.db.err.get", 1, 1.0)
+		return nil, err
+	}
+	return children, nil
+}
+
+// nodeOf returns the last node of a path.
+func nodeOf(path string) string {
+	return path[strings.LastIndexByte(path, '.')+1:]
+}
+
+// byIndexPath sorts index entries by path.
+type byIndexPath []IndexResponse
+
+// Implementation of sort.Interface.
+func (p byIndexPath) Len() int {
+	return len(p)
+}
+func (p byIndexPath) Less(i, j int) bool {
+	return p[i].Path < p[j].Path
+}
+func (p byIndexPath) Swap(i, j int) {
+	p[i], p[j] = p[j], p[i]
+}
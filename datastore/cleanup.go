@@ -0,0 +1,118 @@
+package datastore
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/jeffpierce/cassabon/config"
+	"github.com/jeffpierce/cassabon/logging"
+)
+
+// cleanup removes from the index every path that has no data within the retention of any of its
+// rollup tables, so that queries stop finding series that are no longer reported.
+func (mm *MetricManager) cleanup() {
+
+	defer config.G.OnPanic()
+
+	// Only one sweep at a time; a slow one simply delays the next.
+	if !atomic.CompareAndSwapInt32(&mm.cleaning, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&mm.cleaning, 0)
+
+	config.G.Log.System.LogInfo("MetricManager cleanup of stale paths starting")
+	var checked, removed int
+	rules := mm.currentRules()
+	for _, path := range mm.im.getAllLeafNodes() {
+		select {
+		case <-config.G.OnExit:
+			return
+		default:
+		}
+		checked++
+
+		def := rules.defs[rules.getExpression(path)]
+		stale, err := mm.isStale(path, def)
+		if err != nil {
+			config.G.Log.System.LogWarn("MetricManager cleanup unable to check %s: %s", path, err.Error())
+			continue
+		}
+		if !stale {
+			continue
+		}
+
+		if !mm.removePath(path) {
+			continue
+		}
+		if config.G.MetricManager.CleanupPartitions {
+			for _, w := range def.Windows {
+				if err := mm.engine.delete(context.Background(), w.Table, path, time.Time{}, time.Time{}); err != nil {
+					config.G.Log.System.LogWarn("MetricManager cleanup unable to delete %s from %s: %s",
+						path, w.Table, err.Error())
+				}
+			}
+		}
+		config.G.Log.System.LogDebug("MetricManager cleanup removed %s", path)
+		removed++
+	}
+	logging.Statsd.Client.Inc("metricmgr.cleanup.removed", int64(removed), 1.0)
+	config.G.Log.System.LogInfo("MetricManager cleanup checked %d paths, removed %d", checked, removed)
+}
+
+// prune removes from the index every path that has not been indexed again within the age at which
+// index entries expire, so that queries stop finding series that are no longer reported. Their data
+// is left to expire with the retention of its tables.
+func (mm *MetricManager) prune() {
+
+	defer config.G.OnPanic()
+
+	// Cleanup and pruning both remove paths, so only one runs at a time.
+	if !atomic.CompareAndSwapInt32(&mm.cleaning, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&mm.cleaning, 0)
+
+	var removed int
+	for _, path := range mm.im.getStalePaths(time.Now().Add(-config.G.Index.TTL)) {
+		select {
+		case <-config.G.OnExit:
+			return
+		default:
+		}
+		if mm.removePath(path) {
+			config.G.Log.System.LogDebug("MetricManager pruned %s", path)
+			removed++
+		}
+	}
+	logging.Statsd.Client.Inc("metricmgr.prune.removed", int64(removed), 1.0)
+	config.G.Log.System.LogInfo("MetricManager pruned %d expired paths from the index", removed)
+}
+
+// removePath removes a path from the index, and stops tracking it, reporting whether it did so. The path is
+// removed from the index first, so that if data arrives meanwhile it is indexed again; if the path turns out
+// to be in use, it is indexed again at once.
+func (mm *MetricManager) removePath(path string) bool {
+	mm.known.remove(path)
+	mm.im.removePath(path)
+	if !mm.shardFor(path).forget(path) {
+		config.G.Channels.IndexStore <- config.CarbonMetric{Path: path}
+		return false
+	}
+	return true
+}
+
+// isStale reports whether a path has no data within the retention of any of its rollup tables.
+func (mm *MetricManager) isStale(path string, def config.RollupDef) (bool, error) {
+	now := time.Now()
+	for _, w := range def.Windows {
+		found, err := mm.engine.hasRows(w.Table, path, now.Add(-w.Retention))
+		if err != nil {
+			return false, err
+		}
+		if found {
+			return false, nil
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,77 @@
+package datastore
+
+import (
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/jeffpierce/cassabon/config"
+)
+
+// cleanupManager returns a metric manager whose index holds the paths, each last indexed at a time.
+func cleanupManager(indexed map[string]time.Time) (*MetricManager, memoryIndex) {
+	mm := newQueryManager([]config.RollupWindow{{time.Minute, time.Hour, "rollup_000003600"}})
+	mi := make(memoryIndex)
+	for path, updated := range indexed {
+		for _, node := range pathNodes(path, updated.Unix()) {
+			mi[node.Path] = node
+		}
+	}
+	mm.im = IndexManager{store: mi, tags: new(tagSet)}
+	mm.known.init(100)
+	config.G.Channels.IndexStore = make(chan config.CarbonMetric, 10)
+	return mm, mi
+}
+
+// indexedLeaves returns the leaves left in an index, in order.
+func indexedLeaves(mi memoryIndex) []string {
+	leaves, _ := mi.leaves()
+	sort.Strings(leaves)
+	return leaves
+}
+
+func TestCleanup(t *testing.T) {
+	now := time.Now()
+	mm, mi := cleanupManager(map[string]time.Time{"foo.live": now, "foo.old": now, "foo.expired": now, "foo.none": now})
+	defer startShards(mm)()
+	defer func() { config.G.MetricManager.CleanupPartitions = false }()
+	config.G.MetricManager.CleanupPartitions = true
+
+	// One path has a row within the table's retention, one only before it, and one a row that has expired.
+	me := mm.engine.(*memoryEngine)
+	me.writeBatch(&tableWrite{"rollup_000003600", "", []*partitionWrite{
+		{"foo.live", [][]interface{}{{"foo.live", now.Add(-time.Minute), 1.0, 3600}}},
+		{"foo.old", [][]interface{}{{"foo.old", now.Add(-2 * time.Hour), 1.0, 3600}}},
+		{"foo.expired", [][]interface{}{{"foo.expired", now.Add(-time.Minute), 1.0, 0}}},
+	}, 3})
+
+	mm.cleanup()
+	if leaves := indexedLeaves(mi); len(leaves) != 1 || leaves[0] != "foo.live" {
+		t.Errorf("Expected only foo.live to remain indexed, found %v", leaves)
+	}
+	if _, found := mi["foo"]; !found {
+		t.Errorf("Expected the branch of the path still indexed to remain")
+	}
+	rows := me.tables["rollup_000003600"]
+	if len(rows["foo.live"]) != 1 {
+		t.Errorf("Expected the rows of foo.live to be kept, found %v", rows["foo.live"])
+	}
+	for _, path := range []string{"foo.old", "foo.expired"} {
+		if _, found := rows[path]; found {
+			t.Errorf("Expected the partition of %s to be deleted", path)
+		}
+	}
+}
+
+func TestPrune(t *testing.T) {
+	now := time.Now()
+	defer func(ttl time.Duration) { config.G.Index.TTL = ttl }(config.G.Index.TTL)
+	config.G.Index.TTL = 24 * time.Hour
+	mm, mi := cleanupManager(map[string]time.Time{"foo.recent": now.Add(-time.Hour), "foo.expired": now.Add(-48 * time.Hour)})
+	defer startShards(mm)()
+
+	mm.prune()
+	if leaves := indexedLeaves(mi); len(leaves) != 1 || leaves[0] != "foo.recent" {
+		t.Errorf("Expected only foo.recent to remain indexed, found %v", leaves)
+	}
+}
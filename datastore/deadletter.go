@@ -0,0 +1,148 @@
+package datastore
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/jeffpierce/cassabon/config"
+)
+
+// deadLetter is one row that could not be written, as saved in the dead-letter file.
+type deadLetter struct {
+	Table      string               `json:"table"`
+	Path       string               `json:"path"`
+	Time       int64                `json:"time"` // Milliseconds since the epoch
+	Stat       float64              `json:"stat"`
+	Aggregates *deadLetterAggregate `json:"aggregates,omitempty"`
+}
+
+// deadLetterAggregate holds the aggregate columns of a row, when they are stored.
+type deadLetterAggregate struct {
+	Min   float64 `json:"min"`
+	Max   float64 `json:"max"`
+	Sum   float64 `json:"sum"`
+	Count int64   `json:"count"`
+}
+
+// Serialize appends to the dead-letter file by the concurrent writers.
+var deadLetterMutex sync.Mutex
+
+// writeDeadLetters appends the rows of a failed write to the dead-letter file, one JSON object per line.
+// The file is opened for each call, so that it can be moved aside while the daemon runs.
+func writeDeadLetters(filename string, tw *tableWrite) error {
+
+	deadLetterMutex.Lock()
+	defer deadLetterMutex.Unlock()
+
+	fp, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+
+	w := bufio.NewWriter(fp)
+	for _, pw := range tw.partitions {
+		for _, row := range pw.rows {
+			ts, _ := row[1].(time.Time)
+			stat, _ := row[2].(float64)
+			if math.IsNaN(stat) || math.IsInf(stat, 0) {
+				// JSON can't represent these, and Cassandra wouldn't have stored them usefully.
+				continue
+			}
+			dl := deadLetter{tw.table, pw.path, ts.UnixNano() / int64(time.Millisecond), stat, nil}
+			if len(row) == 8 {
+				min, _ := row[3].(float64)
+				max, _ := row[4].(float64)
+				sum, _ := row[5].(float64)
+				count, _ := row[6].(int64)
+				dl.Aggregates = &deadLetterAggregate{min, max, sum, count}
+			}
+			line, err := json.Marshal(dl)
+			if err != nil {
+				return err
+			}
+			w.Write(line)
+			w.WriteString("\n")
+		}
+	}
+	return w.Flush()
+}
+
+// ReplayDeadLetters re-inserts the rows saved in a dead-letter file, and removes the file.
+// The file is first renamed, so a running daemon starts a fresh one, and any rows that
+// fail again are appended to the configured dead-letter file for a later attempt.
+func ReplayDeadLetters(filename string) (replayed, failed int, err error) {
+
+	dbClient, err := cassandraSession()
+	if err != nil {
+		return
+	}
+	defer dbClient.Close()
+
+	return replayDeadLetters(filename, func(stmt string, row []interface{}) error {
+		return dbClient.Query(stmt, row...).Exec()
+	})
+}
+
+// replayDeadLetters re-inserts the rows saved in a dead-letter file with the insert function, as
+// ReplayDeadLetters does. Lines that can't be parsed, such as one cut short, are logged and counted
+// as failed.
+func replayDeadLetters(filename string, insert func(stmt string, row []interface{}) error) (replayed, failed int, err error) {
+
+	replayFile := fmt.Sprintf("%s.replay.%d", filename, time.Now().Unix())
+	if err = os.Rename(filename, replayFile); err != nil {
+		return
+	}
+
+	fp, err := os.Open(replayFile)
+	if err != nil {
+		return
+	}
+	defer fp.Close()
+
+	stmts := storedStatements()
+	scanner := bufio.NewScanner(fp)
+	for scanner.Scan() {
+		var dl deadLetter
+		if err := json.Unmarshal(scanner.Bytes(), &dl); err != nil {
+			config.G.Log.System.LogWarn("Skipping malformed dead letter %q: %s", scanner.Text(), err.Error())
+			failed++
+			continue
+		}
+		ts := time.Unix(0, dl.Time*int64(time.Millisecond))
+
+		// The row expires when it would have, had it been written on time.
+		ttl := rowTTL(tableRetention(dl.Table), time.Since(ts))
+		if ttl < 1 {
+			config.G.Log.System.LogDebug("Skipping expired dead letter %s %s %v", dl.Table, dl.Path, ts)
+			continue
+		}
+
+		stmt := stmts.get(dl.Table).insertRow(dl.Aggregates != nil)
+		row := []interface{}{dl.Path, ts, dl.Stat, ttl}
+		if a := dl.Aggregates; a != nil {
+			row = []interface{}{dl.Path, ts, dl.Stat, a.Min, a.Max, a.Sum, a.Count, ttl}
+		}
+		if err := insert(stmt, row); err != nil {
+			config.G.Log.System.LogWarn("Replay of %s %s failed: %s", dl.Table, dl.Path, err.Error())
+			failed++
+			tw := &tableWrite{dl.Table, stmt, []*partitionWrite{{dl.Path, [][]interface{}{row}}}, 1}
+			if filename := config.Cassandra().DeadLetterFile; filename != "" {
+				writeDeadLetters(filename, tw)
+			}
+			continue
+		}
+		replayed++
+	}
+	if err = scanner.Err(); err != nil {
+		return
+	}
+
+	err = os.Remove(replayFile)
+	return
+}
@@ -0,0 +1,120 @@
+package datastore
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jeffpierce/cassabon/config"
+	"github.com/jeffpierce/cassabon/logging"
+)
+
+// readDeadLetters returns the rows saved in a dead-letter file.
+func readDeadLetters(t *testing.T, filename string) []deadLetter {
+	fp, err := os.Open(filename)
+	if err != nil {
+		t.Fatalf("Unable to open %s: %s", filename, err.Error())
+	}
+	defer fp.Close()
+	var letters []deadLetter
+	scanner := bufio.NewScanner(fp)
+	for scanner.Scan() {
+		var dl deadLetter
+		if err := json.Unmarshal(scanner.Bytes(), &dl); err != nil {
+			t.Fatalf("Malformed dead letter %q: %s", scanner.Text(), err.Error())
+		}
+		letters = append(letters, dl)
+	}
+	return letters
+}
+
+func TestWriteDeadLetters(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "deadletter")
+	ts := time.Unix(1500000000, 0)
+	tw := &tableWrite{"rollup_86400", "", []*partitionWrite{
+		{"foo.bar", [][]interface{}{
+			{"foo.bar", ts, 1.5, 3600},
+			{"foo.bar", ts.Add(time.Minute), math.NaN(), 3600}, // Not representable, so dropped
+		}},
+		{"foo.baz", [][]interface{}{
+			{"foo.baz", ts, 2.0, 1.0, 3.0, 4.0, int64(2), 3600},
+		}},
+	}, 3}
+
+	// Each failed write is appended to the file.
+	for i := 0; i < 2; i++ {
+		if err := writeDeadLetters(filename, tw); err != nil {
+			t.Fatalf("writeDeadLetters failed: %s", err.Error())
+		}
+	}
+	letters := readDeadLetters(t, filename)
+	if len(letters) != 4 {
+		t.Fatalf("Expected 4 dead letters, got %d: %+v", len(letters), letters)
+	}
+	if dl := letters[0]; dl.Table != "rollup_86400" || dl.Path != "foo.bar" || dl.Time != 1500000000000 || dl.Stat != 1.5 || dl.Aggregates != nil {
+		t.Errorf("Wrong dead letter: %+v", dl)
+	}
+	if a := letters[1].Aggregates; a == nil || *a != (deadLetterAggregate{1, 3, 4, 2}) {
+		t.Errorf("Wrong aggregates: %+v", a)
+	}
+}
+
+func TestReplayDeadLetters(t *testing.T) {
+	config.G.Log.System = logging.NewLogger("system")
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "deadletter")
+	defer config.SetCassandra(*config.Cassandra())
+	config.SetCassandra(config.CassandraSettings{Keyspace: "cassabon", DeadLetterFile: filepath.Join(dir, "deadletter.new")})
+
+	// The file holds rows that replay, one that fails again, one long expired, and a malformed line, then
+	// is cut short mid-row.
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	lines := fmt.Sprintf(`{"table":"rollup_86400","path":"foo.bar","time":%d,"stat":1}
+{"table":"rollup_86400","path":"foo.baz","time":%d,"stat":2,"aggregates":{"min":1,"max":3,"sum":4,"count":2}}
+{"table":"rollup_86400","path":"foo.fail","time":%d,"stat":3}
+{"table":"rollup_86400","path":"foo.old","time":1000,"stat":4}
+not json
+{"table":"rollup_86400","path":"foo.cut`, now, now, now)
+	if err := os.WriteFile(filename, []byte(lines), 0644); err != nil {
+		t.Fatalf("Unable to write %s: %s", filename, err.Error())
+	}
+
+	var inserted []string
+	replayed, failed, err := replayDeadLetters(filename, func(stmt string, row []interface{}) error {
+		path := row[0].(string)
+		if path == "foo.fail" {
+			return fmt.Errorf("timed out")
+		}
+		if expected := newTableStatements("cassabon", "rollup_86400").insertRow(len(row) == 8); stmt != expected {
+			t.Errorf("Wrong statement for %s: %q", path, stmt)
+		}
+		inserted = append(inserted, path)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("replayDeadLetters failed: %s", err.Error())
+	}
+	if replayed != 2 || failed != 3 {
+		t.Errorf("Expected 2 replayed and 3 failed, got %d and %d", replayed, failed)
+	}
+	if len(inserted) != 2 || inserted[0] != "foo.bar" || inserted[1] != "foo.baz" {
+		t.Errorf("Wrong rows inserted: %v", inserted)
+	}
+
+	// The row that failed again is saved for a later attempt, and the replayed file is removed.
+	if letters := readDeadLetters(t, config.Cassandra().DeadLetterFile); len(letters) != 1 || letters[0].Path != "foo.fail" {
+		t.Errorf("Wrong rows saved after the replay: %+v", letters)
+	}
+	if names, _ := filepath.Glob(filepath.Join(dir, "deadletter*")); len(names) != 1 {
+		t.Errorf("Expected only the new dead-letter file to remain, found %v", names)
+	}
+
+	if _, _, err := replayDeadLetters(filename, nil); err == nil {
+		t.Errorf("Expected an error replaying a file that doesn't exist")
+	}
+}
@@ -0,0 +1,506 @@
+package datastore
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jeffpierce/cassabon/config"
+	"github.com/jeffpierce/cassabon/logging"
+	"github.com/jeffpierce/cassabon/middleware"
+)
+
+// ElasticResponse is the struct we unmarshal the response from an ElasticSearch query to.
+type ElasticResponse struct {
+	Took     int      `json:"took"`
+	TimedOut bool     `json:"timed_out"`
+	Shards   ERShards `json:"_shards"`
+	Hits     ERHits   `json:"hits"`
+}
+
+type ERShards struct {
+	Total      int `json:"total"`
+	Successful int `json:"successful"`
+	Failed     int `json:"failed"`
+}
+
+type ERHits struct {
+	Total    int           `json:"total"`
+	MaxScore float32       `json:"max_score"`
+	Hits     []ERSearchHit `json:"hits"`
+}
+
+type ERSearchHit struct {
+	Index  string        `json:"_index"`
+	Type   string        `json:"_type"`
+	ID     string        `json:"_id"`
+	Score  float32       `json:"_score"`
+	Source IndexResponse `json:"_source"`
+}
+
+type ERQuery struct {
+	Sort  []map[string]map[string]string                            `json:"sort"`
+	Query map[string]map[string][]map[string]map[string]interface{} `json:"query"`
+}
+
+// The pause before retrying a request to ElasticSearch, multiplied by the number of the retry.
+const esRetryPause = 100 * time.Millisecond
+
+// elasticIndex keeps the path index in ElasticSearch, one document per node.
+type elasticIndex struct {
+	client *http.Client
+}
+
+// init prepares the client for ElasticSearch, and initializes the mapping when bootstrapping.
+func (ei *elasticIndex) init(bootstrap bool) {
+	var err error
+	if ei.client, err = elasticSearchClient(); err != nil {
+		config.G.Log.System.LogFatal("IndexManager unable to configure TLS for ElasticSearch: %s", err.Error())
+	}
+	if bootstrap {
+		ei.initMapping()
+	}
+}
+
+// reopen replaces the client with one of the configured settings.
+func (ei *elasticIndex) reopen() error {
+	client, err := elasticSearchClient()
+	if err != nil {
+		return fmt.Errorf("unable to configure TLS for ElasticSearch: %s", err.Error())
+	}
+	ei.client = client
+	return nil
+}
+
+// elasticSearchClient returns a client with the configured connection settings.
+func elasticSearchClient() (*http.Client, error) {
+	es := config.G.ElasticSearch
+	return middleware.ElasticSearchClient(middleware.ElasticSearchOptions{
+		CAFile:             es.TLS.CAFile,
+		CertFile:           es.TLS.CertFile,
+		KeyFile:            es.TLS.KeyFile,
+		InsecureSkipVerify: es.TLS.InsecureSkipVerify,
+		PoolSize:           es.PoolSize,
+		DialTimeout:        time.Duration(es.DialTimeout) * time.Millisecond,
+		ReadTimeout:        time.Duration(es.ReadTimeout) * time.Millisecond,
+		Timeout:            time.Duration(es.Timeout) * time.Millisecond,
+	})
+}
+
+// initMapping initializes ElasticSearch for cassabon.
+func (ei *elasticIndex) initMapping() {
+	mapping := map[string]map[string]map[string]map[string]map[string]string{
+		"mappings": map[string]map[string]map[string]map[string]string{
+			"path": map[string]map[string]map[string]string{
+				"properties": map[string]map[string]string{
+					"path": map[string]string{
+						"type":  "string",
+						"index": "not_analyzed",
+					},
+					"depth": map[string]string{
+						"type": "long",
+					},
+					"tenant": map[string]string{
+						"type":  "string",
+						"index": "not_analyzed",
+					},
+					"leaf": map[string]string{
+						"type": "boolean",
+					},
+					"updated": map[string]string{
+						"type": "long",
+					},
+				},
+			},
+		},
+	}
+
+	jsonMap, _ := json.Marshal(mapping)
+	config.G.Log.System.LogDebug("%s", string(jsonMap))
+
+	putreq, _ := http.NewRequest("PUT", config.G.ElasticSearch.MapURL, bytes.NewBuffer(jsonMap))
+	r := ei.httpRequest(putreq)
+
+	config.G.Log.System.LogDebug("%v", string(r))
+
+	if r == nil {
+		config.G.Log.System.LogFatal("Could not initialize mapping for ElasticSearch.")
+	}
+}
+
+// leaves queries ElasticSearch for all leaf nodes.
+func (ei *elasticIndex) leaves() ([]string, error) {
+	sort := []map[string]map[string]string{
+		{
+			"path": map[string]string{
+				"order": "asc",
+			},
+		},
+	}
+	query := map[string]map[string][]map[string]map[string]interface{}{
+		"bool": map[string][]map[string]map[string]interface{}{
+			"must": []map[string]map[string]interface{}{
+				{
+					"match": map[string]interface{}{
+						"leaf": true,
+					},
+				},
+			},
+		},
+	}
+
+	found, err := ei.search(ERQuery{sort, query}, 0)
+	var pathList []string
+	for _, node := range found {
+		pathList = append(pathList, node.Path)
+	}
+	return pathList, err
+}
+
+// stale queries ElasticSearch for the leaf nodes last indexed before a time. Nodes indexed before
+// the time was recorded are left alone.
+func (ei *elasticIndex) stale(before int64) ([]string, error) {
+	sort := []map[string]map[string]string{
+		{
+			"path": map[string]string{
+				"order": "asc",
+			},
+		},
+	}
+	query := map[string]map[string][]map[string]map[string]interface{}{
+		"bool": map[string][]map[string]map[string]interface{}{
+			"must": []map[string]map[string]interface{}{
+				{
+					"match": map[string]interface{}{
+						"leaf": true,
+					},
+				},
+				{
+					"range": map[string]interface{}{
+						"updated": map[string]int64{
+							"gt": 0,
+							"lt": before,
+						},
+					},
+				},
+			},
+		},
+	}
+
+	found, err := ei.search(ERQuery{sort, query}, 0)
+	var pathList []string
+	for _, node := range found {
+		pathList = append(pathList, node.Path)
+	}
+	return pathList, err
+}
+
+// prepRequest returns the search request for a query. The paths that match are counted first, so that all
+// of them are returned, unless there are more than the limit, if any, when the search is refused.
+func (ei *elasticIndex) prepRequest(fullQuery ERQuery, limit int) (*http.Request, error) {
+	jsonQuery, _ := json.Marshal(fullQuery)
+	config.G.Log.System.LogDebug("%s", string(jsonQuery))
+
+	// Get the count so that we capture all of the possible paths.
+	countreq, _ := http.NewRequest("GET", config.G.ElasticSearch.CountURL, strings.NewReader(string(jsonQuery)))
+	count := ei.getCount(countreq)
+	if n, _ := strconv.Atoi(count); limit > 0 && n > limit {
+		return nil, tooManyPaths(limit)
+	}
+	size := "size=" + count
+
+	searchURL := strings.Join([]string{config.G.ElasticSearch.SearchURL, size}, "?")
+	getreq, _ := http.NewRequest("GET", searchURL, strings.NewReader(string(jsonQuery)))
+
+	return getreq, nil
+}
+
+func (ei *elasticIndex) httpRequest(req *http.Request) []byte {
+	resp, err := ei.client.Do(req)
+
+	// Requests that fail to get a response are tried again, with their body rewound, after a pause.
+	for retry := 1; err != nil && retry <= config.G.ElasticSearch.Retries; retry++ {
+		logging.Statsd.Client.Inc("indexmgr.es.retry", 1, 1.0)
+		time.Sleep(time.Duration(retry) * esRetryPause)
+		if req.GetBody != nil {
+			if req.Body, err = req.GetBody(); err != nil {
+				break
+			}
+		}
+		resp, err = ei.client.Do(req)
+	}
+
+	if err != nil {
+		logging.Statsd.Client.Inc("indexmgr.es.err.httpreq", 1, 1.0)
+		config.G.Log.System.LogError("Received error from ElasticSearch: %v, request: %v", err.Error(), req)
+		return nil
+	}
+
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	return body
+}
+
+// put indexes one node via the ElasticSearch REST API.
+func (ei *elasticIndex) put(node IndexResponse) error {
+	urlToPut := strings.Join([]string{config.G.ElasticSearch.PutURL, node.Path}, "/")
+
+	// Marshal the struct into JSON
+	jsonPath, err := json.Marshal(node)
+	if err != nil {
+		logging.Statsd.Client.Inc("indexmgr.es.err.json", 1, 1.0)
+		return err
+	}
+
+	putreq, err := http.NewRequest("PUT", urlToPut, bytes.NewBuffer(jsonPath))
+	if err != nil {
+		logging.Statsd.Client.Inc("indexmgr.es.err.put", 1, 1.0)
+		return err
+	}
+
+	if ei.httpRequest(putreq) == nil {
+		logging.Statsd.Client.Inc("indexmgr.es.err.pmr.req", 1, 1.0)
+		return fmt.Errorf("httprequest to ES came back as nil")
+	}
+	return nil
+}
+
+// putBatch indexes many nodes in a single request to the ElasticSearch bulk API.
+func (ei *elasticIndex) putBatch(nodes []IndexResponse) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, node := range nodes {
+		action := map[string]map[string]string{"index": {"_id": node.Path}}
+		if err := enc.Encode(action); err != nil {
+			logging.Statsd.Client.Inc("indexmgr.es.err.json", 1, 1.0)
+			return err
+		}
+		if err := enc.Encode(node); err != nil {
+			logging.Statsd.Client.Inc("indexmgr.es.err.json", 1, 1.0)
+			return err
+		}
+	}
+
+	postreq, err := http.NewRequest("POST", config.G.ElasticSearch.BulkURL, &buf)
+	if err != nil {
+		logging.Statsd.Client.Inc("indexmgr.es.err.bulk", 1, 1.0)
+		return err
+	}
+	r := ei.httpRequest(postreq)
+	if r == nil {
+		logging.Statsd.Client.Inc("indexmgr.es.err.bulk", 1, 1.0)
+		return fmt.Errorf("httprequest to ES came back as nil")
+	}
+
+	// The request succeeds even if some of the nodes were not indexed, so they must be checked for.
+	var resp struct {
+		Errors bool `json:"errors"`
+	}
+	if err := json.Unmarshal(r, &resp); err != nil || resp.Errors {
+		logging.Statsd.Client.Inc("indexmgr.es.err.bulk", 1, 1.0)
+		return fmt.Errorf("bulk request to ES failed: %s", string(r))
+	}
+	return nil
+}
+
+// remove deletes one node from the index.
+func (ei *elasticIndex) remove(path string) error {
+	delreq, _ := http.NewRequest("DELETE", strings.Join([]string{config.G.ElasticSearch.PutURL, path}, "/"), nil)
+	if ei.httpRequest(delreq) == nil {
+		logging.Statsd.Client.Inc("indexmgr.es.err.delete", 1, 1.0)
+		return fmt.Errorf("httprequest to ES came back as nil")
+	}
+	return nil
+}
+
+// hasChildren reports whether any nodes are indexed immediately beneath a branch.
+func (ei *elasticIndex) hasChildren(branch string) bool {
+	query := map[string]map[string][]map[string]map[string]interface{}{
+		"bool": map[string][]map[string]map[string]interface{}{
+			"must": []map[string]map[string]interface{}{
+				{
+					"regexp": map[string]interface{}{
+						"path": globToRegexp(branch + ".*"),
+					},
+				},
+				{
+					"match": map[string]interface{}{
+						"depth": len(strings.Split(branch, ".")) + 1,
+					},
+				},
+			},
+		},
+	}
+	jsonQuery, _ := json.Marshal(map[string]interface{}{"query": query})
+	countreq, _ := http.NewRequest("GET", config.G.ElasticSearch.CountURL, bytes.NewReader(jsonQuery))
+	r := ei.httpRequest(countreq)
+	if r == nil {
+		// Assume the worst, so that a branch isn't removed from under its children.
+		return true
+	}
+	var resp ElasticResponse
+	_ = json.Unmarshal(r, &resp)
+	return resp.Hits.Total > 0
+}
+
+func (ei *elasticIndex) getCount(req *http.Request) string {
+	var resp ElasticResponse
+	r := ei.httpRequest(req)
+	if r != nil {
+		_ = json.Unmarshal(r, &resp)
+		config.G.Log.System.LogDebug("total: %v", resp.Hits.Total)
+		return strconv.Itoa(resp.Hits.Total)
+	} else {
+		return "0"
+	}
+}
+
+// find returns the nodes matched by any of the queries, in a single ElasticSearch search.
+func (ei *elasticIndex) find(queries []string, tenant string, limit int) ([]IndexResponse, error) {
+	return ei.search(findQuery(queries, tenant), limit)
+}
+
+// findPage returns up to count of the nodes matched by any of the queries, in order, from offset on, and the
+// offset of the next page, or 0 if there are no more. ElasticSearch returns only the page, and one more node,
+// which shows whether there are more.
+func (ei *elasticIndex) findPage(queries []string, tenant string, offset, count int) ([]IndexResponse, int, error) {
+	fullQuery := findQuery(queries, tenant)
+	jsonQuery, _ := json.Marshal(fullQuery)
+	config.G.Log.System.LogDebug("%s", string(jsonQuery))
+	searchURL := fmt.Sprintf("%s?from=%d&size=%d", config.G.ElasticSearch.SearchURL, offset, count+1)
+	getreq, _ := http.NewRequest("GET", searchURL, strings.NewReader(string(jsonQuery)))
+
+	found, err := ei.hits(getreq)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(found) > count {
+		return found[:count], offset + count, nil
+	}
+	return found, 0, nil
+}
+
+// findQuery returns the search for the nodes matched by any of the queries.
+func findQuery(queries []string, tenant string) ERQuery {
+
+	// Convert each query to form suitable for Elasticsearch regexp search, along with the number of nodes
+	// in the path. A tenant's query is also confined to the paths indexed for the tenant, so it doesn't
+	// rely on the regexp alone.
+	var alternatives []map[string]map[string]interface{}
+	for _, query := range queries {
+		must := []map[string]map[string]interface{}{
+			{
+				"regexp": map[string]interface{}{
+					"path": globToRegexp(query),
+				},
+			},
+			{
+				"match": map[string]interface{}{
+					"depth": len(strings.Split(query, ".")),
+				},
+			},
+		}
+		if tenant != "" {
+			must = append(must, map[string]map[string]interface{}{
+				"term": map[string]interface{}{
+					"tenant": tenant,
+				},
+			})
+		}
+		alternatives = append(alternatives, map[string]map[string]interface{}{
+			"bool": map[string]interface{}{
+				"must": must,
+			},
+		})
+	}
+
+	// It's turtles all the way down!  This is totally Vijay's fault.
+	// http://github.com/vijaykramesh -- JP
+	sort := []map[string]map[string]string{
+		{
+			"path": map[string]string{
+				"order": "asc",
+			},
+		},
+	}
+	// A path matching any of the alternatives is returned once.
+	query := map[string]map[string][]map[string]map[string]interface{}{
+		"bool": map[string][]map[string]map[string]interface{}{
+			"should": alternatives,
+		},
+	}
+
+	return ERQuery{sort, query}
+}
+
+// findFuzzy returns the nodes whose paths are within a couple of edits of the query, most similar first.
+func (ei *elasticIndex) findFuzzy(query, tenant string) ([]IndexResponse, error) {
+	must := []map[string]map[string]interface{}{
+		{
+			"fuzzy": map[string]interface{}{
+				"path": map[string]interface{}{
+					"value":     query,
+					"fuzziness": "AUTO",
+				},
+			},
+		},
+		{
+			"match": map[string]interface{}{
+				"depth": len(strings.Split(query, ".")),
+			},
+		},
+	}
+	if tenant != "" {
+		must = append(must, map[string]map[string]interface{}{
+			"term": map[string]interface{}{
+				"tenant": tenant,
+			},
+		})
+	}
+	sort := []map[string]map[string]string{
+		{
+			"_score": map[string]string{
+				"order": "desc",
+			},
+		},
+	}
+	fuzzy := map[string]map[string][]map[string]map[string]interface{}{
+		"bool": map[string][]map[string]map[string]interface{}{
+			"must": must,
+		},
+	}
+	return ei.search(ERQuery{sort, fuzzy}, 0)
+}
+
+// search returns the nodes found by a query, in the order ElasticSearch returns them, unless there are
+// more than the limit, if any.
+func (ei *elasticIndex) search(fullQuery ERQuery, limit int) ([]IndexResponse, error) {
+	getreq, err := ei.prepRequest(fullQuery, limit)
+	if err != nil {
+		return nil, err
+	}
+	return ei.hits(getreq)
+}
+
+// hits returns the nodes found by a search request.
+func (ei *elasticIndex) hits(getreq *http.Request) ([]IndexResponse, error) {
+	r := ei.httpRequest(getreq)
+	if r == nil {
+		logging.Statsd.Client.Inc("indexmgr.es.err.get", 1, 1.0)
+		return nil, fmt.Errorf("Error querying ES")
+	}
+
+	var esResp ElasticResponse
+	var found []IndexResponse
+	_ = json.Unmarshal(r, &esResp)
+	config.G.Log.System.LogDebug("esResp: %v", esResp)
+	for _, hit := range esResp.Hits.Hits {
+		found = append(found, hit.Source)
+	}
+	return found, nil
+}
@@ -0,0 +1,117 @@
+package datastore
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jeffpierce/cassabon/config"
+)
+
+// metricEngine stores the rows of the rollup tables, and of the raw table if any. Each table holds rows
+// by path and time, which are written in batches and read back in ranges of time.
+type metricEngine interface {
+	// ensureSchema creates whatever the configured tables need.
+	ensureSchema() error
+
+	// writeBatch writes the rows, returning the partitions that failed.
+	writeBatch(tw *tableWrite) ([]*partitionWrite, error)
+
+	// query reads the rows of a path in a range of time, inclusive, in order of time.
+	query(ctx context.Context, table, path string, from, to time.Time, aggregates bool, scan func(storedRow)) error
+
+	// count returns the number of rows of a path in a range of time.
+	count(ctx context.Context, table, path string, from, to time.Time) (uint64, error)
+
+	// delete removes the rows of a path in a range of time, or with both times zero, the whole path.
+	delete(ctx context.Context, table, path string, from, to time.Time) error
+
+	// hasRows reports whether a path has rows since a time.
+	hasRows(table, path string, since time.Time) (bool, error)
+
+	// health returns why the engine can't be used, if it can't.
+	health() error
+}
+
+// storedRow is one row read from a table. The aggregates are only read when asked for, and a count of zero
+// means the row was written without them.
+type storedRow struct {
+	time  time.Time
+	stat  float64
+	agg   aggregate
+	count int64
+}
+
+// newMetricEngine returns the configured engine.
+func newMetricEngine(mm *MetricManager) metricEngine {
+	if config.G.MetricManager.Engine == config.ENGINE_MEMORY {
+		return newMemoryEngine()
+	}
+	return cassandraEngine{mm}
+}
+
+// cassandraEngine stores the tables in Cassandra, through the metric manager's sessions.
+type cassandraEngine struct {
+	mm *MetricManager
+}
+
+func (ce cassandraEngine) ensureSchema() error {
+	ce.mm.populateSchema()
+	return nil
+}
+
+func (ce cassandraEngine) writeBatch(tw *tableWrite) ([]*partitionWrite, error) {
+	return tw.execute(ce.mm.db())
+}
+
+func (ce cassandraEngine) query(ctx context.Context, table, path string, from, to time.Time, aggregates bool,
+	scan func(row storedRow)) error {
+
+	var row storedRow
+	query := ce.mm.currentRules().stmts.get(table).selectRows(aggregates)
+	if aggregates {
+		iter := ce.mm.reads().Query(query, path, from, to).WithContext(ctx).Iter()
+		for iter.Scan(&row.agg.min, &row.agg.max, &row.agg.sum, &row.count, &row.time) {
+			scan(row)
+		}
+		return iter.Close()
+	}
+	iter := ce.mm.reads().Query(query, path, from, to).WithContext(ctx).Iter()
+	for iter.Scan(&row.stat, &row.time) {
+		scan(row)
+	}
+	return iter.Close()
+}
+
+func (ce cassandraEngine) count(ctx context.Context, table, path string, from, to time.Time) (uint64, error) {
+	query := ce.mm.currentRules().stmts.get(table).count
+	iter := ce.mm.reads().Query(query, path, from, to).WithContext(ctx).Iter()
+	var count uint64
+	iter.Scan(&count)
+	return count, iter.Close()
+}
+
+func (ce cassandraEngine) delete(ctx context.Context, table, path string, from, to time.Time) error {
+	if from.IsZero() && to.IsZero() {
+		query := ce.mm.currentRules().stmts.get(table).deletePath
+		return ce.mm.db().Query(query, path).WithContext(ctx).Exec()
+	}
+	query := ce.mm.currentRules().stmts.get(table).delete
+	return ce.mm.db().Query(query, path, from, to).WithContext(ctx).Exec()
+}
+
+func (ce cassandraEngine) hasRows(table, path string, since time.Time) (bool, error) {
+	query := ce.mm.currentRules().stmts.get(table).latest
+	var ts time.Time
+	iter := ce.mm.db().Query(query, path, since).Iter()
+	found := iter.Scan(&ts)
+	return found, iter.Close()
+}
+
+func (ce cassandraEngine) health() error {
+	if ce.mm.db() == nil {
+		return fmt.Errorf("not connected")
+	}
+	var version string
+	return ce.mm.db().Query("SELECT release_version FROM system.local").Scan(&version)
+}
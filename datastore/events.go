@@ -0,0 +1,166 @@
+package datastore
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gocql/gocql"
+
+	"github.com/jeffpierce/cassabon/config"
+	"github.com/jeffpierce/cassabon/logging"
+)
+
+// Events are partitioned by tenant and by day, so that a range of time is read from a few partitions.
+const eventBucket = int64(24 * time.Hour / time.Second)
+
+// The most days of events one query may read.
+const maxEventDays = 400
+
+// event is something that happened, such as a deploy, in the form graphite-web's events API presents it.
+type event struct {
+	ID   string   `json:"id"`
+	What string   `json:"what"`
+	When float64  `json:"when"` // Seconds since the epoch
+	Tags []string `json:"tags"`
+	Data string   `json:"data"`
+}
+
+// createEventTable creates the table in which events are recorded.
+func createEventTable(dbClient *gocql.Session) error {
+	query := fmt.Sprintf(
+		`CREATE TABLE IF NOT EXISTS %s.events
+            (tenant text, day bigint, time timestamp, id timeuuid, what text, tags set<text>, data text,
+             PRIMARY KEY ((tenant, day), time, id))
+        WITH CLUSTERING ORDER BY (time ASC, id ASC)`,
+		config.Cassandra().Keyspace)
+	config.G.Log.System.LogDebug(query)
+	return dbClient.Query(query).Exec()
+}
+
+// eventDays returns the days whose partitions hold the events between two times, in seconds since the epoch.
+func eventDays(from, to int64) []int64 {
+	var days []int64
+	for day := floorDiv(from, eventBucket); day <= floorDiv(to, eventBucket); day++ {
+		days = append(days, day)
+	}
+	return days
+}
+
+// floorDiv divides, rounding towards negative infinity.
+func floorDiv(a, b int64) int64 {
+	if a < 0 {
+		return (a - b + 1) / b
+	}
+	return a / b
+}
+
+// normalizeTags returns tags without duplicates or empty tags, in order.
+func normalizeTags(tags []string) []string {
+	seen := make(map[string]bool, len(tags))
+	list := []string{}
+	for _, tag := range tags {
+		if tag != "" && !seen[tag] {
+			seen[tag] = true
+			list = append(list, tag)
+		}
+	}
+	sort.Strings(list)
+	return list
+}
+
+// hasTags reports whether an event has every one of the tags, or with any set, at least one of them.
+// Every event satisfies an empty list of tags.
+func (e event) hasTags(tags []string, any bool) bool {
+	if len(tags) == 0 {
+		return true
+	}
+	has := make(map[string]bool, len(e.Tags))
+	for _, tag := range e.Tags {
+		has[tag] = true
+	}
+	for _, tag := range tags {
+		if any && has[tag] {
+			return true
+		}
+		if !any && !has[tag] {
+			return false
+		}
+	}
+	return !any
+}
+
+// queryEvent records an event, or lists the events in a range of time.
+func (mm *MetricManager) queryEvent(q config.EventQuery) {
+
+	config.G.Log.System.LogDebug("MetricManager::queryEvent %v", q)
+
+	if mm.db() == nil {
+		mm.sendAPIResponse(q.Channel, config.APIQueryResponse{config.AQS_BADREQUEST, "events are only stored in Cassandra", []byte{}})
+		return
+	}
+	keyspace := config.Cassandra().Keyspace
+	switch strings.ToLower(q.Method) {
+
+	case "post":
+		if q.What == "" {
+			mm.sendAPIResponse(q.Channel, config.APIQueryResponse{config.AQS_BADREQUEST, "no what specified", []byte{}})
+			return
+		}
+		when := time.Now()
+		if q.When > 0 {
+			when = time.Unix(q.When, 0)
+		}
+		id := gocql.UUIDFromTime(when)
+		e := event{id.String(), q.What, float64(when.UnixNano()) / float64(time.Second), normalizeTags(q.Tags), q.Data}
+		if err := mm.db().Query(fmt.Sprintf(
+			`INSERT INTO %s.events (tenant, day, time, id, what, tags, data) VALUES (?, ?, ?, ?, ?, ?, ?)`, keyspace),
+			q.Tenant, floorDiv(when.Unix(), eventBucket), when, id, e.What, e.Tags, e.Data).Exec(); err != nil {
+			config.G.Log.System.LogError("MetricManager unable to record event: %s", err.Error())
+			logging.Statsd.Client.Inc("metricmgr.db.err.write", 1, 1.0)
+			mm.sendAPIResponse(q.Channel, config.APIQueryResponse{config.AQS_ERROR, err.Error(), []byte{}})
+			return
+		}
+		mm.sendResponse(q.Channel, e)
+
+	default:
+		if q.From > q.To {
+			mm.sendAPIResponse(q.Channel, config.APIQueryResponse{config.AQS_BADREQUEST, "from is after until", []byte{}})
+			return
+		}
+		days := eventDays(q.From, q.To)
+		if len(days) > maxEventDays {
+			mm.sendAPIResponse(q.Channel, config.APIQueryResponse{config.AQS_BADREQUEST,
+				fmt.Sprintf("events may be listed for at most %d days at once", maxEventDays), []byte{}})
+			return
+		}
+		tags := normalizeTags(q.Tags)
+		list := []event{}
+		var e event
+		var when time.Time
+		var id gocql.UUID
+		for _, day := range days {
+			iter := mm.reads().Query(fmt.Sprintf(
+				`SELECT time, id, what, tags, data FROM %s.events WHERE tenant = ? AND day = ? AND time >= ? AND time <= ?`,
+				keyspace), q.Tenant, day, time.Unix(q.From, 0), time.Unix(q.To, 0)).Iter()
+			for iter.Scan(&when, &id, &e.What, &e.Tags, &e.Data) {
+				e.ID, e.When = id.String(), float64(when.UnixNano())/float64(time.Second)
+				if e.Tags == nil {
+					e.Tags = []string{}
+				}
+				if e.hasTags(tags, q.AnyTag) {
+					list = append(list, e)
+				}
+				e.Tags = nil
+			}
+			if err := iter.Close(); err != nil {
+				config.G.Log.System.LogError("MetricManager unable to read events: %s", err.Error())
+				logging.Statsd.Client.Inc("metricmgr.db.err.read", 1, 1.0)
+				mm.sendAPIResponse(q.Channel, config.APIQueryResponse{config.AQS_ERROR, err.Error(), []byte{}})
+				return
+			}
+		}
+		mm.sendResponse(q.Channel, list)
+	}
+}
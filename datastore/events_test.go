@@ -0,0 +1,48 @@
+package datastore
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestEventDays(t *testing.T) {
+	tests := []struct {
+		from, to int64
+		days     []int64
+	}{
+		{0, 0, []int64{0}},
+		{86399, 86400, []int64{0, 1}},
+		{86400, 3 * 86400, []int64{1, 2, 3}},
+		{-1, 1, []int64{-1, 0}}, // Before the epoch
+	}
+	for _, test := range tests {
+		if days := eventDays(test.from, test.to); !reflect.DeepEqual(days, test.days) {
+			t.Errorf("eventDays(%d, %d) = %v, expected %v", test.from, test.to, days, test.days)
+		}
+	}
+}
+
+func TestEventTags(t *testing.T) {
+	if tags := normalizeTags([]string{"web", "", "deploy", "web"}); !reflect.DeepEqual(tags, []string{"deploy", "web"}) {
+		t.Errorf("normalizeTags() = %v, expected [deploy web]", tags)
+	}
+
+	e := event{Tags: []string{"deploy", "web"}}
+	tests := []struct {
+		tags []string
+		any  bool
+		has  bool
+	}{
+		{nil, false, true},
+		{[]string{"deploy"}, false, true},
+		{[]string{"deploy", "web"}, false, true},
+		{[]string{"deploy", "db"}, false, false},
+		{[]string{"deploy", "db"}, true, true},
+		{[]string{"db", "cache"}, true, false},
+	}
+	for _, test := range tests {
+		if has := e.hasTags(test.tags, test.any); has != test.has {
+			t.Errorf("hasTags(%v, %v) = %v, expected %v", test.tags, test.any, has, test.has)
+		}
+	}
+}
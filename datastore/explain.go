@@ -0,0 +1,42 @@
+package datastore
+
+import (
+	"time"
+)
+
+// queryTrace records how a metric query was answered, and is returned with its series when it is explained.
+// The query cache is bypassed, so that the reads are those it would make.
+type queryTrace struct {
+	Paths   []*pathTrace `json:"paths"`
+	Elapsed float64      `json:"elapsed"` // Seconds taken by the whole query
+}
+
+// pathTrace records how the series of one path was built.
+type pathTrace struct {
+	Path          string       `json:"path"` // As stored, with any tenant
+	Expression    string       `json:"expression"`
+	Method        string       `json:"method"`
+	Reads         []*readTrace `json:"reads"`         // The table reads, finest first
+	Memory        int          `json:"memory"`        // The windows merged from memory, not yet in the database
+	MemoryElapsed float64      `json:"memoryelapsed"` // Seconds taken to fetch them from the shard
+	Consolidation int          `json:"consolidation"` // The number of points combined into each, to meet maxDataPoints
+	Step          int64        `json:"step"`          // Seconds between the values returned
+	Elapsed       float64      `json:"elapsed"`       // Seconds taken to build the series
+}
+
+// readTrace records one read from a rollup table.
+type readTrace struct {
+	Table   string  `json:"table"`
+	Window  int64   `json:"window"` // Seconds per row of the table
+	From    int64   `json:"from"`
+	To      int64   `json:"to"`
+	CQL     string  `json:"cql"`
+	Rows    int     `json:"rows"`
+	Elapsed float64 `json:"elapsed"` // Seconds taken by the read
+	Error   string  `json:"error,omitempty"`
+}
+
+// since returns the seconds since a time, as traces report them.
+func since(start time.Time) float64 {
+	return time.Since(start).Seconds()
+}
@@ -0,0 +1,185 @@
+package datastore
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gocql/gocql"
+
+	"github.com/jeffpierce/cassabon/config"
+	"github.com/jeffpierce/cassabon/whisper"
+)
+
+// The whisper aggregation method corresponding to each rollup method.
+var whisperMethods = map[config.RollupMethod]uint32{
+	config.AVERAGE: whisper.Average,
+	config.MAX:     whisper.Max,
+	config.MIN:     whisper.Min,
+	config.SUM:     whisper.Sum,
+	config.LAST:    whisper.Last,
+	config.COUNTER: whisper.Sum, // The stored values are per-window increases
+}
+
+// exportPoint is one stored row of a path.
+type exportPoint struct {
+	ts   time.Time
+	stat float64
+}
+
+// Export dumps the data stored between from and to for the paths matched by each query, either as
+// CSV, to a file or standard output, or as whisper files, in a directory tree like Graphite's.
+func Export(format, out string, from, to int64, queries []string) (paths, rows int, err error) {
+
+	if format != "csv" && format != "whisper" {
+		return 0, 0, fmt.Errorf("unknown format %q: use csv or whisper", format)
+	}
+	if format == "whisper" && out == "" {
+		return 0, 0, fmt.Errorf("whisper export requires an output directory")
+	}
+	if to == 0 {
+		to = time.Now().Unix()
+	}
+
+	dbClient, err := cassandraSession()
+	if err != nil {
+		return
+	}
+	defer dbClient.Close()
+	overrides, err := loadOverrides(dbClient)
+	if err != nil {
+		return
+	}
+	rules := newRollupRules(overrides)
+
+	// Expand the queries to the paths they match.
+	im := new(IndexManager)
+	im.Init(false)
+	var matched []string
+	for _, query := range queries {
+		var expanded []string
+		if expanded, err = expandQuery(im, query); err != nil {
+			return
+		}
+		matched = append(matched, expanded...)
+	}
+
+	var cw *csv.Writer
+	if format == "csv" {
+		var w io.Writer = os.Stdout
+		if out != "" {
+			var fp *os.File
+			if fp, err = os.Create(out); err != nil {
+				return
+			}
+			defer fp.Close()
+			w = fp
+		}
+		cw = csv.NewWriter(w)
+		defer cw.Flush()
+		cw.Write([]string{"path", "table", "time", "stat"})
+	}
+
+	for _, path := range matched {
+		def := rules.defs[rules.getExpression(path)]
+		windows := make([][]exportPoint, len(def.Windows))
+		for i, w := range def.Windows {
+			if windows[i], err = readExport(dbClient, rules.stmts.get(w.Table), path, from, to); err != nil {
+				return
+			}
+			rows += len(windows[i])
+		}
+
+		if cw != nil {
+			for i, w := range def.Windows {
+				for _, p := range windows[i] {
+					cw.Write([]string{path, w.Table, strconv.FormatInt(p.ts.Unix(), 10),
+						strconv.FormatFloat(p.stat, 'f', -1, 64)})
+				}
+			}
+			if err = cw.Error(); err != nil {
+				return
+			}
+		} else {
+			if err = writeExportWhisper(out, path, def, windows); err != nil {
+				return
+			}
+		}
+		paths++
+	}
+	return
+}
+
+// expandQuery returns the leaf paths matched by a query, looking them up in the index if it has wildcards.
+func expandQuery(im *IndexManager, query string) ([]string, error) {
+	if !strings.ContainsAny(query, "*?[{") {
+		return []string{query}, nil
+	}
+	ch := make(chan config.APIQueryResponse, 1)
+	im.queryGET(config.IndexQuery{"GET", query, "", false, false, 0, 0, "", "", nil, "", ch})
+	resp := <-ch
+	if resp.Status != config.AQS_OK {
+		return nil, fmt.Errorf("%s: %s", query, resp.Message)
+	}
+	var found []IndexResponse
+	if err := json.Unmarshal(resp.Payload, &found); err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, ir := range found {
+		if ir.Leaf {
+			paths = append(paths, ir.Path)
+		}
+	}
+	return paths, nil
+}
+
+// readExport reads the rows of a path stored in a table between from and to, in time order.
+func readExport(dbClient *gocql.Session, stmts *tableStatements, path string, from, to int64) ([]exportPoint, error) {
+	query := stmts.selectStat
+	var points []exportPoint
+	var p exportPoint
+	iter := dbClient.Query(query, path, time.Unix(from, 0), time.Unix(to, 0)).Iter()
+	for iter.Scan(&p.stat, &p.ts) {
+		points = append(points, p)
+	}
+	return points, iter.Close()
+}
+
+// writeExportWhisper writes a path's rows to a whisper file, with one archive for each rollup window.
+func writeExportWhisper(dir, path string, def config.RollupDef, windows [][]exportPoint) error {
+
+	// Convert "foo.bar" to "dir/foo/bar.wsp".
+	filename := filepath.Join(dir, filepath.Join(strings.Split(path, ".")...)+".wsp")
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return err
+	}
+
+	archives := make([]whisper.Archive, len(def.Windows))
+	for i, w := range def.Windows {
+		archives[i] = whisper.Archive{0, uint32(w.Window.Seconds()), uint32(w.Retention / w.Window)}
+	}
+	f, err := whisper.Create(filename, whisperMethods[def.Method], 0, archives)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// A window is written with its end, but whisper stamps each point with the start of its interval.
+	for i, w := range def.Windows {
+		points := make([]whisper.Point, len(windows[i]))
+		for j, p := range windows[i] {
+			points[j] = whisper.Point{uint32(p.ts.Add(-w.Window).Unix()), p.stat}
+		}
+		if err := f.WriteArchive(i, points); err != nil {
+			return fmt.Errorf("%s: %s", filename, err.Error())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,32 @@
+package datastore
+
+import (
+	"encoding/json"
+
+	"github.com/jeffpierce/cassabon/config"
+	"github.com/jeffpierce/cassabon/logging"
+)
+
+// FlushResult is returned for a "FLUSH" metric query.
+type FlushResult struct {
+	Shards int `json:"shards"` // The number of shards whose accumulated data was written
+}
+
+// queryFlush has every shard write out what it has accumulated now, stamped with the current time, as is
+// done before a change of peers, rather than waiting for each window to close. Each window then moves on
+// to the next, so what was written isn't written again.
+func (mm *MetricManager) queryFlush(q config.MetricQuery) {
+
+	config.G.Log.System.LogInfo("MetricManager::queryFlush flushing %d shard(s)", len(mm.shards))
+
+	var fr FlushResult
+	for _, s := range mm.shards {
+		if s.flushNow() {
+			fr.Shards++
+		}
+	}
+	logging.Statsd.Client.Inc("metricmgr.flush.forced", 1, 1.0)
+
+	jsonText, _ := json.Marshal(fr)
+	mm.sendAPIResponse(q.Channel, config.APIQueryResponse{config.AQS_OK, "", jsonText})
+}
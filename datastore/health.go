@@ -0,0 +1,57 @@
+package datastore
+
+import (
+	"encoding/json"
+	"sync/atomic"
+
+	"github.com/jeffpierce/cassabon/config"
+)
+
+// A path no one would store, which is looked up in the index to check that it answers.
+const healthProbePath = "cassabon.healthcheck.probe"
+
+// MetricHealth is returned for a "HEALTH" metric query: whether Cassandra can be read and written,
+// and how much is waiting to be accumulated and written.
+type MetricHealth struct {
+	Cassandra   string `json:"cassandra"`   // "ok", or why a trial query failed
+	BreakerOpen bool   `json:"breakeropen"` // Whether writes are paused after repeated failures
+	Queued      int    `json:"queued"`      // Metrics waiting to be accumulated
+	QueueSize   int    `json:"queuesize"`   // The most metrics that may wait
+	Writes      int    `json:"writes"`      // Batches waiting for a writer
+	LastWrite   int64  `json:"lastwrite"`   // When a batch was last written, in seconds since the epoch, or 0 if never
+}
+
+// IndexHealth is returned for a "health" index query: whether the index answers.
+type IndexHealth struct {
+	Index string `json:"index"` // "ok", or why a trial find failed
+}
+
+// queryHealth reports the state of the Cassandra session, and of the queues in front of it.
+func (mm *MetricManager) queryHealth(q config.MetricQuery) {
+	var mh MetricHealth
+	mh.Cassandra = "ok"
+	if err := mm.engine.health(); err != nil {
+		mh.Cassandra = err.Error()
+	}
+	mh.BreakerOpen = mm.breaker.isOpen()
+	mh.Queued = len(config.G.Channels.MetricStore)
+	mh.QueueSize = cap(config.G.Channels.MetricStore)
+	mh.Writes = len(mm.insert)
+	mh.LastWrite = atomic.LoadInt64(&mm.lastWrite)
+	jsonText, _ := json.Marshal(mh)
+	mm.sendAPIResponse(q.Channel, config.APIQueryResponse{config.AQS_OK, "", jsonText})
+}
+
+// queryHealth reports whether the configured index answers; a copy in memory always would.
+func (im *IndexManager) queryHealth(q config.IndexQuery) {
+	store := im.store
+	if ti, isTrie := store.(*trieIndex); isTrie {
+		store = ti.backing
+	}
+	ih := IndexHealth{"ok"}
+	if _, err := store.find([]string{healthProbePath}, "", 1); err != nil {
+		ih.Index = err.Error()
+	}
+	jsonText, _ := json.Marshal(ih)
+	respond(q, config.APIQueryResponse{config.AQS_OK, "", jsonText})
+}
@@ -0,0 +1,122 @@
+package datastore
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/jeffpierce/cassabon/config"
+	"github.com/jeffpierce/cassabon/whisper"
+)
+
+// How often to report progress while importing, in files.
+const importProgress = 1000
+
+// ImportWhisper loads every whisper file in a directory tree into the rollup tables, and indexes its path.
+// The path of each metric is that of its file relative to the root, prefixed with the supplied prefix,
+// if any. Each rollup window is filled from the archive closest to its precision.
+func ImportWhisper(root, prefix string) (files, rows, failed int, err error) {
+
+	// Set up a metric manager that does nothing but write.
+	mm := new(MetricManager)
+	dbClient, err := cassandraSession()
+	if err != nil {
+		return
+	}
+	defer dbClient.Close()
+	mm.sessions.Store(&cassandraSessions{dbClient, dbClient})
+	mm.engine = cassandraEngine{mm}
+	mm.populateSchema()
+	overrides, err := loadOverrides(dbClient)
+	if err != nil {
+		return
+	}
+	rules := newRollupRules(overrides)
+	mm.insert = make(chan *tableWrite, 5000)
+	cs := config.Cassandra()
+	mm.breaker.init(cs.BreakerFailures, time.Duration(cs.BreakerPause)*time.Second)
+	mm.startWriters()
+	defer func() {
+		mm.stopWriters()
+	}()
+	im := new(IndexManager)
+	im.Init(false)
+
+	prefix = strings.Trim(prefix, ".")
+	now := time.Now()
+	err = filepath.Walk(root, func(filename string, info os.FileInfo, walkErr error) error {
+		if walkErr != nil {
+			config.G.Log.System.LogWarn("Skipping %s: %s", filename, walkErr.Error())
+			failed++
+			return nil
+		}
+		if info.IsDir() || filepath.Ext(filename) != ".wsp" {
+			return nil
+		}
+
+		// Convert "root/foo/bar.wsp" to "prefix.foo.bar".
+		rel, _ := filepath.Rel(root, filename)
+		path := strings.Replace(strings.TrimSuffix(rel, ".wsp"), string(filepath.Separator), ".", -1)
+		if prefix != "" {
+			path = prefix + "." + path
+		}
+		if config.G.Tenants.Enabled {
+			if _, _, err := config.SplitTenant(path); err != nil {
+				config.G.Log.System.LogWarn("Skipping %s: %s", filename, err.Error())
+				failed++
+				return nil
+			}
+		}
+
+		tables, err := readWhisper(filename, path, rules, now)
+		if err != nil {
+			config.G.Log.System.LogWarn("Skipping %s: %s", filename, err.Error())
+			failed++
+			return nil
+		}
+		written, _ := mm.writeBackfill(tables, nil)
+		im.index(path)
+		config.G.Log.System.LogDebug("Imported %s as %s, %d rows", filename, path, written)
+
+		files++
+		rows += written
+		if files%importProgress == 0 {
+			config.G.Log.System.LogInfo("Imported %d files so far, %d rows", files, rows)
+		}
+		return nil
+	})
+	return
+}
+
+// readWhisper rolls up the points of a whisper file into the windows of the expression its path matches.
+func readWhisper(filename, path string, rules *rollupRules, now time.Time) (backfillTables, error) {
+
+	f, err := whisper.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	tables := make(backfillTables)
+	def := rules.defs[rules.getExpression(path)]
+	for _, w := range def.Windows {
+		archive := f.ArchiveFor(w.Window)
+		points, err := f.Points(archive, now)
+		if err != nil {
+			return nil, err
+		}
+
+		// Whisper stamps each point with the start of its interval, but a window is written with its end.
+		spp := float64(f.Archives[archive].SecondsPerPoint)
+		metrics := make([]config.CarbonMetric, 0, len(points))
+		for _, p := range points {
+			if !math.IsNaN(p.Value) {
+				metrics = append(metrics, config.CarbonMetric{path, p.Value, float64(p.Timestamp) + spp})
+			}
+		}
+		tables.add(path, def.Method, w, metrics)
+	}
+	return tables, nil
+}
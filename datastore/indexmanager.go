@@ -3,11 +3,10 @@ package datastore
 import (
 	"bytes"
 	"encoding/json"
-	"io/ioutil"
-	"net/http"
-	"strconv"
+	"fmt"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/otium/queue"
@@ -18,64 +17,102 @@ import (
 
 // IndexResponse defines the individual elements returned as an array by "GET /paths".
 type IndexResponse struct {
-	Path   string `json:"path"`
-	Depth  int    `json:"depth"`
-	Tenant string `json:"tenant"`
-	Leaf   bool   `json:"leaf"`
+	Path    string `json:"path"`
+	Depth   int    `json:"depth"`
+	Tenant  string `json:"tenant"`
+	Leaf    bool   `json:"leaf"`
+	Updated int64  `json:"updated"` // When the node was last indexed, in seconds since the epoch
 }
 
-// ElasticResponse is the struct we unmarshal the response from an ElasticSearch query to.
-type ElasticResponse struct {
-	Took     int      `json:"took"`
-	TimedOut bool     `json:"timed_out"`
-	Shards   ERShards `json:"_shards"`
-	Hits     ERHits   `json:"hits"`
+// pathIndex is where the index of paths is kept. Every node of a path is indexed, each branch as well
+// as the leaf, and the tenant's own node is not. Queries have had their braces expanded, and are in
+// full, tenant and all. A find matching more paths than its limit, unless 0, fails with tooManyPaths.
+type pathIndex interface {
+	init(bootstrap bool)                                                      // Prepares the index for use
+	reopen() error                                                            // Reconnects with the settings in effect
+	put(node IndexResponse) error                                             // Indexes one node
+	remove(path string) error                                                 // Removes one node
+	hasChildren(branch string) bool                                           // Whether nodes lie beneath a branch; true if unsure
+	leaves() ([]string, error)                                                // Every leaf path
+	stale(before int64) ([]string, error)                                     // Leaf paths last indexed before a time
+	find(queries []string, tenant string, limit int) ([]IndexResponse, error) // Nodes matched by any of the queries, up to a limit
 }
 
-type ERShards struct {
-	Total      int `json:"total"`
-	Successful int `json:"successful"`
-	Failed     int `json:"failed"`
+// tooManyPaths is the error from a find that matches more paths than its limit.
+type tooManyPaths int
+
+func (limit tooManyPaths) Error() string {
+	return fmt.Sprintf("query matches more than %d paths, so must be narrowed", int(limit))
 }
 
-type ERHits struct {
-	Total    int           `json:"total"`
-	MaxScore float32       `json:"max_score"`
-	Hits     []ERSearchHit `json:"hits"`
+// batchIndex is a pathIndex that can also index many nodes in a single request.
+type batchIndex interface {
+	putBatch(nodes []IndexResponse) error // Indexes the nodes, in order
 }
 
-type ERSearchHit struct {
-	Index  string        `json:"_index"`
-	Type   string        `json:"_type"`
-	ID     string        `json:"_id"`
-	Score  float32       `json:"_score"`
-	Source IndexResponse `json:"_source"`
+// fuzzyIndex is a pathIndex that can also find paths similar to a query, allowing for misspellings.
+type fuzzyIndex interface {
+	findFuzzy(query, tenant string) ([]IndexResponse, error) // Nodes like the query, best match first
 }
 
-type ERQuery struct {
-	Sort  []map[string]map[string]string                            `json:"sort"`
-	Query map[string]map[string][]map[string]map[string]interface{} `json:"query"`
+// pagedIndex is a pathIndex that can also return a page of the nodes a find matches, without the rest.
+type pagedIndex interface {
+	findPage(queries []string, tenant string, offset, count int) ([]IndexResponse, int, error) // Nodes from offset on, and the next offset
 }
 
+// New paths are indexed in batches of up to this many, gathered for at most indexBatchInterval.
+const (
+	indexBatchSize     = 500
+	indexBatchInterval = 250 * time.Millisecond
+)
+
 type IndexManager struct {
 	wg         *sync.WaitGroup
 	IndexQueue *queue.Queue
+	store      pathIndex
+	tags       *tagSet // The tagged series in the index, for completing tags
 }
 
-func (im *IndexManager) Init(bootstrap bool) {
-	// If bootstrap is true, initialize mapping in ElasticSearch
-	if bootstrap {
-		im.initMapping()
+// newPathIndex returns the configured index, with a copy in memory in front of it if so configured.
+func newPathIndex() pathIndex {
+	var store pathIndex = new(elasticIndex)
+	if config.G.Index.Backend == config.INDEX_CASSANDRA {
+		store = new(cassandraIndex)
 	}
+	if config.G.Index.Memory {
+		store = &trieIndex{backing: store, snapshot: config.G.Index.SnapshotFile}
+	}
+	return store
+}
 
-	// Initialize index worker queue.
+func (im *IndexManager) Init(bootstrap bool) {
+	// If bootstrap is true, initialize the index storage.
+	im.store = newPathIndex()
+	im.store.init(bootstrap)
+	im.tags = new(tagSet)
+
+	// Initialize index worker queue, which takes single paths or batches of them.
 	im.IndexQueue = queue.NewQueue(func(metricPath interface{}) {
-		if path, ok := metricPath.(string); ok {
+		switch path := metricPath.(type) {
+		case string:
 			im.index(path)
+		case []string:
+			im.indexPaths(path)
 		}
 	}, 100)
 }
 
+// Reopen reconnects the index with the connection settings reloaded on SIGHUP. If it can't, the connections
+// in use are kept. It is called while the IndexManager is stopped.
+func (im *IndexManager) Reopen() {
+	if err := im.store.reopen(); err != nil {
+		config.G.Log.System.LogError("IndexManager unable to reconnect: %s; keeping the connections in use", err.Error())
+		return
+	}
+	im.tags.reset()
+	config.G.Log.System.LogInfo("IndexManager reconnected with the reloaded settings")
+}
+
 func (im *IndexManager) Start(wg *sync.WaitGroup) {
 	im.wg = wg
 	im.wg.Add(1)
@@ -86,146 +123,156 @@ func (im *IndexManager) run() {
 
 	defer config.G.OnPanic()
 
+	// A copy of the index in memory is refreshed periodically, and saved on each refresh and on termination.
+	// Only one refresh at a time; a tick that arrives while one is in progress is skipped.
+	var refresh <-chan time.Time
+	var refreshing int32
+	ti, isTrie := im.store.(*trieIndex)
+	if isTrie {
+		ticker := time.NewTicker(config.G.Index.RefreshInterval)
+		defer ticker.Stop()
+		refresh = ticker.C
+	}
+
+	// New paths are gathered into batches, which are indexed when full, or after a short while.
+	var pending []string
+	flush := time.NewTicker(indexBatchInterval)
+	defer flush.Stop()
+
 	// Wait for entries to arrive, and process them.
 	for {
 		select {
 		case <-config.G.OnReload2:
 			config.G.Log.System.LogDebug("IndexManager::run received QUIT message")
+			if len(pending) > 0 {
+				im.IndexQueue.Push(pending)
+			}
+			if isTrie {
+				im.saveSnapshot(ti)
+			}
 			im.wg.Done()
 			return
+		case <-refresh:
+			if !atomic.CompareAndSwapInt32(&refreshing, 0, 1) {
+				config.G.Log.System.LogDebug("IndexManager::run skipped a refresh, as the last is still in progress")
+				continue
+			}
+			go func() {
+				defer atomic.StoreInt32(&refreshing, 0)
+				ti.refresh()
+				im.saveSnapshot(ti)
+			}()
 		case metric := <-config.G.Channels.IndexStore:
-			im.IndexQueue.Push(metric.Path)
+			pending = append(pending, metric.Path)
+			if len(pending) >= indexBatchSize {
+				im.IndexQueue.Push(pending)
+				pending = nil
+			}
+		case <-flush.C:
+			if len(pending) > 0 {
+				im.IndexQueue.Push(pending)
+				pending = nil
+			}
 		case query := <-config.G.Channels.IndexRequest:
 			go im.query(query)
 		}
 	}
 }
 
-// initMapping initializes ElasticSearch for cassabon.
-func (im *IndexManager) initMapping() {
-	mapping := map[string]map[string]map[string]map[string]map[string]string{
-		"mappings": map[string]map[string]map[string]map[string]string{
-			"path": map[string]map[string]map[string]string{
-				"properties": map[string]map[string]string{
-					"path": map[string]string{
-						"type":  "string",
-						"index": "not_analyzed",
-					},
-					"depth": map[string]string{
-						"type": "long",
-					},
-					"tenant": map[string]string{
-						"type": "string",
-					},
-					"leaf": map[string]string{
-						"type": "boolean",
-					},
-				},
-			},
-		},
+// saveSnapshot saves the copy of the index in memory to the snapshot file, if there is one.
+func (im *IndexManager) saveSnapshot(ti *trieIndex) {
+	if ti.snapshot == "" {
+		return
 	}
-
-	jsonMap, _ := json.Marshal(mapping)
-	config.G.Log.System.LogDebug("%s", string(jsonMap))
-
-	putreq, _ := http.NewRequest("PUT", config.G.ElasticSearch.MapURL, bytes.NewBuffer(jsonMap))
-	r := im.httpRequest(putreq)
-
-	config.G.Log.System.LogDebug("%v", string(r))
-
-	if r == nil {
-		config.G.Log.System.LogFatal("Could not initialize mapping for ElasticSearch.")
+	if err := ti.save(); err != nil {
+		config.G.Log.System.LogError("IndexManager unable to write index snapshot: %s", err.Error())
 	}
 }
 
-// getAllLeafNodes queries ElasticSearch for all leaf nodes. Used for populating metric manager's stat paths on reboot.
+// getAllLeafNodes queries the index for all leaf nodes. Used for populating metric manager's stat paths on reboot.
 func (im *IndexManager) getAllLeafNodes() []string {
-	sort := []map[string]map[string]string{
-		{
-			"path": map[string]string{
-				"order": "asc",
-			},
-		},
-	}
-	query := map[string]map[string][]map[string]map[string]interface{}{
-		"bool": map[string][]map[string]map[string]interface{}{
-			"must": []map[string]map[string]interface{}{
-				{
-					"match": map[string]interface{}{
-						"leaf": true,
-					},
-				},
-			},
-		},
-	}
-
-	fullQuery := ERQuery{sort, query}
-	getreq := im.prepRequest(fullQuery)
-	r := im.httpRequest(getreq)
-
-	var esResp ElasticResponse
-	var pathList []string
-
-	if r != nil {
-		_ = json.Unmarshal(r, &esResp)
-
-		config.G.Log.System.LogDebug("esResp: %v", esResp)
-
-		for _, hit := range esResp.Hits.Hits {
-			pathList = append(pathList, hit.Source.Path)
-		}
-	} else {
-		logging.Statsd.Client.Inc("indexmgr.es.err.get", 1, 1.0)
-		config.G.Log.System.LogError("Error querying ES.")
+	pathList, err := im.store.leaves()
+	if err != nil {
+		config.G.Log.System.LogError("Error querying index: %s", err.Error())
 	}
-
 	config.G.Log.System.LogDebug("Retrieved %v stat paths.", len(pathList))
 	return pathList
 }
 
-func (im *IndexManager) prepRequest(fullQuery ERQuery) *http.Request {
-	jsonQuery, _ := json.Marshal(fullQuery)
-	config.G.Log.System.LogDebug("%s", string(jsonQuery))
-
-	// Get the count so that we capture all of the possible paths.
-	countreq, _ := http.NewRequest("GET", config.G.ElasticSearch.CountURL, strings.NewReader(string(jsonQuery)))
-	size := "size=" + im.getCount(countreq)
-
-	searchURL := strings.Join([]string{config.G.ElasticSearch.SearchURL, size}, "?")
-	getreq, _ := http.NewRequest("GET", searchURL, strings.NewReader(string(jsonQuery)))
-
-	return getreq
+// getStalePaths queries the index for the leaf paths that have not been indexed since a time.
+func (im *IndexManager) getStalePaths(before time.Time) []string {
+	pathList, err := im.store.stale(before.Unix())
+	if err != nil {
+		config.G.Log.System.LogError("Error querying index: %s", err.Error())
+	}
+	return pathList
 }
 
 // IndexMetricPath takes a metric path string and sends it off to be processed by processMetricPath().
 func (im *IndexManager) index(path string) {
 	it := time.Now()
 	config.G.Log.System.LogDebug("IndexManager::index path=%s", path)
-	splitPath := strings.Split(path, ".")
-	im.processMetricPath(splitPath, len(splitPath), true)
+	im.processMetricPath(pathNodes(path, it.Unix()))
+	im.tags.update(path, true)
 	logging.Statsd.Client.TimingDuration("indexmgr.index", time.Since(it), 1.0)
 }
 
-func (im *IndexManager) httpRequest(req *http.Request) []byte {
-	client := &http.Client{Timeout: time.Duration(15 * time.Second)}
-	resp, err := client.Do(req)
-
-	if err != nil {
-		logging.Statsd.Client.Inc("indexmgr.es.err.httpreq", 1, 1.0)
-		config.G.Log.System.LogError("Received error from ElasticSearch: %v, request: %v", err.Error(), req)
-		return nil
+// indexPaths indexes a batch of metric paths at once, if the index can store a batch, and otherwise one
+// at a time. Branches shared by several of the paths are indexed once.
+func (im *IndexManager) indexPaths(paths []string) {
+	bi, ok := im.store.(batchIndex)
+	if len(paths) == 0 {
+		return
+	}
+	if !ok {
+		for _, path := range paths {
+			im.index(path)
+		}
+		return
 	}
 
-	defer resp.Body.Close()
-	body, _ := ioutil.ReadAll(resp.Body)
-	return body
+	it := time.Now()
+	config.G.Log.System.LogDebug("IndexManager::indexPaths paths=%d", len(paths))
+	var nodes []IndexResponse
+	seen := make(map[string]int)
+	for _, path := range paths {
+		for _, node := range pathNodes(path, it.Unix()) {
+			// A later path's node replaces an earlier one, as it would if the paths were indexed in turn.
+			if i, found := seen[node.Path]; found {
+				nodes[i] = node
+				continue
+			}
+			seen[node.Path] = len(nodes)
+			nodes = append(nodes, node)
+		}
+	}
+	for retries := 1; ; retries++ {
+		err := bi.putBatch(nodes)
+		if err == nil {
+			break
+		}
+		config.G.Log.System.LogWarn("indexPaths's request to the index failed (%s), sending to retry in %d seconds.",
+			err.Error(), retries)
+		time.Sleep(time.Duration(retries) * time.Second)
+	}
+	for _, path := range paths {
+		im.tags.update(path, true)
+	}
+	logging.Statsd.Client.TimingDuration("indexmgr.indexbatch", time.Since(it), 1.0)
 }
 
-// processMetricPath recursively indexes the metric path via the ElasticSearch REST API.
-func (im *IndexManager) processMetricPath(splitPath []string, pathLen int, isLeaf bool) {
-	// Process the metric path one node at a time.  We store metrics in ElasticSearch.
-	retries := 0
-	for pathLen > 0 {
+// pathNodes returns the nodes to be indexed for a metric path, from the leaf up.
+// Paths with a tenant are stored in full, but the tenant's own node is not indexed.
+func pathNodes(path string, updated int64) []IndexResponse {
+	splitPath := strings.Split(path, ".")
+	var tenant string
+	minLen := 0
+	if config.G.Tenants.Enabled {
+		tenant = splitPath[0]
+		minLen = 1
+	}
+	var nodes []IndexResponse
+	for isLeaf := true; len(splitPath) > minLen; isLeaf = false {
 
 		// Construct the metric string
 		metricPath := strings.Join(splitPath, ".")
@@ -234,58 +281,60 @@ func (im *IndexManager) processMetricPath(splitPath []string, pathLen int, isLea
 		if string(metricPath[len(metricPath)-1]) == "%" {
 			metricPath = metricPath[:len(metricPath)-1]
 		}
-		config.G.Log.System.LogDebug("IndexManager indexing \"%s\"", metricPath)
 
-		pathToIndex := IndexResponse{
+		nodes = append(nodes, IndexResponse{
 			metricPath,
-			pathLen,
-			"",
+			len(splitPath),
+			tenant,
 			isLeaf,
-		}
-
-		urlToPut := strings.Join([]string{config.G.ElasticSearch.PutURL, metricPath}, "/")
+			updated,
+		})
 
-		// Marshal the struct into JSON
-		jsonPath, err := json.Marshal(pathToIndex)
-
-		if err != nil {
-			logging.Statsd.Client.Inc("indexmgr.es.err.json", 1, 1.0)
-			config.G.Log.System.LogError("Unable to marshal pathToIndex of %v, error is %v", pathToIndex, err.Error())
-			return // Let's not fill up ES with junk if we can't marshal our path struct.
-		}
-
-		putreq, err := http.NewRequest("PUT", urlToPut, bytes.NewBuffer(jsonPath))
-
-		if err != nil {
-			logging.Statsd.Client.Inc("indexmgr.es.err.put", 1, 1.0)
-			config.G.Log.System.LogError("Error when attempting to index %v: %v", metricPath, err.Error())
-		}
+		// Pop the last node of the metric off, and resume loop.
+		splitPath = splitPath[:len(splitPath)-1]
+	}
+	return nodes
+}
 
-		r := im.httpRequest(putreq)
-		if r != nil {
-			// Pop the last node of the metric off, set isLeaf to false, and resume loop.
-			_, splitPath = splitPath[len(splitPath)-1], splitPath[:len(splitPath)-1]
-			isLeaf = false
-			pathLen = len(splitPath)
+// processMetricPath indexes the nodes of a metric path one at a time, retrying each until it succeeds.
+func (im *IndexManager) processMetricPath(nodes []IndexResponse) {
+	retries := 0
+	for len(nodes) > 0 {
+		config.G.Log.System.LogDebug("IndexManager indexing \"%s\"", nodes[0].Path)
+		if err := im.store.put(nodes[0]); err == nil {
+			nodes = nodes[1:]
 			retries = 0
 		} else {
-			logging.Statsd.Client.Inc("indexmgr.es.err.pmr.req", 1, 1.0)
 			retries++
-			config.G.Log.System.LogWarn("processMetricPath's httprequest to ES came back as nil, sending to retry in %d seconds.", retries)
+			config.G.Log.System.LogWarn("processMetricPath's request to the index failed (%s), sending to retry in %d seconds.",
+				err.Error(), retries)
 			time.Sleep(time.Duration(retries) * time.Second)
 		}
 	}
 }
 
-func (im *IndexManager) getCount(req *http.Request) string {
-	var resp ElasticResponse
-	r := im.httpRequest(req)
-	if r != nil {
-		_ = json.Unmarshal(r, &resp)
-		config.G.Log.System.LogDebug("total: %v", resp.Hits.Total)
-		return strconv.Itoa(resp.Hits.Total)
-	} else {
-		return "0"
+// removePath removes a leaf path from the index, along with any of its ancestors left without children.
+func (im *IndexManager) removePath(path string) {
+	config.G.Log.System.LogDebug("IndexManager::removePath path=%s", path)
+	splitPath := strings.Split(path, ".")
+	leafLen := len(splitPath)
+	minLen := 1
+	if config.G.Tenants.Enabled {
+		minLen = 2 // The tenant's own node is not indexed
+	}
+	for len(splitPath) >= minLen {
+		nodePath := strings.Join(splitPath, ".")
+		if len(splitPath) < leafLen && im.store.hasChildren(nodePath) {
+			return
+		}
+		if err := im.store.remove(nodePath); err != nil {
+			config.G.Log.System.LogError("Error removing %q from the index: %s", nodePath, err.Error())
+			return
+		}
+		if len(splitPath) == leafLen {
+			im.tags.update(path, false)
+		}
+		splitPath = splitPath[:len(splitPath)-1]
 	}
 }
 
@@ -294,79 +343,354 @@ func (im *IndexManager) query(q config.IndexQuery) {
 	switch strings.ToLower(q.Method) {
 	case "delete":
 		// TODO
+	case "stats":
+		im.queryStats(q)
+	case "health":
+		im.queryHealth(q)
+	case "tags", "values":
+		im.queryTags(q)
 	default:
 		im.queryGET(q)
 	}
 }
 
+// Characters that have special meaning in an Elasticsearch regexp.
+const esRegexpReserved = `.?+*|{}[]()"\#@&<>~`
+
+// globToRegexp converts a path query, in which '*' matches anything, and '?' or a character class such as
+// "[0-9]" or "[!a-f]" matches one character, to an Elasticsearch regexp. Everything else is matched literally,
+// so a query can't escape from a tenant's prefix. Although the regexp doesn't stop wildcards matching a '.',
+// queries also match the depth of the path, which they couldn't if one did.
+func globToRegexp(query string) string {
+	var buf bytes.Buffer
+	runes := []rune(query)
+	for i := 0; i < len(runes); i++ {
+		c := runes[i]
+		switch {
+		case c == '*':
+			buf.WriteString(".*")
+		case c == '?':
+			buf.WriteRune('.')
+		case c == '[' && classEnd(runes, i) > 0:
+			end := classEnd(runes, i)
+			writeClass(&buf, runes[i+1:end])
+			i = end
+		case strings.ContainsRune(esRegexpReserved, c):
+			buf.WriteRune('\\')
+			buf.WriteRune(c)
+		default:
+			buf.WriteRune(c)
+		}
+	}
+	return buf.String()
+}
+
+// classEnd returns the index of the ']' closing the character class opened at runes[open], or -1 if it
+// is never closed, in which case the '[' is matched literally. As in a shell glob, a ']' immediately
+// after the opening '[', or its negation, is part of the class.
+func classEnd(runes []rune, open int) int {
+	i := open + 1
+	if i < len(runes) && (runes[i] == '!' || runes[i] == '^') {
+		i++
+	}
+	if i < len(runes) && runes[i] == ']' {
+		i++
+	}
+	for ; i < len(runes); i++ {
+		if runes[i] == ']' {
+			return i
+		}
+	}
+	return -1
+}
+
+// writeClass writes the contents of a character class as an Elasticsearch regexp class, with every
+// character matched literally but for ranges, and a leading '!' or '^', which negates it.
+func writeClass(buf *bytes.Buffer, class []rune) {
+	buf.WriteRune('[')
+	if len(class) > 0 && (class[0] == '!' || class[0] == '^') {
+		buf.WriteRune('^')
+		class = class[1:]
+	}
+	for i, c := range class {
+		// A '-' at either end is literal, rather than a range.
+		if strings.ContainsRune(esRegexpReserved, c) || c == '^' || (c == '-' && (i == 0 || i == len(class)-1)) {
+			buf.WriteRune('\\')
+		}
+		buf.WriteRune(c)
+	}
+	buf.WriteRune(']')
+}
+
+// The most queries into which a path query's braces may expand.
+const maxBraceExpansions = 256
+
+// expandBraces expands each list of alternatives in braces, as in "servers.{web,db}*.cpu",
+// into a query for each alternative. Braces may be nested.
+func expandBraces(query string) ([]string, error) {
+	open := strings.IndexByte(query, '{')
+	if open < 0 {
+		if strings.IndexByte(query, '}') >= 0 {
+			return nil, fmt.Errorf("unbalanced braces in %q", query)
+		}
+		return []string{query}, nil
+	}
+
+	// Find the matching close, splitting the alternatives at commas not within nested braces.
+	var alternatives []string
+	depth, start, end := 0, open+1, -1
+	for i := open + 1; i < len(query) && end < 0; i++ {
+		switch query[i] {
+		case '{':
+			depth++
+		case '}':
+			if depth == 0 {
+				alternatives = append(alternatives, query[start:i])
+				end = i
+			}
+			depth--
+		case ',':
+			if depth == 0 {
+				alternatives = append(alternatives, query[start:i])
+				start = i + 1
+			}
+		}
+	}
+	if end < 0 {
+		return nil, fmt.Errorf("unbalanced braces in %q", query)
+	}
+
+	// Expand what remains within the alternatives, and after them.
+	var expanded []string
+	for _, alt := range alternatives {
+		more, err := expandBraces(query[:open] + alt + query[end+1:])
+		if err != nil {
+			return nil, err
+		}
+		expanded = append(expanded, more...)
+		if len(expanded) > maxBraceExpansions {
+			return nil, fmt.Errorf("%q expands to more than %d queries", query, maxBraceExpansions)
+		}
+	}
+	return expanded, nil
+}
+
+// hasLeadingWildcard reports whether any of the first n nodes of a query contain a wildcard.
+func hasLeadingWildcard(query string, n int) bool {
+	for i, node := range strings.Split(query, ".") {
+		if i >= n {
+			break
+		}
+		if strings.ContainsAny(node, "*?[") {
+			return true
+		}
+	}
+	return false
+}
+
+// queryPrefixes returns the queries, along with the leading nodes of each down to minDepth,
+// so that the branches on the way to what the queries match are found too.
+func queryPrefixes(queries []string, minDepth int) []string {
+	var prefixes []string
+	seen := make(map[string]bool)
+	for _, query := range queries {
+		nodes := strings.Split(query, ".")
+		for depth := minDepth; depth <= len(nodes); depth++ {
+			prefix := strings.Join(nodes[:depth], ".")
+			if !seen[prefix] {
+				seen[prefix] = true
+				prefixes = append(prefixes, prefix)
+			}
+		}
+	}
+	return prefixes
+}
+
+// pageResponse is returned by "GET /paths" for a page of the results, rather than all of them.
+type pageResponse struct {
+	Paths []IndexResponse `json:"paths"`
+	Next  int             `json:"next,omitempty"` // The offset of the next page, if there is one
+}
+
+// treeNode is one node of graphite-web's "treejson" find format.
+type treeNode struct {
+	Text          string            `json:"text"`
+	Expandable    int               `json:"expandable"`
+	Leaf          int               `json:"leaf"`
+	ID            string            `json:"id"`
+	AllowChildren int               `json:"allowChildren"`
+	Context       map[string]string `json:"context"`
+}
+
+// completerNode is one node of graphite-web's "completer" find format.
+type completerNode struct {
+	Path   string `json:"path"`
+	Name   string `json:"name"`
+	IsLeaf string `json:"is_leaf"`
+}
+
+// graphiteFind converts index entries to the form in which graphite-web answers a find.
+func graphiteFind(list []IndexResponse, format string) interface{} {
+	if format == config.FIND_COMPLETER {
+		metrics := make([]completerNode, 0, len(list))
+		for _, ir := range list {
+			cn := completerNode{ir.Path, nodeOf(ir.Path), "1"}
+			if !ir.Leaf {
+				cn.Path, cn.IsLeaf = ir.Path+".", "0"
+			}
+			metrics = append(metrics, cn)
+		}
+		return map[string][]completerNode{"metrics": metrics}
+	}
+
+	nodes := make([]treeNode, 0, len(list))
+	for _, ir := range list {
+		branch := 1
+		if ir.Leaf {
+			branch = 0
+		}
+		nodes = append(nodes, treeNode{nodeOf(ir.Path), branch, 1 - branch, ir.Path, branch, map[string]string{}})
+	}
+	return nodes
+}
+
+// page returns up to limit entries of a list from offset on, and the offset of the next page, or 0 if
+// there are no more. It pages the results of an index that can't return a page itself.
+func page(list []IndexResponse, offset, limit int) ([]IndexResponse, int) {
+	if offset < 0 {
+		offset = 0
+	}
+	if offset >= len(list) {
+		return []IndexResponse{}, 0
+	}
+	if offset+limit >= len(list) {
+		return list[offset:], 0
+	}
+	return list[offset : offset+limit], offset + limit
+}
+
 // query returns the data matched by the supplied query.
 func (im *IndexManager) queryGET(q config.IndexQuery) {
 
-	config.G.Log.System.LogDebug("IndexManager::query %v", q.Query)
+	config.G.Log.System.LogDebug("IndexManager::query %v req=%s", q.Query, q.RequestID)
 
 	// Query particulars are mandatory.
 	if q.Query == "" {
 		q.Channel <- config.APIQueryResponse{config.AQS_BADREQUEST, "no query specified", []byte{}}
 		return
 	}
-	// Convert query to form suitable for Elasticsearch regexp search.
-	regexpQuery := strings.Replace(q.Query, ".", "\\.", -1)
-	regexpQuery = strings.Replace(regexpQuery, "*", ".*", -1)
+	// Alternatives in braces are expanded into separate queries, since they may differ in depth.
+	// A fuzzy query is taken as it is, since it has no wildcards.
+	queries := []string{q.Query}
+	if !q.Fuzzy {
+		var err error
+		if queries, err = expandBraces(q.Query); err != nil {
+			q.Channel <- config.APIQueryResponse{config.AQS_BADREQUEST, err.Error(), []byte{}}
+			return
+		}
+	}
+
+	// Wildcards in the leading nodes would have the query scan too much of the index.
+	for _, query := range queries {
+		if n := config.G.Index.LiteralNodes; !q.Fuzzy && hasLeadingWildcard(query, n) {
+			q.Channel <- config.APIQueryResponse{config.AQS_BADREQUEST,
+				fmt.Sprintf("the first %d nodes of a query must not contain wildcards", n), []byte{}}
+			return
+		}
+	}
+
+	if q.Fuzzy && q.Expand {
+		q.Channel <- config.APIQueryResponse{config.AQS_BADREQUEST, "fuzzy queries can't be expanded", []byte{}}
+		return
+	}
 
-	// Get number of nodes in the path for the ElasticSearch Query
-	pathDepth := len(strings.Split(q.Query, "."))
+	// Paths are stored in full, so a tenant's query is confined beneath its own node.
+	for i, query := range queries {
+		queries[i] = config.TenantPath(q.Tenant, query)
+	}
+	if q.Expand {
+		minDepth := 1
+		if q.Tenant != "" {
+			minDepth = 2 // The tenant's own node is not indexed
+		}
+		queries = queryPrefixes(queries, minDepth)
+	}
 
-	var esResp ElasticResponse
 	var respList []IndexResponse
 	var resp config.APIQueryResponse
 
-	// It's turtles all the way down!  This is totally Vijay's fault.
-	// http://github.com/vijaykramesh -- JP
-	sort := []map[string]map[string]string{
-		{
-			"path": map[string]string{
-				"order": "asc",
-			},
-		},
-	}
-	query := map[string]map[string][]map[string]map[string]interface{}{
-		"bool": map[string][]map[string]map[string]interface{}{
-			"must": []map[string]map[string]interface{}{
-				{
-					"regexp": map[string]interface{}{
-						"path": regexpQuery,
-					},
-				},
-				{
-					"match": map[string]interface{}{
-						"depth": pathDepth,
-					},
-				},
-			},
-		},
-	}
-
-	fullQuery := ERQuery{sort, query}
-	getreq := im.prepRequest(fullQuery)
-	r := im.httpRequest(getreq)
-
-	if r != nil {
-		_ = json.Unmarshal(r, &esResp)
-
-		config.G.Log.System.LogDebug("esResp: %v", esResp)
-
-		for _, hit := range esResp.Hits.Hits {
-			respList = append(respList, hit.Source)
+	var found []IndexResponse
+	var next int
+	var paged bool
+	var err error
+	if q.Fuzzy {
+		// Fuzzy queries are beyond the copy in memory, and go to the index itself.
+		store := im.store
+		if ti, isTrie := store.(*trieIndex); isTrie {
+			store = ti.backing
+		}
+		fi, ok := store.(fuzzyIndex)
+		if !ok {
+			q.Channel <- config.APIQueryResponse{config.AQS_BADREQUEST,
+				"fuzzy queries require the elasticsearch index", []byte{}}
+			return
+		}
+		found, err = fi.findFuzzy(queries[0], q.Tenant)
+	} else if pi, ok := im.store.(pagedIndex); ok && q.Limit > 0 && q.Format == "" {
+		// Only the page is read from the index, rather than every path matched.
+		if q.Offset < 0 {
+			q.Offset = 0
+		}
+		found, next, err = pi.findPage(queries, q.Tenant, q.Offset, q.Limit)
+		paged = true
+	} else {
+		found, err = im.store.find(queries, q.Tenant, config.G.Index.MaxResults)
+	}
+	if err == nil {
+		for _, node := range found {
+			if q.Tenant != "" {
+				// Never return another tenant's path, whatever the index holds.
+				if node.Tenant != q.Tenant || !strings.HasPrefix(node.Path, q.Tenant+".") {
+					config.G.Log.System.LogWarn("IndexManager dropping %q from the results of tenant %q req=%s",
+						node.Path, q.Tenant, q.RequestID)
+					continue
+				}
+				// Present the path as the tenant sees it.
+				node.Path = strings.TrimPrefix(node.Path, q.Tenant+".")
+				node.Depth--
+			}
+			respList = append(respList, node)
 		}
 
-		jsonResp, _ := json.Marshal(respList)
+		// A page of the results includes where the next begins, if there are more.
+		var jsonResp []byte
+		if q.Format != "" {
+			jsonResp, _ = json.Marshal(graphiteFind(respList, q.Format))
+		} else if paged {
+			if respList == nil {
+				respList = []IndexResponse{}
+			}
+			jsonResp, _ = json.Marshal(pageResponse{respList, next})
+		} else if q.Limit > 0 {
+			var pr pageResponse
+			pr.Paths, pr.Next = page(respList, q.Offset, q.Limit)
+			jsonResp, _ = json.Marshal(pr)
+		} else {
+			jsonResp, _ = json.Marshal(respList)
+		}
 
 		resp = config.APIQueryResponse{config.AQS_OK, "", jsonResp}
+	} else if tooMany, ok := err.(tooManyPaths); ok {
+		resp = config.APIQueryResponse{config.AQS_BADREQUEST, tooMany.Error(), []byte{}}
 	} else {
-		logging.Statsd.Client.Inc("indexmgr.es.err.get", 1, 1.0)
-		config.G.Log.System.LogError("Error querying ES.")
-		resp = config.APIQueryResponse{config.AQS_ERROR, "Error querying ES", []byte{}}
+		config.G.Log.System.LogError("Error querying index: %s req=%s", err.Error(), q.RequestID)
+		resp = config.APIQueryResponse{config.AQS_ERROR, "Error querying index", []byte{}}
 	}
+	respond(q, resp)
+}
+
+// respond sends the response to a query back to the API.
+func respond(q config.IndexQuery, resp config.APIQueryResponse) {
 
 	// If the API gave up on us because we took too long, writing to the channel
 	// will cause first a data race, and then a panic (write on closed channel).
@@ -384,3 +708,42 @@ func (im *IndexManager) queryGET(q config.IndexQuery) {
 		q.Channel <- resp
 	}
 }
+
+// indexStats is returned by "GET /paths/stats": the number of leaf paths, by depth, and by their first node.
+type indexStats struct {
+	Total    int            `json:"total"`
+	ByDepth  map[int]int    `json:"bydepth"`
+	ByPrefix map[string]int `json:"byprefix"`
+}
+
+// pathStats counts leaf paths, as seen by a tenant if tenant isn't "", ignoring other tenants' paths.
+func pathStats(paths []string, tenant string) indexStats {
+	stats := indexStats{ByDepth: make(map[int]int), ByPrefix: make(map[string]int)}
+	for _, path := range paths {
+		if tenant != "" {
+			if !strings.HasPrefix(path, tenant+".") {
+				continue
+			}
+			path = strings.TrimPrefix(path, tenant+".")
+		}
+		nodes := strings.Split(path, ".")
+		stats.Total++
+		stats.ByDepth[len(nodes)]++
+		stats.ByPrefix[nodes[0]]++
+	}
+	return stats
+}
+
+// queryStats returns the counts of the paths in the index, so that operators can see where they lie.
+func (im *IndexManager) queryStats(q config.IndexQuery) {
+	var resp config.APIQueryResponse
+	paths, err := im.store.leaves()
+	if err == nil {
+		jsonResp, _ := json.Marshal(pathStats(paths, q.Tenant))
+		resp = config.APIQueryResponse{config.AQS_OK, "", jsonResp}
+	} else {
+		config.G.Log.System.LogError("Error querying index: %s req=%s", err.Error(), q.RequestID)
+		resp = config.APIQueryResponse{config.AQS_ERROR, "Error querying index", []byte{}}
+	}
+	respond(q, resp)
+}
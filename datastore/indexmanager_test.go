@@ -0,0 +1,195 @@
+package datastore
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/jeffpierce/cassabon/config"
+)
+
+func TestGlobToRegexp(t *testing.T) {
+	tests := []struct {
+		query  string
+		regexp string
+	}{
+		{"foo.bar", `foo\.bar`},
+		{"foo.*", `foo\..*`},
+		{"acme.x)|(other.*", `acme\.x\)\|\(other\..*`},
+		{"a-b_c", "a-b_c"},
+		{"web[0-9].cpu", `web[0-9]\.cpu`},
+		{"host[!a-f]", `host[^a-f]`},
+		{"host[^ab]", `host[^ab]`},
+		{"x[]a]", `x[\]a]`},
+		{"x[-.|]", `x[\-\.\|]`},
+		{"x[a", `x\[a`},
+		{"web?.cpu", `web.\.cpu`},
+		{"a??[?]", `a..[\?]`},
+		{"x]", `x\]`},
+	}
+	for _, test := range tests {
+		if re := globToRegexp(test.query); re != test.regexp {
+			t.Errorf("globToRegexp(%q) = %q, expected %q", test.query, re, test.regexp)
+		}
+	}
+}
+
+func TestExpandBraces(t *testing.T) {
+	tests := []struct {
+		query    string
+		expanded []string
+	}{
+		{"foo.bar", []string{"foo.bar"}},
+		{"servers.{web,db}*.cpu", []string{"servers.web*.cpu", "servers.db*.cpu"}},
+		{"{a,b}.{c,d}", []string{"a.c", "a.d", "b.c", "b.d"}},
+		{"a.{b,c.{d,e}}", []string{"a.b", "a.c.d", "a.c.e"}},
+		{"a{,b}", []string{"a", "ab"}},
+		{"a.{b", nil},
+		{"a.b}", nil},
+	}
+	for _, test := range tests {
+		expanded, err := expandBraces(test.query)
+		if !reflect.DeepEqual(expanded, test.expanded) || (err == nil) != (test.expanded != nil) {
+			t.Errorf("expandBraces(%q) = %q %v, expected %q", test.query, expanded, err, test.expanded)
+		}
+	}
+
+	// Expansions multiply, so are limited.
+	if _, err := expandBraces("{0,1,2,3,4,5,6,7,8,9}.{0,1,2,3,4,5,6,7,8,9}.{0,1,2}"); err == nil {
+		t.Errorf("Expected too many expansions to be refused")
+	}
+}
+
+func TestPathNodes(t *testing.T) {
+	tests := []struct {
+		path, parent, node string
+	}{
+		{"foo", "", "foo"},
+		{"foo.bar", "foo", "bar"},
+		{"foo.bar.baz", "foo.bar", "baz"},
+	}
+	for _, test := range tests {
+		if parent := parentOf(test.path); parent != test.parent {
+			t.Errorf("parentOf(%q) = %q, expected %q", test.path, parent, test.parent)
+		}
+		if node := nodeOf(test.path); node != test.node {
+			t.Errorf("nodeOf(%q) = %q, expected %q", test.path, node, test.node)
+		}
+		if path := childOf(test.parent, test.node); path != test.path {
+			t.Errorf("childOf(%q, %q) = %q, expected %q", test.parent, test.node, path, test.path)
+		}
+	}
+}
+
+func TestQueryPrefixes(t *testing.T) {
+	tests := []struct {
+		queries  []string
+		minDepth int
+		prefixes []string
+	}{
+		{[]string{"a"}, 1, []string{"a"}},
+		{[]string{"a.*.c"}, 1, []string{"a", "a.*", "a.*.c"}},
+		{[]string{"a.b.c", "a.b.d"}, 1, []string{"a", "a.b", "a.b.c", "a.b.d"}},
+		{[]string{"acme.x.*"}, 2, []string{"acme.x", "acme.x.*"}},
+	}
+	for _, test := range tests {
+		if prefixes := queryPrefixes(test.queries, test.minDepth); !reflect.DeepEqual(prefixes, test.prefixes) {
+			t.Errorf("queryPrefixes(%q, %d) = %q, expected %q", test.queries, test.minDepth, prefixes, test.prefixes)
+		}
+	}
+}
+
+func TestIndexNodes(t *testing.T) {
+	saved := config.G.Tenants.Enabled
+	defer func() { config.G.Tenants.Enabled = saved }()
+
+	config.G.Tenants.Enabled = false
+	expected := []IndexResponse{
+		{"a.b.c", 3, "", true, 10},
+		{"a.b", 2, "", false, 10},
+		{"a", 1, "", false, 10},
+	}
+	if nodes := pathNodes("a.b.c", 10); !reflect.DeepEqual(nodes, expected) {
+		t.Errorf("pathNodes(%q) = %v, expected %v", "a.b.c", nodes, expected)
+	}
+
+	// The tenant's own node is not indexed.
+	config.G.Tenants.Enabled = true
+	expected = []IndexResponse{
+		{"acme.b.c", 3, "acme", true, 10},
+		{"acme.b", 2, "acme", false, 10},
+	}
+	if nodes := pathNodes("acme.b.c", 10); !reflect.DeepEqual(nodes, expected) {
+		t.Errorf("pathNodes(%q) = %v, expected %v", "acme.b.c", nodes, expected)
+	}
+}
+
+func TestPage(t *testing.T) {
+	list := []IndexResponse{{Path: "a"}, {Path: "b"}, {Path: "c"}}
+	tests := []struct {
+		offset, limit, length, next int
+	}{
+		{0, 2, 2, 2},
+		{2, 2, 1, 0},
+		{0, 3, 3, 0},
+		{5, 2, 0, 0},
+		{-1, 1, 1, 1},
+	}
+	for _, test := range tests {
+		paths, next := page(list, test.offset, test.limit)
+		if len(paths) != test.length || next != test.next {
+			t.Errorf("page(%d, %d) = %d paths, next %d, expected %d, next %d",
+				test.offset, test.limit, len(paths), next, test.length, test.next)
+		}
+	}
+}
+
+func TestHasLeadingWildcard(t *testing.T) {
+	tests := []struct {
+		query    string
+		n        int
+		wildcard bool
+	}{
+		{"*", 0, false},
+		{"*", 1, true},
+		{"servers.*", 1, false},
+		{"servers.*", 2, true},
+		{"web?.cpu", 1, true},
+		{"a.b", 5, false},
+	}
+	for _, test := range tests {
+		if wildcard := hasLeadingWildcard(test.query, test.n); wildcard != test.wildcard {
+			t.Errorf("hasLeadingWildcard(%q, %d) = %v, expected %v", test.query, test.n, wildcard, test.wildcard)
+		}
+	}
+}
+
+func TestPathStats(t *testing.T) {
+	paths := []string{"acme.servers.web1.cpu", "acme.servers.web2.cpu", "acme.apps.count", "other.x"}
+	stats := pathStats(paths, "acme")
+	expected := indexStats{3, map[int]int{2: 1, 3: 2}, map[string]int{"servers": 2, "apps": 1}}
+	if !reflect.DeepEqual(stats, expected) {
+		t.Errorf("pathStats(acme) = %v, expected %v", stats, expected)
+	}
+	if stats = pathStats(paths, ""); stats.Total != 4 || stats.ByPrefix["acme"] != 3 || stats.ByDepth[4] != 2 {
+		t.Errorf("Unexpected pathStats without tenant: %v", stats)
+	}
+}
+
+func TestGraphiteFind(t *testing.T) {
+	list := []IndexResponse{{Path: "servers.web1", Leaf: false}, {Path: "servers.cpu", Leaf: true}}
+
+	tree, _ := json.Marshal(graphiteFind(list, config.FIND_TREEJSON))
+	expected := `[{"text":"web1","expandable":1,"leaf":0,"id":"servers.web1","allowChildren":1,"context":{}},` +
+		`{"text":"cpu","expandable":0,"leaf":1,"id":"servers.cpu","allowChildren":0,"context":{}}]`
+	if string(tree) != expected {
+		t.Errorf("treejson = %s, expected %s", tree, expected)
+	}
+
+	completer, _ := json.Marshal(graphiteFind(list, config.FIND_COMPLETER))
+	expected = `{"metrics":[{"path":"servers.web1.","name":"web1","is_leaf":"0"},` +
+		`{"path":"servers.cpu","name":"cpu","is_leaf":"1"}]}`
+	if string(completer) != expected {
+		t.Errorf("completer = %s, expected %s", completer, expected)
+	}
+}
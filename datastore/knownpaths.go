@@ -0,0 +1,51 @@
+package datastore
+
+import (
+	"sync"
+)
+
+// knownPaths holds paths known to be indexed, so that a path new to its shard, as every path is after
+// the rollup data is reset for a peer change, isn't sent to the index again. It is seeded from the index
+// on start, and a path is dropped when it is removed from the index. When full, arbitrary paths are dropped
+// to make room, which costs no more than indexing them again.
+type knownPaths struct {
+	m     sync.Mutex
+	size  int
+	paths map[string]struct{}
+}
+
+func (kp *knownPaths) init(size int) {
+	kp.size = size
+	kp.paths = make(map[string]struct{})
+}
+
+// add records a path as indexed, and reports whether it already was.
+// If the cache is disabled, no path is ever known.
+func (kp *knownPaths) add(path string) bool {
+	if kp.size <= 0 {
+		return false
+	}
+	kp.m.Lock()
+	defer kp.m.Unlock()
+	if _, found := kp.paths[path]; found {
+		return true
+	}
+	for k := range kp.paths {
+		if len(kp.paths) < kp.size {
+			break
+		}
+		delete(kp.paths, k)
+	}
+	kp.paths[path] = struct{}{}
+	return false
+}
+
+// remove forgets a path, so that it is indexed again when data next arrives for it.
+func (kp *knownPaths) remove(path string) {
+	if kp.size <= 0 {
+		return
+	}
+	kp.m.Lock()
+	delete(kp.paths, path)
+	kp.m.Unlock()
+}
@@ -0,0 +1,30 @@
+package datastore
+
+import (
+	"testing"
+)
+
+func TestKnownPaths(t *testing.T) {
+	var kp knownPaths
+	kp.init(2)
+	if kp.add("a") || !kp.add("a") {
+		t.Errorf("Expected a to be known only once added")
+	}
+	kp.remove("a")
+	if kp.add("a") {
+		t.Errorf("Expected a to be forgotten once removed")
+	}
+
+	// When full, paths are dropped to make room.
+	kp.add("b")
+	kp.add("c")
+	if len(kp.paths) != 2 || !kp.add("c") {
+		t.Errorf("Expected 2 paths including c, got %v", kp.paths)
+	}
+
+	// Disabled, nothing is known.
+	var disabled knownPaths
+	if disabled.add("a") || disabled.add("a") {
+		t.Errorf("Expected nothing to be known when disabled")
+	}
+}
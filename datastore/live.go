@@ -0,0 +1,166 @@
+package datastore
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/jeffpierce/cassabon/config"
+	"github.com/jeffpierce/cassabon/logging"
+)
+
+// Live subscriptions are limited in number, and each buffers only so many data points between the batches
+// sent to its subscriber; beyond that, data points are dropped rather than holding back ingestion.
+const (
+	maxLiveSubscriptions = 100
+	liveBufferSize       = 10000
+	liveBatchInterval    = 250 * time.Millisecond
+	liveKeepalive        = 15 * time.Second
+)
+
+// liveSubscription receives the incoming metrics whose paths match a pattern, while it is attached.
+type liveSubscription struct {
+	nodes   []string                 // The pattern, split into nodes, each matched as by path.Match
+	metrics chan config.CarbonMetric // Metrics matched, waiting to be sent
+	dropped int64                    // Metrics matched while the buffer was full, accessed atomically
+}
+
+// liveDatapoint is one data point sent to a live subscriber.
+type liveDatapoint struct {
+	Path      string  `json:"path"`
+	Value     float64 `json:"value"`
+	Timestamp float64 `json:"timestamp"`
+}
+
+// liveBatch is one message sent to a live subscriber: the data points received since the last.
+type liveBatch struct {
+	Datapoints []liveDatapoint `json:"datapoints"`
+	Dropped    int64           `json:"dropped"` // Data points left out because the subscriber fell behind
+}
+
+// newLiveSubscription returns a subscription to the paths matched by a pattern of '.'-separated nodes, in
+// which '*' and '?' match within a node, and "[a-f]" or "[!a-f]" match one of its characters.
+func newLiveSubscription(pattern string) (*liveSubscription, error) {
+	nodes := strings.Split(pattern, ".")
+	for _, node := range nodes {
+		if _, err := path.Match(liveNodePattern(node), ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q", pattern)
+		}
+	}
+	return &liveSubscription{nodes: nodes, metrics: make(chan config.CarbonMetric, liveBufferSize)}, nil
+}
+
+// liveNodePattern converts the negated character classes of a path query to those path.Match expects.
+func liveNodePattern(node string) string {
+	return strings.Replace(node, "[!", "[^", -1)
+}
+
+// matches reports whether a path matches the subscription's pattern.
+func (ls *liveSubscription) matches(metricPath string) bool {
+	nodes := strings.Split(metricPath, ".")
+	if len(nodes) != len(ls.nodes) {
+		return false
+	}
+	for i, node := range nodes {
+		if matched, _ := path.Match(liveNodePattern(ls.nodes[i]), node); !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// publish passes a metric to every live subscription whose pattern it matches.
+// Note: Called for every metric when any subscription is attached, so never blocks.
+func (mm *MetricManager) publish(metric config.CarbonMetric) {
+	mm.liveMutex.Lock()
+	defer mm.liveMutex.Unlock()
+	for ls := range mm.live {
+		if !ls.matches(metric.Path) {
+			continue
+		}
+		select {
+		case ls.metrics <- metric:
+		default:
+			atomic.AddInt64(&ls.dropped, 1)
+		}
+	}
+}
+
+// querySUBSCRIBE sends the incoming metrics matching the pattern in the query, in batches, as partial
+// responses, until the API stops waiting for them. An empty batch is sent at once, to acknowledge the query.
+func (mm *MetricManager) querySUBSCRIBE(q config.MetricQuery) {
+
+	config.G.Log.System.LogDebug("MetricManager::querySUBSCRIBE %v", q)
+
+	if len(q.Query) == 0 || q.Query[0] == "" {
+		mm.sendAPIResponse(q.Channel, config.APIQueryResponse{config.AQS_BADREQUEST, "no pattern specified", []byte{}})
+		return
+	}
+	ls, err := newLiveSubscription(config.TenantPath(q.Tenant, q.Query[0]))
+	if err != nil {
+		mm.sendAPIResponse(q.Channel, config.APIQueryResponse{config.AQS_BADREQUEST, err.Error(), []byte{}})
+		return
+	}
+
+	// Attach the subscription, unless there are too many already.
+	mm.liveMutex.Lock()
+	if len(mm.live) >= maxLiveSubscriptions {
+		mm.liveMutex.Unlock()
+		mm.sendAPIResponse(q.Channel, config.APIQueryResponse{config.AQS_ERROR,
+			fmt.Sprintf("too many live subscriptions (max %d)", maxLiveSubscriptions), []byte{}})
+		return
+	}
+	mm.live[ls] = struct{}{}
+	mm.liveMutex.Unlock()
+	atomic.AddInt32(&mm.liveCount, 1)
+	logging.Statsd.Client.Gauge("metricmgr.live.subscriptions", int64(atomic.LoadInt32(&mm.liveCount)), 1.0)
+
+	defer func() {
+		atomic.AddInt32(&mm.liveCount, -1)
+		mm.liveMutex.Lock()
+		delete(mm.live, ls)
+		mm.liveMutex.Unlock()
+		logging.Statsd.Client.Gauge("metricmgr.live.subscriptions", int64(atomic.LoadInt32(&mm.liveCount)), 1.0)
+	}()
+
+	// A batch is sent whenever there is something to send, and otherwise now and then, so that it is
+	// noticed when the subscriber has gone.
+	ticker := time.NewTicker(liveBatchInterval)
+	defer ticker.Stop()
+	batch := liveBatch{Datapoints: []liveDatapoint{}}
+	var sent time.Time
+	for {
+		if len(batch.Datapoints) > 0 || batch.Dropped > 0 || time.Since(sent) >= liveKeepalive {
+			jsonText, _ := json.Marshal(batch)
+			if !mm.sendAPIResponse(q.Channel, config.APIQueryResponse{config.AQS_PARTIAL, "", jsonText}) {
+				return
+			}
+			sent = time.Now()
+			batch = liveBatch{Datapoints: []liveDatapoint{}}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-config.G.OnExit:
+			mm.sendAPIResponse(q.Channel, config.APIQueryResponse{config.AQS_OK, "", []byte{}})
+			return
+		}
+	collect:
+		for {
+			select {
+			case metric := <-ls.metrics:
+				tenantPath := metric.Path
+				if q.Tenant != "" {
+					tenantPath = strings.TrimPrefix(metric.Path, q.Tenant+".")
+				}
+				batch.Datapoints = append(batch.Datapoints, liveDatapoint{tenantPath, metric.Value, metric.Timestamp})
+			default:
+				break collect
+			}
+		}
+		batch.Dropped += atomic.SwapInt64(&ls.dropped, 0)
+	}
+}
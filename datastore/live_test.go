@@ -0,0 +1,51 @@
+package datastore
+
+import (
+	"testing"
+
+	"github.com/jeffpierce/cassabon/config"
+)
+
+func TestLiveSubscription(t *testing.T) {
+	ls, err := newLiveSubscription("foo.*.b[a-f]?.[!0-9]")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	tests := []struct {
+		path    string
+		matches bool
+	}{
+		{"foo.x.bar.z", true},
+		{"foo.xyz.baz.q", true},
+		{"foo.x.bar.1", false},   // Negated class
+		{"foo.x.bzr.z", false},   // Class
+		{"foo.x.y.bar.z", false}, // Deeper
+		{"foo.x.bar", false},     // Shallower
+	}
+	for _, test := range tests {
+		if matches := ls.matches(test.path); matches != test.matches {
+			t.Errorf("matches(%q) = %v, expected %v", test.path, matches, test.matches)
+		}
+	}
+
+	if _, err := newLiveSubscription("foo.[a"); err == nil {
+		t.Errorf("Expected an error for an unclosed class")
+	}
+}
+
+func TestPublish(t *testing.T) {
+	mm := &MetricManager{live: make(map[*liveSubscription]struct{})}
+	ls, _ := newLiveSubscription("foo.*")
+	ls.metrics = make(chan config.CarbonMetric, 1)
+	mm.live[ls] = struct{}{}
+
+	mm.publish(config.CarbonMetric{"foo.a", 1, 100})
+	mm.publish(config.CarbonMetric{"bar.a", 2, 100})
+	mm.publish(config.CarbonMetric{"foo.b", 3, 100}) // The buffer is full
+	if len(ls.metrics) != 1 || ls.dropped != 1 {
+		t.Errorf("Expected 1 metric and 1 dropped, got %d and %d", len(ls.metrics), ls.dropped)
+	}
+	if m := <-ls.metrics; m.Path != "foo.a" {
+		t.Errorf("Expected foo.a, got %v", m)
+	}
+}
@@ -0,0 +1,164 @@
+package datastore
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// memoryRow is a row kept by the memory engine, which expires as it would in Cassandra.
+type memoryRow struct {
+	storedRow
+	expires time.Time
+}
+
+// memoryEngine keeps the tables in memory, so that Cassabon can run for development and tests without a
+// Cassandra cluster. Nothing is kept across restarts.
+type memoryEngine struct {
+	m      sync.RWMutex
+	tables map[string]map[string][]memoryRow // Rows by table and path, in order of time
+}
+
+func newMemoryEngine() *memoryEngine {
+	return &memoryEngine{tables: make(map[string]map[string][]memoryRow)}
+}
+
+func (me *memoryEngine) ensureSchema() error {
+	return nil
+}
+
+// writeBatch stores each row, replacing any of the same path and time, as Cassandra would. The bound values
+// are those of the INSERT statement: path, time, stat, then min, max, sum and count if present, then the TTL.
+func (me *memoryEngine) writeBatch(tw *tableWrite) ([]*partitionWrite, error) {
+	now := time.Now()
+	me.m.Lock()
+	defer me.m.Unlock()
+	paths, found := me.tables[tw.table]
+	if !found {
+		paths = make(map[string][]memoryRow)
+		me.tables[tw.table] = paths
+	}
+	for _, pw := range tw.partitions {
+		for _, values := range pw.rows {
+			row, err := newMemoryRow(values, now)
+			if err != nil {
+				return tw.partitions, err
+			}
+			paths[pw.path] = insertRow(paths[pw.path], row)
+		}
+	}
+	return nil, nil
+}
+
+// newMemoryRow builds a row from the bound values of an INSERT.
+func newMemoryRow(values []interface{}, now time.Time) (memoryRow, error) {
+	var row memoryRow
+	if len(values) != 4 && len(values) != 8 {
+		return row, fmt.Errorf("unexpected number of values in row: %d", len(values))
+	}
+	ts, okTime := values[1].(time.Time)
+	stat, okStat := values[2].(float64)
+	ttl, okTTL := values[len(values)-1].(int)
+	if !okTime || !okStat || !okTTL {
+		return row, fmt.Errorf("unexpected types of values in row: %v", values)
+	}
+	row.time, row.stat, row.expires = ts, stat, now.Add(time.Duration(ttl)*time.Second)
+	if len(values) == 8 {
+		var okMin, okMax, okSum, okCount bool
+		row.agg.min, okMin = values[3].(float64)
+		row.agg.max, okMax = values[4].(float64)
+		row.agg.sum, okSum = values[5].(float64)
+		row.count, okCount = values[6].(int64)
+		if !okMin || !okMax || !okSum || !okCount {
+			return row, fmt.Errorf("unexpected types of aggregates in row: %v", values)
+		}
+	}
+	return row, nil
+}
+
+// insertRow adds a row to a list in order of time, replacing one of the same time.
+func insertRow(rows []memoryRow, row memoryRow) []memoryRow {
+	i := sort.Search(len(rows), func(i int) bool { return !rows[i].time.Before(row.time) })
+	if i < len(rows) && rows[i].time.Equal(row.time) {
+		rows[i] = row
+		return rows
+	}
+	rows = append(rows, memoryRow{})
+	copy(rows[i+1:], rows[i:])
+	rows[i] = row
+	return rows
+}
+
+// rowsIn returns the unexpired rows of a path from a time until another, inclusive;
+// the caller holds the lock.
+func (me *memoryEngine) rowsIn(table, path string, from, to time.Time) []memoryRow {
+	now := time.Now()
+	var list []memoryRow
+	for _, row := range me.tables[table][path] {
+		if row.time.Before(from) || row.time.After(to) || !row.expires.After(now) {
+			continue
+		}
+		list = append(list, row)
+	}
+	return list
+}
+
+func (me *memoryEngine) query(ctx context.Context, table, path string, from, to time.Time, aggregates bool,
+	scan func(row storedRow)) error {
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	me.m.RLock()
+	rows := me.rowsIn(table, path, from, to)
+	me.m.RUnlock()
+	for _, row := range rows {
+		scan(row.storedRow)
+	}
+	return nil
+}
+
+func (me *memoryEngine) count(ctx context.Context, table, path string, from, to time.Time) (uint64, error) {
+	me.m.RLock()
+	defer me.m.RUnlock()
+	return uint64(len(me.rowsIn(table, path, from, to))), ctx.Err()
+}
+
+func (me *memoryEngine) delete(ctx context.Context, table, path string, from, to time.Time) error {
+	me.m.Lock()
+	defer me.m.Unlock()
+	if from.IsZero() && to.IsZero() {
+		delete(me.tables[table], path)
+		return nil
+	}
+	var kept []memoryRow
+	for _, row := range me.tables[table][path] {
+		if row.time.Before(from) || row.time.After(to) {
+			kept = append(kept, row)
+		}
+	}
+	if kept == nil {
+		delete(me.tables[table], path)
+	} else {
+		me.tables[table][path] = kept
+	}
+	return nil
+}
+
+func (me *memoryEngine) hasRows(table, path string, since time.Time) (bool, error) {
+	me.m.RLock()
+	defer me.m.RUnlock()
+	now := time.Now()
+	for _, row := range me.tables[table][path] {
+		if !row.time.Before(since) && row.expires.After(now) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (me *memoryEngine) health() error {
+	return nil
+}
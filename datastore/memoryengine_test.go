@@ -0,0 +1,58 @@
+package datastore
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestMemoryEngine(t *testing.T) {
+	me := newMemoryEngine()
+	ctx := context.Background()
+	base := time.Now().Truncate(time.Hour)
+
+	bw := batchWriter{stmts: newStatementSet("cassabon", nil), batchSize: 100, insert: make(chan *tableWrite, 1)}
+	bw.Prepare("rollup_000003600", time.Hour*24*365*10)
+	bw.Append("foo", base.Add(20*time.Second), 3)
+	bw.Append("foo", base, 1)
+	bw.Append("foo", base.Add(10*time.Second), 2)
+	bw.Append("foo", base, 5) // Replaces the first row at the same time
+	bw.Append("bar", base, 7)
+	bw.Write()
+	if failed, err := me.writeBatch(<-bw.insert); err != nil || len(failed) != 0 {
+		t.Fatalf("Unexpected write failure: %v %v", failed, err)
+	}
+
+	var stats []float64
+	err := me.query(ctx, "rollup_000003600", "foo", base, base.Add(10*time.Second), false,
+		func(row storedRow) { stats = append(stats, row.stat) })
+	if err != nil || len(stats) != 2 || stats[0] != 5 || stats[1] != 2 {
+		t.Errorf("Expected [5 2] in order of time, got %v %v", stats, err)
+	}
+	if count, _ := me.count(ctx, "rollup_000003600", "foo", base, base.Add(time.Minute)); count != 3 {
+		t.Errorf("Expected 3 rows, got %d", count)
+	}
+	if found, _ := me.hasRows("rollup_000003600", "foo", base.Add(15*time.Second)); !found {
+		t.Errorf("Expected rows after 15 seconds")
+	}
+
+	if err := me.delete(ctx, "rollup_000003600", "foo", base, base.Add(10*time.Second)); err != nil {
+		t.Fatalf("Unexpected delete failure: %s", err.Error())
+	}
+	if count, _ := me.count(ctx, "rollup_000003600", "foo", base, base.Add(time.Minute)); count != 1 {
+		t.Errorf("Expected 1 row after deleting a range, got %d", count)
+	}
+	me.delete(ctx, "rollup_000003600", "bar", time.Time{}, time.Time{})
+	if found, _ := me.hasRows("rollup_000003600", "bar", base); found {
+		t.Errorf("Expected no rows after deleting the path")
+	}
+
+	// Rows expire with their retention.
+	bw.Prepare("rollup_000000060", time.Minute)
+	bw.Append("foo", time.Now().Add(-time.Hour), 1)
+	bw.Write()
+	me.writeBatch(<-bw.insert)
+	if found, _ := me.hasRows("rollup_000000060", "foo", time.Time{}); found {
+		t.Errorf("Expected an expired row to be invisible")
+	}
+}
@@ -1,38 +1,98 @@
 package datastore
 
 import (
-	"fmt"
-	"strconv"
-	"strings"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/gocql/gocql"
-
 	"github.com/jeffpierce/cassabon/config"
-	"github.com/jeffpierce/cassabon/logging"
-	"github.com/jeffpierce/cassabon/middleware"
 )
 
 // rollup contains the accumulated metrics data for a path.
 type rollup struct {
-	expr  string    // The text form of the path expression, to locate the definition
-	count []uint64  // The number of data points accumulated (for averaging)
-	value []float64 // One rollup per window definition
+	expr    string      // The text form of the path expression, to locate the definition
+	count   []uint64    // The number of data points accumulated (for averaging)
+	value   []float64   // One rollup per window definition
+	counter float64     // For counters, the previous input value, from which the next delta is taken
+	counted bool        // For counters, whether a previous input value has been seen
+	agg     []aggregate // One per window, if aggregates are stored
+	active  bool        // Whether data has arrived since the path was last indexed
+}
+
+// aggregate holds the extremes and total of the data points accumulated in a window.
+type aggregate struct {
+	min, max, sum float64
+}
+
+// add includes a data point in the aggregate, given the number already included.
+func (a *aggregate) add(value float64, count uint64) {
+	if count == 0 {
+		a.min, a.max, a.sum = value, value, value
+		return
+	}
+	if value < a.min {
+		a.min = value
+	}
+	if value > a.max {
+		a.max = value
+	}
+	a.sum += value
+}
+
+// rollupRules is a snapshot of the rollup configuration, which is replaced, never modified.
+type rollupRules struct {
+	priority  []string                    // First matched expression wins
+	defs      map[string]config.RollupDef // Rollup processing definitions by path expression
+	overrides []rollupOverride            // Paths pinned to an expression, sorted by path
+	exact     map[string]string           // Expressions pinned to exact paths
+	prefixes  []rollupOverride            // Paths pinned by prefix, longest prefix first
+	stmts     *statementSet               // The CQL for each table holding data points
+}
+
+// newRollupRules takes a snapshot of the rollup configuration currently in the globals,
+// combined with the supplied overrides.
+func newRollupRules(overrides []rollupOverride) *rollupRules {
+	rs := config.Rollups()
+	rr := &rollupRules{rs.Priority, rs.Defs, overrides, make(map[string]string), nil, storedStatements()}
+	for _, o := range overrides {
+		if o.Prefix {
+			rr.prefixes = append(rr.prefixes, o)
+		} else {
+			rr.exact[o.Path] = o.Expression
+		}
+	}
+	sort.Stable(byPrefixLength(rr.prefixes))
+	return rr
 }
 
 // runlist contains the paths to be written for an expression, and when to write the rollups.
 type runlist struct {
 	nextWriteTime []time.Time        // The next write time for each rollup bucket
+	timers        []*time.Timer      // The timer for each rollup bucket, which fires at its next write time
 	path          map[string]*rollup // The rollup data for each path matched by the expression
+
+	// For each rollup bucket, the data last written from it, by path. It is kept until the bucket is next
+	// written, by which time it is certain to be stored, so that queries can see it in the meantime.
+	written []map[string]openWindow
 }
 
-// MetricResponse defines the response structure that will be converted into JSON before being returned.
+// MetricResponse defines the structure of the JSON response to a metric query, which is encoded by a seriesStream.
+// Paths with different retentions are read from different tables, so their series may differ in step; each
+// is described in Targets. The top-level range is that of the last path listed, as it always has been.
 type MetricResponse struct {
-	From   int64                    `json:"from"`
-	To     int64                    `json:"to"`
-	Step   int64                    `json:"step"`
-	Series map[string][]interface{} `json:"series"`
+	From    int64                    `json:"from"`
+	To      int64                    `json:"to"`
+	Step    int64                    `json:"step"`
+	Series  map[string][]interface{} `json:"series"`
+	Targets map[string]seriesRange   `json:"targets"`
+}
+
+// seriesRange describes the timestamps of the values in one series of a MetricResponse.
+type seriesRange struct {
+	From int64 `json:"from"` // Timestamp of the first value
+	To   int64 `json:"to"`   // Timestamp of the last value
+	Step int64 `json:"step"` // Seconds between values
 }
 
 type MetricManager struct {
@@ -40,49 +100,112 @@ type MetricManager struct {
 	// Wait Group for managing orderly reloads and termination.
 	wg *sync.WaitGroup
 
-	// The writer must finish last of all, so it gets its own signalling channel and wait group.
+	// The writers must finish last of all, so they get their own signalling channel and wait group.
 	writerWG     sync.WaitGroup
 	writerOnExit chan struct{}
 
-	// Rollup configuration.
-	// Note: Does not reload on SIGHUP.
-	rollupPriority []string                    // First matched expression wins
-	rollup         map[string]config.RollupDef // Rollup processing definitions by path expression
+	// The shards must finish before the writers, and also get their own channel and wait group.
+	shardWG     sync.WaitGroup
+	shardOnExit chan struct{}
+
+	// Rollup configuration, as a *rollupRules; replaced when the rollups are reloaded.
+	rules atomic.Value
+
+	// Database connections, as a *cassandraSessions; replaced when they are rebuilt after failing.
+	sessions atomic.Value
+
+	// Whether the sessions are being checked, and the number of consecutive checks they have failed.
+	checkingSessions int32
+	sessionFailures  int
+
+	// Where the tables are stored.
+	engine metricEngine
+
+	// Channel for async processing of Cassandra writes.
+	insert chan *tableWrite
 
-	// Timer management.
-	setTimeout chan time.Duration // Write a duration to this to get a notification on timeout channel
-	timeout    chan struct{}      // Timeout notifications arrive on this channel
+	// Batches held back so that the writes of windows closing together are spread out, and
+	// the pacer goroutine that releases them; nil unless a flush spread is configured.
+	paced       chan pacedWrite
+	pacerWG     sync.WaitGroup
+	pacerOnExit chan struct{}
 
-	// Database connection.
-	dbClient *gocql.Session
+	// The state of accumulation, saved by the shards on termination; nil unless a state file is configured.
+	saved *savedState
 
-	// Channel for async processing of Cassandra batches.
-	insert chan *gocql.Batch
+	// Pauses writes when Cassandra is persistently failing.
+	breaker circuitBreaker
 
-	// Rollup data.
-	byPath map[string]*rollup  // Stats, by path, for rollup accumulation
-	byExpr map[string]*runlist // Stats, by path within expression, for rollup processing
+	// Shrinks batches when Cassandra is slow.
+	throttle writeThrottle
+
+	// When a batch was last written, in seconds since the epoch, accessed atomically.
+	lastWrite int64
+
+	// Rollup accumulation, spread across shards by path hash.
+	shards    []*shard
+	pathCount int64 // Total unique paths across all shards, accessed atomically
+
+	// Signalled when the rollup overrides have been changed through this instance.
+	overridesChanged chan struct{}
+
+	// Recent query responses, and the generation of the stored data, accessed atomically,
+	// which is advanced whenever it changes.
+	cache      queryCache
+	generation uint64
+
+	// Slots for the metric queries reading from the database; a query waits for one to be free.
+	querySlots chan struct{}
+
+	// The index, from which cleanup removes paths with no stored data, and the paths known to be in it.
+	im       IndexManager
+	known    knownPaths
+	cleaning int32 // Whether a cleanup is in progress, accessed atomically
+
+	// Taps collecting the paths of incoming metrics, for testing rollup definitions.
+	tapMutex sync.Mutex
+	taps     map[*pathTap]struct{}
+	tapCount int32 // Number of attached taps, accessed atomically
+
+	// Live subscriptions to the incoming metrics whose paths match their patterns.
+	liveMutex sync.Mutex
+	live      map[*liveSubscription]struct{}
+	liveCount int32 // Number of attached subscriptions, accessed atomically
 }
 
 func (mm *MetricManager) Init(bootstrap bool, im IndexManager) {
 
-	// Copy in the configuration (requires hard restart to refresh).
-	mm.rollupPriority = config.G.RollupPriority
-	mm.rollup = config.G.Rollup
+	// Copy in the configuration (refreshed by a reload handshake on SIGHUP).
+	mm.rules.Store(newRollupRules(nil))
 
 	// Initialize private objects.
-	mm.setTimeout = make(chan time.Duration, 0)
-	mm.timeout = make(chan struct{}, 1)
-	mm.insert = make(chan *gocql.Batch, 5000)
+	mm.engine = newMetricEngine(mm)
+	mm.insert = make(chan *tableWrite, 5000)
+	cs := config.Cassandra()
+	mm.breaker.init(cs.BreakerFailures, time.Duration(cs.BreakerPause)*time.Second)
+	mm.throttle.init(time.Duration(cs.SlowWrite) * time.Millisecond)
+	mm.shardOnExit = make(chan struct{}, 1)
+	mm.taps = make(map[*pathTap]struct{})
+	mm.live = make(map[*liveSubscription]struct{})
+	mm.overridesChanged = make(chan struct{}, 1)
+	mm.cache.init(config.G.MetricManager.QueryCacheTTL, config.G.MetricManager.QueryCacheSize)
+	mm.querySlots = make(chan struct{}, config.G.MetricManager.MaxQueries)
+	mm.known.init(config.G.Index.KnownPaths)
 
 	// Perform first-time initialization of rollup data accumulation structures.
-	mm.resetRollupData()
+	mm.shards = make([]*shard, config.G.MetricManager.Shards)
+	for i := range mm.shards {
+		mm.shards[i] = new(shard)
+		mm.shards[i].init(mm, mm.shardOnExit)
+	}
 
 	// Reinitialize maps from ES, if they exist.
+	mm.im = im
 	if !bootstrap {
 		leafnodes := im.getAllLeafNodes()
 		for _, node := range leafnodes {
-			mm.addToMaps(node)
+			mm.shardFor(node).addToMaps(node)
+			mm.known.add(node)
 		}
 	}
 }
@@ -92,224 +215,201 @@ func (mm *MetricManager) Start(wg *sync.WaitGroup) {
 	// Start the persistent goroutines.
 	mm.wg = wg
 
-	mm.writerOnExit = make(chan struct{}, 1)
-	mm.writerWG.Add(1)
-	go mm.writer()
+	mm.startWriters()
+	if config.G.MetricManager.FlushSpread > 0 {
+		mm.paced = make(chan pacedWrite, config.G.Channels.MetricStoreChanLen)
+		mm.pacerOnExit = make(chan struct{}, 1)
+		mm.pacerWG.Add(1)
+		go mm.pacer()
+	}
 
-	mm.wg.Add(2)
-	go mm.timer()
+	mm.wg.Add(1)
 	go mm.run()
-
-	// Kick off the timer.
-	mm.setTimeout <- time.Second
 }
 
-func (mm *MetricManager) resetRollupData() {
-
-	// Initialize rollup data structures.
-	mm.byPath = make(map[string]*rollup)
-	mm.byExpr = make(map[string]*runlist)
-	baseTime := time.Now()
-	for expr, rollupdef := range mm.rollup {
-		// For each expression, provide a place to record all the paths that it matches.
-		rl := new(runlist)
-		rl.nextWriteTime = make([]time.Time, len(rollupdef.Windows))
-		rl.path = make(map[string]*rollup)
-		// Establish the next time boundary on which each write will take place.
-		for i, v := range rollupdef.Windows {
-			rl.nextWriteTime[i] = nextTimeBoundary(baseTime, v.Window)
-		}
-		mm.byExpr[expr] = rl
+// startWriters starts the goroutines that write to the database; stopWriters stops them.
+func (mm *MetricManager) startWriters() {
+	mm.writerOnExit = make(chan struct{}, 1)
+	mm.writerWG.Add(config.G.MetricManager.Writers)
+	for i := 0; i < config.G.MetricManager.Writers; i++ {
+		go mm.writer(i)
 	}
 }
 
-// populateSchema ensures that all necessary Cassandra setup has been completed.
-func (mm *MetricManager) populateSchema() {
+// shardFor returns the shard that accumulates the supplied path.
+func (mm *MetricManager) shardFor(path string) *shard {
+	return mm.shards[shardIndex(path, len(mm.shards))]
+}
 
-	// Create the keyspace if it does not exist.
-	if _, err := mm.dbClient.KeyspaceMetadata(config.G.Cassandra.Keyspace); err != nil {
-		// Note: "USE <keyspace>" isn't allowed, and conn.UseKeyspace() isn't sticky.
-		config.G.Log.System.LogInfo("Keyspace not found: %s", err.Error())
-		var options string
-		if len(config.G.Cassandra.CreateOpts) > 0 {
-			options = "," + config.G.Cassandra.CreateOpts
-		}
-		query := fmt.Sprintf(
-			"CREATE KEYSPACE IF NOT EXISTS %s WITH replication = {'class':'%s'%s}",
-			config.G.Cassandra.Keyspace, config.G.Cassandra.Strategy, options)
-		config.G.Log.System.LogDebug(query)
-		if err := mm.dbClient.Query(query).Exec(); err != nil {
-			config.G.Log.System.LogFatal("Could not create keyspace: %s", err.Error())
-		}
-		config.G.Log.System.LogInfo("Keyspace %q created", config.G.Cassandra.Keyspace)
-	}
+// currentRules returns the rollup configuration in effect.
+func (mm *MetricManager) currentRules() *rollupRules {
+	return mm.rules.Load().(*rollupRules)
+}
 
-	// Create tables if they do not exist
-	ksmd, _ := mm.dbClient.KeyspaceMetadata(config.G.Cassandra.Keyspace)
-	for _, table := range config.G.RollupTables {
-		if ksmd != nil {
-			if _, found := ksmd.Tables[table]; found {
-				continue
-			}
-		}
-		var ttlfloat float64
-		ttl := strings.Split(table, "_")[1]
-		ttlfloat, _ = strconv.ParseFloat(ttl, 64)
-		query := fmt.Sprintf(
-			`CREATE TABLE IF NOT EXISTS %s.%s
-                (path text, time timestamp, stat double, PRIMARY KEY (path, time))
-            WITH COMPACT STORAGE
-                AND CLUSTERING ORDER BY (time ASC)
-                AND compaction = {'class': 'org.apache.cassandra.db.compaction.DateTieredCompactionStrategy'}
-                AND compression = {'sstable_compression': 'org.apache.cassandra.io.compress.LZ4Compressor'}
-                AND dclocal_read_repair_chance = 0.1
-                AND default_time_to_live = %v
-                AND gc_grace_seconds = 864000
-                AND memtable_flush_period_in_ms = 0
-                AND read_repair_chance = 0.0
-                AND speculative_retry = '99.0PERCENTILE';`,
-			config.G.Cassandra.Keyspace, table, int(ttlfloat*1.1))
-
-		config.G.Log.System.LogDebug(query)
-		config.G.Log.System.LogInfo("Creating table %q", table)
-
-		if err := mm.dbClient.Query(query).Exec(); err != nil {
-			config.G.Log.System.LogFatal("Table %q creation failed: %s", table, err.Error())
-		}
+// applyRules puts new rollup rules into effect, and has every shard re-match its paths.
+// Note: Must only be called from the MetricManager's run goroutine, once the shards are started.
+func (mm *MetricManager) applyRules(rules *rollupRules) {
+	mm.rules.Store(rules)
+	for _, s := range mm.shards {
+		s.rulesChangeReq <- rules
+	}
+	for _, s := range mm.shards {
+		<-s.rulesChangeRsp
 	}
 }
 
-func (mm *MetricManager) writer() {
+// dataChanged records that the stored data has changed, so that cached query responses are not reused.
+func (mm *MetricManager) dataChanged() {
+	atomic.AddUint64(&mm.generation, 1)
+}
 
-	// We associate a number of retries with each Cassandra batch we receive.
-	type queueEntry struct {
-		tries int
-		batch *gocql.Batch
-	}
+// addPathCount adjusts the count of unique paths seen across all shards.
+func (mm *MetricManager) addPathCount(delta int64) {
+	atomic.AddInt64(&mm.pathCount, delta)
+}
 
-	// The queue for the batches we receive on the insert channel.
-	var queue []queueEntry
-	const numberOfRetries = 5
-
-	var readAllChanneleEntries = func() {
-		checkForMore := true
-		for checkForMore {
-			select {
-			case batch := <-mm.insert:
-				queue = append(queue, queueEntry{numberOfRetries, batch})
-			default:
-				checkForMore = false
-			}
+func (mm *MetricManager) run() {
+
+	defer config.G.OnPanic()
+
+	// Open connection to the Cassandra database here, so we can defer the close.
+	// The memory engine needs none, and so has no overrides, events, or sessions to check.
+	var checkSessions <-chan time.Time
+	if config.G.MetricManager.Engine == config.ENGINE_CASSANDRA {
+		config.G.Log.System.LogDebug("MetricManager initializing Cassandra client")
+		sessions, err := openSessions()
+		if err != nil {
+			// Without Cassandra client we can't do our job, so log, whine, and crash.
+			config.G.Log.System.LogFatal("MetricManager unable to connect to Cassandra at %v, port %s: %s",
+				config.Cassandra().Hosts, config.Cassandra().Port, err.Error())
 		}
+		mm.sessions.Store(sessions)
+		defer func() { mm.currentSessions().close() }()
+		config.G.Log.System.LogDebug("MetricManager Cassandra client initialized")
+
+		ticker := time.NewTicker(time.Duration(config.Cassandra().HealthInterval) * time.Second)
+		defer ticker.Stop()
+		checkSessions = ticker.C
+	}
+
+	config.G.Log.System.LogDebug("MetricManager schema configuration starting...")
+	if err := mm.engine.ensureSchema(); err != nil {
+		config.G.Log.System.LogFatal("MetricManager unable to prepare the schema: %s", err.Error())
 	}
 
-	var writeAllQueueEntries = func() {
-		for len(queue) > 0 {
-			qe := queue[0]
-			queue = queue[1:]
-			writeCount := qe.batch.Size()
-			if err := mm.dbClient.ExecuteBatch(qe.batch); err != nil {
-				config.G.Log.System.LogWarn("MetricManager::writer retrying write: %s", err.Error())
-				logging.Statsd.Client.Inc("metricmgr.db.retry", 1, 1.0)
-				qe.tries--
-				if qe.tries > 0 {
-					queue = append(queue, qe) // Stick it back in the queue
-				}
-				break // On errors, wait for the next timeout before retrying
-			} else {
-				config.G.Log.System.LogDebug("MetricManager::writer wrote batch. Remaining: %d", len(queue))
-				logging.Statsd.Client.Inc("metricmgr.db.insert", int64(writeCount), 1.0)
+	// Apply the persisted overrides to the paths loaded from the index; the memory engine has none.
+	if mm.db() != nil {
+		if overrides, err := loadOverrides(mm.db()); err == nil {
+			rules := newRollupRules(overrides)
+			mm.rules.Store(rules)
+			for _, s := range mm.shards {
+				s.applyRules(rules)
 			}
-			// Drain the channel after each write, so it can't fill up.
-			readAllChanneleEntries()
+		} else {
+			config.G.Log.System.LogError("MetricManager unable to read rollup overrides: %s", err.Error())
 		}
 	}
 
-	for {
-		select {
-		case <-mm.writerOnExit:
-			config.G.Log.System.LogDebug("MetricManager::writer received QUIT message")
-			readAllChanneleEntries()
-			writeAllQueueEntries()
-			mm.writerWG.Done()
-			return
-		case batch := <-mm.insert:
-			queue = append(queue, queueEntry{numberOfRetries, batch})
-		case <-time.After(time.Second):
-			writeAllQueueEntries()
-		}
+	// Resume accumulation where it was left off at the last termination.
+	if config.G.MetricManager.StateFile != "" {
+		mm.restoreState(config.G.MetricManager.StateFile)
 	}
-}
 
-func (mm *MetricManager) run() {
+	// The shards write to the database, so start them only once it is available.
+	for _, s := range mm.shards {
+		s.start(&mm.shardWG)
+	}
 
-	defer config.G.OnPanic()
+	refresh := time.NewTicker(overrideRefresh)
+	defer refresh.Stop()
 
-	// Open connection to the Cassandra database here, so we can defer the close.
-	var err error
-	config.G.Log.System.LogDebug("MetricManager initializing Cassandra client")
-	mm.dbClient, err = middleware.CassandraSession(
-		config.G.Cassandra.Hosts,
-		config.G.Cassandra.Port,
-		"",
-	)
-	if err != nil {
-		// Without Cassandra client we can't do our job, so log, whine, and crash.
-		config.G.Log.System.LogFatal("MetricManager unable to connect to Cassandra at %v, port %s: %s",
-			config.G.Cassandra.Hosts, config.G.Cassandra.Port, err.Error())
+	// A nil channel never delivers, so cleanup is disabled unless its ticker is created.
+	var cleanup <-chan time.Time
+	if config.G.MetricManager.CleanupInterval > 0 {
+		ticker := time.NewTicker(config.G.MetricManager.CleanupInterval)
+		defer ticker.Stop()
+		cleanup = ticker.C
 	}
 
-	defer mm.dbClient.Close()
-	config.G.Log.System.LogDebug("MetricManager Cassandra client initialized")
-
-	config.G.Log.System.LogDebug("MetricManager Cassandra Keyspace configuration starting...")
-	mm.populateSchema()
+	// Likewise, index entries only expire if their ticker is created.
+	var prune <-chan time.Time
+	if config.G.Index.TTL > 0 {
+		ticker := time.NewTicker(config.G.Index.TTL / 4)
+		defer ticker.Stop()
+		prune = ticker.C
+	}
 
 	for {
 		select {
 		case <-config.G.OnPeerChangeReq:
 			config.G.Log.System.LogDebug("MetricManager::run received PEERCHANGE message")
-			mm.flush(true)
-			mm.resetRollupData()
+			for _, s := range mm.shards {
+				s.peerChangeReq <- struct{}{}
+			}
+			for _, s := range mm.shards {
+				<-s.peerChangeRsp
+			}
 			config.G.OnPeerChangeRsp <- struct{}{} // Unblock sender
+		case <-config.G.OnRollupChangeReq:
+			config.G.Log.System.LogDebug("MetricManager::run received ROLLUPCHANGE message")
+			// Create any tables for new retentions before anything can be written to them.
+			if err := mm.engine.ensureSchema(); err != nil {
+				config.G.Log.System.LogError("MetricManager unable to prepare the schema: %s", err.Error())
+			}
+			mm.applyRules(newRollupRules(mm.currentRules().overrides))
+			config.G.OnRollupChangeRsp <- struct{}{} // Unblock sender
+		case <-config.G.OnStoreChangeReq:
+			config.G.Log.System.LogDebug("MetricManager::run received STORECHANGE message")
+			// The memory engine has no connections to reopen.
+			if config.G.MetricManager.Engine == config.ENGINE_CASSANDRA {
+				mm.reopenSessions()
+			}
+			config.G.OnStoreChangeRsp <- struct{}{} // Unblock sender
 		case <-config.G.OnExit:
 			config.G.Log.System.LogDebug("MetricManager::run received QUIT message")
-			mm.flush(true)
-			close(mm.writerOnExit)
-			mm.writerWG.Wait()
+			if config.G.MetricManager.StateFile != "" {
+				mm.saved = new(savedState)
+			}
+			close(mm.shardOnExit)
+			mm.shardWG.Wait()
+			if mm.saved != nil {
+				mm.saveState(config.G.MetricManager.StateFile)
+			}
+			if mm.paced != nil {
+				close(mm.pacerOnExit)
+				mm.pacerWG.Wait()
+			}
+			mm.stopWriters()
 			mm.wg.Done()
 			return
 		case metric := <-config.G.Channels.MetricStore:
-			mm.accumulate(metric)
+			if atomic.LoadInt32(&mm.tapCount) > 0 {
+				mm.tap(metric.Path)
+			}
+			if atomic.LoadInt32(&mm.liveCount) > 0 {
+				mm.publish(metric)
+			}
+			mm.shardFor(metric.Path).metrics <- metric
 		case query := <-config.G.Channels.MetricRequest:
 			go mm.query(query)
-		case <-mm.timeout:
-			mm.flush(false)
-		}
-	}
-}
-
-// timer sends a message on the "timeout" channel after the specified duration.
-func (mm *MetricManager) timer() {
-	for {
-		select {
-		case <-config.G.OnExit:
-			config.G.Log.System.LogDebug("MetricManager::timer received QUIT message")
-			mm.wg.Done()
-			return
-		case duration := <-mm.setTimeout:
-			// Block in this state until a new entry is received.
-			select {
-			case <-config.G.OnExit:
-				// Nothing; do handling above on next iteration.
-			case <-time.After(duration):
-				select {
-				case mm.timeout <- struct{}{}:
-					// Timeout sent.
-				default:
-					// Do not block.
-				}
+		case query := <-config.G.Channels.OverrideRequest:
+			go mm.queryOverride(query)
+		case query := <-config.G.Channels.BackfillRequest:
+			go mm.backfill(query)
+		case query := <-config.G.Channels.EventRequest:
+			go mm.queryEvent(query)
+		case <-mm.overridesChanged:
+			mm.refreshOverrides()
+		case <-refresh.C:
+			mm.refreshOverrides()
+		case <-checkSessions:
+			if atomic.CompareAndSwapInt32(&mm.checkingSessions, 0, 1) {
+				go mm.checkSessions()
 			}
+		case <-cleanup:
+			go mm.cleanup()
+		case <-prune:
+			go mm.prune()
 		}
 	}
 }
@@ -1,10 +1,11 @@
 package datastore
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
-	"math"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/jeffpierce/cassabon/config"
@@ -13,16 +14,73 @@ import (
 
 // query returns the data matched by the supplied query.
 func (mm *MetricManager) query(q config.MetricQuery) {
-	switch strings.ToLower(q.Method) {
+
+	method := strings.ToLower(q.Method)
+	if method == "tap" {
+		// Taps don't touch the database, and wait for as long as they were asked to.
+		mm.queryTAP(q)
+		return
+	}
+	if method == "subscribe" {
+		// Subscriptions last until the subscriber goes, so never hold a query slot.
+		mm.querySUBSCRIBE(q)
+		return
+	}
+	if method == "health" {
+		// A health check must answer even while every query slot is taken.
+		mm.queryHealth(q)
+		return
+	}
+	if method == "rules" {
+		// The rules are in memory, so need no query slot.
+		mm.queryRules(q)
+		return
+	}
+	if method == "flush" {
+		// Flushing writes what has accumulated, rather than reading from the database.
+		mm.queryFlush(q)
+		return
+	}
+
+	// Bound the number of queries reading from the database at once, and the time each may take,
+	// which is as long as the API waits for it, including any time spent waiting for a slot.
+	timeout := config.G.API.Timeouts.GetMetric
+	if method == "delete" {
+		timeout = config.G.API.Timeouts.DeleteMetric
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	select {
+	case mm.querySlots <- struct{}{}:
+		defer func() { <-mm.querySlots }()
+	case <-ctx.Done():
+		logging.Statsd.Client.Inc("metricmgr.query.err.busy", 1, 1.0)
+		mm.sendAPIResponse(q.Channel, config.APIQueryResponse{config.AQS_ERROR,
+			fmt.Sprintf("too many concurrent queries (max %d)", cap(mm.querySlots)), []byte{}})
+		return
+	}
+
+	switch method {
 	case "delete":
-		mm.queryDELETE(q)
+		mm.queryDELETE(ctx, q)
 	default:
-		mm.queryGET(q)
+		mm.queryGET(ctx, q)
 	}
 }
 
+// queryTimedOut reports whether a query ran out of time, and if so tells the API.
+func (mm *MetricManager) queryTimedOut(ctx context.Context, q config.MetricQuery) bool {
+	if ctx.Err() == nil {
+		return false
+	}
+	config.G.Log.System.LogWarn("MetricManager query abandoned: %s %v req=%s", q.Method, q.Query, q.RequestID)
+	logging.Statsd.Client.Inc("metricmgr.query.err.timeout", 1, 1.0)
+	mm.sendAPIResponse(q.Channel, config.APIQueryResponse{config.AQS_ERROR, "query timed out", []byte{}})
+	return true
+}
+
 // delete removes rows matching a key from the metrics store.
-func (mm *MetricManager) queryDELETE(q config.MetricQuery) {
+func (mm *MetricManager) queryDELETE(ctx context.Context, q config.MetricQuery) {
 
 	config.G.Log.System.LogDebug("MetricManager::queryDELETE %v", q)
 
@@ -45,38 +103,40 @@ func (mm *MetricManager) queryDELETE(q config.MetricQuery) {
 
 	// Repeat for each path listed in the request.
 	var delResp deleteResponse = deleteResponse{q.DryRun, make(map[string]deleteResponseDetails)}
-	for _, path := range q.Query {
+	for _, tenantPath := range q.Query {
+		path := config.TenantPath(q.Tenant, tenantPath) // As stored
 		var drDetails deleteResponseDetails = deleteResponseDetails{0, make(map[string]uint64), make(map[string]string)}
 
 		// The path could exist in any table, so look in all of them.
-		for _, table := range config.G.RollupTables {
+		for _, table := range storedTables() {
 
 			// Get counts of the number of rows affected for providing dry-run analysis.
-			drDetails.ByTable[table] = 0
-			query := fmt.Sprintf(`SELECT COUNT(*) FROM %s.%s WHERE path=? AND time>=? AND time<=?`,
-				config.G.Cassandra.Keyspace, table)
-			config.G.Log.System.LogDebug("Querying for %q with: %q", path, query)
-			iter := mm.dbClient.Query(query, path, time.Unix(q.From, 0), time.Unix(q.To, 0)).Iter()
-			var count uint64
-			for iter.Scan(&count) {
-				drDetails.ByTable[table] = count
+			config.G.Log.System.LogDebug("Counting %q in %s from %d to %d", path, table, q.From, q.To)
+			count, err := mm.engine.count(ctx, table, path, time.Unix(q.From, 0), time.Unix(q.To, 0))
+			if err != nil {
+				drDetails.Errors[table] = err.Error()
 			}
+			drDetails.ByTable[table] = count
 			drDetails.Deleted += drDetails.ByTable[table]
 
 			// If this isn't a dry run, do the deletions.
 			// Note: Cassandra provides no feedback on how may rows were actually deleted,
 			//       so we return the counts obtained above as an approximation.
 			if !q.DryRun && drDetails.ByTable[table] > 0 {
-				query := fmt.Sprintf(`DELETE FROM %s.%s WHERE path=? AND time>=? AND time<=?`,
-					config.G.Cassandra.Keyspace, table)
-				config.G.Log.System.LogDebug("Deleting %q with: %q", path, query)
-				if err := mm.dbClient.Query(query, path, time.Unix(q.From, 0), time.Unix(q.To, 0)).Exec(); err != nil {
+				config.G.Log.System.LogDebug("Deleting %q from %s from %d to %d", path, table, q.From, q.To)
+				if err := mm.engine.delete(ctx, table, path, time.Unix(q.From, 0), time.Unix(q.To, 0)); err != nil {
 					drDetails.Errors[table] = err.Error()
 				}
 			}
 		}
 
-		delResp.Paths[path] = drDetails
+		delResp.Paths[tenantPath] = drDetails
+	}
+	if !q.DryRun {
+		mm.dataChanged()
+	}
+	if mm.queryTimedOut(ctx, q) {
+		return
 	}
 
 	// Send the response payload.
@@ -84,7 +144,7 @@ func (mm *MetricManager) queryDELETE(q config.MetricQuery) {
 }
 
 // query returns the data matched by the supplied query.
-func (mm *MetricManager) queryGET(q config.MetricQuery) {
+func (mm *MetricManager) queryGET(ctx context.Context, q config.MetricQuery) {
 
 	config.G.Log.System.LogDebug("MetricManager::queryGET %v", q)
 
@@ -94,167 +154,346 @@ func (mm *MetricManager) queryGET(q config.MetricQuery) {
 		return
 	}
 
-	// Variables to be returned in the response payload.
-	var step int64
-	var normalFrom int64
-	series := map[string][]interface{}{}
+	// If a consolidation method was specified, it must be valid.
+	var consolidateBy config.RollupMethod
+	if q.ConsolidateBy != "" {
+		var err error
+		if consolidateBy, err = config.ParseRollupMethod(q.ConsolidateBy); err != nil {
+			q.Channel <- config.APIQueryResponse{config.AQS_BADREQUEST, err.Error(), []byte{}}
+			return
+		}
+	}
+
+	// If an aggregate was requested, it must be stored; it can't be rolled up the same way as the stat.
+	var aggMethod config.RollupMethod
+	if q.Aggregate != "" {
+		var err error
+		if !config.Cassandra().Aggregates {
+			q.Channel <- config.APIQueryResponse{config.AQS_BADREQUEST, "aggregates are not stored", []byte{}}
+			return
+		}
+		if aggMethod, err = aggregateMethod(q.Aggregate); err != nil {
+			q.Channel <- config.APIQueryResponse{config.AQS_BADREQUEST, err.Error(), []byte{}}
+			return
+		}
+	}
 
-	// Get difference between now and q.From to determine which rollup table to query
-	timeDelta := time.Since(time.Unix(q.From, 0))
+	// Raw data points can only be read if they are stored, and have no aggregates.
+	if q.Raw {
+		if config.G.MetricManager.RawTable == "" {
+			q.Channel <- config.APIQueryResponse{config.AQS_BADREQUEST, "raw data points are not stored", []byte{}}
+			return
+		}
+		if q.Aggregate != "" {
+			q.Channel <- config.APIQueryResponse{config.AQS_BADREQUEST, "raw data points have no aggregates", []byte{}}
+			return
+		}
+	}
+
+	// Identical queries made close together are answered from the cache. The generation is taken
+	// before reading, so that a response built while data was being written is never reused.
+	var cacheKey string
+	generation := atomic.LoadUint64(&mm.generation)
+	if mm.cache.enabled() && !q.Explain {
+		cacheKey = queryCacheKey(q)
+		if payload, found := mm.cache.get(cacheKey, generation, time.Now()); found {
+			logging.Statsd.Client.Inc("metricmgr.cache.hit", 1, 1.0)
+			mm.sendAPIResponse(q.Channel, config.APIQueryResponse{config.AQS_OK, "", payload})
+			return
+		}
+		logging.Statsd.Client.Inc("metricmgr.cache.miss", 1, 1.0)
+	}
+
+	// An unspecified end time means "now".
+	if q.To == 0 {
+		q.To = time.Now().Unix()
+	}
+
+	// The series are streamed as they are built, each with the time range and step it covers.
+	stream := newSeriesStream(mm, q.Channel, streamChunkSize)
+
+	// An explained query records what was done along the way.
+	var trace *queryTrace
+	queryStart := time.Now()
+	if q.Explain {
+		trace = &queryTrace{Paths: []*pathTrace{}}
+		stream.explain = trace
+	}
+
+	// Use a consistent current time for deciding which tables hold which parts of the range,
+	// and a consistent rollup configuration, in case it is reloaded during the query.
+	now := time.Now().Unix()
+	rules := mm.currentRules()
 
 	// Repeat for each path listed in the request.
-	for _, path := range q.Query {
-
-		// Determine lookup table name and data point step from config of rollup.
-		var table string
-		expr := mm.getExpression(path)
-		config.G.Log.System.LogDebug("Determining step/table for path %q, expr %q", path, expr)
-		for _, window := range mm.rollup[expr].Windows {
-			config.G.Log.System.LogDebug("eval timeDelta: %v, ret: %v win: %v table: %s",
-				timeDelta, window.Retention, window.Window, window.Table)
-			if timeDelta < window.Retention {
-				table = window.Table
-				step = int64(window.Window.Seconds())
-				config.G.Log.System.LogDebug("Using step=%d seconds, table=%s", step, table)
-				break
-			}
+	for _, tenantPath := range q.Query {
+		path := config.TenantPath(q.Tenant, tenantPath) // As stored
+		pathStart := time.Now()
+
+		// Determine which tables cover which parts of the time range. The series is returned at
+		// the step of the finest table used, which is the first segment, so that each part of the
+		// range keeps the resolution of its table. Raw data points are rolled up as they are read,
+		// into the finest window.
+		expr := rules.getExpression(path)
+		segments := querySegments(rules.defs[expr].Windows, q.From, q.To, now, q.MaxDataPoints)
+		if q.Raw {
+			w := rules.defs[expr].Windows[0]
+			w.Table = config.G.MetricManager.RawTable
+			segments = []querySegment{{w, q.From, q.To}}
+		}
+		step := int64(segments[0].window.Window.Seconds())
+		config.G.Log.System.LogDebug("Path %q, expr %q, %d segment(s), step=%d seconds",
+			path, expr, len(segments), step)
+
+		// Place each returned stat into the bucket for its step boundary; buckets for which
+		// no stats were returned become nulls. Stats from older, coarser segments each fill
+		// the bucket at their own timestamp, leaving nulls between them.
+		method := rules.defs[expr].Method
+		if q.Aggregate != "" {
+			method = aggMethod
+		}
+		var pt *pathTrace
+		if trace != nil {
+			pt = &pathTrace{Path: path, Expression: expr, Method: method.String(), Reads: []*readTrace{}}
+			trace.Paths = append(trace.Paths, pt)
 		}
+		sb := newSeriesBuilder(method, q.From, q.To, step)
+		var latest int64 // Timestamp of the most recent row read from the finest table
+		for i, seg := range segments {
+
+			// The oldest segment extends back to cover the first bucket.
+			segFrom := seg.from
+			if i == len(segments)-1 {
+				segFrom = sb.from - step + 1
+			}
 
-		// Generate normalized from so that items graph correctly.
-		normalFrom = q.From + (step - (q.From % step))
-
-		// Build query for this stat path
-		query := fmt.Sprintf(`SELECT stat,time FROM %s.%s WHERE path=? AND time>=? AND time<=?`,
-			config.G.Cassandra.Keyspace, table)
-		config.G.Log.System.LogDebug("Querying for %q with: %q", path, query)
-
-		// Populate statList with returned stats.
-		var statList []interface{} = make([]interface{}, 0)
-		var stat float64
-		var mergeCount uint64
-		var mergeValue float64
-		var ts, nextTS time.Time
-		nextTS = nextTimeBoundary(time.Unix(normalFrom, 0), time.Duration(step)*time.Second)
-		iter := mm.dbClient.Query(query, path, time.Unix(normalFrom, 0), time.Unix(q.To, 0)).Iter()
-		for iter.Scan(&stat, &ts) {
-
-			// Fill in any gaps in the series.
-			for nextTS.Before(ts) {
-				if ts.Sub(nextTS) >= time.Duration(step)*time.Second {
-					if mergeCount > 0 {
-						if mm.rollup[expr].Method == config.AVERAGE {
-							// Calculate averages by dividing by the count.
-							mergeValue = mergeValue / float64(mergeCount)
+			// Build query for this stat path
+			query := rules.stmts.get(seg.window.Table).selectRows(q.Aggregate != "")
+			config.G.Log.System.LogDebug("Querying for %q from %d to %d with: %q", path, segFrom, seg.to, query)
+
+			var previous float64
+			var rows int
+			readStart := time.Now()
+			err := mm.engine.query(ctx, seg.window.Table, path, time.Unix(segFrom, 0), time.Unix(seg.to, 0), q.Aggregate != "",
+				func(row storedRow) {
+					first := rows == 0
+					rows++
+					if i == 0 && row.time.Unix() > latest {
+						latest = row.time.Unix()
+					}
+					stat := row.stat
+					if q.Aggregate != "" {
+						// Rows written before aggregates were enabled have a count of zero.
+						if row.count == 0 {
+							return
+						}
+						stat = row.agg.value(q.Aggregate, uint64(row.count))
+					} else if q.Raw && method == config.COUNTER {
+						// Raw counters record the counter itself; convert to increases, as accumulation does.
+						stat, previous = counterDelta(previous, stat), stat
+						if first {
+							return
 						}
-						config.G.Log.System.LogDebug("ins: %14.8f %v ( %v )", mergeValue,
-							nextTS.UTC().Format("15:04:05.000"), ts.Format("15:04:05.000"))
-						statList = append(statList, mergeValue)
-						mergeValue = 0
-						mergeCount = 0
-					} else {
-						config.G.Log.System.LogDebug("ins: %14s %v ( %v )", "nil",
-							nextTS.UTC().Format("15:04:05.000"), ts.Format("15:04:05.000"))
-						statList = append(statList, nil)
 					}
+					config.G.Log.System.LogDebug("row: %14.8f %v", stat, row.time.UTC().Format("15:04:05.000"))
+					sb.add(row.time.Unix(), stat)
+				})
+			if pt != nil {
+				rt := &readTrace{seg.window.Table, int64(seg.window.Window.Seconds()), segFrom, seg.to, query, rows, since(readStart), ""}
+				if err != nil {
+					rt.Error = err.Error()
+				}
+				pt.Reads = append(pt.Reads, rt)
+			}
+			if err != nil {
+				if mm.queryTimedOut(ctx, q) {
+					return
 				}
-				nextTS = nextTS.Add(time.Duration(step) * time.Second)
+				config.G.Log.System.LogError("Error closing stat iteration: %s req=%s", err.Error(), q.RequestID)
+				logging.Statsd.Client.Inc("metricmgr.db.err.read", 1, 1.0)
 			}
+		}
 
-			// Append the current stat.
-			if ts.Equal(nextTS) {
-				if mergeCount > 0 {
-					config.G.Log.System.LogDebug("---: %14.8f %v ( %v )", stat,
-						ts.Format("15:04:05.000"), nextTS.UTC().Format("15:04:05.000"))
-					mergeValue = mm.applyMethod(mm.rollup[expr].Method, mergeValue, stat, mergeCount)
-					mergeCount++
-					if mm.rollup[expr].Method == config.AVERAGE {
-						mergeValue = mergeValue / float64(mergeCount)
-					}
-					stat = mergeValue
-					mergeValue = 0
-					mergeCount = 0
+		// Merge in what has accumulated in the most recent window, but not yet been written, and what
+		// was last written from it, unless the database already returned it. That may still be on its way
+		// to the database, so would otherwise be missing from the response until it gets there.
+		// Raw data points not yet written are left out, since the rollup is not what is wanted.
+		// Note: This follows the database reads, so a window flushed in between is seen as written;
+		//       either way, it is never counted twice.
+		if !q.Raw {
+			memoryStart := time.Now()
+			snap := mm.shardFor(path).snapshot(path, segments[0].window.Table)
+			if snap.written.end.Unix() <= latest {
+				snap.written = openWindow{}
+			}
+			window := segments[0].window.Window
+			for _, ow := range []openWindow{snap.written, snap.open} {
+				if ow.count == 0 || ow.end.Add(-window).Unix() >= q.To {
+					continue
 				}
-				config.G.Log.System.LogDebug("row: %14.8f %v ( %v )", stat,
-					ts.Format("15:04:05.000"), nextTS.UTC().Format("15:04:05.000"))
-				if math.IsNaN(stat) {
-					statList = append(statList, nil)
-				} else {
-					statList = append(statList, stat)
+				value := ow.value
+				if q.Aggregate != "" {
+					value = ow.agg.value(q.Aggregate, ow.count)
 				}
-				nextTS = ts.Add(time.Duration(step) * time.Second)
-			} else {
-				config.G.Log.System.LogDebug("---: %14.8f %v ( %v )", stat,
-					ts.Format("15:04:05.000"), nextTS.UTC().Format("15:04:05.000"))
-				mergeValue = mm.applyMethod(mm.rollup[expr].Method, mergeValue, stat, mergeCount)
-				mergeCount++
-				nextTS = nextTimeBoundary(ts, time.Duration(step)*time.Second)
+				config.G.Log.System.LogDebug("mem: %14.8f %v", value, ow.end.UTC().Format("15:04:05.000"))
+				// A window still open closes after the end of the range; the series is extended to include it.
+				sb.extend(ow.end.Unix())
+				sb.add(ow.end.Unix(), value)
+				if pt != nil {
+					pt.Memory++
+				}
+			}
+			if pt != nil {
+				pt.MemoryElapsed = since(memoryStart)
 			}
 		}
 
-		if err := iter.Close(); err != nil {
-			config.G.Log.System.LogError("Error closing stat iteration: %s", err.Error())
-			logging.Statsd.Client.Inc("metricmgr.db.err.read", 1, 1.0)
+		// Reduce the number of data points to the requested maximum, if necessary.
+		// Unless the caller says otherwise, combine points the same way they were rolled up.
+		if q.ConsolidateBy != "" {
+			method = consolidateBy
 		}
-
-		// Write final data point, if there is one.
-		if mergeCount > 0 {
-			if mm.rollup[expr].Method == config.AVERAGE {
-				// Calculate averages by dividing by the count.
-				mergeValue = mergeValue / float64(mergeCount)
-			}
-			config.G.Log.System.LogDebug("ins: %14.8f %v ( %v )", mergeValue,
-				nextTS.UTC().Format("15:04:05.000"), ts.Format("15:04:05.000"))
-			statList = append(statList, mergeValue)
-			mergeValue = 0
-			mergeCount = 0
+		normalFrom, normalTo := sb.from, sb.to()
+		values, factor := consolidate(sb.series(), method, q.MaxDataPoints)
+		if factor > 1 {
+			step = step * int64(factor)
+			normalTo = normalFrom + int64(len(values)-1)*step
 		}
-
-		// Fill in gaps after the last data point.
-		to := time.Unix(q.To, 0)
-		nextTS = nextTS.Add(time.Duration(step) * time.Second)
-		for nextTS.Before(to) {
-			config.G.Log.System.LogDebug("pad: %14s %v ( %v )", "nil",
-				nextTS.UTC().Format("15:04:05.000"), to.UTC().Format("15:04:05.000"))
-			statList = append(statList, nil)
-			nextTS = nextTS.Add(time.Duration(step) * time.Second)
+		if pt != nil {
+			pt.Consolidation, pt.Step, pt.Elapsed = factor, step, since(pathStart)
 		}
 
 		// Append to series portion of response.
+		statList := toJSONValues(values)
 		config.G.Log.System.LogDebug("Result: %s=%v", path, statList)
-		series[path] = statList
+		sent, err := stream.add(tenantPath, statList, seriesRange{normalFrom, normalTo, step})
+		if err != nil {
+			config.G.Log.System.LogError("JSON encoding error: %s", err.Error())
+			logging.Statsd.Client.Inc("metricmgr.db.err.read", 1, 1.0)
+			mm.sendAPIResponse(q.Channel, config.APIQueryResponse{config.AQS_ERROR, "JSON encoding error", []byte{}})
+			return
+		}
+		if !sent {
+			// The API has given up waiting; there is no point reading the rest.
+			return
+		}
 	}
 
-	// Build the response payload and wrap it in the channel reply struct.
-	payload := MetricResponse{normalFrom, q.To, step, series}
-	mm.sendResponse(q.Channel, &payload)
+	// Complete the response payload, caching it only if it was small enough to be sent whole.
+	if trace != nil {
+		trace.Elapsed = since(queryStart)
+	}
+	payload := stream.finish()
+	if cacheKey != "" && !stream.streamed {
+		mm.cache.put(cacheKey, payload, generation, time.Now())
+	}
+	mm.sendAPIResponse(q.Channel, config.APIQueryResponse{config.AQS_OK, "", payload})
+}
+
+// aggregateMethod returns the method by which values of a stored aggregate are combined.
+func aggregateMethod(name string) (config.RollupMethod, error) {
+	switch name {
+	case "min":
+		return config.MIN, nil
+	case "max":
+		return config.MAX, nil
+	case "sum", "count":
+		return config.SUM, nil
+	}
+	return config.AVERAGE, fmt.Errorf("\"%s\" is not a stored aggregate: use min, max, sum or count", name)
+}
+
+// value returns the named aggregate of a window, whose data point count is supplied.
+func (a aggregate) value(name string, count uint64) float64 {
+	switch name {
+	case "min":
+		return a.min
+	case "max":
+		return a.max
+	case "sum":
+		return a.sum
+	}
+	return float64(count)
+}
+
+// querySegment is the part of a query's time range that is served by one rollup table.
+type querySegment struct {
+	window config.RollupWindow // The rollup window whose table holds this part of the range
+	from   int64               // Start of this part of the range
+	to     int64               // End of this part of the range
+}
+
+// querySegments divides the range [from, to] among the shortest windows whose retention
+// covers each part of it, ordered from most recent (finest) to oldest (coarsest).
+// If maxDataPoints is set, windows too fine to return the whole range within that
+// many points are passed over, as their data would only be consolidated away.
+// Note: Windows must be sorted in ascending order, as they are by the config loader.
+func querySegments(windows []config.RollupWindow, from, to, now int64, maxDataPoints int) []querySegment {
+
+	// Nothing is stored later than now, so don't let a future end time influence selection.
+	span := to
+	if span > now {
+		span = now
+	}
+	span = span - from
+
+	var segments []querySegment
+	end := to
+	for i, w := range windows {
+		if maxDataPoints > 0 && i < len(windows)-1 && span/int64(w.Window.Seconds()) > int64(maxDataPoints) {
+			continue
+		}
+		oldest := now - int64(w.Retention.Seconds())
+		if oldest <= from || i == len(windows)-1 {
+			// This window covers the remainder of the range.
+			return append(segments, querySegment{w, from, end})
+		}
+		if oldest < end {
+			// This window covers only the most recent part of what remains.
+			segments = append(segments, querySegment{w, oldest, end})
+			end = oldest - 1
+		}
+	}
+	return segments
 }
 
 // sendResponse takes care of the details of returning a response to the API code.
 func (mm *MetricManager) sendResponse(respChannel chan config.APIQueryResponse, payload interface{}) {
+	mm.sendAPIResponse(respChannel, encodeResponse(payload))
+}
+
+// encodeResponse wraps the JSON encoding of a response payload in the channel reply struct.
+func encodeResponse(payload interface{}) config.APIQueryResponse {
+	jsonResp, err := json.Marshal(payload)
+	if err != nil {
+		config.G.Log.System.LogError("JSON encoding error: %s", err.Error())
+		logging.Statsd.Client.Inc("metricmgr.db.err.read", 1, 1.0)
+		return config.APIQueryResponse{config.AQS_ERROR, "JSON encoding error", []byte{}}
+	}
+	return config.APIQueryResponse{config.AQS_OK, "", jsonResp}
+}
+
+// sendAPIResponse returns a response to the API code, unless it has given up waiting.
+// It reports whether the response was delivered.
+func (mm *MetricManager) sendAPIResponse(respChannel chan config.APIQueryResponse, resp config.APIQueryResponse) (sent bool) {
 
 	// If the API gave up on us because we took too long, writing to the channel
 	// will cause first a data race, and then a panic (write on closed channel).
 	// We check, but if we lose a race we will need to recover.
 	defer func() {
-		_ = recover()
+		if recover() != nil {
+			sent = false
+		}
 	}()
 
-	// Wrap the response payload in the channel reply struct.
-	var resp config.APIQueryResponse
-	if jsonResp, err := json.Marshal(payload); err == nil {
-		resp = config.APIQueryResponse{config.AQS_OK, "", jsonResp}
-	} else {
-		resp = config.APIQueryResponse{config.AQS_ERROR, "JSON encoding error", []byte{}}
-		config.G.Log.System.LogError("JSON encoding error: %s", err.Error())
-		logging.Statsd.Client.Inc("metricmgr.db.err.read", 1, 1.0)
-	}
-
 	// Check whether the channel is closed before attempting a write.
 	select {
 	case <-respChannel:
 		// Immediate return means channel is closed (we know there is no data in it).
+		return false
 	default:
 		// If the channel would have blocked, it is open, we can write to it.
 		respChannel <- resp
+		return true
 	}
 }
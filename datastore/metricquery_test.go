@@ -0,0 +1,187 @@
+package datastore
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jeffpierce/cassabon/config"
+	"github.com/jeffpierce/cassabon/logging"
+)
+
+// newQueryManager returns a metric manager storing in memory, with a single shard accumulating
+// every path under the supplied windows. The shard is not yet started.
+func newQueryManager(windows []config.RollupWindow) *MetricManager {
+	config.G.Log.System = logging.NewLogger("system")
+	config.G.Log.Carbon = logging.NewLogger("carbon")
+	logging.Statsd.Open("", "", "cassabon")
+
+	mm := &MetricManager{engine: newMemoryEngine(), insert: make(chan *tableWrite, 100)}
+	mm.rules.Store(&rollupRules{
+		priority: []string{config.ROLLUP_CATCHALL},
+		defs:     map[string]config.RollupDef{config.ROLLUP_CATCHALL: {config.AVERAGE, nil, windows}},
+		exact:    map[string]string{},
+		stmts:    newStatementSet("cassabon", nil),
+	})
+	mm.shardOnExit = make(chan struct{})
+	mm.shards = []*shard{new(shard)}
+	mm.shards[0].init(mm, mm.shardOnExit)
+	return mm
+}
+
+// startShards starts the shards of a metric manager, and returns the function that stops them.
+func startShards(mm *MetricManager) func() {
+	var wg sync.WaitGroup
+	for _, s := range mm.shards {
+		s.start(&wg)
+	}
+	return func() {
+		close(mm.shardOnExit)
+		wg.Wait()
+	}
+}
+
+// queryResponse runs a query, and decodes its response.
+func queryResponse(t *testing.T, mm *MetricManager, q config.MetricQuery) MetricResponse {
+	q.Channel = make(chan config.APIQueryResponse, 10)
+	mm.queryGET(context.Background(), q)
+	resp := <-q.Channel
+	if resp.Status != config.AQS_OK {
+		t.Fatalf("Query failed: %d %s", resp.Status, resp.Message)
+	}
+	var mr MetricResponse
+	if err := json.Unmarshal(resp.Payload, &mr); err != nil {
+		t.Fatalf("Bad response %s: %s", resp.Payload, err.Error())
+	}
+	return mr
+}
+
+func TestQuerySegments(t *testing.T) {
+
+	windows := []config.RollupWindow{
+		{10 * time.Second, time.Hour, "rollup_000003600"},
+		{time.Minute, 24 * time.Hour, "rollup_000086400"},
+		{time.Hour, 30 * 24 * time.Hour, "rollup_002592000"},
+	}
+	const now = 1000000000
+
+	// A range entirely within the shortest retention uses only the finest table.
+	segs := querySegments(windows, now-1800, now, now, 0)
+	if len(segs) != 1 || segs[0].window.Table != "rollup_000003600" {
+		t.Errorf("Expected only the finest table, got %v", segs)
+	}
+
+	// A range spanning two retentions is split at the retention boundary.
+	segs = querySegments(windows, now-7200, now, now, 0)
+	if len(segs) != 2 {
+		t.Fatalf("Expected 2 segments, got %v", segs)
+	}
+	if segs[0].from != now-3600 || segs[0].to != now || segs[1].from != now-7200 || segs[1].to != now-3601 {
+		t.Errorf("Wrong segment boundaries: %v", segs)
+	}
+
+	// A historical range skips the tables whose retention does not reach it.
+	segs = querySegments(windows, now-5*86400, now-4*86400, now, 0)
+	if len(segs) != 1 || segs[0].window.Table != "rollup_002592000" {
+		t.Errorf("Expected only the coarsest table, got %v", segs)
+	}
+
+	// A point limit passes over tables that would return too many points.
+	segs = querySegments(windows, now-1800, now+600, now, 100)
+	if len(segs) != 1 || segs[0].window.Table != "rollup_000086400" || segs[0].to != now+600 {
+		t.Errorf("Expected the 1m table for 30m in 100 points, got %v", segs)
+	}
+}
+
+func TestQueryUnflushed(t *testing.T) {
+
+	windows := []config.RollupWindow{{time.Minute, time.Hour, "rollup_000003600"}}
+	mm := newQueryManager(windows)
+
+	// One window has been written, and the next is still accumulating.
+	now := time.Now()
+	written := now.Truncate(time.Minute)
+	bw := batchWriter{stmts: newStatementSet("cassabon", nil), batchSize: 100, insert: make(chan *tableWrite, 1)}
+	bw.Prepare("rollup_000003600", time.Hour)
+	bw.Append("cpu", written, 7)
+	bw.Write()
+	mm.engine.writeBatch(<-bw.insert)
+	s := mm.shards[0]
+	s.addToMaps("cpu")
+	s.accumulate(config.CarbonMetric{Path: "cpu", Value: 2})
+	s.accumulate(config.CarbonMetric{Path: "cpu", Value: 4})
+	defer startShards(mm)()
+
+	// The open window closes after the end of the range, and is included as the last value.
+	mr := queryResponse(t, mm, config.MetricQuery{Query: []string{"cpu"}, From: now.Add(-5 * time.Minute).Unix(), To: now.Unix()})
+	values := mr.Series["cpu"]
+	if len(values) < 2 {
+		t.Fatalf("Expected at least 2 values, got %v", values)
+	}
+	if last := values[len(values)-1]; last != 3.0 {
+		t.Errorf("Expected the unflushed average 3 last, got %v in %v", last, values)
+	}
+	if prev := values[len(values)-2]; prev != 7.0 {
+		t.Errorf("Expected the written value 7 before it, got %v in %v", prev, values)
+	}
+	if target := mr.Targets["cpu"]; target.To <= now.Unix() {
+		t.Errorf("Expected the range to extend past now, got %+v", target)
+	}
+
+	// A range ending before the open window began leaves it out.
+	mr = queryResponse(t, mm, config.MetricQuery{Query: []string{"cpu"}, From: now.Add(-5 * time.Minute).Unix(), To: written.Add(-time.Minute).Unix()})
+	for _, v := range mr.Series["cpu"] {
+		if v != nil {
+			t.Errorf("Expected no values before the open window, got %v", mr.Series["cpu"])
+		}
+	}
+}
+
+func TestQueryAcrossRollups(t *testing.T) {
+
+	windows := []config.RollupWindow{
+		{10 * time.Second, time.Hour, "rollup_000003600"},
+		{time.Minute, 24 * time.Hour, "rollup_000086400"},
+	}
+	mm := newQueryManager(windows)
+	defer startShards(mm)()
+
+	// The last hour is read from the 10s table, and what is older from the 1m table.
+	to := time.Now().Truncate(time.Minute)
+	from := to.Add(-2 * time.Hour)
+	bw := batchWriter{stmts: newStatementSet("cassabon", nil), batchSize: 100, insert: make(chan *tableWrite, 2)}
+	bw.Prepare("rollup_000003600", time.Hour)
+	bw.Append("cpu", to.Add(-20*time.Second), 1)
+	bw.Append("cpu", to.Add(-10*time.Second), 2)
+	bw.Write()
+	bw.Prepare("rollup_000086400", 24*time.Hour)
+	bw.Append("cpu", from.Add(10*time.Minute), 5)
+	bw.Append("cpu", from.Add(11*time.Minute), 6)
+	bw.Write()
+	mm.engine.writeBatch(<-bw.insert)
+	mm.engine.writeBatch(<-bw.insert)
+
+	mr := queryResponse(t, mm, config.MetricQuery{Query: []string{"cpu"}, From: from.Unix(), To: to.Unix()})
+	target, values := mr.Targets["cpu"], mr.Series["cpu"]
+	if target.Step != 10 || target.From != from.Unix() {
+		t.Fatalf("Expected the 10s step of the finest table from %d, got %+v", from.Unix(), target)
+	}
+	at := func(ts time.Time) interface{} {
+		return values[(ts.Unix()-target.From)/target.Step]
+	}
+
+	// The recent range keeps its 10s resolution.
+	if at(to.Add(-20*time.Second)) != 1.0 || at(to.Add(-10*time.Second)) != 2.0 {
+		t.Errorf("Expected 1 and 2 10s apart, got %v and %v", at(to.Add(-20*time.Second)), at(to.Add(-10*time.Second)))
+	}
+
+	// The older range has a value each minute, with nulls between.
+	if at(from.Add(10*time.Minute)) != 5.0 || at(from.Add(11*time.Minute)) != 6.0 {
+		t.Errorf("Expected 5 and 6 a minute apart, got %v and %v", at(from.Add(10*time.Minute)), at(from.Add(11*time.Minute)))
+	}
+	if v := at(from.Add(10*time.Minute + 30*time.Second)); v != nil {
+		t.Errorf("Expected null between the minutes, got %v", v)
+	}
+}
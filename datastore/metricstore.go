@@ -1,40 +1,38 @@
 package datastore
 
 import (
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/jeffpierce/cassabon/config"
 	"github.com/jeffpierce/cassabon/logging"
 )
 
-// getExpression returns the first expression that matches the supplied path.
-func (mm *MetricManager) getExpression(path string) string {
-	var expr string
-	for _, expr = range mm.rollupPriority {
-		if expr != config.ROLLUP_CATCHALL {
-			if mm.rollup[expr].Expression.MatchString(path) {
-				break
-			}
-		}
-		// Catchall always appears last, and is therefore the default value.
+// getExpression returns the expression to which the supplied path is pinned,
+// or else the first expression that matches it.
+func (rr *rollupRules) getExpression(path string) string {
+	if expr, found := rr.pinned(path); found {
+		return expr
 	}
-	return expr
+	return config.MatchRollup(rr.priority, rr.defs, path)
 }
 
 // applyMethod combines values using the appropriate rollup method.
-func (mm *MetricManager) applyMethod(method config.RollupMethod, currentVal, newVal float64, count uint64) float64 {
+func applyMethod(method config.RollupMethod, currentVal, newVal float64, count uint64) float64 {
 	switch method {
 	case config.AVERAGE:
 		currentVal = currentVal + newVal
 	case config.MAX:
-		if currentVal < newVal {
+		if currentVal < newVal || count == 0 {
 			currentVal = newVal
 		}
 	case config.MIN:
 		if currentVal > newVal || count == 0 {
 			currentVal = newVal
 		}
-	case config.SUM:
+	case config.SUM, config.COUNTER:
+		// Counter inputs have already been converted to deltas, which are summed.
 		currentVal = currentVal + newVal
 	case config.LAST:
 		currentVal = newVal
@@ -42,144 +40,252 @@ func (mm *MetricManager) applyMethod(method config.RollupMethod, currentVal, new
 	return currentVal
 }
 
-// addToMaps adds a rollup into the mm.byPath and mm.byExpr maps.
-func (mm *MetricManager) addToMaps(metricPath string) *rollup {
+// A counter that decreases is assumed to have wrapped, rather than been reset to zero,
+// when its previous value was within this fraction of the maximum for its size.
+const counterWrapMargin = 0.1
+
+// counterDelta returns the increase of a counter from its previous value, allowing for wrapping.
+func counterDelta(previous, current float64) float64 {
+	if current >= previous {
+		return current - previous
+	}
+	for _, max := range []float64{1 << 32, 1 << 64} {
+		if previous <= max && previous >= max*(1-counterWrapMargin) && current < max*counterWrapMargin {
+			return max - previous + current
+		}
+	}
+	// The counter was reset, so everything it now holds accumulated since.
+	return current
+}
+
+// addToMaps adds a rollup into the s.byPath and s.byExpr maps.
+func (s *shard) addToMaps(metricPath string) *rollup {
 	var currentRollup *rollup
 
-	expr := mm.getExpression(metricPath)
+	expr := s.rules.getExpression(metricPath)
 	currentRollup = new(rollup)
 	currentRollup.expr = expr
-	currentRollup.count = make([]uint64, len(mm.rollup[expr].Windows))
-	currentRollup.value = make([]float64, len(mm.rollup[expr].Windows))
-	mm.byPath[metricPath] = currentRollup
-	mm.byExpr[expr].path[metricPath] = currentRollup
+	currentRollup.count = make([]uint64, len(s.rules.defs[expr].Windows))
+	currentRollup.value = make([]float64, len(s.rules.defs[expr].Windows))
+	if config.Cassandra().Aggregates {
+		currentRollup.agg = make([]aggregate, len(s.rules.defs[expr].Windows))
+	}
+	s.byPath[metricPath] = currentRollup
+	s.byExpr[expr].path[metricPath] = currentRollup
+	s.mm.addPathCount(1)
 
 	return currentRollup
 }
 
 // accumulate records a metric according to the rollup definitions.
-func (mm *MetricManager) accumulate(metric config.CarbonMetric) {
+func (s *shard) accumulate(metric config.CarbonMetric) {
 	config.G.Log.System.LogDebug("MetricManager::accumulate %s=%v", metric.Path, metric.Value)
 
 	// Locate the metric in the map.
 	var currentRollup *rollup
 	var found bool
-	if currentRollup, found = mm.byPath[metric.Path]; !found {
+	if currentRollup, found = s.byPath[metric.Path]; !found {
 
 		// Initialize, and insert the new rollup into both maps.
-		currentRollup = mm.addToMaps(metric.Path)
+		currentRollup = s.addToMaps(metric.Path)
+
+		// Send the entry off for writing to the path index, unless it is already there.
+		if !s.mm.known.add(metric.Path) {
+			config.G.Channels.IndexStore <- metric
+		}
+	} else {
+		currentRollup.active = true
+	}
 
-		// Send the entry off for writing to the path index.
-		config.G.Channels.IndexStore <- metric
+	// Store the data point as received, if raw data points are kept and it has not already expired.
+	if s.raw != nil {
+		ts := time.Unix(0, int64(metric.Timestamp*float64(time.Second)))
+		if s.raw.ttl(ts) > 0 {
+			s.raw.Append(metric.Path, ts, metric.Value)
+		}
+	}
+
+	// Counters record the increase since the previous value; the first only sets the baseline.
+	method := s.rules.defs[currentRollup.expr].Method
+	value := metric.Value
+	if method == config.COUNTER {
+		previous, seen := currentRollup.counter, currentRollup.counted
+		currentRollup.counter, currentRollup.counted = metric.Value, true
+		if !seen {
+			return
+		}
+		value = counterDelta(previous, metric.Value)
 	}
 
 	// Apply the incoming metric to each rollup bucket.
 	for i, v := range currentRollup.value {
-		currentRollup.value[i] = mm.applyMethod(
-			mm.rollup[currentRollup.expr].Method, v, metric.Value, currentRollup.count[i])
+		currentRollup.value[i] = applyMethod(method, v, value, currentRollup.count[i])
+		if currentRollup.agg != nil {
+			currentRollup.agg[i].add(value, currentRollup.count[i])
+		}
 		currentRollup.count[i]++
 	}
 }
 
-// flush persists the accumulated metrics to the database.
-func (mm *MetricManager) flush(terminating bool) {
-	config.G.Log.System.LogDebug("MetricManager::flush terminating=%v", terminating)
+// flushWindows persists what accumulated in windows that have closed, and sets their timers for the next.
+// Note: Must only be called from the shard's own goroutine.
+func (s *shard) flushWindows(windows []windowDue) {
+	config.G.Log.System.LogDebug("MetricManager::flushWindows %d window(s)", len(windows))
 
 	// Report the current length of the list of unique paths seen.
-	logging.Statsd.Client.Gauge("path.count", int64(len(mm.byPath)), 1.0)
+	logging.Statsd.Client.Gauge("path.count", atomic.LoadInt64(&s.mm.pathCount), 1.0)
 
-	// Use a consistent current time for all tests in this cycle.
+	// The batches of a closing window may be spread out over time.
 	baseTime := time.Now()
+	statTime := func(d windowDue) time.Time {
+		return d.runList.nextWriteTime[d.window]
+	}
+	wrote := s.writeWindows(windows, statTime, s.mm.paced != nil)
+	logging.Statsd.Client.TimingDuration("metricmgr.flush", time.Since(baseTime), 1.0)
+	if s.writeRaw() || wrote {
+		s.mm.dataChanged()
+	}
 
-	// Use a reasonable default value for setting the next timer delay.
-	nextFlush := baseTime.Add(time.Minute)
+	// Set a new window closing time for each just-cleared window. If this flush ran late,
+	// any boundaries already passed are skipped, and their data written with this one.
+	for _, d := range windows {
+		d.runList.nextWriteTime[d.window] = nextTimeBoundary(baseTime, s.rules.defs[d.expr].Windows[d.window].Window)
+		d.runList.timers[d.window].Reset(d.runList.nextWriteTime[d.window].Sub(baseTime))
+	}
+}
 
-	// Set up the database batch writer.
-	bw := batchWriter{}
-	bw.Init(mm.dbClient, config.G.Cassandra.Keyspace, config.G.Cassandra.BatchSize, mm.insert)
-
-	// Walk the set of expressions.
-	for expr, runList := range mm.byExpr {
-
-		// For each expression, inspect each rollup window.
-		// Note: Each window is written to a different table.
-		for i, windowEnd := range runList.nextWriteTime {
-
-			// If the window has closed, or if terminating, process and clear the data.
-			if windowEnd.Before(baseTime) || terminating {
-
-				var statTime time.Time
-				if terminating {
-					statTime = baseTime
-				} else {
-					statTime = windowEnd
-				}
-
-				// Every row in the batch has the same timestamp, is written to the same
-				// table, has the same retention period, and matches the same expression.
-				bw.Prepare(mm.rollup[expr].Windows[i].Table)
-
-				// Iterate over all the paths that match the current expression.
-				for path, rollup := range runList.path {
-
-					if rollup.count[i] > 0 {
-						// Data has accumulated while this window was open; write it.
-						var value float64
-						if mm.rollup[expr].Method == config.AVERAGE {
-							// Calculate averages by dividing by the count.
-							value = rollup.value[i] / float64(rollup.count[i])
-						} else {
-							// Other rollup methods use the value as-is.
-							value = rollup.value[i]
-						}
-
-						if config.G.Log.System.GetLogLevel() < logging.Info {
-							config.G.Log.Carbon.LogInfo(
-								"match=%q tbl=%s ts=%v path=%s val=%.4f win=%v ret=%v ",
-								expr, mm.rollup[expr].Windows[i].Table,
-								statTime.UTC().Format("15:04:05.000"), path, value,
-								mm.rollup[expr].Windows[i].Window, mm.rollup[expr].Windows[i].Retention)
-						}
-
-						bw.Append(path, statTime, value)
-					}
-
-					// Ensure the bucket is empty for the next open window.
-					rollup.count[i] = 0
-					rollup.value[i] = 0
-				}
-				if bw.Size() > 0 {
-					bw.Write()
-				}
-
-				// Set a new window closing time for the just-cleared window.
-				runList.nextWriteTime[i] = nextTimeBoundary(baseTime, mm.rollup[expr].Windows[i].Window)
-			}
-			// ASSERT: runList.nextWriteTime[i] time is in the future (later than baseTime).
+// flush persists everything accumulated, whether or not its window has closed, stamped with the current time.
+// This is done before a change of peers or rules, and on termination.
+// Note: Must only be called from the shard's own goroutine, or before it is started.
+func (s *shard) flush() {
+	config.G.Log.System.LogDebug("MetricManager::flush")
 
-			// Adjust the timer delay downwards if this window closing time is
-			// earlier than all others seen so far.
-			if nextFlush.After(runList.nextWriteTime[i]) {
-				nextFlush = runList.nextWriteTime[i]
-			}
+	baseTime := time.Now()
+	var windows []windowDue
+	for expr, runList := range s.byExpr {
+		for i := range runList.nextWriteTime {
+			windows = append(windows, windowDue{expr, i, runList})
 		}
 	}
+	statTime := func(windowDue) time.Time {
+		return baseTime
+	}
+	if s.writeWindows(windows, statTime, false) || s.writeRaw() {
+		s.mm.dataChanged()
+	}
+}
+
+// writeWindows writes the data accumulated in each of the windows, and reports whether anything was written.
+// Up to the configured number of windows are written at once; this is safe because each holds its data
+// in its own elements of the rollups, and the maps are only read.
+func (s *shard) writeWindows(windows []windowDue, statTime func(windowDue) time.Time, hold bool) bool {
+	var wrote int32
+	write := func(d windowDue) {
+		bw := s.batchWriter()
+		bw.hold = hold
+		if s.writeWindow(&bw, d.expr, d.window, statTime(d)) {
+			atomic.StoreInt32(&wrote, 1)
+		}
+	}
+
+	if config.G.MetricManager.FlushParallelism <= 1 || len(windows) <= 1 {
+		for _, d := range windows {
+			write(d)
+		}
+		return wrote != 0
+	}
+
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, config.G.MetricManager.FlushParallelism)
+	for _, d := range windows {
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(d windowDue) {
+			defer wg.Done()
+			write(d)
+			<-slots
+		}(d)
+	}
+	wg.Wait()
+	return wrote != 0
+}
 
-	// Set a timer to expire when the earliest future window closing occurs.
-	if !terminating {
+// batchWriter returns a batch writer for the rollup tables.
+func (s *shard) batchWriter() batchWriter {
+	cs := config.Cassandra()
+	bw := batchWriter{}
+	bw.Init(s.rules.stmts, s.mm.throttle.batchSize(cs.BatchSize), cs.Aggregates, s.mm.insert)
+	bw.abort = s.onExit
+	return bw
+}
+
+// writeWindow writes the data accumulated in one window of an expression, stamped with statTime,
+// and clears it for the next. It reports whether anything was written.
+func (s *shard) writeWindow(bw *batchWriter, expr string, i int, statTime time.Time) bool {
+
+	// Every row in the batch has the same timestamp, is written to the same
+	// table, has the same retention period, and matches the same expression.
+	w := s.rules.defs[expr].Windows[i]
+	bw.Prepare(w.Table, w.Retention)
+
+	// Iterate over all the paths that match the current expression. What is written is kept aside
+	// before the bucket is cleared, since it may be a while before the database has it.
+	wrote := false
+	written := make(map[string]openWindow)
+	for path, rollup := range s.byExpr[expr].path {
+
+		if rollup.count[i] > 0 {
+			// Data has accumulated while this window was open; write it.
+			var value float64
+			if s.rules.defs[expr].Method == config.AVERAGE {
+				// Calculate averages by dividing by the count.
+				value = rollup.value[i] / float64(rollup.count[i])
+			} else {
+				// Other rollup methods use the value as-is.
+				value = rollup.value[i]
+			}
+
+			if config.G.Log.System.GetLogLevel() < logging.Info {
+				config.G.Log.Carbon.LogInfo(
+					"match=%q tbl=%s ts=%v path=%s val=%.4f win=%v ret=%v ",
+					expr, w.Table, statTime.UTC().Format("15:04:05.000"), path, value, w.Window, w.Retention)
+			}
 
-		// Convert window closing time to a duration, and do a sanity check.
-		delay := nextFlush.Sub(baseTime)
-		if delay.Nanoseconds() < 0 {
-			delay = time.Millisecond
+			ow := openWindow{end: statTime, value: value, count: rollup.count[i]}
+			if rollup.agg != nil {
+				ow.agg = rollup.agg[i]
+				bw.AppendAggregate(path, statTime, value, rollup.agg[i], rollup.count[i])
+			} else {
+				bw.Append(path, statTime, value)
+			}
+			written[path] = ow
+			wrote = true
 		}
 
-		// Perform a non-blocking write to the timeout channel.
-		select {
-		case mm.setTimeout <- delay:
-			// Notification sent
-		default:
-			// Do not block if channel is at capacity
+		// Ensure the bucket is empty for the next open window.
+		rollup.count[i] = 0
+		rollup.value[i] = 0
+		if rollup.agg != nil {
+			rollup.agg[i] = aggregate{}
 		}
 	}
+	s.byExpr[expr].written[i] = written
+	if bw.Size() > 0 {
+		bw.Write()
+	}
+	if len(bw.held) > 0 {
+		s.mm.pace(expr, w.Table, statTime, w.Window, bw.held)
+		bw.held = nil
+	}
+	return wrote
+}
+
+// writeRaw writes the raw data points received since it was last called, and reports whether there were any.
+func (s *shard) writeRaw() bool {
+	if s.raw == nil || s.raw.Size() == 0 {
+		return false
+	}
+	s.raw.Write()
+	s.raw.batchSize = s.mm.throttle.batchSize(config.Cassandra().BatchSize)
+	return true
 }
@@ -0,0 +1,209 @@
+package datastore
+
+import (
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/jeffpierce/cassabon/config"
+	"github.com/jeffpierce/cassabon/logging"
+)
+
+func TestCounterDelta(t *testing.T) {
+	tests := []struct {
+		previous, current, delta float64
+	}{
+		{100, 150, 50},                          // Normal increase
+		{100, 100, 0},                           // No change
+		{1<<32 - 10, 5, 15},                     // 32-bit wrap
+		{1<<64 - 1<<20, 1 << 10, 1<<20 + 1<<10}, // 64-bit wrap
+		{5000, 20, 20},                          // Reset
+	}
+	for _, test := range tests {
+		if delta := counterDelta(test.previous, test.current); delta != test.delta {
+			t.Errorf("counterDelta(%v, %v) = %v, expected %v", test.previous, test.current, delta, test.delta)
+		}
+	}
+}
+
+func TestOverridePrecedence(t *testing.T) {
+	defer config.SetRollups(*config.Rollups())
+	config.SetRollups(config.RollupSet{
+		Priority: []string{"^foo.*", "^bar.*", config.ROLLUP_CATCHALL},
+		Defs: map[string]config.RollupDef{
+			"^foo.*":               {config.SUM, regexp.MustCompile("^foo.*"), nil},
+			"^bar.*":               {config.MAX, regexp.MustCompile("^bar.*"), nil},
+			config.ROLLUP_CATCHALL: {config.AVERAGE, nil, nil},
+		},
+	})
+
+	rr := newRollupRules([]rollupOverride{
+		{"foo.", true, "^bar.*", time.Time{}},
+		{"foo.a.", true, config.ROLLUP_CATCHALL, time.Time{}},
+		{"foo.a.b", false, "^foo.*", time.Time{}},
+		{"baz.", true, "^gone.*", time.Time{}}, // Names an expression that isn't configured
+	})
+	tests := []struct {
+		path, expr string
+	}{
+		{"foo.x", "^bar.*"},                 // Prefix
+		{"foo.a.x", config.ROLLUP_CATCHALL}, // Longer prefix
+		{"foo.a.b", "^foo.*"},               // Exact match
+		{"baz.x", config.ROLLUP_CATCHALL},   // Ignored override
+		{"bar.x", "^bar.*"},                 // No override
+	}
+	for _, test := range tests {
+		if expr := rr.getExpression(test.path); expr != test.expr {
+			t.Errorf("getExpression(%q) = %q, expected %q", test.path, expr, test.expr)
+		}
+	}
+}
+
+func TestDescribeRules(t *testing.T) {
+	defer config.SetRollups(*config.Rollups())
+	config.SetRollups(config.RollupSet{
+		Priority: []string{"^foo.*", config.ROLLUP_CATCHALL},
+		Defs: map[string]config.RollupDef{
+			"^foo.*": {config.SUM, regexp.MustCompile("^foo.*"), []config.RollupWindow{
+				{time.Minute, 24 * time.Hour, "rollup_000000060"},
+				{time.Hour, 30 * 24 * time.Hour, "rollup_000003600"},
+			}},
+			config.ROLLUP_CATCHALL: {config.AVERAGE, nil, []config.RollupWindow{
+				{time.Minute, 24 * time.Hour, "rollup_000000060"},
+			}},
+		},
+	})
+
+	resp := describeRules(newRollupRules([]rollupOverride{{"foo.", true, config.ROLLUP_CATCHALL, time.Time{}}}))
+	if len(resp.Rollups) != 2 || resp.Rollups[0].Expression != "^foo.*" || resp.Rollups[1].Expression != config.ROLLUP_CATCHALL {
+		t.Fatalf("Wrong rollups: %+v", resp.Rollups)
+	}
+	if resp.Rollups[0].Method != "sum" || len(resp.Rollups[0].Windows) != 2 {
+		t.Errorf("Wrong rollup: %+v", resp.Rollups[0])
+	}
+	if w := resp.Rollups[0].Windows[1]; w != (WindowInfo{"1h0m0s", "720h0m0s", "rollup_000003600"}) {
+		t.Errorf("Wrong window: %+v", w)
+	}
+	if len(resp.Tables) != 2 || resp.Tables[0] != "rollup_000000060" || resp.Tables[1] != "rollup_000003600" {
+		t.Errorf("Wrong tables: %v", resp.Tables)
+	}
+	if len(resp.Overrides) != 1 || resp.Overrides[0].Path != "foo." {
+		t.Errorf("Wrong overrides: %+v", resp.Overrides)
+	}
+}
+
+func TestWrittenWindow(t *testing.T) {
+	config.G.Log.System = logging.NewLogger("system")
+	config.G.Log.Carbon = logging.NewLogger("carbon")
+	logging.Statsd.Open("", "", "cassabon")
+
+	windows := []config.RollupWindow{{time.Minute, time.Hour, "rollup_3600"}}
+	s := &shard{
+		mm: &MetricManager{insert: make(chan *tableWrite, 10)},
+		rules: &rollupRules{
+			priority: []string{config.ROLLUP_CATCHALL},
+			defs:     map[string]config.RollupDef{config.ROLLUP_CATCHALL: {config.AVERAGE, nil, windows}},
+			exact:    map[string]string{},
+			stmts:    newStatementSet("cassabon", nil),
+		},
+	}
+	s.resetRollupData()
+	defer s.stopTimers()
+	s.addToMaps("cpu") // Already known, so not sent for indexing
+	s.accumulate(config.CarbonMetric{Path: "cpu", Value: 2})
+	s.accumulate(config.CarbonMetric{Path: "cpu", Value: 4})
+
+	// Until written, the data is only open.
+	snap := s.captureWindow("cpu", "rollup_3600")
+	if snap.open.count != 2 || snap.open.value != 3 || snap.written.count != 0 {
+		t.Errorf("Expected open data only, got %+v", snap)
+	}
+
+	// Once written, it is kept aside while a new window accumulates.
+	end := time.Unix(1000, 0)
+	bw := s.batchWriter()
+	s.writeWindow(&bw, config.ROLLUP_CATCHALL, 0, end)
+	s.accumulate(config.CarbonMetric{Path: "cpu", Value: 10})
+	snap = s.captureWindow("cpu", "rollup_3600")
+	if snap.written.count != 2 || snap.written.value != 3 || !snap.written.end.Equal(end) {
+		t.Errorf("Expected the written data to be kept, got %+v", snap.written)
+	}
+	if snap.open.count != 1 || snap.open.value != 10 {
+		t.Errorf("Expected the new window to be open, got %+v", snap.open)
+	}
+
+	// It is released when the window is next written.
+	s.writeWindow(&bw, config.ROLLUP_CATCHALL, 0, end.Add(time.Minute))
+	s.writeWindow(&bw, config.ROLLUP_CATCHALL, 0, end.Add(2*time.Minute))
+	if snap = s.captureWindow("cpu", "rollup_3600"); snap.written.count != 0 || snap.open.count != 0 {
+		t.Errorf("Expected nothing to be kept, got %+v", snap)
+	}
+	if len(s.mm.insert) != 2 {
+		t.Errorf("Expected 2 batches to be written, got %d", len(s.mm.insert))
+	}
+}
+
+func TestAdvanceWindows(t *testing.T) {
+	windows := []config.RollupWindow{{time.Minute, time.Hour, "rollup_3600"}, {time.Hour, 24 * time.Hour, "rollup_86400"}}
+	s := &shard{
+		mm: &MetricManager{},
+		rules: &rollupRules{
+			priority: []string{config.ROLLUP_CATCHALL},
+			defs:     map[string]config.RollupDef{config.ROLLUP_CATCHALL: {config.AVERAGE, nil, windows}},
+			exact:    map[string]string{},
+			stmts:    newStatementSet("cassabon", nil),
+		},
+	}
+	s.resetRollupData()
+	defer s.stopTimers()
+	rl := s.byExpr[config.ROLLUP_CATCHALL]
+	ends := append([]time.Time(nil), rl.nextWriteTime...)
+
+	// After a forced flush, each window next closes at the end of the one after.
+	s.advanceWindows()
+	for i, w := range windows {
+		if expected := ends[i].Add(w.Window); !rl.nextWriteTime[i].Equal(expected) {
+			t.Errorf("Expected the %s window to close at %v, got %v", w.Table, expected, rl.nextWriteTime[i])
+		}
+	}
+}
+
+func TestAnnounceActive(t *testing.T) {
+	config.G.Log.System = logging.NewLogger("system")
+	logging.Statsd.Open("", "", "cassabon")
+	saved := config.G.Channels.IndexStore
+	defer func() { config.G.Channels.IndexStore = saved }()
+	config.G.Channels.IndexStore = make(chan config.CarbonMetric, 10)
+
+	s := &shard{
+		mm: &MetricManager{},
+		rules: &rollupRules{
+			priority: []string{config.ROLLUP_CATCHALL},
+			defs:     map[string]config.RollupDef{config.ROLLUP_CATCHALL: {config.AVERAGE, nil, nil}},
+			exact:    map[string]string{},
+			stmts:    newStatementSet("cassabon", nil),
+		},
+	}
+	s.resetRollupData()
+
+	// A new path is indexed on arrival, so is only active once more data arrives for it.
+	s.accumulate(config.CarbonMetric{Path: "cpu", Value: 1})
+	s.accumulate(config.CarbonMetric{Path: "mem", Value: 1})
+	s.accumulate(config.CarbonMetric{Path: "cpu", Value: 2})
+	for len(config.G.Channels.IndexStore) > 0 {
+		<-config.G.Channels.IndexStore
+	}
+	s.announceActive()
+	if len(config.G.Channels.IndexStore) != 1 {
+		t.Fatalf("Expected 1 path to be announced, got %d", len(config.G.Channels.IndexStore))
+	}
+	if metric := <-config.G.Channels.IndexStore; metric.Path != "cpu" {
+		t.Errorf("Expected cpu to be announced, got %q", metric.Path)
+	}
+
+	// Once announced, a path isn't again until more data arrives.
+	s.announceActive()
+	if len(config.G.Channels.IndexStore) != 0 {
+		t.Errorf("Expected nothing to be announced, got %d", len(config.G.Channels.IndexStore))
+	}
+}
@@ -0,0 +1,114 @@
+package datastore
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gocql/gocql"
+
+	"github.com/jeffpierce/cassabon/config"
+)
+
+// migration is one step in the evolution of the Cassandra schema.
+// Note: Tables created from the configuration always have the latest shape, so each
+//       apply function must be idempotent, and check before altering anything.
+type migration struct {
+	version     int
+	description string
+	apply       func(dbClient *gocql.Session) error
+}
+
+// The schema migrations, in the order in which they must be applied.
+// Append new migrations to the end; never renumber or remove one that has been released.
+var migrations = []migration{
+	{1, "baseline rollup tables (path, time, stat)", func(dbClient *gocql.Session) error { return nil }},
+	{2, "rollup_overrides table", createOverrideTable},
+	{3, "path_index table", createPathIndexTable},
+	{4, "path_index updated column", addPathIndexUpdated},
+	{5, "events table", createEventTable},
+	{6, "rollup table aggregate columns", addAggregateColumns},
+}
+
+// The states recorded for a migration in the schema_version table.
+const (
+	migrationRunning = "running"
+	migrationApplied = "applied"
+)
+
+// How long to wait for a migration being applied by another Cassabon instance.
+const migrationWait = 2 * time.Minute
+
+// createSchemaVersionTable ensures that the table recording applied migrations exists.
+func createSchemaVersionTable(dbClient *gocql.Session) error {
+	query := fmt.Sprintf(
+		`CREATE TABLE IF NOT EXISTS %s.schema_version
+            (version int PRIMARY KEY, description text, owner text, state text, updated timestamp)`,
+		config.Cassandra().Keyspace)
+	config.G.Log.System.LogDebug(query)
+	return dbClient.Query(query).Exec()
+}
+
+// runMigrations applies, in order, every migration not yet recorded as applied.
+// A lightweight transaction claims each migration, so that when several Cassabon instances
+// start at once, exactly one applies it and the others wait for it to complete.
+func runMigrations(dbClient *gocql.Session) error {
+
+	if err := createSchemaVersionTable(dbClient); err != nil {
+		return err
+	}
+
+	owner := config.G.Carbon.Listen
+	keyspace := config.Cassandra().Keyspace
+	for _, m := range migrations {
+
+		// Try to claim the migration; this fails if it has already been claimed.
+		var version int
+		var description, currentOwner, state string
+		var updated time.Time
+		claimed, err := dbClient.Query(fmt.Sprintf(
+			`INSERT INTO %s.schema_version (version, description, owner, state, updated)
+                VALUES (?, ?, ?, ?, ?) IF NOT EXISTS`, keyspace),
+			m.version, m.description, owner, migrationRunning, time.Now()).ScanCAS(
+			&version, &description, &currentOwner, &state, &updated)
+		if err != nil {
+			return fmt.Errorf("claiming migration %d: %s", m.version, err.Error())
+		}
+
+		if !claimed {
+			if state == migrationApplied {
+				continue
+			}
+			// Someone else is applying it; wait for them to finish.
+			config.G.Log.System.LogInfo("Waiting for %s to apply schema migration %d", currentOwner, m.version)
+			deadline := time.Now().Add(migrationWait)
+			for state != migrationApplied {
+				if time.Now().After(deadline) {
+					return fmt.Errorf("migration %d claimed by %s at %v did not complete", m.version, currentOwner, updated)
+				}
+				time.Sleep(time.Second)
+				if err := dbClient.Query(fmt.Sprintf(
+					`SELECT state FROM %s.schema_version WHERE version = ?`, keyspace),
+					m.version).Consistency(gocql.Quorum).Scan(&state); err != nil {
+					return fmt.Errorf("checking migration %d: %s", m.version, err.Error())
+				}
+			}
+			continue
+		}
+
+		// We own it; apply it, and record the outcome.
+		config.G.Log.System.LogInfo("Applying schema migration %d: %s", m.version, m.description)
+		if err := m.apply(dbClient); err != nil {
+			// Release the claim, so the migration can be retried.
+			dbClient.Query(fmt.Sprintf(`DELETE FROM %s.schema_version WHERE version = ? IF owner = ?`, keyspace),
+				m.version, owner).Exec()
+			return fmt.Errorf("applying migration %d: %s", m.version, err.Error())
+		}
+		if err := dbClient.Query(fmt.Sprintf(
+			`UPDATE %s.schema_version SET state = ?, updated = ? WHERE version = ?`, keyspace),
+			migrationApplied, time.Now(), m.version).Exec(); err != nil {
+			return fmt.Errorf("recording migration %d: %s", m.version, err.Error())
+		}
+		config.G.Log.System.LogInfo("Schema migration %d applied", m.version)
+	}
+	return nil
+}
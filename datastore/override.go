@@ -0,0 +1,209 @@
+package datastore
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gocql/gocql"
+
+	"github.com/jeffpierce/cassabon/config"
+	"github.com/jeffpierce/cassabon/logging"
+)
+
+// How often the overrides are re-read, to pick up changes made through other Cassabon instances.
+const overrideRefresh = time.Minute
+
+// rollupOverride pins a path, or every path beginning with a prefix, to a rollup expression,
+// taking precedence over the priority order of the expressions.
+type rollupOverride struct {
+	Path       string    `json:"path"`
+	Prefix     bool      `json:"prefix"`
+	Expression string    `json:"expression"`
+	Updated    time.Time `json:"updated"`
+}
+
+// createOverrideTable creates the table in which the rollup overrides are persisted.
+func createOverrideTable(dbClient *gocql.Session) error {
+	query := fmt.Sprintf(
+		`CREATE TABLE IF NOT EXISTS %s.rollup_overrides
+            (path text, prefix boolean, expression text, updated timestamp, PRIMARY KEY (path, prefix))`,
+		config.Cassandra().Keyspace)
+	config.G.Log.System.LogDebug(query)
+	return dbClient.Query(query).Exec()
+}
+
+// loadOverrides reads all the rollup overrides, in a consistent order.
+func loadOverrides(dbClient *gocql.Session) ([]rollupOverride, error) {
+	var overrides []rollupOverride
+	var o rollupOverride
+	iter := dbClient.Query(fmt.Sprintf(`SELECT path, prefix, expression, updated FROM %s.rollup_overrides`,
+		config.Cassandra().Keyspace)).Iter()
+	for iter.Scan(&o.Path, &o.Prefix, &o.Expression, &o.Updated) {
+		overrides = append(overrides, o)
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	sort.Sort(byOverridePath(overrides))
+	return overrides, nil
+}
+
+// overridesEqual reports whether two sorted lists of overrides pin the same paths to the same expressions.
+func overridesEqual(a, b []rollupOverride) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Path != b[i].Path || a[i].Prefix != b[i].Prefix || a[i].Expression != b[i].Expression {
+			return false
+		}
+	}
+	return true
+}
+
+// byOverridePath sorts overrides by path, with the exact match before the prefix.
+type byOverridePath []rollupOverride
+
+// Implementation of sort.Interface.
+func (o byOverridePath) Len() int {
+	return len(o)
+}
+func (o byOverridePath) Swap(i, j int) {
+	o[i], o[j] = o[j], o[i]
+}
+func (o byOverridePath) Less(i, j int) bool {
+	if o[i].Path != o[j].Path {
+		return o[i].Path < o[j].Path
+	}
+	return !o[i].Prefix && o[j].Prefix
+}
+
+// byPrefixLength sorts overrides so that longer prefixes come first.
+type byPrefixLength []rollupOverride
+
+// Implementation of sort.Interface.
+func (o byPrefixLength) Len() int {
+	return len(o)
+}
+func (o byPrefixLength) Swap(i, j int) {
+	o[i], o[j] = o[j], o[i]
+}
+func (o byPrefixLength) Less(i, j int) bool {
+	return len(o[i].Path) > len(o[j].Path)
+}
+
+// pinned returns the expression to which a path is pinned by an override, if any.
+// An exact match wins over a prefix, and a longer prefix over a shorter one. Overrides naming an
+// expression that is no longer configured are ignored.
+func (rr *rollupRules) pinned(path string) (string, bool) {
+	if expr, found := rr.exact[path]; found {
+		if _, ok := rr.defs[expr]; ok {
+			return expr, true
+		}
+	}
+	for _, o := range rr.prefixes {
+		if strings.HasPrefix(path, o.Path) {
+			if _, ok := rr.defs[o.Expression]; ok {
+				return o.Expression, true
+			}
+		}
+	}
+	return "", false
+}
+
+// refreshOverrides re-reads the overrides, and applies them if they have changed.
+// Note: Must only be called from the MetricManager's run goroutine.
+func (mm *MetricManager) refreshOverrides() {
+	if mm.db() == nil {
+		return
+	}
+	overrides, err := loadOverrides(mm.db())
+	if err != nil {
+		config.G.Log.System.LogError("MetricManager unable to read rollup overrides: %s", err.Error())
+		logging.Statsd.Client.Inc("metricmgr.db.err.read", 1, 1.0)
+		return
+	}
+	if overridesEqual(mm.currentRules().overrides, overrides) {
+		return
+	}
+	config.G.Log.System.LogInfo("Rollup overrides changed, %d in effect", len(overrides))
+	mm.applyRules(newRollupRules(overrides))
+}
+
+// queryOverride lists, sets or removes rollup overrides.
+func (mm *MetricManager) queryOverride(q config.OverrideQuery) {
+
+	config.G.Log.System.LogDebug("MetricManager::queryOverride %v", q)
+
+	if mm.db() == nil {
+		q.Channel <- config.APIQueryResponse{config.AQS_BADREQUEST, "overrides are only stored in Cassandra", []byte{}}
+		return
+	}
+	var resp interface{}
+	keyspace := config.Cassandra().Keyspace
+	switch strings.ToLower(q.Method) {
+
+	case "put", "post":
+		if q.Path == "" {
+			q.Channel <- config.APIQueryResponse{config.AQS_BADREQUEST, "no path specified", []byte{}}
+			return
+		}
+		if _, found := mm.currentRules().defs[q.Expression]; !found {
+			q.Channel <- config.APIQueryResponse{config.AQS_BADREQUEST,
+				fmt.Sprintf("no rollup is configured for expression %q", q.Expression), []byte{}}
+			return
+		}
+		o := rollupOverride{config.TenantPath(q.Tenant, q.Path), q.Prefix, q.Expression, time.Now()}
+		if err := mm.db().Query(fmt.Sprintf(
+			`INSERT INTO %s.rollup_overrides (path, prefix, expression, updated) VALUES (?, ?, ?, ?)`, keyspace),
+			o.Path, o.Prefix, o.Expression, o.Updated).Exec(); err != nil {
+			q.Channel <- config.APIQueryResponse{config.AQS_ERROR, err.Error(), []byte{}}
+			return
+		}
+		o.Path = q.Path
+		resp = o
+
+	case "delete":
+		if q.Path == "" {
+			q.Channel <- config.APIQueryResponse{config.AQS_BADREQUEST, "no path specified", []byte{}}
+			return
+		}
+		if err := mm.db().Query(fmt.Sprintf(
+			`DELETE FROM %s.rollup_overrides WHERE path = ? AND prefix = ?`, keyspace),
+			config.TenantPath(q.Tenant, q.Path), q.Prefix).Exec(); err != nil {
+			q.Channel <- config.APIQueryResponse{config.AQS_ERROR, err.Error(), []byte{}}
+			return
+		}
+		resp = rollupOverride{Path: q.Path, Prefix: q.Prefix}
+
+	default:
+		overrides, err := loadOverrides(mm.db())
+		if err != nil {
+			q.Channel <- config.APIQueryResponse{config.AQS_ERROR, err.Error(), []byte{}}
+			return
+		}
+		// A tenant sees only its own overrides, as it named them.
+		list := []rollupOverride{}
+		for _, o := range overrides {
+			if q.Tenant != "" {
+				if !strings.HasPrefix(o.Path, q.Tenant+".") {
+					continue
+				}
+				o.Path = strings.TrimPrefix(o.Path, q.Tenant+".")
+			}
+			list = append(list, o)
+		}
+		mm.sendResponse(q.Channel, list)
+		return
+	}
+
+	// Have the change applied now, rather than at the next periodic refresh.
+	select {
+	case mm.overridesChanged <- struct{}{}:
+	default:
+		// A refresh is already pending.
+	}
+	mm.sendResponse(q.Channel, resp)
+}
@@ -0,0 +1,156 @@
+package datastore
+
+import (
+	"container/heap"
+	"hash/fnv"
+	"time"
+
+	"github.com/jeffpierce/cassabon/config"
+)
+
+// pacedWrite is a batch held back from the writers until its release time.
+type pacedWrite struct {
+	at    time.Time
+	write *tableWrite
+}
+
+// pacedWrites orders held batches by release time, earliest first.
+type pacedWrites []pacedWrite
+
+// Implementation of heap.Interface.
+func (p pacedWrites) Len() int {
+	return len(p)
+}
+func (p pacedWrites) Less(i, j int) bool {
+	return p[i].at.Before(p[j].at)
+}
+func (p pacedWrites) Swap(i, j int) {
+	p[i], p[j] = p[j], p[i]
+}
+func (p *pacedWrites) Push(x interface{}) {
+	*p = append(*p, x.(pacedWrite))
+}
+func (p *pacedWrites) Pop() interface{} {
+	old := *p
+	pw := old[len(old)-1]
+	*p = old[:len(old)-1]
+	return pw
+}
+
+// flushSpread returns the time over which the batches of a closing window are spread: the configured
+// spread, but no more than half the window, so that they are all written well before it closes again.
+func flushSpread(window time.Duration) time.Duration {
+	spread := config.G.MetricManager.FlushSpread
+	if spread > window/2 {
+		spread = window / 2
+	}
+	return spread
+}
+
+// releaseTimes returns when each of the batches of a closing window is released to the writers, evenly
+// spaced across the spread. Each expression and table starts at its own offset into the spread, so that
+// windows closing together do not all begin writing at the same instant.
+func releaseTimes(expr, table string, closed time.Time, spread time.Duration, batches int) []time.Time {
+	at := make([]time.Time, batches)
+	if spread <= 0 || batches == 0 {
+		for i := range at {
+			at[i] = closed
+		}
+		return at
+	}
+	h := fnv.New64a()
+	h.Write([]byte(expr))
+	h.Write([]byte{0})
+	h.Write([]byte(table))
+	offset := time.Duration(h.Sum64() % uint64(spread))
+	interval := spread / time.Duration(batches)
+	for i := range at {
+		at[i] = closed.Add((offset + time.Duration(i)*interval) % spread)
+	}
+	return at
+}
+
+// pace holds back the batches of a closing window, to be released to the writers across the spread.
+func (mm *MetricManager) pace(expr, table string, closed time.Time, window time.Duration, writes []*tableWrite) {
+	for i, at := range releaseTimes(expr, table, closed, flushSpread(window), len(writes)) {
+		mm.paced <- pacedWrite{at, writes[i]}
+	}
+}
+
+// writersStuckAfter is how long the pacer waits, on termination, for the writers to take a batch before it
+// takes them to be stuck, and abandons the batches it still holds.
+var writersStuckAfter = 30 * time.Second
+
+// pacer releases held batches to the writers when their time comes. On termination, it releases all
+// that remain at once, so must be stopped after the shards and before the writers.
+func (mm *MetricManager) pacer() {
+
+	defer config.G.OnPanic()
+
+	// A single timer wakes the pacer when the earliest batch is due, set again on each pass.
+	var held pacedWrites
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+	defer timer.Stop()
+	for {
+		// A nil channel never delivers, so the timer is only waited for while batches are held.
+		var due <-chan time.Time
+		if len(held) > 0 {
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(held[0].at.Sub(time.Now()))
+			due = timer.C
+		}
+
+		select {
+		case <-mm.pacerOnExit:
+			config.G.Log.System.LogDebug("MetricManager::pacer received QUIT message")
+			mm.releaseAll(held)
+			mm.pacerWG.Done()
+			return
+		case pw := <-mm.paced:
+			heap.Push(&held, pw)
+		case <-due:
+			// Release what is due, below.
+		}
+
+		// A batch the writers haven't taken by termination is held again, to be released with the rest.
+		now := time.Now()
+		released := false
+		for len(held) > 0 && !held[0].at.After(now) {
+			pw := heap.Pop(&held).(pacedWrite)
+			if !offer(mm.insert, pw.write, mm.pacerOnExit) {
+				heap.Push(&held, pw)
+				break
+			}
+			released = true
+		}
+		if released {
+			mm.dataChanged()
+		}
+	}
+}
+
+// releaseAll hands every held batch to the writers on termination, waiting while they are backlogged, since
+// they are stopped only after the pacer. Only if they take nothing for writersStuckAfter are they taken to be
+// stuck, and what remains abandoned.
+func (mm *MetricManager) releaseAll(held pacedWrites) {
+	if len(held) == 0 {
+		return
+	}
+	stuck := make(chan struct{})
+	watchdog := time.AfterFunc(writersStuckAfter, func() { close(stuck) })
+	defer watchdog.Stop()
+	for _, pw := range held {
+		submit(mm.insert, pw.write, stuck)
+		// Once fired, the watchdog stays fired, so the rest are abandoned without waiting.
+		if watchdog.Stop() {
+			watchdog.Reset(writersStuckAfter)
+		}
+	}
+	mm.dataChanged()
+}
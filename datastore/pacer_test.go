@@ -0,0 +1,118 @@
+package datastore
+
+import (
+	"container/heap"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jeffpierce/cassabon/config"
+	"github.com/jeffpierce/cassabon/logging"
+)
+
+func TestReleaseTimes(t *testing.T) {
+	closed := time.Unix(1000, 0)
+	spread := 10 * time.Second
+
+	// Without a spread, every batch is released at once.
+	for _, at := range releaseTimes("foo", "rollup_60", closed, 0, 3) {
+		if !at.Equal(closed) {
+			t.Errorf("Expected %v, got %v", closed, at)
+		}
+	}
+
+	// With one, batches are evenly spaced within it.
+	at := releaseTimes("foo", "rollup_60", closed, spread, 4)
+	for i, a := range at {
+		if a.Before(closed) || !a.Before(closed.Add(spread)) {
+			t.Errorf("Expected batch %d within the spread, got %v", i, a)
+		}
+		if i > 0 {
+			gap := a.Sub(at[i-1])
+			if gap < 0 {
+				gap += spread
+			}
+			if gap != spread/4 {
+				t.Errorf("Expected batch %d %v after the previous, got %v", i, spread/4, gap)
+			}
+		}
+	}
+
+	// The offset into the spread is consistent for an expression and table, and differs between them.
+	if again := releaseTimes("foo", "rollup_60", closed, spread, 4); !again[0].Equal(at[0]) {
+		t.Errorf("Expected a consistent offset, got %v and %v", at[0], again[0])
+	}
+	differ := false
+	for _, expr := range []string{"bar", "baz", "qux", "quux"} {
+		if !releaseTimes(expr, "rollup_60", closed, spread, 1)[0].Equal(at[0]) {
+			differ = true
+		}
+	}
+	if !differ {
+		t.Errorf("Expected expressions to start at different offsets")
+	}
+}
+
+func TestPacedWrites(t *testing.T) {
+	var held pacedWrites
+	for _, s := range []int64{30, 10, 20} {
+		heap.Push(&held, pacedWrite{time.Unix(s, 0), nil})
+	}
+	for _, s := range []int64{10, 20, 30} {
+		if pw := heap.Pop(&held).(pacedWrite); pw.at.Unix() != s {
+			t.Errorf("Expected %d, got %d", s, pw.at.Unix())
+		}
+	}
+}
+
+func TestPacerStop(t *testing.T) {
+	config.G.Log.System = logging.NewLogger("system")
+	logging.Statsd.Open("", "", "cassabon")
+	defer config.SetCassandra(*config.Cassandra())
+	deadLetters := filepath.Join(t.TempDir(), "deadletter")
+	config.SetCassandra(config.CassandraSettings{DeadLetterFile: deadLetters})
+
+	// The writers are backlogged: the insert channel is full, and a batch is held for later.
+	mm := &MetricManager{insert: make(chan *tableWrite, 1), paced: make(chan pacedWrite), pacerOnExit: make(chan struct{})}
+	mm.insert <- &tableWrite{table: "queued"}
+	mm.pacerWG.Add(1)
+	go mm.pacer()
+	mm.paced <- pacedWrite{time.Now().Add(time.Hour), &tableWrite{table: "held"}}
+
+	// On a normal stop, the held batch waits for the writers, rather than being abandoned.
+	close(mm.pacerOnExit)
+	time.Sleep(50 * time.Millisecond)
+	for _, table := range []string{"queued", "held"} {
+		select {
+		case tw := <-mm.insert:
+			if tw.table != table {
+				t.Errorf("Expected the %s batch, got %s", table, tw.table)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Expected the %s batch to be handed to the writers", table)
+		}
+	}
+	mm.pacerWG.Wait()
+	if _, err := os.Stat(deadLetters); !os.IsNotExist(err) {
+		t.Errorf("Expected nothing to be abandoned, got %v", err)
+	}
+
+	// If the writers take nothing for a while, they are stuck, and the rest is abandoned.
+	defer func(d time.Duration) { writersStuckAfter = d }(writersStuckAfter)
+	writersStuckAfter = 10 * time.Millisecond
+	mm.pacerOnExit = make(chan struct{})
+	mm.insert <- &tableWrite{table: "queued"}
+	mm.pacerWG.Add(1)
+	go mm.pacer()
+	row := []interface{}{"foo", time.Now(), 1.0, 3600}
+	mm.paced <- pacedWrite{time.Now().Add(time.Hour), &tableWrite{"rollup_3600", "", []*partitionWrite{{"foo", [][]interface{}{row}}}, 1}}
+	close(mm.pacerOnExit)
+	mm.pacerWG.Wait()
+	if len(mm.insert) != 1 {
+		t.Errorf("Expected only the queued batch, found %d", len(mm.insert))
+	}
+	if letters := readDeadLetters(t, deadLetters); len(letters) != 1 || letters[0].Path != "foo" {
+		t.Errorf("Expected the held batch to be abandoned, got %+v", letters)
+	}
+}
@@ -0,0 +1,81 @@
+package datastore
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jeffpierce/cassabon/config"
+)
+
+// queryCache holds recent query responses, so that identical queries arriving close together, as from
+// the panels of a dashboard, are answered with a single read. Entries expire after a short time, and
+// are invalidated whenever the stored data changes, which is counted by a generation number.
+type queryCache struct {
+	m       sync.Mutex
+	ttl     time.Duration
+	size    int
+	entries map[string]cacheEntry
+}
+
+// cacheEntry is one cached response payload.
+type cacheEntry struct {
+	payload    []byte
+	generation uint64    // The generation of the stored data from which the payload was built
+	expires    time.Time // When the payload becomes too old to return
+}
+
+func (qc *queryCache) init(ttl time.Duration, size int) {
+	qc.ttl = ttl
+	qc.size = size
+	qc.entries = make(map[string]cacheEntry)
+}
+
+// enabled reports whether responses are to be cached at all.
+func (qc *queryCache) enabled() bool {
+	return qc.ttl > 0 && qc.size > 0
+}
+
+// queryCacheKey returns the key under which the response to a query is cached.
+func queryCacheKey(q config.MetricQuery) string {
+	parts := []string{q.Tenant, strconv.FormatInt(q.From, 10), strconv.FormatInt(q.To, 10),
+		strconv.Itoa(q.MaxDataPoints), q.ConsolidateBy, q.Aggregate, strconv.FormatBool(q.Raw)}
+	return strings.Join(append(parts, q.Query...), "\x00")
+}
+
+// get returns the cached payload for a key, if it is current.
+func (qc *queryCache) get(key string, generation uint64, now time.Time) ([]byte, bool) {
+	qc.m.Lock()
+	defer qc.m.Unlock()
+	e, found := qc.entries[key]
+	if !found {
+		return nil, false
+	}
+	if e.generation != generation || now.After(e.expires) {
+		delete(qc.entries, key)
+		return nil, false
+	}
+	return e.payload, true
+}
+
+// put caches a payload, making room if necessary by discarding entries that are no longer current,
+// or failing that, arbitrary ones.
+func (qc *queryCache) put(key string, payload []byte, generation uint64, now time.Time) {
+	qc.m.Lock()
+	defer qc.m.Unlock()
+	if len(qc.entries) >= qc.size {
+		for k, e := range qc.entries {
+			if e.generation != generation || now.After(e.expires) {
+				delete(qc.entries, k)
+			}
+		}
+		for k := range qc.entries {
+			if len(qc.entries) < qc.size {
+				break
+			}
+			delete(qc.entries, k)
+		}
+	}
+	qc.entries[key] = cacheEntry{payload, generation, now.Add(qc.ttl)}
+}
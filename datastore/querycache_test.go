@@ -0,0 +1,44 @@
+package datastore
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jeffpierce/cassabon/config"
+)
+
+func TestQueryCache(t *testing.T) {
+	var qc queryCache
+	qc.init(5*time.Second, 2)
+	now := time.Unix(1000, 0)
+
+	a := queryCacheKey(config.MetricQuery{Query: []string{"foo", "bar"}, From: 100})
+	b := queryCacheKey(config.MetricQuery{Query: []string{"foo"}, From: 100})
+	c := queryCacheKey(config.MetricQuery{Query: []string{"foo"}, From: 100, Tenant: "x"})
+	if a == b || b == c {
+		t.Fatalf("Expected distinct keys for distinct queries")
+	}
+
+	qc.put(a, []byte("A"), 1, now)
+	if p, found := qc.get(a, 1, now.Add(time.Second)); !found || string(p) != "A" {
+		t.Errorf("Expected a cached payload, got %q %v", p, found)
+	}
+	if _, found := qc.get(a, 1, now.Add(6*time.Second)); found {
+		t.Errorf("Expected the payload to have expired")
+	}
+
+	qc.put(a, []byte("A"), 1, now)
+	if _, found := qc.get(a, 2, now); found {
+		t.Errorf("Expected the payload to be invalidated by a new generation")
+	}
+
+	qc.put(a, []byte("A"), 2, now)
+	qc.put(b, []byte("B"), 2, now)
+	qc.put(c, []byte("C"), 2, now)
+	if len(qc.entries) > 2 {
+		t.Errorf("Expected at most 2 entries, found %d", len(qc.entries))
+	}
+	if p, found := qc.get(c, 2, now); !found || string(p) != "C" {
+		t.Errorf("Expected the newest payload to be cached, got %q %v", p, found)
+	}
+}
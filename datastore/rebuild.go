@@ -0,0 +1,53 @@
+package datastore
+
+import (
+	"github.com/jeffpierce/cassabon/config"
+)
+
+// RebuildIndex indexes every path that has data in any of the tables, for recovery after the loss or
+// corruption of the index. Paths already indexed are indexed again, which does them no harm.
+func RebuildIndex() (paths int, err error) {
+
+	dbClient, err := cassandraSession()
+	if err != nil {
+		return
+	}
+	defer dbClient.Close()
+	im := new(IndexManager)
+	im.Init(false)
+
+	// A path is stored in the partitions of several tables, but is indexed only once.
+	seen := make(map[string]bool)
+	var batch []string
+	stmts := storedStatements()
+	for _, table := range storedTables() {
+		var path string
+		iter := dbClient.Query(stmts.get(table).distinctPaths).Iter()
+		for iter.Scan(&path) {
+			if seen[path] {
+				continue
+			}
+			seen[path] = true
+			if config.G.Tenants.Enabled {
+				if _, _, e := config.SplitTenant(path); e != nil {
+					config.G.Log.System.LogWarn("Skipping %s: %s", path, e.Error())
+					continue
+				}
+			}
+			if batch = append(batch, path); len(batch) == indexBatchSize {
+				im.indexPaths(batch)
+				batch = nil
+			}
+			paths++
+			if paths%importProgress == 0 {
+				config.G.Log.System.LogInfo("Indexed %d paths so far", paths)
+			}
+		}
+		if err = iter.Close(); err != nil {
+			return
+		}
+		config.G.Log.System.LogInfo("Scanned table %q, %d paths indexed so far", table, paths)
+	}
+	im.indexPaths(batch)
+	return
+}
@@ -0,0 +1,57 @@
+package datastore
+
+import (
+	"encoding/json"
+
+	"github.com/jeffpierce/cassabon/config"
+)
+
+// RulesResponse is returned for a "RULES" metric query: the rollup rules the shards are applying, which are
+// those configured as of the last reload, with the overrides in force.
+type RulesResponse struct {
+	Rollups   []RollupInfo     `json:"rollups"`   // In order of priority; the first expression matched wins
+	Tables    []string         `json:"tables"`    // The tables written to, in the order of the rollups
+	Overrides []rollupOverride `json:"overrides"` // Paths pinned to an expression, sorted by path
+}
+
+// RollupInfo describes one rollup definition.
+type RollupInfo struct {
+	Expression string       `json:"expression"`
+	Method     string       `json:"method"`
+	Windows    []WindowInfo `json:"windows"`
+}
+
+// WindowInfo describes one window of a rollup definition.
+type WindowInfo struct {
+	Window    string `json:"window"`
+	Retention string `json:"retention"`
+	Table     string `json:"table"`
+}
+
+// describeRules returns the description of a set of rollup rules.
+func describeRules(rr *rollupRules) RulesResponse {
+	resp := RulesResponse{[]RollupInfo{}, []string{}, rr.overrides}
+	if resp.Overrides == nil {
+		resp.Overrides = []rollupOverride{}
+	}
+	seen := make(map[string]bool)
+	for _, expr := range rr.priority {
+		def := rr.defs[expr]
+		ri := RollupInfo{expr, def.Method.String(), []WindowInfo{}}
+		for _, w := range def.Windows {
+			ri.Windows = append(ri.Windows, WindowInfo{w.Window.String(), w.Retention.String(), w.Table})
+			if !seen[w.Table] {
+				seen[w.Table] = true
+				resp.Tables = append(resp.Tables, w.Table)
+			}
+		}
+		resp.Rollups = append(resp.Rollups, ri)
+	}
+	return resp
+}
+
+// queryRules reports the rollup rules in effect.
+func (mm *MetricManager) queryRules(q config.MetricQuery) {
+	jsonText, _ := json.Marshal(describeRules(mm.currentRules()))
+	mm.sendAPIResponse(q.Channel, config.APIQueryResponse{config.AQS_OK, "", jsonText})
+}
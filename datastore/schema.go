@@ -0,0 +1,188 @@
+package datastore
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gocql/gocql"
+
+	"github.com/jeffpierce/cassabon/config"
+)
+
+// cqlMap renders a map of options as a CQL map literal, with keys in a consistent order.
+func cqlMap(options map[string]string) string {
+	keys := make([]string, 0, len(options))
+	for k := range options {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, len(keys))
+	for i, k := range keys {
+		pairs[i] = fmt.Sprintf("'%s': '%s'", k, options[k])
+	}
+	return "{" + strings.Join(pairs, ", ") + "}"
+}
+
+// tableRetention returns the retention period encoded in the name of a rollup table.
+func tableRetention(table string) time.Duration {
+	parts := strings.Split(table, "_")
+	if len(parts) != 2 {
+		return 0
+	}
+	seconds, _ := strconv.ParseInt(parts[1], 10, 64)
+	return time.Duration(seconds) * time.Second
+}
+
+// storedTables returns the names of the tables holding data points: the rollup tables, and the raw table if any.
+func storedTables() []string {
+	tables := config.Rollups().Tables
+	if config.G.MetricManager.RawTable == "" {
+		return tables
+	}
+	return append([]string{config.G.MetricManager.RawTable}, tables...)
+}
+
+// populateSchema ensures that all necessary Cassandra setup has been completed.
+func (mm *MetricManager) populateSchema() {
+
+	// Create the keyspace if it does not exist.
+	if _, err := mm.db().KeyspaceMetadata(config.Cassandra().Keyspace); err != nil {
+		// Note: "USE <keyspace>" isn't allowed, and conn.UseKeyspace() isn't sticky.
+		config.G.Log.System.LogInfo("Keyspace not found: %s", err.Error())
+		replication, err := config.Cassandra().KeyspaceReplication()
+		if err != nil {
+			config.G.Log.System.LogFatal("Could not create keyspace: %s", err.Error())
+		}
+		query := fmt.Sprintf("CREATE KEYSPACE IF NOT EXISTS %s WITH replication = %s",
+			config.Cassandra().Keyspace, replication)
+		config.G.Log.System.LogDebug(query)
+		if err := mm.db().Query(query).Exec(); err != nil {
+			config.G.Log.System.LogFatal("Could not create keyspace: %s", err.Error())
+		}
+		config.G.Log.System.LogInfo("Keyspace %q created", config.Cassandra().Keyspace)
+	}
+
+	// Create tables if they do not exist. They have the latest shape, so the rollup tables have the aggregate
+	// columns, whether or not aggregates are stored, unless they are COMPACT STORAGE, which can't have them.
+	// The raw data points have no aggregates.
+	ksmd, _ := mm.db().KeyspaceMetadata(config.Cassandra().Keyspace)
+	for _, table := range storedTables() {
+		if ksmd != nil {
+			if _, found := ksmd.Tables[table]; found {
+				continue
+			}
+		}
+		columns := "path text, time timestamp, stat double"
+		if config.Cassandra().Schema == config.SCHEMA_MODERN && table != config.G.MetricManager.RawTable {
+			columns += ", " + aggregateColumns
+		}
+		opts := config.Cassandra().TableOptions(table)
+		var clauses []string
+		if config.Cassandra().Schema == config.SCHEMA_LEGACY {
+			clauses = append(clauses, "COMPACT STORAGE")
+		}
+		clauses = append(clauses,
+			"CLUSTERING ORDER BY (time ASC)",
+			"compaction = "+cqlMap(opts.Compaction),
+			"compression = "+cqlMap(opts.Compression))
+		if opts.DCLocalReadRepairChance != nil {
+			clauses = append(clauses, fmt.Sprintf("dclocal_read_repair_chance = %v", *opts.DCLocalReadRepairChance))
+		}
+		clauses = append(clauses,
+			fmt.Sprintf("default_time_to_live = %d", rowTTL(tableRetention(table), 0)),
+			fmt.Sprintf("gc_grace_seconds = %d", *opts.GCGraceSeconds),
+			"memtable_flush_period_in_ms = 0")
+		if opts.ReadRepairChance != nil {
+			clauses = append(clauses, fmt.Sprintf("read_repair_chance = %v", *opts.ReadRepairChance))
+		}
+		clauses = append(clauses, "speculative_retry = '99.0PERCENTILE'")
+		query := fmt.Sprintf(
+			`CREATE TABLE IF NOT EXISTS %s.%s
+                (%s, PRIMARY KEY (path, time))
+            WITH %s;`,
+			config.Cassandra().Keyspace, table, columns, strings.Join(clauses, "\n                AND "))
+
+		config.G.Log.System.LogDebug(query)
+		config.G.Log.System.LogInfo("Creating table %q", table)
+
+		if err := mm.db().Query(query).Exec(); err != nil {
+			config.G.Log.System.LogFatal("Table %q creation failed: %s", table, err.Error())
+		}
+	}
+
+	// Bring the schema up to date.
+	if err := runMigrations(mm.db()); err != nil {
+		config.G.Log.System.LogFatal("Schema migration failed: %s", err.Error())
+	}
+}
+
+// The columns holding the aggregates of each window's data points, when enabled.
+const aggregateColumns = "min double, max double, sum double, count bigint"
+
+// addAggregateColumns adds the aggregate columns to the rollup tables created without them. COMPACT STORAGE
+// tables can't have them, so are left alone; UpgradeSchema adds them as it converts the tables.
+// Rows written before the columns were added have a count of zero.
+func addAggregateColumns(dbClient *gocql.Session) error {
+	if config.Cassandra().Schema != config.SCHEMA_MODERN {
+		return nil
+	}
+	ksmd, err := dbClient.KeyspaceMetadata(config.Cassandra().Keyspace)
+	if err != nil {
+		return err
+	}
+	for _, table := range config.Rollups().Tables {
+		if tmd, found := ksmd.Tables[table]; !found || tmd.Columns["count"] != nil {
+			continue
+		}
+		if err := addTableAggregateColumns(dbClient, table); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addTableAggregateColumns adds the aggregate columns to a rollup table.
+func addTableAggregateColumns(dbClient *gocql.Session, table string) error {
+	query := fmt.Sprintf("ALTER TABLE %s.%s ADD (%s)", config.Cassandra().Keyspace, table, aggregateColumns)
+	config.G.Log.System.LogDebug(query)
+	config.G.Log.System.LogInfo("Adding aggregate columns to table %q", table)
+	return dbClient.Query(query).Exec()
+}
+
+// UpgradeSchema converts existing COMPACT STORAGE rollup tables for use in the modern schema mode.
+// Tables that have already been converted report an error from Cassandra, which is only logged.
+func UpgradeSchema() (upgraded int, err error) {
+
+	dbClient, err := cassandraSession()
+	if err != nil {
+		return
+	}
+	defer dbClient.Close()
+
+	ksmd, err := dbClient.KeyspaceMetadata(config.Cassandra().Keyspace)
+	if err != nil {
+		return
+	}
+	for _, table := range storedTables() {
+		if _, found := ksmd.Tables[table]; !found {
+			continue
+		}
+		query := fmt.Sprintf("ALTER TABLE %s.%s DROP COMPACT STORAGE", config.Cassandra().Keyspace, table)
+		config.G.Log.System.LogDebug(query)
+		if e := dbClient.Query(query).Exec(); e != nil {
+			config.G.Log.System.LogWarn("Table %q not upgraded: %s", table, e.Error())
+			continue
+		}
+		if table != config.G.MetricManager.RawTable && ksmd.Tables[table].Columns["count"] == nil {
+			if e := addTableAggregateColumns(dbClient, table); e != nil {
+				config.G.Log.System.LogWarn("Table %q upgraded without aggregate columns: %s", table, e.Error())
+			}
+		}
+		config.G.Log.System.LogInfo("Table %q upgraded", table)
+		upgraded++
+	}
+	return
+}
@@ -0,0 +1,140 @@
+package datastore
+
+import (
+	"math"
+
+	"github.com/jeffpierce/cassabon/config"
+)
+
+// seriesBuilder accumulates stored rows into buckets aligned on a fixed step.
+type seriesBuilder struct {
+	method config.RollupMethod // How multiple rows falling into one bucket are combined
+	from   int64               // Timestamp of the first bucket, a multiple of step
+	step   int64               // Seconds between buckets
+	count  []uint64            // Number of rows merged into each bucket
+	value  []float64           // Merged value of each bucket
+}
+
+// alignUp returns the first multiple of step at or after ts.
+func alignUp(ts, step int64) int64 {
+	if r := ts % step; r != 0 {
+		ts += step - r
+	}
+	return ts
+}
+
+// alignDown returns the last multiple of step at or before ts.
+func alignDown(ts, step int64) int64 {
+	return ts - (ts % step)
+}
+
+// newSeriesBuilder creates a builder with one bucket per step boundary in [from, to].
+func newSeriesBuilder(method config.RollupMethod, from, to, step int64) *seriesBuilder {
+	if step < 1 {
+		step = 1
+	}
+	sb := new(seriesBuilder)
+	sb.method = method
+	sb.step = step
+	sb.from = alignUp(from, step)
+	points := 0
+	if last := alignDown(to, step); last >= sb.from {
+		points = int((last-sb.from)/step) + 1
+	}
+	sb.count = make([]uint64, points)
+	sb.value = make([]float64, points)
+	return sb
+}
+
+// to returns the timestamp of the last bucket.
+func (sb *seriesBuilder) to() int64 {
+	if len(sb.value) == 0 {
+		return sb.from
+	}
+	return sb.from + int64(len(sb.value)-1)*sb.step
+}
+
+// extend adds buckets up to the one for ts, if that is later than the last bucket.
+func (sb *seriesBuilder) extend(ts int64) {
+	last := alignUp(ts, sb.step)
+	if last < sb.from {
+		return
+	}
+	for points := int((last-sb.from)/sb.step) + 1; len(sb.value) < points; {
+		sb.count = append(sb.count, 0)
+		sb.value = append(sb.value, 0)
+	}
+}
+
+// add merges a row into the bucket whose boundary closes the window containing ts.
+// Rows are written at window end times, so a row between boundaries belongs to the next one.
+func (sb *seriesBuilder) add(ts int64, value float64) {
+	if math.IsNaN(value) || ts < sb.from-sb.step {
+		return
+	}
+	i := int((alignUp(ts, sb.step) - sb.from) / sb.step)
+	if i < 0 || i >= len(sb.value) {
+		return
+	}
+	sb.value[i] = applyMethod(sb.method, sb.value[i], value, sb.count[i])
+	sb.count[i]++
+}
+
+// series returns the bucket values, with NaN marking buckets that received no rows.
+func (sb *seriesBuilder) series() []float64 {
+	values := make([]float64, len(sb.value))
+	for i, v := range sb.value {
+		switch {
+		case sb.count[i] == 0:
+			values[i] = math.NaN()
+		case sb.method == config.AVERAGE:
+			values[i] = v / float64(sb.count[i])
+		default:
+			values[i] = v
+		}
+	}
+	return values
+}
+
+// consolidate combines runs of adjacent values so that no more than maxPoints remain,
+// returning the combined values and the number of original values in each run.
+func consolidate(values []float64, method config.RollupMethod, maxPoints int) ([]float64, int) {
+	if maxPoints < 1 || len(values) <= maxPoints {
+		return values, 1
+	}
+	factor := (len(values) + maxPoints - 1) / maxPoints
+	out := make([]float64, 0, maxPoints)
+	for start := 0; start < len(values); start += factor {
+		end := start + factor
+		if end > len(values) {
+			end = len(values)
+		}
+		var value float64
+		var count uint64
+		for _, v := range values[start:end] {
+			if !math.IsNaN(v) {
+				value = applyMethod(method, value, v, count)
+				count++
+			}
+		}
+		switch {
+		case count == 0:
+			value = math.NaN()
+		case method == config.AVERAGE:
+			value = value / float64(count)
+		}
+		out = append(out, value)
+	}
+	return out, factor
+}
+
+// toJSONValues converts a series to a form that encodes missing values as null.
+func toJSONValues(values []float64) []interface{} {
+	out := make([]interface{}, len(values))
+	for i, v := range values {
+		if !math.IsNaN(v) {
+			out[i] = v
+		}
+	}
+	return out
+}
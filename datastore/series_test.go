@@ -0,0 +1,70 @@
+package datastore
+
+import (
+	"math"
+	"testing"
+
+	"github.com/jeffpierce/cassabon/config"
+)
+
+func TestSeriesBuilder(t *testing.T) {
+
+	// 95..205 at a 10s step is aligned to 100..200, which is 11 buckets.
+	sb := newSeriesBuilder(config.AVERAGE, 95, 205, 10)
+	if sb.from != 100 || sb.to() != 200 {
+		t.Errorf("Wrong alignment: got %d..%d, expected 100..200", sb.from, sb.to())
+	}
+
+	sb.add(100, 1)
+	sb.add(127, 2) // Belongs to the 130 boundary
+	sb.add(130, 4)
+	sb.add(300, 9) // Out of range, ignored
+
+	values := sb.series()
+	if len(values) != 11 {
+		t.Fatalf("Wrong number of values: got %d, expected 11", len(values))
+	}
+	if values[0] != 1 {
+		t.Errorf("Wrong value at 100: got %v, expected 1", values[0])
+	}
+	if values[3] != 3 {
+		t.Errorf("Wrong value at 130: got %v, expected 3", values[3])
+	}
+	if !math.IsNaN(values[1]) {
+		t.Errorf("Expected gap at 110, got %v", values[1])
+	}
+
+	json := toJSONValues(values)
+	if json[1] != nil || json[0] != 1.0 {
+		t.Errorf("Wrong JSON conversion: %v", json)
+	}
+}
+
+func TestConsolidate(t *testing.T) {
+
+	nan := math.NaN()
+	values := []float64{1, 3, nan, nan, 5, 7, 2}
+
+	out, factor := consolidate(values, config.MAX, 3)
+	if factor != 3 || len(out) != 3 {
+		t.Fatalf("Wrong consolidation: factor %d, %d values, expected 3 and 3", factor, len(out))
+	}
+	if out[0] != 3 || out[1] != 7 || out[2] != 2 {
+		t.Errorf("Wrong consolidated values: %v", out)
+	}
+
+	out, _ = consolidate(values, config.AVERAGE, 4)
+	if out[0] != 2 || !math.IsNaN(out[1]) || out[2] != 6 {
+		t.Errorf("Wrong consolidated averages: %v", out)
+	}
+
+	// A maximum of negative values is not taken to be the zero the accumulator starts from.
+	out, _ = consolidate([]float64{-3, -1, -2, -5}, config.MAX, 2)
+	if out[0] != -1 || out[1] != -2 {
+		t.Errorf("Wrong consolidated negative maxima: %v", out)
+	}
+
+	if _, factor = consolidate(values, config.AVERAGE, 0); factor != 1 {
+		t.Errorf("Expected no consolidation without a limit, got factor %d", factor)
+	}
+}
@@ -0,0 +1,171 @@
+package datastore
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/gocql/gocql"
+
+	"github.com/jeffpierce/cassabon/config"
+	"github.com/jeffpierce/cassabon/logging"
+	"github.com/jeffpierce/cassabon/middleware"
+)
+
+// How long sessions that have been replaced stay open, so that queries begun on them can finish.
+const sessionCloseDelay = 30 * time.Second
+
+// The number of Cassandra hosts up, as the write session sees them.
+var hostsUp int32
+
+// cassandraSessions are the metric manager's connections to Cassandra: one for writes, and one for
+// answering queries, so that heavy reads can't take the connections writes need.
+type cassandraSessions struct {
+	write *gocql.Session
+	read  *gocql.Session
+}
+
+// openSessions opens the write and read sessions.
+func openSessions() (*cassandraSessions, error) {
+	opts := cassandraOptions(config.Cassandra())
+	opts.HostsUp = &hostsUp
+	write, err := middleware.CassandraSession(opts)
+	if err != nil {
+		return nil, err
+	}
+	read, err := cassandraReadSession()
+	if err != nil {
+		write.Close()
+		return nil, err
+	}
+	return &cassandraSessions{write, read}, nil
+}
+
+// close closes both sessions.
+func (cs *cassandraSessions) close() {
+	cs.write.Close()
+	if cs.read != cs.write {
+		cs.read.Close()
+	}
+}
+
+// currentSessions returns the sessions in use, which are nil until they are opened.
+func (mm *MetricManager) currentSessions() *cassandraSessions {
+	if cs, ok := mm.sessions.Load().(*cassandraSessions); ok {
+		return cs
+	}
+	return &cassandraSessions{}
+}
+
+// db returns the session for writes and administration.
+func (mm *MetricManager) db() *gocql.Session {
+	return mm.currentSessions().write
+}
+
+// reads returns the session for answering queries.
+func (mm *MetricManager) reads() *gocql.Session {
+	return mm.currentSessions().read
+}
+
+// checkSessions runs a trivial query on each session, and reports their health and the number of hosts up
+// to statsd. Once the checks have failed often enough in a row, the sessions are replaced by new ones,
+// without waiting for a restart. The caller sets checkingSessions, which is cleared on return.
+func (mm *MetricManager) checkSessions() {
+	defer atomic.StoreInt32(&mm.checkingSessions, 0)
+
+	logging.Statsd.Client.Gauge("metricmgr.db.hosts.up", int64(atomic.LoadInt32(&hostsUp)), 1.0)
+	cs := mm.currentSessions()
+	var version string
+	err := cs.write.Query("SELECT release_version FROM system.local").Scan(&version)
+	if err == nil {
+		err = cs.read.Query("SELECT release_version FROM system.local").Scan(&version)
+	}
+	if err == nil {
+		logging.Statsd.Client.Gauge("metricmgr.db.healthy", 1, 1.0)
+		mm.sessionFailures = 0
+		return
+	}
+	logging.Statsd.Client.Gauge("metricmgr.db.healthy", 0, 1.0)
+	mm.sessionFailures++
+	config.G.Log.System.LogWarn("MetricManager Cassandra health check failed (%d in a row): %s",
+		mm.sessionFailures, err.Error())
+	if mm.sessionFailures < config.Cassandra().RebuildAfter {
+		return
+	}
+
+	if err := mm.replaceSessions(); err != nil {
+		cs := config.Cassandra()
+		config.G.Log.System.LogError("MetricManager unable to reconnect to Cassandra at %v, port %s: %s",
+			cs.Hosts, cs.Port, err.Error())
+		return
+	}
+	mm.sessionFailures = 0
+	logging.Statsd.Client.Inc("metricmgr.db.session.rebuilt", 1, 1.0)
+	config.G.Log.System.LogWarn("MetricManager reconnected to Cassandra after repeated failures")
+}
+
+// reopenSessions replaces the sessions with ones opened with the Cassandra settings reloaded on SIGHUP, once
+// any health check in progress is done. If they can't be opened, those in use are kept.
+func (mm *MetricManager) reopenSessions() {
+	for !atomic.CompareAndSwapInt32(&mm.checkingSessions, 0, 1) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	defer atomic.StoreInt32(&mm.checkingSessions, 0)
+
+	if err := mm.replaceSessions(); err != nil {
+		cs := config.Cassandra()
+		config.G.Log.System.LogError("MetricManager unable to connect to Cassandra at %v, port %s: %s; keeping the sessions in use",
+			cs.Hosts, cs.Port, err.Error())
+		return
+	}
+	mm.sessionFailures = 0
+	cs := config.Cassandra()
+	config.G.Log.System.LogInfo("MetricManager reconnected to Cassandra at %v, port %s", cs.Hosts, cs.Port)
+}
+
+// replaceSessions opens new sessions, and puts them in place of those in use, which are closed once queries
+// begun on them have had time to finish.
+func (mm *MetricManager) replaceSessions() error {
+	fresh, err := openSessions()
+	if err != nil {
+		return err
+	}
+	old := mm.currentSessions()
+	mm.sessions.Store(fresh)
+	time.AfterFunc(sessionCloseDelay, old.close)
+	return nil
+}
+
+// cassandraSession opens a session with the configured Cassandra cluster, for writes and administration.
+func cassandraSession() (*gocql.Session, error) {
+	return middleware.CassandraSession(cassandraOptions(config.Cassandra()))
+}
+
+// cassandraReadSession opens a session with the configured Cassandra cluster for answering queries.
+func cassandraReadSession() (*gocql.Session, error) {
+	cs := config.Cassandra()
+	opts := cassandraOptions(cs)
+	reads := cs.Reads
+	opts.LocalDC = reads.LocalDC
+	opts.Consistency = reads.Consistency
+	opts.Timeout = time.Duration(reads.Timeout) * time.Millisecond
+	opts.NumConns = reads.NumConns
+	opts.Retries = reads.QueryRetries
+	return middleware.CassandraSession(opts)
+}
+
+// cassandraOptions returns the settings of a Cassandra session for writes.
+func cassandraOptions(cs *config.CassandraSettings) middleware.CassandraOptions {
+	return middleware.CassandraOptions{
+		Hosts:    cs.Hosts,
+		Port:     cs.Port,
+		LocalDC:  cs.LocalDC,
+		Timeout:  time.Duration(cs.Timeout) * time.Millisecond,
+		NumConns: cs.NumConns,
+		Retries:  cs.QueryRetries,
+
+		Compression:  cs.Compression,
+		ProtoVersion: cs.ProtoVersion,
+		CQLVersion:   cs.CQLVersion,
+		Consistency:  cs.Consistency,
+	}
+}
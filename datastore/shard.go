@@ -0,0 +1,402 @@
+package datastore
+
+import (
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/jeffpierce/cassabon/config"
+)
+
+// shard accumulates rollups for the subset of paths whose hash selects it.
+type shard struct {
+
+	// The owning MetricManager, for configuration and the database writer.
+	mm *MetricManager
+
+	// Wait Group for managing orderly termination.
+	wg *sync.WaitGroup
+
+	// Incoming metrics for paths owned by this shard.
+	metrics chan config.CarbonMetric
+
+	// Requests for unflushed data from the query path.
+	snapshotReq chan snapshotRequest
+
+	// Requests to stop tracking paths that have been removed from the index.
+	forgetReq chan forgetRequest
+
+	// Requests to write out everything accumulated now, each with the channel on which to report it done.
+	flushReq chan chan struct{}
+
+	// Peer change and rollup change handshakes, and termination notification.
+	peerChangeReq  chan struct{}
+	peerChangeRsp  chan struct{}
+	rulesChangeReq chan *rollupRules
+	rulesChangeRsp chan struct{}
+	onExit         chan struct{}
+
+	// Notifications from the window timers that a window has closed.
+	due chan windowDue
+
+	// Ticks on which active paths are indexed again, when index entries expire; nil otherwise.
+	announce *time.Ticker
+
+	// The rollup configuration in effect for this shard's data.
+	rules *rollupRules
+
+	// Batches of raw data points, written at each flush; nil unless raw data points are stored.
+	raw *batchWriter
+
+	// Rollup data.
+	byPath map[string]*rollup  // Stats, by path, for rollup accumulation
+	byExpr map[string]*runlist // Stats, by path within expression, for rollup processing
+}
+
+// windowDue notifies a shard that a window of an expression has closed, so its data should be written.
+type windowDue struct {
+	expr    string
+	window  int
+	runList *runlist // The runlist of the timer, which is stale if the rollup data was since reset
+}
+
+// snapshotRequest asks a shard for the data accumulated so far in an open window.
+type snapshotRequest struct {
+	path  string              // The path whose data is requested
+	table string              // The table of the rollup window, which identifies it across reloads
+	reply chan windowSnapshot // Channel to send the data back on
+}
+
+// forgetRequest asks a shard to stop tracking a path, unless it has data not yet written.
+type forgetRequest struct {
+	path  string    // The path to be forgotten
+	reply chan bool // Channel to report back on whether it was forgotten
+}
+
+// openWindow is the unflushed data accumulated for a path in one rollup window.
+type openWindow struct {
+	end   time.Time // When the window closes, which is the timestamp it will be written with
+	value float64   // The rollup value, as it would be written now
+	count uint64    // Number of data points accumulated; zero if none, or path unknown
+	agg   aggregate // The aggregates of the data points, if stored
+}
+
+// windowSnapshot is the unflushed data for a path in a rollup window, and the data last written from
+// the window, which may still be on its way to the database.
+type windowSnapshot struct {
+	open    openWindow
+	written openWindow
+}
+
+// shardIndex returns the index of the shard that owns the supplied path.
+// Note: FNV is used rather than Pearson, which already partitions paths across peers.
+func shardIndex(path string, shardCount int) int {
+	h := fnv.New32a()
+	h.Write([]byte(path))
+	return int(h.Sum32() % uint32(shardCount))
+}
+
+func (s *shard) init(mm *MetricManager, onExit chan struct{}) {
+
+	s.mm = mm
+	s.onExit = onExit
+	s.rules = mm.currentRules()
+
+	// Initialize private objects.
+	s.metrics = make(chan config.CarbonMetric, config.G.Channels.MetricStoreChanLen)
+	s.snapshotReq = make(chan snapshotRequest, config.G.Channels.MetricRequestChanLen)
+	s.forgetReq = make(chan forgetRequest, 1)
+	s.flushReq = make(chan chan struct{}, 1)
+	s.peerChangeReq = make(chan struct{}, 1)
+	s.peerChangeRsp = make(chan struct{}, 1)
+	s.rulesChangeReq = make(chan *rollupRules, 1)
+	s.rulesChangeRsp = make(chan struct{}, 1)
+	s.due = make(chan windowDue, config.G.Channels.MetricRequestChanLen)
+
+	// Perform first-time initialization of rollup data accumulation structures.
+	s.resetRollupData()
+}
+
+func (s *shard) start(wg *sync.WaitGroup) {
+
+	// The raw data points are written to a single table, so one batch is prepared for the life of the shard.
+	if config.G.MetricManager.RawTable != "" {
+		s.raw = new(batchWriter)
+		cs := config.Cassandra()
+		s.raw.Init(s.rules.stmts, cs.BatchSize, false, s.mm.insert)
+		s.raw.Prepare(config.G.MetricManager.RawTable, config.G.MetricManager.RawRetention)
+		s.raw.abort = s.onExit
+	}
+
+	// Active paths are indexed again well within the age at which index entries expire.
+	if config.G.Index.TTL > 0 {
+		s.announce = time.NewTicker(config.G.Index.TTL / 4)
+	}
+
+	s.wg = wg
+	s.wg.Add(1)
+	go s.run()
+}
+
+func (s *shard) resetRollupData() {
+
+	// Initialize rollup data structures.
+	s.stopTimers()
+	s.mm.addPathCount(-int64(len(s.byPath)))
+	s.byPath = make(map[string]*rollup)
+	s.byExpr = make(map[string]*runlist)
+	baseTime := time.Now()
+	for expr, rollupdef := range s.rules.defs {
+		// For each expression, provide a place to record all the paths that it matches.
+		rl := new(runlist)
+		rl.nextWriteTime = make([]time.Time, len(rollupdef.Windows))
+		rl.timers = make([]*time.Timer, len(rollupdef.Windows))
+		rl.written = make([]map[string]openWindow, len(rollupdef.Windows))
+		rl.path = make(map[string]*rollup)
+		// Establish the next time boundary on which each write will take place, with a timer
+		// of its own, so that a window is written on time however long the others take.
+		for i, v := range rollupdef.Windows {
+			rl.nextWriteTime[i] = nextTimeBoundary(baseTime, v.Window)
+			rl.timers[i] = time.AfterFunc(rl.nextWriteTime[i].Sub(baseTime), s.notifier(windowDue{expr, i, rl}))
+		}
+		s.byExpr[expr] = rl
+	}
+}
+
+// closedWindows returns the windows whose timers have fired: the one supplied, and any others waiting.
+// Timers from before the rollup data was last reset are ignored.
+func (s *shard) closedWindows(due windowDue) []windowDue {
+	var windows []windowDue
+	for {
+		if s.byExpr[due.expr] == due.runList {
+			windows = append(windows, due)
+		}
+		select {
+		case due = <-s.due:
+			// Another window has closed.
+		default:
+			return windows
+		}
+	}
+}
+
+// notifier returns the function run by a window's timer, which tells the shard that the window has closed.
+func (s *shard) notifier(due windowDue) func() {
+	return func() {
+		select {
+		case s.due <- due:
+		case <-s.onExit:
+		}
+	}
+}
+
+// advanceWindows moves every open window on to the next, once a forced flush has written what accumulated in
+// it, so that it isn't written a second time when it closes. A window whose timer has already fired is left
+// to be written, and moved on, as it closes.
+// Note: Must only be called from the shard's own goroutine.
+func (s *shard) advanceWindows() {
+	now := time.Now()
+	for expr, rl := range s.byExpr {
+		for i, w := range s.rules.defs[expr].Windows {
+			if rl.timers[i].Stop() {
+				rl.nextWriteTime[i] = rl.nextWriteTime[i].Add(w.Window)
+				rl.timers[i].Reset(rl.nextWriteTime[i].Sub(now))
+			}
+		}
+	}
+}
+
+// stopTimers stops the timers of every window.
+func (s *shard) stopTimers() {
+	for _, rl := range s.byExpr {
+		for _, t := range rl.timers {
+			t.Stop()
+		}
+	}
+}
+
+func (s *shard) run() {
+
+	defer config.G.OnPanic()
+
+	// A nil channel never delivers, so paths are only indexed again if the ticker is created.
+	var announce <-chan time.Time
+	if s.announce != nil {
+		defer s.announce.Stop()
+		announce = s.announce.C
+	}
+
+	for {
+		select {
+		case <-s.peerChangeReq:
+			s.flush()
+			s.resetRollupData()
+			s.peerChangeRsp <- struct{}{} // Unblock sender
+		case rules := <-s.rulesChangeReq:
+			s.applyRules(rules)
+			s.rulesChangeRsp <- struct{}{} // Unblock sender
+		case <-s.onExit:
+			config.G.Log.System.LogDebug("MetricManager::shard::run received QUIT message")
+			s.stopTimers()
+			if s.mm.saved != nil {
+				// Save what has accumulated, rather than writing windows that have not yet closed.
+				s.mm.saved.add(s.save())
+				s.writeRaw()
+			} else {
+				s.flush()
+			}
+			s.wg.Done()
+			return
+		case metric := <-s.metrics:
+			s.accumulate(metric)
+		case req := <-s.snapshotReq:
+			req.reply <- s.captureWindow(req.path, req.table)
+		case req := <-s.forgetReq:
+			req.reply <- s.removeFromMaps(req.path)
+		case reply := <-s.flushReq:
+			s.flush()
+			s.advanceWindows()
+			reply <- struct{}{}
+		case due := <-s.due:
+			s.flushWindows(s.closedWindows(due))
+		case <-announce:
+			s.announceActive()
+		}
+	}
+}
+
+// announceActive sends every path that has received data since it was last indexed to be indexed again,
+// so that its index entries don't expire.
+// Note: Must only be called from the shard's own goroutine.
+func (s *shard) announceActive() {
+	announced := 0
+	for path, r := range s.byPath {
+		if r.active {
+			r.active = false
+			config.G.Channels.IndexStore <- config.CarbonMetric{Path: path}
+			announced++
+		}
+	}
+	config.G.Log.System.LogDebug("MetricManager::shard announced %d active paths", announced)
+}
+
+// applyRules writes out what accumulated under the rules in effect, then matches every known
+// path against the new rules.
+// Note: Must only be called from the shard's own goroutine, or before it is started.
+func (s *shard) applyRules(rules *rollupRules) {
+	s.flush()
+	paths := s.byPath
+	s.rules = rules
+	s.resetRollupData()
+	for path, old := range paths {
+		// Keep counter baselines, so no increase is lost across the change.
+		r := s.addToMaps(path)
+		r.counter, r.counted = old.counter, old.counted
+	}
+}
+
+// snapshot returns the unflushed data for a path in the rollup window written to a table.
+// It is safe to call from any goroutine, and returns an empty result once the shard has exited.
+func (s *shard) snapshot(path, table string) windowSnapshot {
+	req := snapshotRequest{path, table, make(chan windowSnapshot, 1)}
+	select {
+	case s.snapshotReq <- req:
+	case <-s.onExit:
+		return windowSnapshot{}
+	}
+	select {
+	case snap := <-req.reply:
+		return snap
+	case <-s.onExit:
+		return windowSnapshot{}
+	}
+}
+
+// captureWindow captures the unflushed data for a path in the rollup window written to a table,
+// along with what was last written from the window.
+// Note: Must only be called from the shard's own goroutine.
+func (s *shard) captureWindow(path, table string) windowSnapshot {
+	var snap windowSnapshot
+	r, found := s.byPath[path]
+	if !found {
+		return snap
+	}
+	window := -1
+	for i, w := range s.rules.defs[r.expr].Windows {
+		if w.Table == table {
+			window = i
+			break
+		}
+	}
+	if window < 0 {
+		return snap
+	}
+	snap.written = s.byExpr[r.expr].written[window][path]
+	if r.count[window] == 0 {
+		return snap
+	}
+	ow := &snap.open
+	ow.end = s.byExpr[r.expr].nextWriteTime[window]
+	ow.count = r.count[window]
+	ow.value = r.value[window]
+	if r.agg != nil {
+		ow.agg = r.agg[window]
+	}
+	if s.rules.defs[r.expr].Method == config.AVERAGE {
+		ow.value = ow.value / float64(ow.count)
+	}
+	return snap
+}
+
+// forget stops tracking a path, so that it is indexed again if more data arrives, and reports whether
+// it did so. A path with data not yet written is in use, so is kept.
+// It is safe to call from any goroutine, and reports false once the shard has exited.
+func (s *shard) forget(path string) bool {
+	req := forgetRequest{path, make(chan bool, 1)}
+	select {
+	case s.forgetReq <- req:
+	case <-s.onExit:
+		return false
+	}
+	select {
+	case forgotten := <-req.reply:
+		return forgotten
+	case <-s.onExit:
+		return false
+	}
+}
+
+// flushNow writes out everything accumulated, whether or not its window has closed, and reports whether it did so.
+// It is safe to call from any goroutine, and reports false once the shard has exited.
+func (s *shard) flushNow() bool {
+	reply := make(chan struct{}, 1)
+	select {
+	case s.flushReq <- reply:
+	case <-s.onExit:
+		return false
+	}
+	select {
+	case <-reply:
+		return true
+	case <-s.onExit:
+		return false
+	}
+}
+
+// removeFromMaps removes an unused path from the s.byPath and s.byExpr maps, and reports whether it did so.
+// Note: Must only be called from the shard's own goroutine.
+func (s *shard) removeFromMaps(path string) bool {
+	r, found := s.byPath[path]
+	if !found {
+		return true
+	}
+	for _, count := range r.count {
+		if count > 0 {
+			return false
+		}
+	}
+	delete(s.byPath, path)
+	delete(s.byExpr[r.expr].path, path)
+	s.mm.addPathCount(-1)
+	return true
+}
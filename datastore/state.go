@@ -0,0 +1,230 @@
+package datastore
+
+import (
+	"bufio"
+	"encoding/json"
+	"math"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/jeffpierce/cassabon/config"
+)
+
+// savedRollup is the accumulation state of one path, as saved in the state file on termination.
+type savedRollup struct {
+	Path    string        `json:"path"`
+	Counter *float64      `json:"counter,omitempty"` // For counters, the previous input value, if one was seen
+	Windows []savedWindow `json:"windows,omitempty"` // The windows in which data has accumulated
+}
+
+// savedWindow is the data accumulated in one open window of a path.
+type savedWindow struct {
+	Table string      `json:"table"` // The table of the window, which identifies it across restarts
+	End   int64       `json:"end"`   // When the window closes, in seconds since the epoch
+	Value float64     `json:"value"` // The rollup value; for averages, the sum of the data points
+	Count uint64      `json:"count"`
+	Agg   *[3]float64 `json:"agg,omitempty"` // The min, max and sum of the data points, if stored
+}
+
+// savedState collects the state saved by each shard as it terminates.
+type savedState struct {
+	m       sync.Mutex
+	rollups []savedRollup
+}
+
+// add records the saved state of some paths.
+func (ss *savedState) add(rollups []savedRollup) {
+	ss.m.Lock()
+	defer ss.m.Unlock()
+	ss.rollups = append(ss.rollups, rollups...)
+}
+
+// writeStateFile writes the saved state, one JSON object per line. It is written under a temporary
+// name, and renamed once complete, so that a partly written file is never restored.
+func writeStateFile(filename string, rollups []savedRollup) error {
+	fp, err := os.Create(filename + ".tmp")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(fp)
+	for _, sr := range rollups {
+		var line []byte
+		if line, err = json.Marshal(sr); err != nil {
+			break
+		}
+		w.Write(line)
+		if _, err = w.WriteString("\n"); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if e := fp.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		os.Remove(fp.Name())
+		return err
+	}
+	return os.Rename(fp.Name(), filename)
+}
+
+// saveState writes the state saved by the shards to the state file. If that fails, the data accumulated
+// in open windows is written to the database instead, stamped with the current time, as a flush would.
+// Must be called once the shards have terminated, and before the writers.
+func (mm *MetricManager) saveState(filename string) {
+	rollups := mm.saved.rollups
+	err := writeStateFile(filename, rollups)
+	if err == nil {
+		config.G.Log.System.LogInfo("MetricManager saved the state of %d paths", len(rollups))
+		return
+	}
+	config.G.Log.System.LogError("MetricManager unable to write state file: %s", err.Error())
+
+	end := time.Now().Unix()
+	tables := make(backfillTables)
+	rules := mm.currentRules()
+	for _, sr := range rollups {
+		method := rules.defs[rules.getExpression(sr.Path)].Method
+		for _, sw := range sr.Windows {
+			tables.put(sr.Path, sw.Table, end, sw.bucket(method))
+		}
+	}
+	// The writers may be stuck, so rather than wait for them, abandon what they won't take.
+	abort := make(chan struct{})
+	close(abort)
+	mm.writeBackfill(tables, abort)
+}
+
+// save captures the data accumulated in every open window, and the counter baselines,
+// so that they can be restored on restart rather than written early.
+// Note: Must only be called from the shard's own goroutine.
+func (s *shard) save() []savedRollup {
+	var rollups []savedRollup
+	for path, r := range s.byPath {
+		sr := savedRollup{Path: path}
+		if r.counted {
+			counter := r.counter
+			sr.Counter = &counter
+		}
+		for i, w := range s.rules.defs[r.expr].Windows {
+			if r.count[i] == 0 {
+				continue
+			}
+			// JSON can't represent these, and Cassandra wouldn't have stored them usefully.
+			if math.IsNaN(r.value[i]) || math.IsInf(r.value[i], 0) {
+				continue
+			}
+			sw := savedWindow{w.Table, s.byExpr[r.expr].nextWriteTime[i].Unix(), r.value[i], r.count[i], nil}
+			if r.agg != nil {
+				sw.Agg = &[3]float64{r.agg[i].min, r.agg[i].max, r.agg[i].sum}
+			}
+			sr.Windows = append(sr.Windows, sw)
+		}
+		if sr.Counter != nil || len(sr.Windows) > 0 {
+			rollups = append(rollups, sr)
+		}
+	}
+	return rollups
+}
+
+// restore puts the saved state of a path back into accumulation. Windows that are open again are
+// resumed; those that closed while the daemon was stopped are added to the supplied tables, to be
+// written with their proper end times. Windows still open that can't be resumed, because the rollup
+// definition changed, are added to be written stamped with the current time, as a flush would, and
+// their number is returned.
+// Note: Must only be called from the shard's own goroutine, or before it is started.
+func (s *shard) restore(sr savedRollup, closed backfillTables, now time.Time) (changed int) {
+	r, found := s.byPath[sr.Path]
+	if !found {
+		r = s.addToMaps(sr.Path)
+		config.G.Channels.IndexStore <- config.CarbonMetric{Path: sr.Path}
+	}
+	if sr.Counter != nil {
+		r.counter, r.counted = *sr.Counter, true
+	}
+
+	def := s.rules.defs[r.expr]
+	for _, sw := range sr.Windows {
+		b := sw.bucket(def.Method)
+		end := time.Unix(sw.End, 0)
+
+		// Resume the window if it is still the one open; the zero count means nothing has arrived since.
+		resumed := false
+		for i, w := range def.Windows {
+			if w.Table == sw.Table && s.byExpr[r.expr].nextWriteTime[i].Equal(end) && r.count[i] == 0 {
+				r.value[i], r.count[i] = sw.Value, sw.Count
+				if r.agg != nil {
+					r.agg[i] = b.agg
+				}
+				resumed = true
+			}
+		}
+		if resumed {
+			continue
+		}
+		if !end.Before(now) {
+			config.G.Log.System.LogDebug("MetricManager flushing the %s window of %s, its rollup definition changed",
+				sw.Table, sr.Path)
+			closed.put(sr.Path, sw.Table, now.Unix(), b)
+			changed++
+			continue
+		}
+
+		// Otherwise, write it as it would have been had the daemon kept running.
+		closed.put(sr.Path, sw.Table, sw.End, b)
+	}
+	return
+}
+
+// bucket returns the saved data as it is written to the database.
+func (sw savedWindow) bucket(method config.RollupMethod) *backfillBucket {
+	b := &backfillBucket{method: method, value: sw.Value, count: sw.Count}
+	if sw.Agg != nil {
+		b.agg = aggregate{sw.Agg[0], sw.Agg[1], sw.Agg[2]}
+	}
+	return b
+}
+
+// restoreState reloads the accumulation state saved on termination, if any, and removes the file,
+// so that it is never restored twice. Must be called before the shards are started.
+func (mm *MetricManager) restoreState(filename string) {
+
+	fp, err := os.Open(filename)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			config.G.Log.System.LogError("MetricManager unable to read state file: %s", err.Error())
+		}
+		return
+	}
+	defer os.Remove(filename)
+	defer fp.Close()
+
+	now := time.Now()
+	closed := make(backfillTables)
+	restored, changed := 0, 0
+	scanner := bufio.NewScanner(fp)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var sr savedRollup
+		if err := json.Unmarshal(scanner.Bytes(), &sr); err != nil || sr.Path == "" {
+			config.G.Log.System.LogWarn("MetricManager skipping malformed state: %q", scanner.Text())
+			continue
+		}
+		changed += mm.shardFor(sr.Path).restore(sr, closed, now)
+		restored++
+	}
+	if err := scanner.Err(); err != nil {
+		config.G.Log.System.LogError("MetricManager unable to read state file: %s", err.Error())
+	}
+
+	if changed > 0 {
+		config.G.Log.System.LogWarn("MetricManager flushing %d open windows whose rollup definitions changed while stopped",
+			changed)
+	}
+	rows, skipped := mm.writeBackfill(closed, nil)
+	config.G.Log.System.LogInfo("MetricManager restored the state of %d paths, writing %d closed windows, %d expired",
+		restored, rows, skipped)
+}
@@ -0,0 +1,122 @@
+package datastore
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/jeffpierce/cassabon/config"
+)
+
+func TestSaveRestore(t *testing.T) {
+	windows := []config.RollupWindow{{time.Minute, time.Hour, "rollup_3600"}}
+	rules := &rollupRules{
+		priority: []string{"^net.*", config.ROLLUP_CATCHALL},
+		defs: map[string]config.RollupDef{
+			"^net.*":               {config.COUNTER, regexp.MustCompile("^net.*"), windows},
+			config.ROLLUP_CATCHALL: {config.AVERAGE, nil, windows},
+		},
+		exact: map[string]string{},
+		stmts: newStatementSet("cassabon", nil),
+	}
+	newShard := func() *shard {
+		s := &shard{mm: &MetricManager{}, rules: rules}
+		s.resetRollupData()
+		s.addToMaps("cpu")
+		s.addToMaps("net.rx")
+		return s
+	}
+
+	// Accumulate an average, and a counter baseline with no data yet.
+	s := newShard()
+	defer s.stopTimers()
+	end := s.byExpr[config.ROLLUP_CATCHALL].nextWriteTime[0]
+	cpu := s.byPath["cpu"]
+	cpu.value[0], cpu.count[0] = 6, 2
+	rx := s.byPath["net.rx"]
+	rx.counter, rx.counted = 150, true
+
+	// Round trip the state through a file.
+	filename := filepath.Join(t.TempDir(), "state")
+	if err := writeStateFile(filename, s.save()); err != nil {
+		t.Fatalf("Unable to write state file: %s", err.Error())
+	}
+	fp, err := os.Open(filename)
+	if err != nil {
+		t.Fatalf("Unable to open state file: %s", err.Error())
+	}
+	defer fp.Close()
+	var saved []savedRollup
+	for scanner := bufio.NewScanner(fp); scanner.Scan(); {
+		var sr savedRollup
+		if err := json.Unmarshal(scanner.Bytes(), &sr); err != nil {
+			t.Fatalf("Malformed state %q: %s", scanner.Text(), err.Error())
+		}
+		saved = append(saved, sr)
+	}
+	if len(saved) != 2 {
+		t.Fatalf("Expected the state of 2 paths, found %d", len(saved))
+	}
+
+	// A window that is still open resumes.
+	s2 := newShard()
+	defer s2.stopTimers()
+	for _, expr := range []string{"^net.*", config.ROLLUP_CATCHALL} {
+		s2.byExpr[expr].nextWriteTime[0] = end
+	}
+	closed := make(backfillTables)
+	for _, sr := range saved {
+		s2.restore(sr, closed, end.Add(-time.Second))
+	}
+	if r := s2.byPath["cpu"]; r.value[0] != 6 || r.count[0] != 2 {
+		t.Errorf("Expected the open window to resume, got %v %v", r.value, r.count)
+	}
+	if r := s2.byPath["net.rx"]; !r.counted || r.counter != 150 {
+		t.Errorf("Expected the counter baseline to be restored, got %v %v", r.counter, r.counted)
+	}
+	if len(closed) != 0 {
+		t.Errorf("Expected nothing to be written, got %v", closed)
+	}
+
+	// A window that closed meanwhile is written with its end time.
+	s3 := newShard()
+	defer s3.stopTimers()
+	for _, expr := range []string{"^net.*", config.ROLLUP_CATCHALL} {
+		s3.byExpr[expr].nextWriteTime[0] = end.Add(2 * time.Minute)
+	}
+	for _, sr := range saved {
+		s3.restore(sr, closed, end.Add(time.Minute))
+	}
+	if r := s3.byPath["cpu"]; r.count[0] != 0 {
+		t.Errorf("Expected the closed window not to resume, got %v", r.count)
+	}
+	expected := &backfillBucket{config.AVERAGE, 6, 2, aggregate{}}
+	if b := closed["rollup_3600"].paths["cpu"][end.Unix()]; !reflect.DeepEqual(b, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, b)
+	}
+
+	// A window still open, whose definition changed meanwhile, is written as a flush would.
+	s4 := newShard()
+	defer s4.stopTimers()
+	now := end.Add(-time.Second)
+	for _, expr := range []string{"^net.*", config.ROLLUP_CATCHALL} {
+		s4.byExpr[expr].nextWriteTime[0] = end.Add(time.Minute)
+	}
+	changed := make(backfillTables)
+	for _, sr := range saved {
+		if n := s4.restore(sr, changed, now); (n != 0) != (sr.Path == "cpu") {
+			t.Errorf("Wrong number of windows flushed for %s: %d", sr.Path, n)
+		}
+	}
+	if r := s4.byPath["cpu"]; r.count[0] != 0 {
+		t.Errorf("Expected the changed window not to resume, got %v", r.count)
+	}
+	if b := changed["rollup_3600"].paths["cpu"][now.Unix()]; !reflect.DeepEqual(b, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, b)
+	}
+}
@@ -0,0 +1,97 @@
+package datastore
+
+import (
+	"fmt"
+
+	"github.com/jeffpierce/cassabon/config"
+)
+
+// The CQL run against every rollup table, as templates taking the keyspace and table name.
+const (
+	cqlInsert          = `INSERT INTO %s.%s (path, time, stat) VALUES (?, ?, ?) USING TTL ?`
+	cqlInsertAggregate = `INSERT INTO %s.%s (path, time, stat, min, max, sum, count) VALUES (?, ?, ?, ?, ?, ?, ?) USING TTL ?`
+	cqlSelect          = `SELECT stat,time FROM %s.%s WHERE path=? AND time>=? AND time<=?`
+	cqlSelectAggregate = `SELECT min,max,sum,count,time FROM %s.%s WHERE path=? AND time>=? AND time<=?`
+	cqlCount           = `SELECT COUNT(*) FROM %s.%s WHERE path=? AND time>=? AND time<=?`
+	cqlDelete          = `DELETE FROM %s.%s WHERE path=? AND time>=? AND time<=?`
+	cqlDeletePath      = `DELETE FROM %s.%s WHERE path=?`
+	cqlLatest          = `SELECT time FROM %s.%s WHERE path=? AND time>=? LIMIT 1`
+	cqlDistinctPaths   = `SELECT DISTINCT path FROM %s.%s`
+)
+
+// tableStatements holds the CQL run against one table.
+type tableStatements struct {
+	insert          string
+	insertAggregate string
+	selectStat      string
+	selectAggregate string
+	count           string
+	delete          string
+	deletePath      string
+	latest          string
+	distinctPaths   string
+}
+
+// newTableStatements builds the statements for a table from the templates.
+func newTableStatements(keyspace, table string) *tableStatements {
+	build := func(template string) string {
+		return fmt.Sprintf(template, keyspace, table)
+	}
+	return &tableStatements{
+		insert:          build(cqlInsert),
+		insertAggregate: build(cqlInsertAggregate),
+		selectStat:      build(cqlSelect),
+		selectAggregate: build(cqlSelectAggregate),
+		count:           build(cqlCount),
+		delete:          build(cqlDelete),
+		deletePath:      build(cqlDeletePath),
+		latest:          build(cqlLatest),
+		distinctPaths:   build(cqlDistinctPaths),
+	}
+}
+
+// insertRow returns the statement inserting a row, with or without the aggregates.
+func (ts *tableStatements) insertRow(aggregates bool) string {
+	if aggregates {
+		return ts.insertAggregate
+	}
+	return ts.insert
+}
+
+// selectRows returns the statement reading rows, with or without the aggregates.
+func (ts *tableStatements) selectRows(aggregates bool) string {
+	if aggregates {
+		return ts.selectAggregate
+	}
+	return ts.selectStat
+}
+
+// statementSet holds the statements for each table, built when the rollup tables are loaded,
+// so that queries and flushes look them up rather than formatting them every time.
+type statementSet struct {
+	keyspace string
+	tables   map[string]*tableStatements
+}
+
+// newStatementSet builds the statements for the tables in a keyspace.
+func newStatementSet(keyspace string, tables []string) *statementSet {
+	ss := &statementSet{keyspace, make(map[string]*tableStatements, len(tables))}
+	for _, table := range tables {
+		ss.tables[table] = newTableStatements(keyspace, table)
+	}
+	return ss
+}
+
+// storedStatements builds the statements for the tables currently holding data points.
+func storedStatements() *statementSet {
+	return newStatementSet(config.Cassandra().Keyspace, storedTables())
+}
+
+// get returns the statements for a table. A table that isn't in the set, such as one named
+// in a dead letter from before the rollups were changed, has its statements built on the spot.
+func (ss *statementSet) get(table string) *tableStatements {
+	if ts, found := ss.tables[table]; found {
+		return ts
+	}
+	return newTableStatements(ss.keyspace, table)
+}
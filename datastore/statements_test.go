@@ -0,0 +1,27 @@
+package datastore
+
+import (
+	"testing"
+)
+
+func TestStatementSet(t *testing.T) {
+	ss := newStatementSet("ks", []string{"rollup_60", "rollup_300"})
+	expected := `SELECT stat,time FROM ks.rollup_60 WHERE path=? AND time>=? AND time<=?`
+	if got := ss.get("rollup_60").selectRows(false); got != expected {
+		t.Errorf("Expected %q, got %q", expected, got)
+	}
+	if ss.get("rollup_60") != ss.get("rollup_60") {
+		t.Errorf("Expected the statements of a loaded table to be looked up, not rebuilt")
+	}
+	if got := ss.get("rollup_300").insertRow(true); got != `INSERT INTO ks.rollup_300 (path, time, stat, min, max, sum, count) VALUES (?, ?, ?, ?, ?, ?, ?) USING TTL ?` {
+		t.Errorf("Wrong aggregate insert for rollup_300: %q", got)
+	}
+
+	// A table that isn't loaded still gets its statements.
+	if got := ss.get("rollup_3600").deletePath; got != `DELETE FROM ks.rollup_3600 WHERE path=?` {
+		t.Errorf("Wrong delete for an unloaded table: %q", got)
+	}
+	if len(ss.tables) != 2 {
+		t.Errorf("Expected 2 tables in the set, found %d", len(ss.tables))
+	}
+}
@@ -0,0 +1,80 @@
+package datastore
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/jeffpierce/cassabon/config"
+)
+
+// The size of encoded series at which they are passed on to the API, rather than held until the response is complete.
+const streamChunkSize = 64 << 10
+
+// seriesStream encodes a MetricResponse one series at a time. Once the encoding grows past the chunk size,
+// it is sent to the API as a partial response, so a response covering many paths or a long time range is
+// never held in memory all at once. A response that stays small is sent whole, exactly as before.
+type seriesStream struct {
+	mm       *MetricManager
+	ch       chan config.APIQueryResponse
+	chunk    int                 // Size at which the buffer is sent on
+	buf      bytes.Buffer        // Encoding not yet sent
+	seen     map[string]struct{} // Paths already encoded, since a path may be listed more than once
+	streamed bool                // Whether any part of the response has been sent
+	targets  []byte              // Encoding of the range of each series, sent last
+	last     seriesRange         // Range of the series most recently added
+	explain  *queryTrace         // How the query was answered, sent last, if it is explained
+}
+
+// newSeriesStream returns a stream of series to the supplied response channel.
+func newSeriesStream(mm *MetricManager, ch chan config.APIQueryResponse, chunk int) *seriesStream {
+	s := &seriesStream{mm: mm, ch: ch, chunk: chunk, seen: make(map[string]struct{})}
+	s.buf.WriteString(`{"series":{`)
+	return s
+}
+
+// add encodes the series of a path, and the range it covers. It reports false if the API has stopped
+// waiting for the response.
+func (s *seriesStream) add(path string, values []interface{}, r seriesRange) (bool, error) {
+	s.last = r
+	if _, found := s.seen[path]; found {
+		return true, nil
+	}
+	key, _ := json.Marshal(path)
+	list, err := json.Marshal(values)
+	if err != nil {
+		return true, err
+	}
+	target, _ := json.Marshal(r)
+	if len(s.seen) > 0 {
+		s.buf.WriteByte(',')
+		s.targets = append(s.targets, ',')
+	}
+	s.seen[path] = struct{}{}
+	s.targets = append(append(append(s.targets, key...), ':'), target...)
+	s.buf.Write(key)
+	s.buf.WriteByte(':')
+	s.buf.Write(list)
+
+	if s.buf.Len() < s.chunk {
+		return true, nil
+	}
+	s.streamed = true
+	payload := make([]byte, s.buf.Len())
+	copy(payload, s.buf.Bytes())
+	s.buf.Reset()
+	return s.mm.sendAPIResponse(s.ch, config.APIQueryResponse{config.AQS_PARTIAL, "", payload}), nil
+}
+
+// finish completes the response with the range of each series, and any explanation of the query, and
+// returns what remains to be sent. The payload is the whole response only if no part of it has been streamed.
+func (s *seriesStream) finish() []byte {
+	fmt.Fprintf(&s.buf, `},"targets":{%s},"from":%d,"to":%d,"step":%d`, s.targets, s.last.From, s.last.To, s.last.Step)
+	if s.explain != nil {
+		explain, _ := json.Marshal(s.explain)
+		s.buf.WriteString(`,"explain":`)
+		s.buf.Write(explain)
+	}
+	s.buf.WriteByte('}')
+	return s.buf.Bytes()
+}
@@ -0,0 +1,91 @@
+package datastore
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/jeffpierce/cassabon/config"
+)
+
+func TestSeriesStream(t *testing.T) {
+	series := map[string][]interface{}{
+		"foo.bar": {1.0, nil, 3.5},
+		"foo.baz": {nil, 2.0, nil},
+	}
+	targets := map[string]seriesRange{
+		"foo.bar": {100, 160, 30},
+		"foo.baz": {60, 180, 60},
+	}
+	expected := MetricResponse{60, 180, 60, series, targets}
+
+	// A large chunk size sends the response whole.
+	ch := make(chan config.APIQueryResponse, 10)
+	s := newSeriesStream(&MetricManager{}, ch, 1<<20)
+	s.add("foo.baz", series["foo.baz"], targets["foo.baz"])
+	s.add("foo.bar", series["foo.bar"], targets["foo.bar"])
+	s.add("foo.baz", series["foo.baz"], targets["foo.baz"])
+	payload := s.finish()
+	if s.streamed || len(ch) != 0 {
+		t.Errorf("Expected nothing to be streamed")
+	}
+	var got MetricResponse
+	if err := json.Unmarshal(payload, &got); err != nil || !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected %v, got %v (%v)", expected, got, err)
+	}
+
+	// A tiny chunk size sends each series as it is added. Like the API's, the channel is unbuffered.
+	ch = make(chan config.APIQueryResponse)
+	parts := make(chan []config.APIQueryResponse)
+	go func() {
+		parts <- []config.APIQueryResponse{<-ch, <-ch}
+	}()
+	s = newSeriesStream(&MetricManager{}, ch, 1)
+	for _, path := range []string{"foo.bar", "foo.baz"} {
+		if sent, err := s.add(path, series[path], targets[path]); !sent || err != nil {
+			t.Fatalf("Expected %s to be sent, got %v %v", path, sent, err)
+		}
+	}
+	if !s.streamed {
+		t.Errorf("Expected the response to be streamed")
+	}
+	var all []byte
+	for _, resp := range <-parts {
+		if resp.Status != config.AQS_PARTIAL {
+			t.Errorf("Expected a partial response, got %v", resp.Status)
+		}
+		all = append(all, resp.Payload...)
+	}
+	all = append(all, s.finish()...)
+	got = MetricResponse{}
+	if err := json.Unmarshal(all, &got); err != nil || !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected %v, got %v (%v)", expected, got, err)
+	}
+
+	// Once the API stops waiting, nothing more is sent.
+	close(ch)
+	s = newSeriesStream(&MetricManager{}, ch, 1)
+	if sent, _ := s.add("foo.bar", series["foo.bar"], targets["foo.bar"]); sent {
+		t.Errorf("Expected the send to fail on a closed channel")
+	}
+}
+
+func TestSeriesStreamExplain(t *testing.T) {
+	ch := make(chan config.APIQueryResponse, 10)
+	s := newSeriesStream(&MetricManager{}, ch, 1<<20)
+	s.explain = &queryTrace{Paths: []*pathTrace{{Path: "foo.bar", Expression: "^foo.*", Reads: []*readTrace{
+		{Table: "rollup_000000060", Window: 60, Rows: 3},
+	}}}}
+	s.add("foo.bar", []interface{}{1.0}, seriesRange{60, 60, 60})
+
+	var got struct {
+		MetricResponse
+		Explain queryTrace `json:"explain"`
+	}
+	if err := json.Unmarshal(s.finish(), &got); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(got.Series) != 1 || len(got.Explain.Paths) != 1 || got.Explain.Paths[0].Reads[0].Rows != 3 {
+		t.Errorf("Wrong explained response: %+v", got)
+	}
+}
@@ -0,0 +1,294 @@
+package datastore
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jeffpierce/cassabon/config"
+)
+
+// The most tags or values completed when no limit is given, as graphite-web completes them.
+const defaultTagLimit = 100
+
+// tagExpr is a graphite tag expression, such as "dc=east", "dc!=east", "dc=~ea.*" or "dc!=~ea.*",
+// which a tagged series must satisfy. A regular expression is anchored at the start of the value.
+type tagExpr struct {
+	tag    string
+	negate bool
+	value  string
+	re     *regexp.Regexp // For "=~" and "!=~", the value anchored at the start
+}
+
+// parseTagExpr parses a graphite tag expression.
+func parseTagExpr(s string) (tagExpr, error) {
+	var e tagExpr
+	i := strings.Index(s, "=")
+	if i < 1 {
+		return e, fmt.Errorf("invalid tag expression %q", s)
+	}
+	e.tag, e.value = s[:i], s[i+1:]
+	if strings.HasSuffix(e.tag, "!") {
+		e.tag, e.negate = strings.TrimSuffix(e.tag, "!"), true
+	}
+	if strings.HasPrefix(e.value, "~") {
+		var err error
+		if e.re, err = regexp.Compile("^(?:" + strings.TrimPrefix(e.value, "~") + ")"); err != nil {
+			return e, fmt.Errorf("invalid regexp in tag expression %q: %s", s, err.Error())
+		}
+	}
+	if e.tag == "" {
+		return e, fmt.Errorf("invalid tag expression %q", s)
+	}
+	return e, nil
+}
+
+// matches reports whether a series with the tags satisfies the expression. A tag the series doesn't have
+// has an empty value.
+func (e tagExpr) matches(tags map[string]string) bool {
+	value := tags[e.tag]
+	if e.re != nil {
+		return e.re.MatchString(value) != e.negate
+	}
+	return (value == e.value) != e.negate
+}
+
+// parseTaggedPath returns the tags of a tagged series, whose path is in graphite's "name;tag=value;..." form,
+// with its name as the tag "name". A path without tags isn't a tagged series.
+func parseTaggedPath(path string) (map[string]string, bool) {
+	parts := strings.Split(path, ";")
+	if len(parts) < 2 || parts[0] == "" {
+		return nil, false
+	}
+	tags := map[string]string{"name": parts[0]}
+	for _, part := range parts[1:] {
+		i := strings.Index(part, "=")
+		if i < 1 {
+			return nil, false
+		}
+		tags[part[:i]] = part[i+1:]
+	}
+	return tags, true
+}
+
+// tagSet holds the tags of every tagged series in the index, by path, so that completing a tag doesn't
+// examine every leaf. It is kept up to date as this instance indexes and removes paths, and is read from
+// the index when first used, and again as often as the copy of the index in memory is refreshed, to
+// take in the paths that other instances have indexed.
+type tagSet struct {
+	sync.Mutex
+	series  map[string]map[string]string // The tags of each tagged path, or nil until read from the index
+	loaded  time.Time                    // When the set was last read from the index
+	loading sync.Mutex                   // Held while the set is being read from the index
+	changed map[string]bool              // Paths indexed (true) or removed (false) while it is being read
+}
+
+// update records that a path has been indexed, or removed from the index.
+func (ts *tagSet) update(path string, indexed bool) {
+	if !strings.Contains(path, ";") {
+		return
+	}
+	ts.Lock()
+	defer ts.Unlock()
+	if ts.changed != nil {
+		ts.changed[path] = indexed
+	}
+	if ts.series != nil {
+		ts.apply(path, indexed)
+	}
+}
+
+// apply adds a path to the set, or removes it. The caller holds the lock.
+func (ts *tagSet) apply(path string, indexed bool) {
+	if !indexed {
+		delete(ts.series, path)
+	} else if tags, ok := parseTaggedPath(path); ok {
+		ts.series[path] = tags
+	}
+}
+
+// due reports whether the set must be read from the index before it is used.
+func (ts *tagSet) due() bool {
+	ts.Lock()
+	defer ts.Unlock()
+	return ts.series == nil || time.Since(ts.loaded) >= config.G.Index.RefreshInterval
+}
+
+// reset has the set read from the index again before it is next used.
+func (ts *tagSet) reset() {
+	ts.Lock()
+	ts.loaded = time.Time{}
+	ts.Unlock()
+}
+
+// load reads the set from the index's leaves, if it is due. Only one read is made at a time: until the
+// first completes, others wait for it, and after that, the set in hand is used while it is read again.
+// Paths indexed or removed during the read are applied to what it returns.
+func (ts *tagSet) load(leaves func() ([]string, error)) error {
+	ts.Lock()
+	first := ts.series == nil
+	ts.Unlock()
+	if first {
+		ts.loading.Lock()
+	} else if !ts.loading.TryLock() {
+		return nil
+	}
+	defer ts.loading.Unlock()
+	if !ts.due() {
+		return nil
+	}
+
+	ts.Lock()
+	ts.changed = make(map[string]bool)
+	ts.Unlock()
+	paths, err := leaves()
+	ts.Lock()
+	defer ts.Unlock()
+	changed := ts.changed
+	ts.changed = nil
+	if err != nil {
+		return err
+	}
+	ts.series = make(map[string]map[string]string)
+	for _, path := range paths {
+		ts.apply(path, true)
+	}
+	for path, indexed := range changed {
+		ts.apply(path, indexed)
+	}
+	ts.loaded = time.Now()
+	return nil
+}
+
+// newTagSet returns a set holding the tags of the tagged series among the paths.
+func newTagSet(paths []string) *tagSet {
+	ts := &tagSet{series: make(map[string]map[string]string), loaded: time.Now()}
+	for _, path := range paths {
+		ts.apply(path, true)
+	}
+	return ts
+}
+
+// matching returns the tags of each of the tenant's tagged series that satisfies every expression. The
+// caller holds the lock.
+func (ts *tagSet) matching(tenant string, exprs []tagExpr) []map[string]string {
+	var series []map[string]string
+	for path, tags := range ts.series {
+		if tenant != "" {
+			if !strings.HasPrefix(path, tenant+".") {
+				continue
+			}
+			name := strings.TrimPrefix(tags["name"], tenant+".")
+			if name == "" {
+				continue
+			}
+			tenantTags := make(map[string]string, len(tags))
+			for tag, value := range tags {
+				tenantTags[tag] = value
+			}
+			tenantTags["name"] = name
+			tags = tenantTags
+		}
+		matched := true
+		for _, e := range exprs {
+			if !e.matches(tags) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			series = append(series, tags)
+		}
+	}
+	return series
+}
+
+// completions returns, in order, up to a limit of the distinct strings beginning with a prefix.
+func completions(found map[string]bool, prefix string, limit int) []string {
+	list := []string{}
+	for s := range found {
+		if strings.HasPrefix(s, prefix) {
+			list = append(list, s)
+		}
+	}
+	sort.Strings(list)
+	if len(list) > limit {
+		list = list[:limit]
+	}
+	return list
+}
+
+// completeTags returns the tags beginning with a prefix of the tagged series satisfying the expressions,
+// other than those the expressions already name. The caller holds the lock.
+func (ts *tagSet) completeTags(tenant string, exprs []tagExpr, prefix string, limit int) []string {
+	named := make(map[string]bool, len(exprs))
+	for _, e := range exprs {
+		named[e.tag] = true
+	}
+	found := make(map[string]bool)
+	for _, tags := range ts.matching(tenant, exprs) {
+		for tag := range tags {
+			if !named[tag] {
+				found[tag] = true
+			}
+		}
+	}
+	return completions(found, prefix, limit)
+}
+
+// completeValues returns the values beginning with a prefix of a tag of the tagged series satisfying the
+// expressions. The caller holds the lock.
+func (ts *tagSet) completeValues(tenant string, exprs []tagExpr, tag, prefix string, limit int) []string {
+	found := make(map[string]bool)
+	for _, tags := range ts.matching(tenant, exprs) {
+		if value, ok := tags[tag]; ok {
+			found[value] = true
+		}
+	}
+	return completions(found, prefix, limit)
+}
+
+// queryTags completes the tags, or the values of a tag, of the tagged series in the index, for graphite-web's
+// "/tags/autoComplete" endpoints, from the set of tagged series kept in memory.
+func (im *IndexManager) queryTags(q config.IndexQuery) {
+
+	config.G.Log.System.LogDebug("IndexManager::queryTags %s %q %q %v req=%s", q.Method, q.Tag, q.Query, q.Exprs, q.RequestID)
+
+	if strings.ToLower(q.Method) == "values" && q.Tag == "" {
+		respond(q, config.APIQueryResponse{config.AQS_BADREQUEST, "no tag specified", []byte{}})
+		return
+	}
+	var exprs []tagExpr
+	for _, s := range q.Exprs {
+		e, err := parseTagExpr(s)
+		if err != nil {
+			respond(q, config.APIQueryResponse{config.AQS_BADREQUEST, err.Error(), []byte{}})
+			return
+		}
+		exprs = append(exprs, e)
+	}
+	limit := q.Limit
+	if limit <= 0 {
+		limit = defaultTagLimit
+	}
+
+	if err := im.tags.load(im.store.leaves); err != nil {
+		config.G.Log.System.LogError("Error querying index: %s req=%s", err.Error(), q.RequestID)
+		respond(q, config.APIQueryResponse{config.AQS_ERROR, "Error querying index", []byte{}})
+		return
+	}
+	var list []string
+	im.tags.Lock()
+	if strings.ToLower(q.Method) == "values" {
+		list = im.tags.completeValues(q.Tenant, exprs, q.Tag, q.Query, limit)
+	} else {
+		list = im.tags.completeTags(q.Tenant, exprs, q.Query, limit)
+	}
+	im.tags.Unlock()
+	jsonResp, _ := json.Marshal(list)
+	respond(q, config.APIQueryResponse{config.AQS_OK, "", jsonResp})
+}
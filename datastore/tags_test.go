@@ -0,0 +1,116 @@
+package datastore
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jeffpierce/cassabon/config"
+)
+
+func TestParseTagExpr(t *testing.T) {
+	tags := map[string]string{"name": "disk.used", "dc": "east", "rack": "a1"}
+	tests := []struct {
+		expr    string
+		matches bool
+	}{
+		{"dc=east", true},
+		{"dc!=east", false},
+		{"dc=~ea", true}, // Anchored at the start only
+		{"dc=~st", false},
+		{"dc!=~w.*", true},
+		{"host=", true}, // A missing tag is empty
+		{"name=disk.used", true},
+	}
+	for _, test := range tests {
+		e, err := parseTagExpr(test.expr)
+		if err != nil {
+			t.Errorf("parseTagExpr(%q) unexpected error: %v", test.expr, err)
+			continue
+		}
+		if matches := e.matches(tags); matches != test.matches {
+			t.Errorf("%q matches = %v, expected %v", test.expr, matches, test.matches)
+		}
+	}
+	for _, expr := range []string{"dc", "=east", "!=east", "dc=~[a"} {
+		if _, err := parseTagExpr(expr); err == nil {
+			t.Errorf("parseTagExpr(%q) expected an error", expr)
+		}
+	}
+}
+
+func TestCompleteTags(t *testing.T) {
+	paths := []string{
+		"disk.used;dc=east;rack=a1",
+		"disk.used;dc=west;rack=b2",
+		"cpu.idle;dc=east;host=web1",
+		"disk.free", // Not tagged
+		"acme.disk.used;dc=north;owner=ops",
+	}
+	ts := newTagSet(paths)
+	dcEast, _ := parseTagExpr("dc=east")
+
+	tests := []struct {
+		tenant string
+		exprs  []tagExpr
+		prefix string
+		limit  int
+		tags   []string
+	}{
+		{"", nil, "", 100, []string{"dc", "host", "name", "owner", "rack"}},
+		{"", nil, "", 2, []string{"dc", "host"}},
+		{"", nil, "r", 100, []string{"rack"}},
+		{"", []tagExpr{dcEast}, "", 100, []string{"host", "name", "rack"}},
+		{"acme", nil, "", 100, []string{"dc", "name", "owner"}},
+	}
+	for _, test := range tests {
+		if tags := ts.completeTags(test.tenant, test.exprs, test.prefix, test.limit); !reflect.DeepEqual(tags, test.tags) {
+			t.Errorf("completeTags(%q, %q) = %v, expected %v", test.tenant, test.prefix, tags, test.tags)
+		}
+	}
+
+	if values := ts.completeValues("", nil, "dc", "", 100); !reflect.DeepEqual(values, []string{"east", "north", "west"}) {
+		t.Errorf("completeValues(dc) = %v, expected [east north west]", values)
+	}
+	if values := ts.completeValues("", []tagExpr{dcEast}, "name", "d", 100); !reflect.DeepEqual(values, []string{"disk.used"}) {
+		t.Errorf("completeValues(name, d) = %v, expected [disk.used]", values)
+	}
+}
+
+func TestTagSet(t *testing.T) {
+	config.G.Index.RefreshInterval = time.Hour
+	ts := new(tagSet)
+
+	// Until the set is read from the index, updates are kept to apply to what is read.
+	reads := 0
+	leaves := func() ([]string, error) {
+		reads++
+		ts.update("cpu.idle;host=web2", true)
+		ts.update("disk.used;dc=west", false)
+		return []string{"disk.used;dc=east", "disk.used;dc=west", "disk.free"}, nil
+	}
+	ts.update("mem.free;dc=south", true)
+	if err := ts.load(leaves); err != nil {
+		t.Fatalf("load failed: %v", err)
+	}
+	if values := ts.completeValues("", nil, "name", "", 100); !reflect.DeepEqual(values, []string{"cpu.idle", "disk.used"}) {
+		t.Errorf("After loading, names = %v, expected [cpu.idle disk.used]", values)
+	}
+
+	// After that, updates change the set directly, and it isn't read again until it is due.
+	ts.update("mem.free;dc=south", true)
+	ts.update("disk.used;dc=east", false)
+	ts.update("net.rx", true) // Not tagged
+	if err := ts.load(leaves); err != nil || reads != 1 {
+		t.Errorf("Expected the set to be read once, read %d times (%v)", reads, err)
+	}
+	if values := ts.completeValues("", nil, "dc", "", 100); !reflect.DeepEqual(values, []string{"south"}) {
+		t.Errorf("After updates, dc values = %v, expected [south]", values)
+	}
+
+	ts.reset()
+	ts.load(leaves)
+	if reads != 2 {
+		t.Errorf("Expected the set to be read again after a reset, read %d times", reads)
+	}
+}
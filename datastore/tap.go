@@ -0,0 +1,66 @@
+package datastore
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/jeffpierce/cassabon/config"
+)
+
+// The most paths a tap will collect, to bound its memory use on a busy server.
+const maxTapPaths = 1000
+
+// pathTap collects the distinct paths of incoming metrics while it is attached.
+type pathTap struct {
+	paths map[string]struct{}
+}
+
+// tap records a path in every attached tap.
+// Note: Called for every metric when any tap is attached, so stays cheap.
+func (mm *MetricManager) tap(path string) {
+	mm.tapMutex.Lock()
+	defer mm.tapMutex.Unlock()
+	for t := range mm.taps {
+		if len(t.paths) < maxTapPaths {
+			t.paths[path] = struct{}{}
+		}
+	}
+}
+
+// queryTAP returns the distinct paths of the metrics received between From and To.
+func (mm *MetricManager) queryTAP(q config.MetricQuery) {
+
+	config.G.Log.System.LogDebug("MetricManager::queryTAP %v", q)
+
+	duration := time.Duration(q.To-q.From) * time.Second
+	if duration <= 0 {
+		q.Channel <- config.APIQueryResponse{config.AQS_BADREQUEST, "sample duration must be positive", []byte{}}
+		return
+	}
+
+	// Attach the tap, and collect paths until the time is up.
+	t := &pathTap{make(map[string]struct{})}
+	mm.tapMutex.Lock()
+	mm.taps[t] = struct{}{}
+	mm.tapMutex.Unlock()
+	atomic.AddInt32(&mm.tapCount, 1)
+
+	select {
+	case <-time.After(duration):
+	case <-config.G.OnExit:
+	}
+
+	atomic.AddInt32(&mm.tapCount, -1)
+	mm.tapMutex.Lock()
+	delete(mm.taps, t)
+	mm.tapMutex.Unlock()
+
+	// Send the response payload.
+	paths := make([]string, 0, len(t.paths))
+	for path := range t.paths {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	mm.sendResponse(q.Channel, paths)
+}
@@ -0,0 +1,387 @@
+package datastore
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/jeffpierce/cassabon/config"
+)
+
+// trieNode is one node of a path in the in-memory index.
+type trieNode struct {
+	children map[string]*trieNode
+	indexed  bool // Whether the node was indexed, rather than only lying on the way to one that was
+	leaf     bool // Whether the node was indexed as a leaf
+}
+
+// newTrieNode returns a node with no children.
+func newTrieNode() *trieNode {
+	return &trieNode{children: make(map[string]*trieNode)}
+}
+
+// trieIndex keeps a copy of the index in memory, in front of the configured one. Finds are answered from
+// memory, while changes are also made to the configured index, which remains the shared, durable copy.
+// Paths indexed by peers are picked up when the copy is refreshed from the configured index. A snapshot
+// of the copy is saved to a file, so that a restart doesn't have to read the configured index in full.
+type trieIndex struct {
+	backing  pathIndex
+	snapshot string // File to which the copy is saved, if any
+	m        sync.RWMutex
+	root     *trieNode
+	pending  []IndexResponse // Nodes put while a refresh is under way, which it may not have seen
+}
+
+// init prepares the configured index, and loads the copy from the snapshot, or else from the configured index.
+func (ti *trieIndex) init(bootstrap bool) {
+	ti.backing.init(bootstrap)
+	ti.root = newTrieNode()
+	if bootstrap {
+		return
+	}
+	if ti.snapshot != "" {
+		if err := ti.load(ti.snapshot); err == nil {
+			return
+		} else if !os.IsNotExist(err) {
+			config.G.Log.System.LogError("IndexManager unable to read index snapshot: %s", err.Error())
+		}
+	}
+	ti.refresh()
+}
+
+// reopen reconnects the configured index; the copy in memory is kept.
+func (ti *trieIndex) reopen() error {
+	return ti.backing.reopen()
+}
+
+// refresh replaces the copy with the paths now in the configured index.
+// If they can't be read, the copy is kept as it is.
+func (ti *trieIndex) refresh() {
+	ti.m.Lock()
+	ti.pending = []IndexResponse{}
+	ti.m.Unlock()
+	leaves, err := ti.backing.leaves()
+	if err != nil {
+		ti.m.Lock()
+		ti.pending = nil
+		ti.m.Unlock()
+		config.G.Log.System.LogError("IndexManager unable to refresh in-memory index: %s", err.Error())
+		return
+	}
+	root := newTrieNode()
+	for _, path := range leaves {
+		insertPath(root, path, true, true)
+	}
+	ti.m.Lock()
+	for _, node := range ti.pending {
+		insertPath(root, node.Path, node.Leaf, false)
+	}
+	ti.root, ti.pending = root, nil
+	ti.m.Unlock()
+	config.G.Log.System.LogInfo("IndexManager loaded %d paths into the in-memory index", len(leaves))
+}
+
+// insertPath adds a node to a trie. With branches set, every node above it is marked as indexed too,
+// but for the tenant's own node, which is never indexed.
+func insertPath(root *trieNode, path string, leaf, branches bool) {
+	n := root
+	nodes := strings.Split(path, ".")
+	for i, name := range nodes {
+		child, found := n.children[name]
+		if !found {
+			child = newTrieNode()
+			n.children[name] = child
+		}
+		n = child
+		if branches && i < len(nodes)-1 && !(i == 0 && config.G.Tenants.Enabled) {
+			n.indexed = true
+		}
+	}
+	n.indexed, n.leaf = true, leaf
+}
+
+// lookup returns the node at a path, or nil if there is none.
+// Note: Must be called with the read lock held.
+func (ti *trieIndex) lookup(path string) *trieNode {
+	n := ti.root
+	for _, name := range strings.Split(path, ".") {
+		if n = n.children[name]; n == nil {
+			return nil
+		}
+	}
+	return n
+}
+
+// put indexes one node in the configured index, then in the copy once it is stored.
+func (ti *trieIndex) put(node IndexResponse) error {
+	if err := ti.backing.put(node); err != nil {
+		return err
+	}
+	ti.m.Lock()
+	insertPath(ti.root, node.Path, node.Leaf, false)
+	if ti.pending != nil {
+		ti.pending = append(ti.pending, node)
+	}
+	ti.m.Unlock()
+	return nil
+}
+
+// putBatch indexes many nodes in the configured index, in one request if it can, then in the copy.
+func (ti *trieIndex) putBatch(nodes []IndexResponse) error {
+	if bi, ok := ti.backing.(batchIndex); ok {
+		if err := bi.putBatch(nodes); err != nil {
+			return err
+		}
+	} else {
+		for _, node := range nodes {
+			if err := ti.backing.put(node); err != nil {
+				return err
+			}
+		}
+	}
+	ti.m.Lock()
+	for _, node := range nodes {
+		insertPath(ti.root, node.Path, node.Leaf, false)
+	}
+	if ti.pending != nil {
+		ti.pending = append(ti.pending, nodes...)
+	}
+	ti.m.Unlock()
+	return nil
+}
+
+// remove deletes one node from the configured index, and from the copy.
+func (ti *trieIndex) remove(path string) error {
+	if err := ti.backing.remove(path); err != nil {
+		return err
+	}
+	ti.m.Lock()
+	defer ti.m.Unlock()
+	nodes := strings.Split(path, ".")
+	parent := ti.root
+	for _, name := range nodes[:len(nodes)-1] {
+		if parent = parent.children[name]; parent == nil {
+			return nil
+		}
+	}
+	last := nodes[len(nodes)-1]
+	if n := parent.children[last]; n != nil {
+		if len(n.children) > 0 {
+			n.indexed, n.leaf = false, false
+		} else {
+			delete(parent.children, last)
+		}
+	}
+	return nil
+}
+
+// hasChildren reports whether any nodes are indexed immediately beneath a branch. If the copy has none,
+// the index is asked too, as peers may have indexed some since the copy was refreshed.
+func (ti *trieIndex) hasChildren(branch string) bool {
+	ti.m.RLock()
+	n := ti.lookup(branch)
+	found := n != nil && len(n.children) > 0
+	ti.m.RUnlock()
+	return found || ti.backing.hasChildren(branch)
+}
+
+// leaves returns every leaf path in the copy, in order.
+func (ti *trieIndex) leaves() ([]string, error) {
+	var pathList []string
+	ti.walk(func(path string, n *trieNode) {
+		if n.leaf {
+			pathList = append(pathList, path)
+		}
+	})
+	sort.Strings(pathList)
+	return pathList, nil
+}
+
+// stale asks the configured index, as the copy doesn't record when nodes were indexed.
+func (ti *trieIndex) stale(before int64) ([]string, error) {
+	return ti.backing.stale(before)
+}
+
+// walk calls fn for every indexed node in the copy.
+func (ti *trieIndex) walk(fn func(path string, n *trieNode)) {
+	ti.m.RLock()
+	defer ti.m.RUnlock()
+	var visit func(path string, n *trieNode)
+	visit = func(path string, n *trieNode) {
+		if n.indexed {
+			fn(path, n)
+		}
+		for name, child := range n.children {
+			visit(childOf(path, name), child)
+		}
+	}
+	for name, child := range ti.root.children {
+		visit(name, child)
+	}
+}
+
+// find returns the nodes matched by any of the queries, walking down the copy one node at a time.
+func (ti *trieIndex) find(queries []string, tenant string, limit int) ([]IndexResponse, error) {
+	found, err := ti.match(queries, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	// Present them in order, as the other indexes do.
+	list := make([]IndexResponse, 0, len(found))
+	for path, leaf := range found {
+		list = append(list, ti.response(path, leaf))
+	}
+	sort.Sort(byIndexPath(list))
+	return list, nil
+}
+
+// findPage returns up to count of the nodes matched by any of the queries, in order, from offset on, and the
+// offset of the next page, or 0 if there are no more. Only the page is built, so it isn't bound by a limit.
+func (ti *trieIndex) findPage(queries []string, tenant string, offset, count int) ([]IndexResponse, int, error) {
+	found, err := ti.match(queries, 0)
+	if err != nil {
+		return nil, 0, err
+	}
+	paths := make([]string, 0, len(found))
+	for path := range found {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	next := 0
+	if offset >= len(paths) {
+		paths = nil
+	} else if offset+count < len(paths) {
+		paths, next = paths[offset:offset+count], offset+count
+	} else {
+		paths = paths[offset:]
+	}
+	list := make([]IndexResponse, 0, len(paths))
+	for _, path := range paths {
+		list = append(list, ti.response(path, found[path]))
+	}
+	return list, next, nil
+}
+
+// match returns the paths of the nodes of the copy matched by any of the queries, and whether each is a leaf.
+func (ti *trieIndex) match(queries []string, limit int) (map[string]bool, error) {
+	found := make(map[string]bool)
+	for _, query := range queries {
+		nodes := strings.Split(query, ".")
+
+		// Wildcard nodes are matched with a regexp, which is valid Go as well as for Elasticsearch.
+		matchers := make([]*regexp.Regexp, len(nodes))
+		for i, node := range nodes {
+			if strings.ContainsAny(node, "*?[") {
+				re, err := regexp.Compile("^" + globToRegexp(node) + "$")
+				if err != nil {
+					return nil, err
+				}
+				matchers[i] = re
+			}
+		}
+
+		ti.m.RLock()
+		var visit func(path string, n *trieNode, depth int)
+		visit = func(path string, n *trieNode, depth int) {
+			if depth == len(nodes) || (limit > 0 && len(found) > limit) {
+				if depth == len(nodes) && n.indexed {
+					found[path] = n.leaf
+				}
+				return
+			}
+			if matchers[depth] == nil {
+				if child := n.children[nodes[depth]]; child != nil {
+					visit(childOf(path, nodes[depth]), child, depth+1)
+				}
+				return
+			}
+			for name, child := range n.children {
+				if matchers[depth].MatchString(name) {
+					visit(childOf(path, name), child, depth+1)
+				}
+			}
+		}
+		visit("", ti.root, 0)
+		ti.m.RUnlock()
+		if limit > 0 && len(found) > limit {
+			return nil, tooManyPaths(limit)
+		}
+	}
+	return found, nil
+}
+
+// response returns the index entry for a node of the copy.
+func (ti *trieIndex) response(path string, leaf bool) IndexResponse {
+	ir := IndexResponse{Path: path, Depth: strings.Count(path, ".") + 1, Leaf: leaf}
+	if config.G.Tenants.Enabled {
+		ir.Tenant = path[:strings.IndexByte(path+".", '.')]
+	}
+	return ir
+}
+
+// save writes the copy to the snapshot file, one entry per line, as the state file is written.
+func (ti *trieIndex) save() error {
+	var entries []IndexResponse
+	ti.walk(func(path string, n *trieNode) {
+		entries = append(entries, ti.response(path, n.leaf))
+	})
+	fp, err := os.Create(ti.snapshot + ".tmp")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(fp)
+	enc := json.NewEncoder(w)
+	for _, ir := range entries {
+		if err = enc.Encode(ir); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if e := fp.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		os.Remove(fp.Name())
+		return err
+	}
+	return os.Rename(fp.Name(), ti.snapshot)
+}
+
+// load replaces the copy with the contents of a snapshot file.
+func (ti *trieIndex) load(filename string) error {
+	fp, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+
+	root := newTrieNode()
+	count := 0
+	scanner := bufio.NewScanner(fp)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var ir IndexResponse
+		if err := json.Unmarshal(scanner.Bytes(), &ir); err != nil || ir.Path == "" {
+			config.G.Log.System.LogWarn("IndexManager skipping malformed snapshot entry: %q", scanner.Text())
+			continue
+		}
+		insertPath(root, ir.Path, ir.Leaf, false)
+		count++
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	ti.m.Lock()
+	ti.root = root
+	ti.m.Unlock()
+	config.G.Log.System.LogInfo("IndexManager loaded %d nodes from the index snapshot", count)
+	return nil
+}
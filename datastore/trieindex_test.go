@@ -0,0 +1,135 @@
+package datastore
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/jeffpierce/cassabon/config"
+	"github.com/jeffpierce/cassabon/logging"
+)
+
+// memoryIndex is a pathIndex that keeps its nodes in a map, standing in for the configured index.
+type memoryIndex map[string]IndexResponse
+
+func (mi memoryIndex) init(bootstrap bool) {}
+func (mi memoryIndex) reopen() error       { return nil }
+func (mi memoryIndex) put(node IndexResponse) error {
+	mi[node.Path] = node
+	return nil
+}
+func (mi memoryIndex) remove(path string) error {
+	delete(mi, path)
+	return nil
+}
+func (mi memoryIndex) hasChildren(branch string) bool {
+	for path := range mi {
+		if strings.HasPrefix(path, branch+".") {
+			return true
+		}
+	}
+	return false
+}
+func (mi memoryIndex) leaves() ([]string, error) {
+	var pathList []string
+	for path, node := range mi {
+		if node.Leaf {
+			pathList = append(pathList, path)
+		}
+	}
+	return pathList, nil
+}
+func (mi memoryIndex) stale(before int64) ([]string, error) {
+	var pathList []string
+	for path, node := range mi {
+		if node.Leaf && node.Updated < before {
+			pathList = append(pathList, path)
+		}
+	}
+	return pathList, nil
+}
+func (mi memoryIndex) find(queries []string, tenant string, limit int) ([]IndexResponse, error) {
+	return nil, nil
+}
+
+func foundPaths(t *testing.T, ti *trieIndex, queries ...string) []string {
+	found, err := ti.find(queries, "", 0)
+	if err != nil {
+		t.Fatalf("find(%q) failed: %s", queries, err.Error())
+	}
+	var paths []string
+	for _, ir := range found {
+		paths = append(paths, ir.Path)
+	}
+	return paths
+}
+
+func TestTrieIndex(t *testing.T) {
+	config.G.Log.System = logging.NewLogger("system")
+	logging.Statsd.Open("", "", "cassabon")
+
+	backing := memoryIndex{"servers.web1.cpu": {"servers.web1.cpu", 3, "", true, 0}}
+	ti := &trieIndex{backing: backing, snapshot: filepath.Join(t.TempDir(), "index.snapshot")}
+
+	// Without a snapshot, the copy is loaded from the index, branches and all.
+	ti.init(false)
+	if paths := foundPaths(t, ti, "servers.*"); !reflect.DeepEqual(paths, []string{"servers.web1"}) {
+		t.Errorf("Expected the branch to be found, got %q", paths)
+	}
+
+	// Nodes put are found, without asking the index.
+	for _, ir := range []IndexResponse{
+		{"servers.db1.cpu", 3, "", true, 0},
+		{"servers.db1", 2, "", false, 0},
+		{"servers.web2.cpu", 3, "", true, 0},
+	} {
+		ti.put(ir)
+	}
+	if paths := foundPaths(t, ti, "servers.web?.cpu", "servers.db[0-9].*"); !reflect.DeepEqual(paths,
+		[]string{"servers.db1.cpu", "servers.web1.cpu", "servers.web2.cpu"}) {
+		t.Errorf("Unexpected paths found: %q", paths)
+	}
+	if _, err := ti.find([]string{"servers.*.cpu"}, "", 2); err != tooManyPaths(2) {
+		t.Errorf("Expected too many paths to be refused, got %v", err)
+	}
+	// A page holds only the nodes from its offset on, without the limit on all those matched.
+	for _, test := range []struct {
+		offset, count, next int
+		paths               []string
+	}{
+		{0, 2, 2, []string{"servers.db1.cpu", "servers.web1.cpu"}},
+		{2, 2, 0, []string{"servers.web2.cpu"}},
+		{3, 2, 0, []string{}},
+	} {
+		found, next, err := ti.findPage([]string{"servers.*.cpu"}, "", test.offset, test.count)
+		paths := []string{}
+		for _, ir := range found {
+			paths = append(paths, ir.Path)
+		}
+		if err != nil || next != test.next || !reflect.DeepEqual(paths, test.paths) {
+			t.Errorf("findPage(%d, %d) = %q, next %d (%v), expected %q, next %d",
+				test.offset, test.count, paths, next, err, test.paths, test.next)
+		}
+	}
+	if !ti.hasChildren("servers.db1") || ti.hasChildren("servers.db1.cpu") {
+		t.Errorf("Unexpected children of servers.db1")
+	}
+
+	// A removed node is no longer found, but its parent is.
+	ti.remove("servers.db1.cpu")
+	if paths := foundPaths(t, ti, "servers.db1", "servers.db1.*"); !reflect.DeepEqual(paths, []string{"servers.db1"}) {
+		t.Errorf("Expected only the branch, got %q", paths)
+	}
+
+	// The copy is restored from the snapshot, rather than the index.
+	if err := ti.save(); err != nil {
+		t.Fatalf("save failed: %s", err.Error())
+	}
+	restored := &trieIndex{backing: memoryIndex{}, snapshot: ti.snapshot}
+	restored.init(false)
+	leaves, _ := restored.leaves()
+	if !reflect.DeepEqual(leaves, []string{"servers.web1.cpu", "servers.web2.cpu"}) {
+		t.Errorf("Unexpected leaves restored: %q", leaves)
+	}
+}
@@ -0,0 +1,328 @@
+package datastore
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jeffpierce/cassabon/config"
+	"github.com/jeffpierce/cassabon/logging"
+)
+
+// circuitBreaker pauses database writes after repeated failures, so that a struggling
+// cluster isn't hammered with retries, and writes are buffered rather than abandoned.
+type circuitBreaker struct {
+	m         sync.Mutex
+	threshold int           // Consecutive failures that open the breaker
+	pause     time.Duration // How long the breaker stays open before a trial write
+	failures  int           // Consecutive failures seen so far
+	openUntil time.Time     // While open, the time at which a trial write is permitted
+}
+
+func (cb *circuitBreaker) init(threshold int, pause time.Duration) {
+	cb.threshold = threshold
+	cb.pause = pause
+}
+
+// allow reports whether a write may be attempted now.
+func (cb *circuitBreaker) allow(now time.Time) bool {
+	cb.m.Lock()
+	defer cb.m.Unlock()
+	if cb.failures < cb.threshold {
+		return true
+	}
+	if now.Before(cb.openUntil) {
+		return false
+	}
+	// Half-open: permit this one trial write, and hold off everyone else until it resolves.
+	cb.openUntil = now.Add(cb.pause)
+	return true
+}
+
+// success records a successful write, closing the breaker.
+func (cb *circuitBreaker) success() {
+	cb.m.Lock()
+	defer cb.m.Unlock()
+	if cb.failures >= cb.threshold {
+		config.G.Log.System.LogInfo("MetricManager database writes resumed")
+		logging.Statsd.Client.Gauge("metricmgr.db.breaker.open", 0, 1.0)
+	}
+	cb.failures = 0
+}
+
+// isOpen reports whether writes are paused.
+func (cb *circuitBreaker) isOpen() bool {
+	cb.m.Lock()
+	defer cb.m.Unlock()
+	return cb.threshold > 0 && cb.failures >= cb.threshold
+}
+
+// failure records a failed write, opening the breaker if there have been too many.
+func (cb *circuitBreaker) failure(now time.Time) {
+	cb.m.Lock()
+	defer cb.m.Unlock()
+	cb.failures++
+	if cb.failures == cb.threshold {
+		config.G.Log.System.LogError("MetricManager pausing database writes for %v after %d failures",
+			cb.pause, cb.failures)
+		logging.Statsd.Client.Gauge("metricmgr.db.breaker.open", 1, 1.0)
+	}
+	if cb.failures >= cb.threshold {
+		cb.openUntil = now.Add(cb.pause)
+	}
+}
+
+// writeThrottle adapts batch sizes to the latency of database writes: while batches are slow, they are
+// shrunk, so that each holds up a writer for less time and retries repeat less work; once batches are
+// fast again, they grow back to the configured size.
+type writeThrottle struct {
+	m       sync.Mutex
+	slow    time.Duration // Latency above which a batch is slow; 0 disables adaptation
+	latency time.Duration // Moving average of the latency of batches
+	scale   float64       // Fraction of the configured batch size in use
+}
+
+// The smallest fraction of the configured batch size to which batches are shrunk.
+const minBatchScale = 1.0 / 16
+
+func (wt *writeThrottle) init(slow time.Duration) {
+	wt.slow = slow
+	wt.scale = 1
+}
+
+// observe records the latency of a batch, and adjusts the batch size accordingly.
+func (wt *writeThrottle) observe(latency time.Duration) {
+	wt.m.Lock()
+	defer wt.m.Unlock()
+	wt.latency = (7*wt.latency + latency) / 8
+	if wt.slow <= 0 {
+		return
+	}
+	switch {
+	case wt.latency > wt.slow && wt.scale > minBatchScale:
+		wt.scale = math.Max(wt.scale/2, minBatchScale)
+		config.G.Log.System.LogWarn("MetricManager database writes are slow (%v), batch size reduced to %.0f%%",
+			wt.latency, wt.scale*100)
+	case wt.latency < wt.slow/2 && wt.scale < 1:
+		wt.scale = math.Min(wt.scale*1.25, 1)
+	}
+	logging.Statsd.Client.Gauge("metricmgr.db.latency", wt.latency.Nanoseconds()/int64(time.Millisecond), 1.0)
+}
+
+// batchSize returns the batch size to be used in place of the configured one.
+func (wt *writeThrottle) batchSize(size int) int {
+	wt.m.Lock()
+	defer wt.m.Unlock()
+	if wt.scale == 0 {
+		// Not initialized, so not adapting.
+		return size
+	}
+	if n := int(float64(size) * wt.scale); n > 1 {
+		return n
+	}
+	return 1
+}
+
+// submit hands a batch to the writers. While they are backlogged, it waits, which holds back ingestion,
+// unless abort is closed, in which case the batch is abandoned; a nil abort waits indefinitely.
+func submit(insert chan *tableWrite, write *tableWrite, abort <-chan struct{}) {
+	if !offer(insert, write, abort) {
+		config.G.Log.System.LogError("MetricManager abandoning write of %d rows to %s, writers are backlogged",
+			write.size, write.table)
+		abandonWrite(write)
+	}
+}
+
+// offer hands a batch to the writers, waiting while they are backlogged unless abort is closed, and reports
+// whether they took it.
+func offer(insert chan *tableWrite, write *tableWrite, abort <-chan struct{}) bool {
+	select {
+	case insert <- write:
+		return true
+	default:
+	}
+	select {
+	case insert <- write:
+		return true
+	case <-abort:
+		return false
+	}
+}
+
+// abandonWrite gives up on a batch, saving its rows to the dead-letter file if there is one.
+func abandonWrite(tw *tableWrite) {
+	logging.Statsd.Client.Inc("metricmgr.db.err.write", int64(tw.size), 1.0)
+	if filename := config.Cassandra().DeadLetterFile; filename != "" {
+		if err := writeDeadLetters(filename, tw); err != nil {
+			config.G.Log.System.LogError("MetricManager unable to save dead letters: %s", err.Error())
+		}
+	}
+}
+
+// stopWriters stops the writers, each once it has made a last attempt at the writes it has queued, then
+// makes a last attempt at the writes left on the insert channel, which is drained here alone.
+func (mm *MetricManager) stopWriters() {
+	close(mm.writerOnExit)
+	mm.writerWG.Wait()
+	for {
+		select {
+		case write := <-mm.insert:
+			mm.writeLast(write)
+		default:
+			return
+		}
+	}
+}
+
+// writeLast makes a last attempt at a write, on termination, abandoning whatever fails.
+func (mm *MetricManager) writeLast(write *tableWrite) {
+	failed, err := mm.engine.writeBatch(write)
+	if err == nil {
+		logging.Statsd.Client.Inc("metricmgr.db.insert", int64(write.size), 1.0)
+		return
+	}
+	tw := &tableWrite{write.table, write.stmt, failed, 0}
+	for _, pw := range failed {
+		tw.size += len(pw.rows)
+	}
+	logging.Statsd.Client.Inc("metricmgr.db.insert", int64(write.size-tw.size), 1.0)
+	config.G.Log.System.LogError("MetricManager abandoning write of %d rows on termination: %s", tw.size, err.Error())
+	abandonWrite(tw)
+}
+
+// writer executes the writes it receives on the insert channel, retrying failures.
+// Several writers run concurrently, so that one slow write doesn't hold up the rest.
+func (mm *MetricManager) writer(id int) {
+
+	// We associate a number of attempts, and the time of the next one, with each write.
+	type queueEntry struct {
+		tries int
+		next  time.Time
+		write *tableWrite
+	}
+
+	// The queue for the writes we receive on the insert channel. Once the rows queued reach this writer's
+	// share of the maximum, no more are taken until some are written, so the insert channel fills, and
+	// the shards wait to hand over their batches, holding back ingestion rather than growing the queue.
+	var queue []queueEntry
+	var queuedRows int
+	cs := config.Cassandra()
+	maxQueued := cs.MaxQueuedRows / config.G.MetricManager.Writers
+	maxTries := cs.WriteRetries
+	backoff := time.Duration(cs.WriteBackoff) * time.Millisecond
+	const maxBackoff = time.Minute
+
+	var enqueue = func(write *tableWrite) {
+		queue = append(queue, queueEntry{0, time.Time{}, write})
+		queuedRows += write.size
+	}
+
+	var readAllChannelEntries = func() {
+		for queuedRows < maxQueued {
+			select {
+			case write := <-mm.insert:
+				enqueue(write)
+			default:
+				return
+			}
+		}
+	}
+
+	// writeQueueEntry makes one attempt at a write, and reports whether it should be retried.
+	var writeQueueEntry = func(qe *queueEntry, now time.Time) bool {
+		writeCount := qe.write.size
+		start := time.Now()
+		failed, err := mm.engine.writeBatch(qe.write)
+		mm.throttle.observe(time.Since(start))
+		if err == nil {
+			mm.breaker.success()
+			atomic.StoreInt64(&mm.lastWrite, time.Now().Unix())
+			config.G.Log.System.LogDebug("MetricManager::writer[%d] wrote batch. Remaining: %d", id, len(queue))
+			logging.Statsd.Client.Inc("metricmgr.db.insert", int64(writeCount), 1.0)
+			return false
+		}
+		mm.breaker.failure(now)
+
+		// Only the partitions that failed need to be written again.
+		qe.write = &tableWrite{qe.write.table, qe.write.stmt, failed, 0}
+		for _, pw := range failed {
+			qe.write.size += len(pw.rows)
+		}
+		logging.Statsd.Client.Inc("metricmgr.db.insert", int64(writeCount-qe.write.size), 1.0)
+
+		qe.tries++
+		if qe.tries >= maxTries {
+			config.G.Log.System.LogError("MetricManager::writer[%d] abandoning write of %d rows after %d tries: %s",
+				id, qe.write.size, qe.tries, err.Error())
+			abandonWrite(qe.write)
+			return false
+		}
+
+		// Back off exponentially before the next try.
+		delay := backoff << uint(qe.tries-1)
+		if delay > maxBackoff || delay <= 0 {
+			delay = maxBackoff
+		}
+		qe.next = now.Add(delay)
+		config.G.Log.System.LogWarn("MetricManager::writer[%d] retrying write of %d partitions in %v: %s",
+			id, len(failed), delay, err.Error())
+		logging.Statsd.Client.Inc("metricmgr.db.retry", 1, 1.0)
+		return true
+	}
+
+	// writeDueQueueEntries attempts every write whose backoff has expired, while the breaker allows.
+	// Rows are counted out of the queue as each write is taken from it, and back in as it is retained, which
+	// may be with fewer rows than before, if some were written.
+	var writeDueQueueEntries = func() {
+		var retained []queueEntry
+		var retain = func(qe queueEntry) {
+			retained = append(retained, qe)
+			queuedRows += qe.write.size
+		}
+		for len(queue) > 0 {
+			qe := queue[0]
+			queue = queue[1:]
+			queuedRows -= qe.write.size
+			now := time.Now()
+			if now.Before(qe.next) || !mm.breaker.allow(now) {
+				retain(qe)
+				continue
+			}
+			if writeQueueEntry(&qe, now) {
+				retain(qe)
+			}
+			// Drain the channel after each write, so it can't fill up unless this writer is backlogged.
+			readAllChannelEntries()
+		}
+		queue = retained
+		logging.Statsd.Client.Gauge("metricmgr.db.queued", int64(len(queue)), 1.0)
+	}
+
+	ticker := time.NewTicker(250 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		// A nil channel never delivers, so nothing more is taken while this writer is backlogged.
+		insert := mm.insert
+		if queuedRows >= maxQueued {
+			insert = nil
+		}
+
+		select {
+		case <-mm.writerOnExit:
+			config.G.Log.System.LogDebug("MetricManager::writer[%d] received QUIT message", id)
+			// Make one last attempt at everything queued, regardless of backoff or breaker state. What is
+			// left on the insert channel is written once every writer has stopped.
+			for _, qe := range queue {
+				mm.writeLast(qe.write)
+			}
+			mm.writerWG.Done()
+			return
+		case write := <-insert:
+			enqueue(write)
+			writeDueQueueEntries()
+		case <-ticker.C:
+			writeDueQueueEntries()
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package datastore
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jeffpierce/cassabon/config"
+	"github.com/jeffpierce/cassabon/logging"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+
+	config.G.Log.System = logging.NewLogger("system")
+	logging.Statsd.Open("", "", "cassabon")
+
+	cb := circuitBreaker{}
+	cb.init(2, time.Minute)
+	now := time.Now()
+
+	cb.failure(now)
+	if !cb.allow(now) {
+		t.Errorf("Breaker opened before reaching the failure threshold")
+	}
+	cb.failure(now)
+	if cb.allow(now) {
+		t.Errorf("Breaker did not open at the failure threshold")
+	}
+
+	// After the pause, exactly one trial write is permitted.
+	later := now.Add(2 * time.Minute)
+	if !cb.allow(later) {
+		t.Errorf("Breaker did not permit a trial write after the pause")
+	}
+	if cb.allow(later) {
+		t.Errorf("Breaker permitted a second trial write")
+	}
+
+	cb.success()
+	if !cb.allow(later) {
+		t.Errorf("Breaker did not close after a successful write")
+	}
+}
+
+func TestWriteThrottle(t *testing.T) {
+
+	config.G.Log.System = logging.NewLogger("system")
+	logging.Statsd.Open("", "", "cassabon")
+
+	var wt writeThrottle
+	if size := wt.batchSize(100); size != 100 {
+		t.Errorf("Expected an uninitialized throttle to leave the batch size alone, got %d", size)
+	}
+
+	wt.init(100 * time.Millisecond)
+	for i := 0; i < 50; i++ {
+		wt.observe(time.Second)
+	}
+	if size := wt.batchSize(100); size != 6 {
+		t.Errorf("Expected slow writes to shrink batches to the minimum, got %d", size)
+	}
+	if size := wt.batchSize(1); size != 1 {
+		t.Errorf("Expected at least one row per batch, got %d", size)
+	}
+
+	for i := 0; i < 100; i++ {
+		wt.observe(time.Millisecond)
+	}
+	if size := wt.batchSize(100); size != 100 {
+		t.Errorf("Expected fast writes to restore the batch size, got %d", size)
+	}
+}
+
+func TestSubmit(t *testing.T) {
+
+	config.G.Log.System = logging.NewLogger("system")
+	logging.Statsd.Open("", "", "cassabon")
+
+	insert := make(chan *tableWrite, 1)
+	abort := make(chan struct{})
+	submit(insert, &tableWrite{table: "a"}, abort)
+	if len(insert) != 1 {
+		t.Fatalf("Expected the batch to be accepted")
+	}
+
+	// A full channel waits until the batch is taken, or the abort channel is closed.
+	done := make(chan struct{})
+	go func() {
+		submit(insert, &tableWrite{table: "b"}, abort)
+		close(done)
+	}()
+	if tw := <-insert; tw.table != "a" {
+		t.Errorf("Expected the first batch, got %q", tw.table)
+	}
+	<-done
+	if tw := <-insert; tw.table != "b" {
+		t.Errorf("Expected the second batch, got %q", tw.table)
+	}
+
+	submit(insert, &tableWrite{table: "c"}, abort)
+	close(abort)
+	submit(insert, &tableWrite{table: "d"}, abort)
+	if tw := <-insert; tw.table != "c" || len(insert) != 0 {
+		t.Errorf("Expected only the batch sent before the abort, got %q", tw.table)
+	}
+}
+
+func TestStopWriters(t *testing.T) {
+
+	config.G.Log.System = logging.NewLogger("system")
+	logging.Statsd.Open("", "", "cassabon")
+	defer func(writers int) { config.G.MetricManager.Writers = writers }(config.G.MetricManager.Writers)
+	config.G.MetricManager.Writers = 2
+
+	// With no share of queued rows, the writers take nothing, so every write is left on the insert channel.
+	me := newMemoryEngine()
+	mm := &MetricManager{engine: me, insert: make(chan *tableWrite, 10)}
+	base := time.Now().Truncate(time.Hour)
+	bw := batchWriter{stmts: newStatementSet("cassabon", nil), batchSize: 1, insert: mm.insert}
+	bw.Prepare("rollup_000003600", 24*time.Hour)
+	for i := 0; i < 3; i++ {
+		bw.Append("foo", base.Add(time.Duration(i)*time.Second), float64(i))
+	}
+	bw.Write()
+	mm.startWriters()
+
+	// Once the writers have stopped, what they left is written.
+	mm.stopWriters()
+	if len(mm.insert) != 0 {
+		t.Errorf("Expected the insert channel to be drained, %d writes remain", len(mm.insert))
+	}
+	if count, _ := me.count(context.Background(), "rollup_000003600", "foo", base, base.Add(time.Minute)); count != 3 {
+		t.Errorf("Expected 3 rows to be written, got %d", count)
+	}
+}
@@ -242,6 +242,15 @@ func (cpl *CarbonPlaintextListener) metricHandler(line string) {
 		return
 	}
 
+	// When multi-tenant, the path must begin with the name of its tenant.
+	if config.G.Tenants.Enabled {
+		if _, _, err := config.SplitTenant(statPath); err != nil {
+			config.G.Log.System.LogWarn("Malformed Carbon metric, %s", err.Error())
+			logging.Statsd.Client.Inc(config.G.Statsd.Events.ReceiveFail.Key, 1, config.G.Statsd.Events.ReceiveFail.SampleRate)
+			return
+		}
+	}
+
 	// Determine which Cassabon peer owns this path.
 	peerIndex, isMine := cpl.peerList.OwnerOf(statPath)
 	if isMine {
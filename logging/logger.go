@@ -43,6 +43,14 @@ func Reopen() {
 	}
 }
 
+// SetRotation sets the size at which all log files are rotated, and the number of rotated files kept.
+func SetRotation(maxSize int64, maxBackups int) {
+
+	for _, l := range loggers {
+		l.SetRotation(maxSize, maxBackups)
+	}
+}
+
 // The loggers, one per facility.
 var loggers map[string]*FileLogger = map[string]*FileLogger{}
 
@@ -113,6 +121,25 @@ type FileLogger struct {
 	skipEmit    bool         // flag to permit panicing without incurring deadlock
 	logFile     *os.File     // The file handle of the opened file
 	logger      *log.Logger  // The logger that writes to the file
+	size        int64        // The size of the log file, as written
+	maxSize     int64        // The size at which the log file is rotated; 0 if never
+	maxBackups  int          // The number of rotated log files kept, as logFilename.1 to logFilename.N
+}
+
+// logWriter writes the lines of a logger to its file, rotating the file when it is full. The log.Logger
+// serializes its writes, which are made only while the logger's lock is held for reading.
+type logWriter struct {
+	l *FileLogger
+}
+
+func (w logWriter) Write(p []byte) (int, error) {
+	l := w.l
+	if l.maxSize > 0 && l.size > 0 && l.size+int64(len(p)) > l.maxSize && l.logFilename != "" {
+		l.rotate()
+	}
+	n, err := l.logFile.Write(p)
+	l.size += int64(n)
+	return n, err
 }
 
 func (l *FileLogger) init(logFacility string) {
@@ -127,6 +154,14 @@ func (l *FileLogger) SetLogLevel(logLevel Severity) {
 	l.emit(Info, "Log level set to %s", SeverityToText(logLevel))
 }
 
+// SetRotation sets the size at which the log file is rotated, 0 for never, and the number of rotated files kept.
+func (l *FileLogger) SetRotation(maxSize int64, maxBackups int) {
+	l.m.Lock()
+	defer l.m.Unlock()
+	l.maxSize = maxSize
+	l.maxBackups = maxBackups
+}
+
 // GetLogLevel returns the current logging level threshold.
 func (l *FileLogger) GetLogLevel() Severity {
 	l.m.RLock()
@@ -242,9 +277,43 @@ func (l *FileLogger) openLogfile() *os.File {
 		l.LogFatal("Unable to reopen logfile '%v'. Error: '%s'", l.logFilename, err.Error())
 	}
 
+	// Rotation by size counts from the size of the file as found.
+	l.size = 0
+	if fi, err := fp.Stat(); err == nil {
+		l.size = fi.Size()
+	}
+
 	return fp
 }
 
+// rotate renames the full log file to logFilename.1, after renaming each older file to the next number and
+// removing the oldest, and opens a new file. It is called while the log.Logger is writing, so it may not log.
+func (l *FileLogger) rotate() {
+
+	os.Remove(fmt.Sprintf("%s.%d", l.logFilename, l.maxBackups))
+	for i := l.maxBackups - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", l.logFilename, i), fmt.Sprintf("%s.%d", l.logFilename, i+1))
+	}
+	if l.maxBackups > 0 {
+		os.Rename(l.logFilename, l.logFilename+".1")
+	} else {
+		os.Remove(l.logFilename)
+	}
+
+	fp, err := os.OpenFile(l.logFilename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		// Inability to log is a fatal error. We do not run blind.
+		fmt.Fprintf(l.logFile, "Unable to open rotated logfile '%v'. Error: '%s'\n", l.logFilename, err.Error())
+		l.skipEmit = true
+		l.LogFatal("Unable to open rotated logfile '%v'. Error: '%s'", l.logFilename, err.Error())
+	}
+	l.logFile.Close()
+	l.logFile = fp
+
+	// If the file couldn't be renamed, it is appended to, and rotated again after maxSize more.
+	l.size = 0
+}
+
 // rotate closes any open log files and (re-)opens them with the same name.
 func (l *FileLogger) closeAndOrOpen(action int) {
 
@@ -255,7 +324,7 @@ func (l *FileLogger) closeAndOrOpen(action int) {
 	// Use stderr and skip messages if no log filename was specified.
 	if l.logFilename == "" {
 		l.logFile = os.Stderr
-		l.logger = log.New(l.logFile, "", log.Ldate|log.Lmicroseconds)
+		l.logger = log.New(logWriter{l}, "", log.Ldate|log.Lmicroseconds)
 		return
 	}
 
@@ -264,14 +333,14 @@ func (l *FileLogger) closeAndOrOpen(action int) {
 	case 1:
 		// Initial open of the log file.
 		l.logFile = l.openLogfile()
-		l.logger = log.New(l.logFile, "", log.Ldate|log.Lmicroseconds)
+		l.logger = log.New(logWriter{l}, "", log.Ldate|log.Lmicroseconds)
 		l.emit(Info, "Log opened")
 	case 2:
 		// Close log file, and re-open with the same name.
 		l.emit(Info, "Log closed on signal")
 		l.logFile.Close()
 		l.logFile = l.openLogfile()
-		l.logger = log.New(l.logFile, "", log.Ldate|log.Lmicroseconds)
+		l.logger = log.New(logWriter{l}, "", log.Ldate|log.Lmicroseconds)
 		l.emit(Info, "Log reopened on signal")
 	case 3:
 		// Close the log file.
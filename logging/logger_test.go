@@ -3,6 +3,7 @@ package logging
 import (
 	"bufio"
 	"os"
+	"strings"
 	"testing"
 )
 
@@ -82,3 +83,51 @@ func TestLogger(t *testing.T) {
 		os.Remove(LOGFILE)
 	}
 }
+
+func TestRotation(t *testing.T) {
+
+	const LOGFILE string = "./rotate.log"
+	remove := func() {
+		for _, name := range []string{LOGFILE, LOGFILE + ".1", LOGFILE + ".2", LOGFILE + ".3"} {
+			os.Remove(name)
+		}
+	}
+	remove()
+	defer remove()
+
+	L := new(FileLogger)
+	L.init("TEST")
+	L.SetRotation(500, 2)
+	L.Open(LOGFILE, Debug)
+	for i := 0; i < 50; i++ {
+		L.LogInfo("Line %d of the rotation test", i)
+	}
+	L.Close()
+
+	// The current file and two backups remain, none larger than the maximum.
+	for _, name := range []string{LOGFILE, LOGFILE + ".1", LOGFILE + ".2"} {
+		if fi, err := os.Stat(name); err != nil {
+			t.Errorf("Expected %s: %s", name, err.Error())
+		} else if fi.Size() > 500 {
+			t.Errorf("Expected %s no larger than 500 bytes, found %d", name, fi.Size())
+		}
+	}
+	if _, err := os.Stat(LOGFILE + ".3"); err == nil {
+		t.Errorf("Expected no more than 2 backups")
+	}
+
+	// The newest lines are in the current file.
+	fp, err := os.Open(LOGFILE)
+	if err != nil {
+		t.Fatalf("Unable to open test log file: %s", err.Error())
+	}
+	defer fp.Close()
+	var last string
+	scanner := bufio.NewScanner(fp)
+	for scanner.Scan() {
+		last = scanner.Text()
+	}
+	if !strings.HasSuffix(last, "Log closed") {
+		t.Errorf("Unexpected last line: %q", last)
+	}
+}
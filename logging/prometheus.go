@@ -0,0 +1,192 @@
+package logging
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cactus/go-statsd-client/statsd"
+)
+
+// timing is the count and total of the durations reported for a stat.
+type timing struct {
+	count int64
+	sum   time.Duration
+}
+
+// recorder is a Statter that keeps the value of each counter, gauge and timing in memory, while passing
+// every stat on to statsd, so that they may also be served to Prometheus. Every stat is recorded, whatever
+// the rate at which it is sampled for statsd. A Prometheus counter never decreases, so a counter that is
+// decremented is recorded as a gauge from then on.
+type recorder struct {
+	statsd.Statter
+	m        sync.Mutex
+	counters map[string]int64
+	gauges   map[string]int64
+	timings  map[string]timing
+	levels   map[string]bool // Counters that have been decremented, and so are recorded as gauges
+}
+
+// newRecorder returns a recorder in front of a statsd client.
+func newRecorder(client statsd.Statter) *recorder {
+	return &recorder{
+		Statter:  client,
+		counters: make(map[string]int64),
+		gauges:   make(map[string]int64),
+		timings:  make(map[string]timing),
+		levels:   make(map[string]bool),
+	}
+}
+
+func (r *recorder) Inc(stat string, value int64, rate float32) error {
+	r.m.Lock()
+	if r.levels[stat] {
+		r.gauges[stat] += value
+	} else {
+		r.counters[stat] += value
+	}
+	r.m.Unlock()
+	return r.Statter.Inc(stat, value, rate)
+}
+
+func (r *recorder) Dec(stat string, value int64, rate float32) error {
+	r.m.Lock()
+	if !r.levels[stat] {
+		r.levels[stat] = true
+		r.gauges[stat] += r.counters[stat]
+		delete(r.counters, stat)
+	}
+	r.gauges[stat] -= value
+	r.m.Unlock()
+	return r.Statter.Dec(stat, value, rate)
+}
+
+func (r *recorder) Gauge(stat string, value int64, rate float32) error {
+	r.m.Lock()
+	r.gauges[stat] = value
+	r.m.Unlock()
+	return r.Statter.Gauge(stat, value, rate)
+}
+
+func (r *recorder) GaugeDelta(stat string, value int64, rate float32) error {
+	r.m.Lock()
+	r.gauges[stat] += value
+	r.m.Unlock()
+	return r.Statter.GaugeDelta(stat, value, rate)
+}
+
+func (r *recorder) Timing(stat string, delta int64, rate float32) error {
+	r.record(stat, time.Duration(delta)*time.Millisecond)
+	return r.Statter.Timing(stat, delta, rate)
+}
+
+func (r *recorder) TimingDuration(stat string, delta time.Duration, rate float32) error {
+	r.record(stat, delta)
+	return r.Statter.TimingDuration(stat, delta, rate)
+}
+
+// record adds a duration to the timing of a stat.
+func (r *recorder) record(stat string, delta time.Duration) {
+	r.m.Lock()
+	t := r.timings[stat]
+	t.count++
+	t.sum += delta
+	r.timings[stat] = t
+	r.m.Unlock()
+}
+
+// WritePrometheus writes every stat recorded so far, and the current memory usage, in the Prometheus text
+// exposition format. Each name is prefixed with "cassabon_", and has its dots replaced by underscores.
+func (s *StatsWriter) WritePrometheus(w io.Writer) error {
+	r, ok := s.Client.(*recorder)
+	if !ok {
+		return fmt.Errorf("Stats Writer is not open")
+	}
+
+	var memStats runtime.MemStats
+	runtime.ReadMemStats(&memStats)
+	gauges := map[string]int64{
+		"goroutines":          int64(runtime.NumGoroutine()),
+		"memory.alloc":        int64(memStats.Alloc),
+		"memory.heap.in_use":  int64(memStats.HeapInuse),
+		"memory.heap.objects": int64(memStats.HeapObjects),
+		"memory.sys":          int64(memStats.Sys),
+	}
+
+	r.m.Lock()
+	counters := make(map[string]int64, len(r.counters))
+	for stat, v := range r.counters {
+		counters[stat] = v
+	}
+	for stat, v := range r.gauges {
+		gauges[stat] = v
+	}
+	timings := make(map[string]timing, len(r.timings))
+	for stat, t := range r.timings {
+		timings[stat] = t
+	}
+	r.m.Unlock()
+
+	var err error
+	write := func(format string, args ...interface{}) {
+		if err == nil {
+			_, err = fmt.Fprintf(w, format, args...)
+		}
+	}
+	for _, stat := range sortedStats(counters) {
+		name := prometheusName(stat) + "_total"
+		write("# TYPE %s counter\n%s %d\n", name, name, counters[stat])
+	}
+	for _, stat := range sortedStats(gauges) {
+		name := prometheusName(stat)
+		write("# TYPE %s gauge\n%s %d\n", name, name, gauges[stat])
+	}
+	timed := make([]string, 0, len(timings))
+	for stat := range timings {
+		timed = append(timed, stat)
+	}
+	sort.Strings(timed)
+	for _, stat := range timed {
+		name := prometheusName(stat) + "_seconds"
+		write("# TYPE %s summary\n%s_sum %g\n%s_count %d\n", name, name, timings[stat].sum.Seconds(), name, timings[stat].count)
+	}
+	return err
+}
+
+// ResetRecorded sets every counter and timing recorded so far back to zero, as though none had been reported
+// since startup. Gauges are levels rather than totals, so keep their values.
+func (s *StatsWriter) ResetRecorded() error {
+	r, ok := s.Client.(*recorder)
+	if !ok {
+		return fmt.Errorf("Stats Writer is not open")
+	}
+	r.m.Lock()
+	r.counters = make(map[string]int64)
+	r.timings = make(map[string]timing)
+	r.m.Unlock()
+	return nil
+}
+
+// sortedStats returns the names of the stats, in order.
+func sortedStats(stats map[string]int64) []string {
+	list := make([]string, 0, len(stats))
+	for stat := range stats {
+		list = append(list, stat)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// prometheusName returns the Prometheus name of a stat, with every character not allowed in one replaced.
+func prometheusName(stat string) string {
+	name := []byte("cassabon_" + stat)
+	for i, c := range name {
+		if !(c == '_' || c == ':' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9') {
+			name[i] = '_'
+		}
+	}
+	return string(name)
+}
@@ -42,6 +42,9 @@ func (s *StatsWriter) Open(host string, port string, prefix string) error {
 		}
 	}
 
+	// Whatever is sent to statsd, the stats may also be served to Prometheus.
+	s.Client = newRecorder(s.Client)
+
 	// Report memory usage stats every second.
 	s.quit = make(chan struct{})
 	if err == nil {
@@ -1,7 +1,10 @@
 package logging
 
 import (
+	"bytes"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestStats(t *testing.T) {
@@ -18,3 +21,63 @@ func TestStats(t *testing.T) {
 	}
 	Statsd.Close()
 }
+
+func TestWritePrometheus(t *testing.T) {
+
+	Statsd.Open("", "", "cassabon")
+	defer Statsd.Close()
+	Statsd.Client.Inc("carbon.received", 2, 0.1)
+	Statsd.Client.Inc("carbon.received", 1, 1.0)
+	Statsd.Client.Inc("api.live.clients", 2, 1.0)
+	Statsd.Client.Dec("api.live.clients", 1, 1.0)
+	Statsd.Client.Inc("api.live.clients", 3, 1.0)
+	Statsd.Client.Gauge("path.count", 42, 1.0)
+	Statsd.Client.TimingDuration("metricmgr.flush", 1500*time.Millisecond, 1.0)
+	Statsd.Client.Timing("metricmgr.flush", 500, 1.0)
+
+	var buf bytes.Buffer
+	if err := Statsd.WritePrometheus(&buf); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if strings.Contains(buf.String(), "api_live_clients_total") {
+		t.Errorf("Decremented counter served as a counter in:\n%s", buf.String())
+	}
+	for _, expected := range []string{
+		"# TYPE cassabon_carbon_received_total counter\ncassabon_carbon_received_total 3\n",
+		"# TYPE cassabon_path_count gauge\ncassabon_path_count 42\n",
+		"# TYPE cassabon_api_live_clients gauge\ncassabon_api_live_clients 4\n", // Decremented, so a gauge
+		"cassabon_metricmgr_flush_seconds_sum 2\ncassabon_metricmgr_flush_seconds_count 2\n",
+		"\ncassabon_goroutines ",
+	} {
+		if !strings.Contains(buf.String(), expected) {
+			t.Errorf("Expected %q in:\n%s", expected, buf.String())
+		}
+	}
+}
+
+func TestResetRecorded(t *testing.T) {
+
+	Statsd.Open("", "", "cassabon")
+	defer Statsd.Close()
+	Statsd.Client.Inc("carbon.received", 3, 1.0)
+	Statsd.Client.Gauge("path.count", 42, 1.0)
+	Statsd.Client.Timing("metricmgr.flush", 500, 1.0)
+	if err := Statsd.ResetRecorded(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	Statsd.Client.Inc("carbon.received", 1, 1.0)
+
+	var buf bytes.Buffer
+	if err := Statsd.WritePrometheus(&buf); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !strings.Contains(buf.String(), "\ncassabon_carbon_received_total 1\n") {
+		t.Errorf("Counter not reset in:\n%s", buf.String())
+	}
+	if !strings.Contains(buf.String(), "\ncassabon_path_count 42\n") {
+		t.Errorf("Gauge not kept in:\n%s", buf.String())
+	}
+	if strings.Contains(buf.String(), "metricmgr_flush") {
+		t.Errorf("Timing not reset in:\n%s", buf.String())
+	}
+}
@@ -2,25 +2,215 @@
 package middleware
 
 import (
+	"fmt"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gocql/gocql"
 )
 
-// Returns a round-robin simple connection pool to the Cassandra cluster.
-func CassandraSession(chosts []string, cport string, ckeyspace string) (*gocql.Session, error) {
+// CassandraOptions are the connection settings of a Cassandra session.
+type CassandraOptions struct {
+	Hosts    []string // Hostnames or IP addresses of the Cassandra ring
+	Port     string   // Cassandra port
+	Keyspace string   // Keyspace of the session, if any
+	LocalDC  string   // Datacenter whose hosts are preferred as coordinators; "" treats all alike
+
+	Timeout  time.Duration // How long a connection may take to open, and a query to be answered
+	NumConns int           // Connections held open to each host
+	Retries  int           // Times a failed query is retried before its error is returned
+
+	Compression  string // Frame compression: "snappy", or "" for none
+	ProtoVersion int    // Native protocol version, from 1 to 4; 0 for the driver's default
+	CQLVersion   string // CQL version; "" for the driver's default
+	Consistency  string // Default consistency level, such as "one"; "" is one
+
+	HostsUp *int32 // If set, kept equal to the number of hosts up
+}
+
+// Returns a connection pool to the Cassandra cluster. Each query is sent to a replica of its partition,
+// if the driver can tell which, and otherwise to the hosts of the local datacenter in turn, with those
+// of other datacenters tried only when none of the local hosts can be reached.
+func CassandraSession(opts CassandraOptions) (*gocql.Session, error) {
 
 	// Port must be numeric. Parse error will result in invalid port, which is reported.
-	port, _ := strconv.ParseInt(cport, 10, 64)
+	port, _ := strconv.ParseInt(opts.Port, 10, 64)
 
 	// Build a cluster configuration.
-	clusterCfg := gocql.NewCluster(chosts...)
+	clusterCfg := gocql.NewCluster(opts.Hosts...)
 	clusterCfg.Port = int(port)
-	clusterCfg.Keyspace = ckeyspace
-	clusterCfg.Timeout = time.Duration(time.Second)
+	clusterCfg.Keyspace = opts.Keyspace
+	clusterCfg.Timeout = opts.Timeout
+	clusterCfg.NumConns = opts.NumConns
+	if opts.Retries > 0 {
+		clusterCfg.RetryPolicy = &gocql.SimpleRetryPolicy{NumRetries: opts.Retries}
+	}
 	clusterCfg.Consistency = gocql.One
+	if opts.Consistency != "" {
+		consistency, err := parseConsistency(opts.Consistency)
+		if err != nil {
+			return nil, err
+		}
+		clusterCfg.Consistency = consistency
+	}
+	if opts.ProtoVersion < 0 || opts.ProtoVersion > 4 {
+		return nil, fmt.Errorf("unsupported Cassandra protocol version %d", opts.ProtoVersion)
+	}
+	if opts.ProtoVersion > 0 {
+		clusterCfg.ProtoVersion = opts.ProtoVersion
+	}
+	if opts.CQLVersion != "" {
+		clusterCfg.CQLVersion = opts.CQLVersion
+	}
+	switch opts.Compression {
+	case "":
+	case "snappy":
+		clusterCfg.Compressor = gocql.SnappyCompressor{}
+	default:
+		return nil, fmt.Errorf("unsupported Cassandra compression %q", opts.Compression)
+	}
+	clusterCfg.PoolConfig.HostSelectionPolicy = &localFirstPolicy{
+		gocql.TokenAwareHostPolicy(&dcAwareRoundRobinPolicy{localDC: opts.LocalDC, hostsUp: opts.HostsUp}),
+		opts.LocalDC,
+	}
 
 	// Create session.
 	return clusterCfg.CreateSession()
 }
+
+// parseConsistency returns the consistency level named, in either case.
+func parseConsistency(s string) (gocql.Consistency, error) {
+	for _, c := range []gocql.Consistency{gocql.Any, gocql.One, gocql.Two, gocql.Three, gocql.Quorum,
+		gocql.All, gocql.LocalQuorum, gocql.EachQuorum, gocql.LocalOne} {
+		if strings.EqualFold(c.String(), s) {
+			return c, nil
+		}
+	}
+	return gocql.One, fmt.Errorf("unknown Cassandra consistency level %q", s)
+}
+
+// selectedHost is a host picked by a policy, which keeps no record of the outcome.
+type selectedHost struct {
+	info *gocql.HostInfo
+}
+
+func (h selectedHost) Info() *gocql.HostInfo { return h.info }
+func (h selectedHost) Mark(error)            {}
+
+// dcAwareRoundRobinPolicy picks the hosts of the local datacenter in turn, followed by those of the
+// others in turn. With no local datacenter, all hosts are local.
+type dcAwareRoundRobinPolicy struct {
+	localDC string
+	hostsUp *int32
+	mu      sync.RWMutex
+	local   []*gocql.HostInfo
+	remote  []*gocql.HostInfo
+	pos     uint32
+}
+
+func (p *dcAwareRoundRobinPolicy) SetPartitioner(partitioner string) {}
+
+func (p *dcAwareRoundRobinPolicy) AddHost(host *gocql.HostInfo) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.local, p.remote = removeHost(p.local, host.Peer()), removeHost(p.remote, host.Peer())
+	if p.localDC == "" || host.DataCenter() == p.localDC {
+		p.local = append(p.local, host)
+	} else {
+		p.remote = append(p.remote, host)
+	}
+	p.countHosts()
+}
+
+func (p *dcAwareRoundRobinPolicy) RemoveHost(addr string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.local, p.remote = removeHost(p.local, addr), removeHost(p.remote, addr)
+	p.countHosts()
+}
+
+// countHosts records the number of hosts up, if asked to; the caller holds the lock.
+func (p *dcAwareRoundRobinPolicy) countHosts() {
+	if p.hostsUp != nil {
+		atomic.StoreInt32(p.hostsUp, int32(len(p.local)+len(p.remote)))
+	}
+}
+
+func (p *dcAwareRoundRobinPolicy) HostUp(host *gocql.HostInfo) { p.AddHost(host) }
+func (p *dcAwareRoundRobinPolicy) HostDown(addr string)        { p.RemoveHost(addr) }
+
+func (p *dcAwareRoundRobinPolicy) Pick(qry gocql.ExecutableQuery) gocql.NextHost {
+	p.mu.RLock()
+	hosts := make([]*gocql.HostInfo, 0, len(p.local)+len(p.remote))
+	hosts = append(hosts, rotate(p.local, p.pos)...)
+	hosts = append(hosts, rotate(p.remote, p.pos)...)
+	p.mu.RUnlock()
+	atomic.AddUint32(&p.pos, 1)
+
+	var i int
+	return func() gocql.SelectedHost {
+		if i >= len(hosts) {
+			return nil
+		}
+		i++
+		return selectedHost{hosts[i-1]}
+	}
+}
+
+// removeHost returns a list of hosts without the one at an address, leaving the original untouched.
+func removeHost(hosts []*gocql.HostInfo, addr string) []*gocql.HostInfo {
+	list := make([]*gocql.HostInfo, 0, len(hosts))
+	for _, h := range hosts {
+		if h.Peer() != addr {
+			list = append(list, h)
+		}
+	}
+	return list
+}
+
+// rotate returns a list of hosts beginning at a position, wrapping around to the start.
+func rotate(hosts []*gocql.HostInfo, pos uint32) []*gocql.HostInfo {
+	if len(hosts) == 0 {
+		return nil
+	}
+	start := int(pos % uint32(len(hosts)))
+	return append(hosts[start:len(hosts):len(hosts)], hosts[:start]...)
+}
+
+// localFirstPolicy defers the hosts of other datacenters picked by the policy it wraps until those of the
+// local datacenter are exhausted, so that a replica chosen by token in a remote datacenter doesn't
+// coordinate a query that a local host could.
+type localFirstPolicy struct {
+	gocql.HostSelectionPolicy
+	localDC string
+}
+
+func (p *localFirstPolicy) Pick(qry gocql.ExecutableQuery) gocql.NextHost {
+	next := p.HostSelectionPolicy.Pick(qry)
+	if p.localDC == "" {
+		return next
+	}
+	var deferred []gocql.SelectedHost
+	return func() gocql.SelectedHost {
+		for next != nil {
+			h := next()
+			if h == nil {
+				next = nil
+				break
+			}
+			if h.Info().DataCenter() == p.localDC {
+				return h
+			}
+			deferred = append(deferred, h)
+		}
+		if len(deferred) == 0 {
+			return nil
+		}
+		h := deferred[0]
+		deferred = deferred[1:]
+		return h
+	}
+}
@@ -0,0 +1,56 @@
+package middleware
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+)
+
+// ElasticSearchOptions are the connection settings of an ElasticSearch client.
+type ElasticSearchOptions struct {
+	CAFile             string        // CA certificates that the server's certificate must be signed by
+	CertFile           string        // Client certificate, presented to the server if set
+	KeyFile            string        // Key of the client certificate
+	InsecureSkipVerify bool          // Whether to accept any server certificate
+	PoolSize           int           // The most idle connections kept open for reuse
+	DialTimeout        time.Duration // How long a connection may take to open
+	ReadTimeout        time.Duration // How long the server may take to begin its response
+	Timeout            time.Duration // How long a request may take in all
+}
+
+// ElasticSearchClient returns an HTTP client for the ElasticSearch REST API. If a CA file is supplied,
+// the server's certificate must be signed by it; with a certificate and key, the client presents them.
+func ElasticSearchClient(opts ElasticSearchOptions) (*http.Client, error) {
+
+	tlsCfg := &tls.Config{InsecureSkipVerify: opts.InsecureSkipVerify}
+	if opts.CAFile != "" {
+		pem, err := ioutil.ReadFile(opts.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsCfg.RootCAs = x509.NewCertPool()
+		if !tlsCfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", opts.CAFile)
+		}
+	}
+	if opts.CertFile != "" || opts.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsCfg.Certificates = []tls.Certificate{cert}
+	}
+
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           (&net.Dialer{Timeout: opts.DialTimeout}).DialContext,
+		TLSClientConfig:       tlsCfg,
+		MaxIdleConnsPerHost:   opts.PoolSize,
+		ResponseHeaderTimeout: opts.ReadTimeout,
+	}
+	return &http.Client{Transport: transport, Timeout: opts.Timeout}, nil
+}
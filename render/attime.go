@@ -0,0 +1,177 @@
+package render
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The names of the months and days of the week, as a time reference may begin them.
+var (
+	monthNames   = []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}
+	weekdayNames = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+)
+
+// ParseTime returns the time given as graphite-web's from and until parameters give it, in seconds since the
+// epoch: a number of seconds since the epoch itself, or a reference such as "now", "noon", "yesterday",
+// "monday", "jan1", "12/31/2015" or "HH:MM_YYYYMMDD", followed by an offset of intervals such as "-1d" or
+// "+1h30min". Dates and times of day are in the location of now, and an offset alone is from now.
+func ParseTime(s string, now time.Time) (int64, error) {
+	t := strings.NewReplacer("_", "", ",", "", " ", "").Replace(strings.ToLower(strings.TrimSpace(s)))
+	if isDigits(t) && !(len(t) == 8 && isDate(t)) {
+		return strconv.ParseInt(t, 10, 64)
+	}
+	ref, offset := t, ""
+	if i := strings.IndexAny(t, "+-"); i >= 0 {
+		ref, offset = t[:i], t[i:]
+	}
+	base, err := parseTimeReference(ref, now)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q: %s", s, err.Error())
+	}
+	delta, err := parseTimeOffset(offset)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q: %s", s, err.Error())
+	}
+	return base.Unix() + delta, nil
+}
+
+// isDigits reports whether a string is a number of digits.
+func isDigits(s string) bool {
+	return s != "" && strings.Trim(s, "0123456789") == ""
+}
+
+// isDate reports whether eight digits might be a date in YYYYMMDD form, rather than seconds since the epoch.
+func isDate(s string) bool {
+	year, _ := strconv.Atoi(s[:4])
+	month, _ := strconv.Atoi(s[4:6])
+	day, _ := strconv.Atoi(s[6:])
+	return year > 1900 && month < 13 && day < 32
+}
+
+// parseTimeReference returns the time a reference gives: now, or a time of day, on a day which is today
+// unless the reference names another. A time of day without a day is today's, and a day without a time of
+// day begins at midnight.
+func parseTimeReference(ref string, now time.Time) (time.Time, error) {
+	if ref == "" || ref == "now" {
+		return now, nil
+	}
+
+	// The time of day.
+	hour, minute := 0, 0
+	if i := strings.Index(ref, ":"); i > 0 && i < 3 && len(ref) >= i+3 {
+		var err1, err2 error
+		hour, err1 = strconv.Atoi(ref[:i])
+		minute, err2 = strconv.Atoi(ref[i+1 : i+3])
+		if err1 != nil || err2 != nil || hour > 23 || minute > 59 {
+			return now, fmt.Errorf("invalid time of day")
+		}
+		ref = ref[i+3:]
+		if strings.HasPrefix(ref, "am") {
+			ref = ref[2:]
+		} else if strings.HasPrefix(ref, "pm") {
+			hour, ref = (hour+12)%24, ref[2:]
+		}
+	}
+	switch {
+	case strings.HasPrefix(ref, "noon"):
+		hour, minute, ref = 12, 0, ref[4:]
+	case strings.HasPrefix(ref, "midnight"):
+		hour, minute, ref = 0, 0, ref[8:]
+	case strings.HasPrefix(ref, "teatime"):
+		hour, minute, ref = 16, 0, ref[7:]
+	}
+	year, month, day := now.Date()
+
+	// The day.
+	switch {
+	case ref == "" || ref == "today":
+	case ref == "yesterday":
+		day--
+	case ref == "tomorrow":
+		day++
+	case strings.Count(ref, "/") == 2:
+		parts := strings.Split(ref, "/")
+		m, err1 := strconv.Atoi(parts[0])
+		d, err2 := strconv.Atoi(parts[1])
+		y, err3 := strconv.Atoi(parts[2])
+		if err1 != nil || err2 != nil || err3 != nil {
+			return now, fmt.Errorf("invalid date")
+		}
+		if y < 1900 {
+			y += 1900
+		}
+		if y < 1970 {
+			y += 100
+		}
+		if !validDate(y, m, d) {
+			return now, fmt.Errorf("invalid date")
+		}
+		year, month, day = y, time.Month(m), d
+	case len(ref) == 8 && isDigits(ref):
+		y, _ := strconv.Atoi(ref[:4])
+		m, _ := strconv.Atoi(ref[4:6])
+		d, _ := strconv.Atoi(ref[6:])
+		if !validDate(y, m, d) {
+			return now, fmt.Errorf("invalid date")
+		}
+		year, month, day = y, time.Month(m), d
+	case len(ref) >= 3 && indexOf(monthNames, ref[:3]) >= 0:
+		digits := strings.TrimLeft(ref, "abcdefghijklmnopqrstuvwxyz")
+		d, err := strconv.Atoi(digits)
+		m := indexOf(monthNames, ref[:3]) + 1
+		if err != nil || !validDate(year, m, d) {
+			return now, fmt.Errorf("invalid day of the month")
+		}
+		month, day = time.Month(m), d
+	case len(ref) >= 3 && indexOf(weekdayNames, ref[:3]) >= 0:
+		// The most recent such day, which may be today.
+		ago := (int(now.Weekday()) - indexOf(weekdayNames, ref[:3]) + 7) % 7
+		day -= ago
+	default:
+		return now, fmt.Errorf("unknown day reference %q", ref)
+	}
+
+	// A day before the first of the month, or after its last, is in the month before or after.
+	return time.Date(year, month, day, hour, minute, 0, 0, now.Location()), nil
+}
+
+// validDate reports whether a year, month and day are a date.
+func validDate(year, month, day int) bool {
+	return month >= 1 && month <= 12 && day >= 1 && time.Date(year, time.Month(month), day, 0, 0, 0, 0, time.UTC).Day() == day
+}
+
+// parseTimeOffset returns the seconds in an offset such as "-1d" or "+1h30min", in which every interval
+// has the sign of the first.
+func parseTimeOffset(offset string) (int64, error) {
+	if offset == "" {
+		return 0, nil
+	}
+	sign := offset[:1]
+	s := offset[1:]
+	if s == "" {
+		return 0, fmt.Errorf("invalid offset %q", offset)
+	}
+	var total int64
+	for s != "" {
+		digits := len(s) - len(strings.TrimLeft(s, "0123456789"))
+		letters := len(s[digits:]) - len(strings.TrimLeft(s[digits:], "abcdefghijklmnopqrstuvwxyz"))
+		seconds, err := parseInterval(sign + s[:digits+letters])
+		if err != nil {
+			return 0, err
+		}
+		total, s = total+seconds, s[digits+letters:]
+	}
+	return total, nil
+}
+
+// indexOf returns the index of a string in a list, or -1 if it isn't there.
+func indexOf(list []string, s string) int {
+	for i, v := range list {
+		if v == s {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,233 @@
+package render
+
+import (
+	"math"
+	"strings"
+)
+
+// aggregator combines the values of many series at one time into one. NaNs, which are missing values,
+// are ignored; if every value is missing, so is the result.
+type aggregator func(values []float64) float64
+
+// aggregators are the ways in which series may be combined, by the names graphite-web gives them.
+var aggregators = map[string]aggregator{
+	"sum":     aggregateSum,
+	"average": aggregateAverage,
+	"avg":     aggregateAverage,
+	"min":     aggregateMin,
+	"max":     aggregateMax,
+}
+
+func aggregateSum(values []float64) float64 {
+	sum, n := 0.0, 0
+	for _, v := range values {
+		if !math.IsNaN(v) {
+			sum += v
+			n++
+		}
+	}
+	if n == 0 {
+		return math.NaN()
+	}
+	return sum
+}
+
+func aggregateAverage(values []float64) float64 {
+	sum, n := 0.0, 0
+	for _, v := range values {
+		if !math.IsNaN(v) {
+			sum += v
+			n++
+		}
+	}
+	if n == 0 {
+		return math.NaN()
+	}
+	return sum / float64(n)
+}
+
+func aggregateMin(values []float64) float64 {
+	min := math.NaN()
+	for _, v := range values {
+		if !math.IsNaN(v) && (math.IsNaN(min) || v < min) {
+			min = v
+		}
+	}
+	return min
+}
+
+func aggregateMax(values []float64) float64 {
+	max := math.NaN()
+	for _, v := range values {
+		if !math.IsNaN(v) && (math.IsNaN(max) || v > max) {
+			max = v
+		}
+	}
+	return max
+}
+
+func init() {
+	for name, agg := range map[string]aggregator{
+		"sumSeries":     aggregateSum,
+		"sum":           aggregateSum,
+		"averageSeries": aggregateAverage,
+		"avg":           aggregateAverage,
+		"minSeries":     aggregateMin,
+		"maxSeries":     aggregateMax,
+	} {
+		functions[name] = combination(agg)
+	}
+	functions["groupByNode"] = groupByNode
+}
+
+// combination returns a function that combines the series of all its arguments into one, named for the call.
+func combination(agg aggregator) function {
+	return func(ctx *context, call *expr) ([]*Series, error) {
+		list, err := ctx.seriesArgs(call, 0)
+		if err != nil || len(list) == 0 {
+			return nil, err
+		}
+		return []*Series{combine(call.text, list, agg)}, nil
+	}
+}
+
+// groupByNode(seriesList, nodeNum, callback="average") combines the series that have the same node at an
+// index of their paths, and names each result for that node. The callback may also be named as a function,
+// such as "sumSeries".
+func groupByNode(ctx *context, call *expr) ([]*Series, error) {
+	list, err := ctx.seriesArg(call, 0)
+	if err != nil {
+		return nil, err
+	}
+	node, err := intArg(call, 1)
+	if err != nil {
+		return nil, err
+	}
+	agg := aggregateAverage
+	if len(call.args) > 2 {
+		name, err := stringArg(call, 2)
+		if err != nil {
+			return nil, err
+		}
+		var found bool
+		if agg, found = aggregators[strings.TrimSuffix(name, "Series")]; !found {
+			return nil, targetError("%s: unknown callback %q", call.name, name)
+		}
+	}
+
+	// Groups are listed in the order in which their first series are.
+	var keys []string
+	groups := make(map[string][]*Series)
+	for _, s := range list {
+		key := pathNodes(s.Name, []int{node})
+		if _, found := groups[key]; !found {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], s)
+	}
+	result := make([]*Series, 0, len(keys))
+	for _, key := range keys {
+		result = append(result, combine(key, groups[key], agg))
+	}
+	return result, nil
+}
+
+// combine aggregates the values of many series at each time into one series. Series with different steps
+// are first consolidated to the least common multiple of them, as graphite-web does.
+func combine(name string, list []*Series, agg aggregator) *Series {
+	step := int64(0)
+	for _, s := range list {
+		step = lcm(step, s.Step)
+	}
+	var aligned []*Series
+	start, end := int64(math.MaxInt64), int64(math.MinInt64)
+	for _, s := range list {
+		c := consolidate(s, step)
+		if len(c.Values) == 0 {
+			continue
+		}
+		if c.Start < start {
+			start = c.Start
+		}
+		if c.End() > end {
+			end = c.End()
+		}
+		aligned = append(aligned, c)
+	}
+	result := &Series{Name: name, Start: start, Step: step, PathExpression: name}
+	if len(aligned) == 0 {
+		result.Start = 0
+		return result
+	}
+	values := make([]float64, len(aligned))
+	for t := start; t <= end; t += step {
+		for i, s := range aligned {
+			values[i] = s.at(t)
+		}
+		result.Values = append(result.Values, agg(values))
+	}
+	return result
+}
+
+// at returns the value at a timestamp, or NaN if the series has none there.
+func (s *Series) at(t int64) float64 {
+	if s.Step <= 0 || t < s.Start || (t-s.Start)%s.Step != 0 {
+		return math.NaN()
+	}
+	i := (t - s.Start) / s.Step
+	if i >= int64(len(s.Values)) {
+		return math.NaN()
+	}
+	return s.Values[i]
+}
+
+// consolidate returns a series averaged into intervals of a step, itself a multiple of the series' own,
+// each beginning at a multiple of the step.
+func consolidate(s *Series, step int64) *Series {
+	if step == s.Step || s.Step <= 0 || len(s.Values) == 0 {
+		return s
+	}
+	c := &Series{Name: s.Name, Start: s.Start - s.Start%step, Step: step}
+	var bucket []float64
+	next := c.Start + step
+	for i, v := range s.Values {
+		t := s.Start + int64(i)*s.Step
+		for t >= next {
+			c.Values = append(c.Values, aggregateAverage(bucket))
+			bucket, next = bucket[:0], next+step
+		}
+		bucket = append(bucket, v)
+	}
+	c.Values = append(c.Values, aggregateAverage(bucket))
+	return c
+}
+
+// Consolidate returns a series averaged into intervals long enough that it has at most maxDataPoints values,
+// as graphite-web consolidates a render with maxDataPoints. A series with no more than that is returned as it is.
+func Consolidate(s *Series, maxDataPoints int) *Series {
+	if maxDataPoints <= 0 || len(s.Values) <= maxDataPoints || s.Step <= 0 {
+		return s
+	}
+	// Intervals begin at multiples of the step, so a series not aligned to one may need a longer step.
+	for n := (len(s.Values) + maxDataPoints - 1) / maxDataPoints; ; n++ {
+		if c := consolidate(s, s.Step*int64(n)); len(c.Values) <= maxDataPoints {
+			c.PathExpression = s.PathExpression
+			return c
+		}
+	}
+}
+
+// lcm returns the least common multiple of two steps, treating 0 as no step yet.
+func lcm(a, b int64) int64 {
+	if a <= 0 {
+		return b
+	}
+	if b <= 0 {
+		return a
+	}
+	x, y := a, b
+	for y != 0 {
+		x, y = y, x%y
+	}
+	return a / x * b
+}
@@ -0,0 +1,185 @@
+package render
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/csv"
+	"math"
+	"strconv"
+	"time"
+)
+
+// The layout of the timestamps of the CSV render format, which are in UTC.
+const csvTimeLayout = "2006-01-02 15:04:05"
+
+// graphite-web's pickle and msgpack render formats describe each series by these fields, in this order.
+// The end is that of the interval of the last value, rather than its timestamp.
+var seriesFields = []string{"name", "pathExpression", "start", "end", "step", "values"}
+
+// fieldValue returns the value of one of the fields of a series, as an int64, a string, or a list of float64.
+func fieldValue(s *Series, field string) interface{} {
+	switch field {
+	case "name":
+		return s.Name
+	case "pathExpression":
+		if s.PathExpression == "" {
+			return s.Name
+		}
+		return s.PathExpression
+	case "start":
+		return s.Start
+	case "end":
+		return s.End() + s.Step
+	case "step":
+		return s.Step
+	}
+	return s.Values
+}
+
+// Pickle encodes a list of series as graphite-web's pickle render format does, for a graphite-web that
+// lists Cassabon among its CLUSTER_SERVERS: a list of dicts, with None for each missing value. Only the
+// opcodes of pickle protocol 2 that this needs are written.
+func Pickle(list []*Series) []byte {
+	buf := []byte{0x80, 2, ']'} // PROTO 2, EMPTY_LIST
+	if len(list) > 0 {
+		buf = append(buf, '(') // MARK
+	}
+	for _, s := range list {
+		buf = append(buf, '}', '(') // EMPTY_DICT, MARK
+		for _, field := range seriesFields {
+			buf = pickleString(buf, field)
+			switch v := fieldValue(s, field).(type) {
+			case string:
+				buf = pickleString(buf, v)
+			case int64:
+				buf = pickleInt(buf, v)
+			case []float64:
+				buf = append(buf, ']') // EMPTY_LIST
+				if len(v) > 0 {
+					buf = append(buf, '(') // MARK
+				}
+				for _, f := range v {
+					if math.IsNaN(f) || math.IsInf(f, 0) {
+						buf = append(buf, 'N') // NONE
+					} else {
+						buf = append(buf, 'G') // BINFLOAT
+						buf = appendUint64(buf, math.Float64bits(f))
+					}
+				}
+				if len(v) > 0 {
+					buf = append(buf, 'e') // APPENDS
+				}
+			}
+		}
+		buf = append(buf, 'u') // SETITEMS
+	}
+	if len(list) > 0 {
+		buf = append(buf, 'e') // APPENDS
+	}
+	return append(buf, '.') // STOP
+}
+
+// pickleString appends a pickled unicode string.
+func pickleString(buf []byte, s string) []byte {
+	buf = append(buf, 'X') // BINUNICODE
+	buf = append(buf, byte(len(s)), byte(len(s)>>8), byte(len(s)>>16), byte(len(s)>>24))
+	return append(buf, s...)
+}
+
+// pickleInt appends a pickled integer.
+func pickleInt(buf []byte, v int64) []byte {
+	if v >= math.MinInt32 && v <= math.MaxInt32 {
+		u := uint32(v)
+		return append(buf, 'J', byte(u), byte(u>>8), byte(u>>16), byte(u>>24)) // BININT
+	}
+	buf = append(buf, 0x8a, 8) // LONG1, as 8 little-endian bytes
+	u := uint64(v)
+	for i := uint(0); i < 8; i++ {
+		buf = append(buf, byte(u>>(8*i)))
+	}
+	return buf
+}
+
+// Msgpack encodes a list of series as graphite-web's msgpack render format does: an array of maps,
+// with nil for each missing value.
+func Msgpack(list []*Series) []byte {
+	buf := msgpackHeader(nil, 0x90, 0xdc, len(list))
+	for _, s := range list {
+		buf = msgpackHeader(buf, 0x80, 0xde, len(seriesFields))
+		for _, field := range seriesFields {
+			buf = msgpackString(buf, field)
+			switch v := fieldValue(s, field).(type) {
+			case string:
+				buf = msgpackString(buf, v)
+			case int64:
+				buf = append(buf, 0xd3) // int 64
+				buf = appendUint64(buf, uint64(v))
+			case []float64:
+				buf = msgpackHeader(buf, 0x90, 0xdc, len(v))
+				for _, f := range v {
+					if math.IsNaN(f) || math.IsInf(f, 0) {
+						buf = append(buf, 0xc0) // nil
+					} else {
+						buf = append(buf, 0xcb) // float 64
+						buf = appendUint64(buf, math.Float64bits(f))
+					}
+				}
+			}
+		}
+	}
+	return buf
+}
+
+// msgpackHeader appends the header of an array or map of n elements: fix is the type's fixed-size
+// form, and wide its form with a 16-bit count, which is followed by that with a 32-bit count.
+func msgpackHeader(buf []byte, fix, wide byte, n int) []byte {
+	switch {
+	case n < 16:
+		return append(buf, fix|byte(n))
+	case n < 1<<16:
+		return append(buf, wide, byte(n>>8), byte(n))
+	}
+	return append(buf, wide+1, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+}
+
+// msgpackString appends a string.
+func msgpackString(buf []byte, s string) []byte {
+	n := len(s)
+	switch {
+	case n < 32:
+		buf = append(buf, 0xa0|byte(n))
+	case n < 1<<8:
+		buf = append(buf, 0xd9, byte(n))
+	case n < 1<<16:
+		buf = append(buf, 0xda, byte(n>>8), byte(n))
+	default:
+		buf = append(buf, 0xdb, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	}
+	return append(buf, s...)
+}
+
+// appendUint64 appends a value in big-endian order.
+func appendUint64(buf []byte, v uint64) []byte {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	return append(buf, b[:]...)
+}
+
+// CSV encodes a list of series as graphite-web's CSV render format does: a row of name, timestamp and
+// value for each value of each series, with the value empty where it is missing.
+func CSV(list []*Series) []byte {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	for _, s := range list {
+		for i, v := range s.Values {
+			ts := time.Unix(s.Start+int64(i)*s.Step, 0).UTC().Format(csvTimeLayout)
+			value := ""
+			if !math.IsNaN(v) && !math.IsInf(v, 0) {
+				value = strconv.FormatFloat(v, 'f', -1, 64)
+			}
+			w.Write([]string{s.Name, ts, value})
+		}
+	}
+	w.Flush()
+	return buf.Bytes()
+}
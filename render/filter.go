@@ -0,0 +1,96 @@
+package render
+
+import (
+	"math"
+	"regexp"
+	"sort"
+)
+
+func init() {
+	functions["highestMax"] = highest(aggregateMax)
+	functions["highestAverage"] = highest(aggregateAverage)
+	functions["exclude"] = matching(false)
+	functions["grep"] = matching(true)
+	functions["limit"] = limit
+}
+
+// highest returns a function that keeps the n series which rank highest by an aggregate of their values,
+// highest first. Series with no values rank lowest.
+func highest(agg aggregator) function {
+	return func(ctx *context, call *expr) ([]*Series, error) {
+		list, err := ctx.seriesArg(call, 0)
+		if err != nil {
+			return nil, err
+		}
+		n, err := intArg(call, 1)
+		if err != nil || n < 0 {
+			return nil, targetError("%s: argument 2 must be a number of series", call.name)
+		}
+		ranked := byRank{list, make([]float64, len(list))}
+		for i, s := range list {
+			if ranked.ranks[i] = agg(s.Values); math.IsNaN(ranked.ranks[i]) {
+				ranked.ranks[i] = math.Inf(-1)
+			}
+		}
+		sort.Stable(ranked)
+		if n < len(list) {
+			list = list[:n]
+		}
+		return list, nil
+	}
+}
+
+// byRank sorts series by their ranks, highest first.
+type byRank struct {
+	list  []*Series
+	ranks []float64
+}
+
+func (r byRank) Len() int           { return len(r.list) }
+func (r byRank) Less(i, j int) bool { return r.ranks[i] > r.ranks[j] }
+func (r byRank) Swap(i, j int) {
+	r.list[i], r.list[j] = r.list[j], r.list[i]
+	r.ranks[i], r.ranks[j] = r.ranks[j], r.ranks[i]
+}
+
+// matching returns a function that keeps the series whose names match a regular expression, or else
+// those whose names don't: grep(seriesList, pattern) and exclude(seriesList, pattern).
+func matching(keep bool) function {
+	return func(ctx *context, call *expr) ([]*Series, error) {
+		list, err := ctx.seriesArg(call, 0)
+		if err != nil {
+			return nil, err
+		}
+		pattern, err := stringArg(call, 1)
+		if err != nil {
+			return nil, err
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, targetError("%s: %s", call.name, err.Error())
+		}
+		kept := make([]*Series, 0, len(list))
+		for _, s := range list {
+			if re.MatchString(s.Name) == keep {
+				kept = append(kept, s)
+			}
+		}
+		return kept, nil
+	}
+}
+
+// limit(seriesList, n) keeps the first n series.
+func limit(ctx *context, call *expr) ([]*Series, error) {
+	list, err := ctx.seriesArg(call, 0)
+	if err != nil {
+		return nil, err
+	}
+	n, err := intArg(call, 1)
+	if err != nil || n < 0 {
+		return nil, targetError("%s: argument 2 must be a number of series", call.name)
+	}
+	if n < len(list) {
+		list = list[:n]
+	}
+	return list, nil
+}
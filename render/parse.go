@@ -0,0 +1,140 @@
+package render
+
+import (
+	"strconv"
+	"strings"
+)
+
+// exprKind is what an expression in a target is.
+type exprKind int
+
+const (
+	exprPath   exprKind = iota // A path expression, which may contain wildcards and braces
+	exprCall                   // A function call
+	exprString                 // A quoted string
+	exprNumber                 // A number
+	exprBool                   // true or false
+)
+
+// expr is a parsed target, or one argument of a function call within it.
+type expr struct {
+	kind exprKind
+	text string  // The expression as written, which also names the series it produces
+	name string  // The name of the function called
+	args []*expr // The arguments of the function called
+	str  string  // The value of a string
+	num  float64 // The value of a number
+	b    bool    // The value of a boolean
+}
+
+// parser reads an expression from a target one character at a time.
+type parser struct {
+	target string
+	pos    int
+}
+
+// parse returns the expression that a target consists of.
+func parse(target string) (*expr, error) {
+	p := &parser{target: target}
+	e, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpace()
+	if p.pos < len(p.target) {
+		return nil, targetError("unexpected %q at offset %d of %q", p.target[p.pos], p.pos, target)
+	}
+	return e, nil
+}
+
+// skipSpace moves past any spaces.
+func (p *parser) skipSpace() {
+	for p.pos < len(p.target) && (p.target[p.pos] == ' ' || p.target[p.pos] == '\t') {
+		p.pos++
+	}
+}
+
+// expr reads one expression: a string, a function call, or else a number, a boolean or a path.
+func (p *parser) expr() (*expr, error) {
+	p.skipSpace()
+	if p.pos >= len(p.target) {
+		return nil, targetError("unexpected end of %q", p.target)
+	}
+	if c := p.target[p.pos]; c == '"' || c == '\'' {
+		return p.quoted(c)
+	}
+
+	// A token runs to the next delimiter, except where a brace makes a comma part of a path.
+	start := p.pos
+	depth := 0
+	for ; p.pos < len(p.target); p.pos++ {
+		c := p.target[p.pos]
+		if c == '{' {
+			depth++
+		} else if c == '}' && depth > 0 {
+			depth--
+		} else if depth == 0 && (c == ',' || c == '(' || c == ')' || c == ' ') {
+			break
+		}
+	}
+	token := p.target[start:p.pos]
+	if token == "" {
+		return nil, targetError("expected an expression at offset %d of %q", start, p.target)
+	}
+	if p.pos < len(p.target) && p.target[p.pos] == '(' {
+		return p.call(start, token)
+	}
+	switch {
+	case token == "true" || token == "false":
+		return &expr{kind: exprBool, text: token, b: token == "true"}, nil
+	case strings.ContainsAny(token[:1], "-+.0123456789"):
+		if n, err := strconv.ParseFloat(token, 64); err == nil {
+			return &expr{kind: exprNumber, text: token, num: n}, nil
+		}
+	}
+	return &expr{kind: exprPath, text: token}, nil
+}
+
+// quoted reads a string, which runs to the next of the quote it starts with.
+func (p *parser) quoted(quote byte) (*expr, error) {
+	start := p.pos
+	end := strings.IndexByte(p.target[start+1:], quote)
+	if end < 0 {
+		return nil, targetError("unterminated string at offset %d of %q", start, p.target)
+	}
+	p.pos = start + 1 + end + 1
+	return &expr{kind: exprString, text: p.target[start:p.pos], str: p.target[start+1 : p.pos-1]}, nil
+}
+
+// call reads the arguments of a function call, the name of which has been read, up to its closing parenthesis.
+func (p *parser) call(start int, name string) (*expr, error) {
+	e := &expr{kind: exprCall, name: name}
+	p.pos++ // Past the opening parenthesis
+	p.skipSpace()
+	if p.pos < len(p.target) && p.target[p.pos] == ')' {
+		p.pos++
+		e.text = p.target[start:p.pos]
+		return e, nil
+	}
+	for {
+		arg, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		e.args = append(e.args, arg)
+		p.skipSpace()
+		if p.pos >= len(p.target) {
+			return nil, targetError("missing ')' in %q", p.target)
+		}
+		switch p.target[p.pos] {
+		case ',':
+			p.pos++
+		case ')':
+			p.pos++
+			e.text = p.target[start:p.pos]
+			return e, nil
+		default:
+			return nil, targetError("unexpected %q at offset %d of %q", p.target[p.pos], p.pos, p.target)
+		}
+	}
+}
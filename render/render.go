@@ -0,0 +1,225 @@
+// Package render evaluates graphite-web render targets: path expressions, and the functions applied to them.
+package render
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Series is one named list of values, evenly spaced in time.
+type Series struct {
+	Name   string    // The path, or the expression that produced the series
+	Start  int64     // Timestamp of the first value
+	Step   int64     // Seconds between values
+	Values []float64 // NaN where there is no value
+
+	PathExpression string // The path expression whose series this was derived from, or the name of a combination
+}
+
+// End returns the timestamp of the last value.
+func (s *Series) End() int64 {
+	if len(s.Values) == 0 {
+		return s.Start
+	}
+	return s.Start + int64(len(s.Values)-1)*s.Step
+}
+
+// MarshalJSON encodes the series as graphite-web's render API does, with each value paired with its timestamp.
+func (s *Series) MarshalJSON() ([]byte, error) {
+	name, err := json.Marshal(s.Name)
+	if err != nil {
+		return nil, err
+	}
+	buf := append(append([]byte(`{"target":`), name...), `,"datapoints":[`...)
+	for i, v := range s.Values {
+		if i > 0 {
+			buf = append(buf, ',')
+		}
+		buf = append(buf, '[')
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			buf = append(buf, "null"...)
+		} else {
+			buf = strconv.AppendFloat(buf, v, 'g', -1, 64)
+		}
+		buf = append(buf, ',')
+		buf = strconv.AppendInt(buf, s.Start+int64(i)*s.Step, 10)
+		buf = append(buf, ']')
+	}
+	return append(buf, "]}"...), nil
+}
+
+// Fetcher returns the series of the paths matched by a path expression, over a time range.
+type Fetcher func(pathExpr string, from, to int64) ([]*Series, error)
+
+// TargetError reports a target that can't be evaluated as written, as opposed to a failure to fetch its series.
+type TargetError struct {
+	Message string
+}
+
+func (e *TargetError) Error() string {
+	return e.Message
+}
+
+// targetError returns a TargetError with a formatted message.
+func targetError(format string, args ...interface{}) error {
+	return &TargetError{fmt.Sprintf(format, args...)}
+}
+
+// context is what a function needs to evaluate its arguments.
+type context struct {
+	from  int64
+	to    int64
+	fetch Fetcher
+}
+
+// function evaluates one call, given its arguments as written. Series arguments are evaluated by the
+// function itself, so that it may change the time range over which they are fetched.
+type function func(ctx *context, call *expr) ([]*Series, error)
+
+// functions are the functions that may be called in a target, by name.
+var functions = map[string]function{}
+
+// Evaluate parses a target, and returns the series it produces over a time range.
+func Evaluate(target string, from, to int64, fetch Fetcher) ([]*Series, error) {
+	e, err := parse(target)
+	if err != nil {
+		return nil, err
+	}
+	return (&context{from, to, fetch}).series(e)
+}
+
+// series evaluates an expression that produces a list of series.
+func (ctx *context) series(e *expr) ([]*Series, error) {
+	switch e.kind {
+	case exprPath:
+		list, err := ctx.fetch(e.text, ctx.from, ctx.to)
+		for _, s := range list {
+			s.PathExpression = e.text
+		}
+		return list, err
+	case exprCall:
+		fn, found := functions[e.name]
+		if !found {
+			return nil, targetError("unknown function %q", e.name)
+		}
+		return fn(ctx, e)
+	}
+	return nil, targetError("expected a series list, found %s", e.text)
+}
+
+// seriesArg evaluates the argument of a call at an index, which must produce a list of series.
+func (ctx *context) seriesArg(call *expr, i int) ([]*Series, error) {
+	if i >= len(call.args) {
+		return nil, targetError("%s: missing series list argument %d", call.name, i+1)
+	}
+	return ctx.series(call.args[i])
+}
+
+// seriesArgs evaluates every argument of a call from an index on, each of which must produce a list of series,
+// and returns the series of them all.
+func (ctx *context) seriesArgs(call *expr, from int) ([]*Series, error) {
+	if from >= len(call.args) {
+		return nil, targetError("%s: missing series list argument %d", call.name, from+1)
+	}
+	var list []*Series
+	for _, arg := range call.args[from:] {
+		s, err := ctx.series(arg)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, s...)
+	}
+	return list, nil
+}
+
+// numberArg returns the argument of a call at an index, which must be a number.
+func numberArg(call *expr, i int) (float64, error) {
+	if i >= len(call.args) || call.args[i].kind != exprNumber {
+		return 0, targetError("%s: argument %d must be a number", call.name, i+1)
+	}
+	return call.args[i].num, nil
+}
+
+// intArg returns the argument of a call at an index, which must be a whole number.
+func intArg(call *expr, i int) (int, error) {
+	n, err := numberArg(call, i)
+	if err != nil || n != math.Trunc(n) {
+		return 0, targetError("%s: argument %d must be a whole number", call.name, i+1)
+	}
+	return int(n), nil
+}
+
+// stringArg returns the argument of a call at an index, which must be a quoted string.
+func stringArg(call *expr, i int) (string, error) {
+	if i >= len(call.args) || call.args[i].kind != exprString {
+		return "", targetError("%s: argument %d must be a string", call.name, i+1)
+	}
+	return call.args[i].str, nil
+}
+
+func init() {
+	functions["alias"] = alias
+	functions["aliasByNode"] = aliasByNode
+}
+
+// alias(seriesList, newName) renames every series.
+func alias(ctx *context, call *expr) ([]*Series, error) {
+	list, err := ctx.seriesArg(call, 0)
+	if err != nil {
+		return nil, err
+	}
+	name, err := stringArg(call, 1)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range list {
+		s.Name = name
+	}
+	return list, nil
+}
+
+// aliasByNode(seriesList, *nodes) renames every series to the nodes of its path at the listed indexes,
+// counting from 0, or back from the end if negative.
+func aliasByNode(ctx *context, call *expr) ([]*Series, error) {
+	list, err := ctx.seriesArg(call, 0)
+	if err != nil {
+		return nil, err
+	}
+	var indexes []int
+	for i := 1; i < len(call.args); i++ {
+		n, err := intArg(call, i)
+		if err != nil {
+			return nil, err
+		}
+		indexes = append(indexes, n)
+	}
+	for _, s := range list {
+		s.Name = pathNodes(s.Name, indexes)
+	}
+	return list, nil
+}
+
+// pathNodes returns the nodes at the listed indexes of the path within a series name, joined by dots.
+// The path is the innermost argument of any function calls that the name still records.
+func pathNodes(name string, indexes []int) string {
+	if i := strings.LastIndexByte(name, '('); i >= 0 {
+		name = name[i+1:]
+	}
+	if i := strings.IndexAny(name, ",)"); i >= 0 {
+		name = name[:i]
+	}
+	nodes := strings.Split(name, ".")
+	var picked []string
+	for _, i := range indexes {
+		if i < 0 {
+			i += len(nodes)
+		}
+		if i >= 0 && i < len(nodes) {
+			picked = append(picked, nodes[i])
+		}
+	}
+	return strings.Join(picked, ".")
+}
@@ -0,0 +1,393 @@
+package render
+
+import (
+	"encoding/json"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testFetcher serves series from a fixed set, matching path expressions literally.
+func testFetcher(series map[string][]*Series) Fetcher {
+	return func(pathExpr string, from, to int64) ([]*Series, error) {
+		var list []*Series
+		for _, s := range series[pathExpr] {
+			c := *s
+			c.Values = append([]float64{}, s.Values...)
+			list = append(list, &c)
+		}
+		return list, nil
+	}
+}
+
+func TestParse(t *testing.T) {
+
+	e, err := parse(`alias(foo.{a,b}.*, "x,y") `)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if e.kind != exprCall || e.name != "alias" || len(e.args) != 2 {
+		t.Fatalf("Wrong call: %+v", e)
+	}
+	if e.text != `alias(foo.{a,b}.*, "x,y")` {
+		t.Errorf("Wrong call text: %q", e.text)
+	}
+	if e.args[0].kind != exprPath || e.args[0].text != "foo.{a,b}.*" {
+		t.Errorf("Wrong path argument: %+v", e.args[0])
+	}
+	if e.args[1].kind != exprString || e.args[1].str != "x,y" {
+		t.Errorf("Wrong string argument: %+v", e.args[1])
+	}
+
+	e, err = parse("f(g(a.b), -1.5, true, 'c', 2xx.y)")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	kinds := []exprKind{exprCall, exprNumber, exprBool, exprString, exprPath}
+	for i, kind := range kinds {
+		if e.args[i].kind != kind {
+			t.Errorf("Argument %d: expected kind %d, got %+v", i, kind, e.args[i])
+		}
+	}
+	if e.args[0].text != "g(a.b)" || e.args[1].num != -1.5 || !e.args[2].b {
+		t.Errorf("Wrong arguments: %+v %+v %+v", e.args[0], e.args[1], e.args[2])
+	}
+
+	for _, bad := range []string{"", "f(a.b", "f(a.b))", "f(a.b,)", "f('x)", "f(a b)"} {
+		if _, err := parse(bad); err == nil {
+			t.Errorf("Expected %q to fail", bad)
+		} else if _, ok := err.(*TargetError); !ok {
+			t.Errorf("Expected a TargetError for %q, got %v", bad, err)
+		}
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+
+	fetch := testFetcher(map[string][]*Series{
+		"foo.*.bar": {
+			{"foo.a.bar", 100, 10, []float64{1, 2}, ""},
+			{"foo.b.bar", 100, 10, []float64{3, math.NaN()}, ""},
+		},
+	})
+
+	list, err := Evaluate("foo.*.bar", 100, 110, fetch)
+	if err != nil || len(list) != 2 || list[1].Name != "foo.b.bar" {
+		t.Errorf("Wrong bare path result: %v %v", list, err)
+	}
+
+	list, err = Evaluate("aliasByNode(foo.*.bar, 1)", 100, 110, fetch)
+	if err != nil || len(list) != 2 || list[0].Name != "a" || list[1].Name != "b" {
+		t.Errorf("Wrong aliasByNode result: %v %v", list, err)
+	}
+
+	list, err = Evaluate("alias(aliasByNode(foo.*.bar, -1), 'x')", 100, 110, fetch)
+	if err != nil || len(list) != 2 || list[0].Name != "x" {
+		t.Errorf("Wrong nested result: %v %v", list, err)
+	}
+
+	for _, bad := range []string{"nosuch(foo.*.bar)", "alias(foo.*.bar)", "alias(1, 'x')", "aliasByNode(foo.*.bar, 1.5)"} {
+		if _, err := Evaluate(bad, 100, 110, fetch); err == nil {
+			t.Errorf("Expected %q to fail", bad)
+		}
+	}
+}
+
+func TestSeriesJSON(t *testing.T) {
+	s := &Series{"foo.bar", 100, 10, []float64{1.5, math.NaN(), 3}, ""}
+	text, err := json.Marshal([]*Series{s})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var got []map[string]interface{}
+	if err := json.Unmarshal(text, &got); err != nil {
+		t.Fatalf("Invalid JSON %s: %v", text, err)
+	}
+	expected := []map[string]interface{}{{
+		"target":     "foo.bar",
+		"datapoints": []interface{}{[]interface{}{1.5, 100.0}, []interface{}{nil, 110.0}, []interface{}{3.0, 120.0}},
+	}}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected %v, got %v", expected, got)
+	}
+	if s.End() != 120 {
+		t.Errorf("Wrong end: %d", s.End())
+	}
+}
+
+func TestCombine(t *testing.T) {
+
+	nan := math.NaN()
+	fetch := testFetcher(map[string][]*Series{
+		"web*.requests": {
+			{"web1.requests", 100, 10, []float64{1, 2, nan}, ""},
+			{"web2.requests", 110, 10, []float64{3, 4, nan}, ""},
+		},
+		"db.requests": {
+			{"db.requests", 100, 20, []float64{10, 20}, ""},
+		},
+	})
+
+	cases := []struct {
+		target string
+		start  int64
+		values []float64
+	}{
+		{"sumSeries(web*.requests)", 100, []float64{1, 5, 4, nan}},
+		{"averageSeries(web*.requests)", 100, []float64{1, 2.5, 4, nan}},
+		{"minSeries(web*.requests)", 100, []float64{1, 2, 4, nan}},
+		{"maxSeries(web*.requests)", 100, []float64{1, 3, 4, nan}},
+		// Series at a 10s step are averaged into the 20s step of the other before they are combined.
+		{"sumSeries(web*.requests, db.requests)", 100, []float64{14.5, 24}},
+	}
+	for _, c := range cases {
+		list, err := Evaluate(c.target, 100, 130, fetch)
+		if err != nil || len(list) != 1 {
+			t.Errorf("%s: unexpected result %v %v", c.target, list, err)
+			continue
+		}
+		s := list[0]
+		if s.Name != c.target || s.Start != c.start || !sameValues(s.Values, c.values) {
+			t.Errorf("%s: expected %d %v, got %q %d %v", c.target, c.start, c.values, s.Name, s.Start, s.Values)
+		}
+	}
+
+	fetch = testFetcher(map[string][]*Series{
+		"*.cpu.*": {
+			{"web1.cpu.user", 100, 10, []float64{1, 2}, ""},
+			{"web2.cpu.user", 100, 10, []float64{3, 4}, ""},
+			{"web1.cpu.system", 100, 10, []float64{5, nan}, ""},
+		},
+	})
+	list, err := Evaluate("groupByNode(*.cpu.*, 2, 'sum')", 100, 110, fetch)
+	if err != nil || len(list) != 2 {
+		t.Fatalf("Unexpected groupByNode result: %v %v", list, err)
+	}
+	if list[0].Name != "user" || !sameValues(list[0].Values, []float64{4, 6}) {
+		t.Errorf("Wrong first group: %q %v", list[0].Name, list[0].Values)
+	}
+	if list[1].Name != "system" || !sameValues(list[1].Values, []float64{5, nan}) {
+		t.Errorf("Wrong second group: %q %v", list[1].Name, list[1].Values)
+	}
+	if list, _ = Evaluate("groupByNode(*.cpu.*, 0)", 100, 110, fetch); len(list) != 2 || list[0].Values[0] != 3 {
+		t.Errorf("Wrong default groupByNode result: %v", list)
+	}
+	if _, err = Evaluate("groupByNode(*.cpu.*, 0, 'median')", 100, 110, fetch); err == nil {
+		t.Errorf("Expected an unknown callback to fail")
+	}
+}
+
+// sameValues reports whether two lists of values are equal, treating NaNs as equal.
+func sameValues(a, b []float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] && !(math.IsNaN(a[i]) && math.IsNaN(b[i])) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestTransform(t *testing.T) {
+
+	nan := math.NaN()
+	var fetched []int64
+	fetch := func(pathExpr string, from, to int64) ([]*Series, error) {
+		fetched = append(fetched, from, to)
+		start := from - from%10
+		s := &Series{Name: pathExpr, Start: start, Step: 10}
+		for t := start; t <= to; t += 10 {
+			s.Values = append(s.Values, float64(t/10))
+		}
+		return []*Series{s}, nil
+	}
+	counter := testFetcher(map[string][]*Series{
+		"c": {{"c", 100, 10, []float64{1, 3, nan, 6, 2, 250}, ""}},
+	})
+
+	cases := []struct {
+		target string
+		fetch  Fetcher
+		name   string
+		start  int64
+		values []float64
+	}{
+		{"derivative(c)", counter, "derivative(c)", 100, []float64{nan, 2, nan, nan, -4, 248}},
+		{"nonNegativeDerivative(c)", counter, "nonNegativeDerivative(c)", 100, []float64{nan, 2, nan, 3, nan, 248}},
+		{"nonNegativeDerivative(c, 255)", counter, "nonNegativeDerivative(c)", 100, []float64{nan, 2, nan, 3, 252, 248}},
+		{"scale(c, 2)", counter, "scale(c,2)", 100, []float64{2, 6, nan, 12, 4, 500}},
+		{"offset(c, -1)", counter, "offset(c,-1)", 100, []float64{0, 2, nan, 5, 1, 249}},
+		{"movingAverage(c, 2)", counter, "movingAverage(c,2)", 100, []float64{1, 2, 3, 6, 4, 126}},
+		{"timeShift(a, '1min')", fetch, `timeShift(a, "1min")`, 100, []float64{4, 5, 6}},
+		{"timeShift(a, '+10s')", fetch, `timeShift(a, "+10s")`, 100, []float64{11, 12, 13}},
+		{"movingAverage(a, '30s')", fetch, `movingAverage(a,'30s')`, 100, []float64{9, 10, 11}},
+	}
+	for _, c := range cases {
+		fetched = nil
+		list, err := Evaluate(c.target, 100, 120, c.fetch)
+		if err != nil || len(list) != 1 {
+			t.Errorf("%s: unexpected result %v %v", c.target, list, err)
+			continue
+		}
+		s := list[0]
+		if s.Name != c.name || s.Start != c.start || !sameValues(s.Values, c.values) {
+			t.Errorf("%s: expected %q %d %v, got %q %d %v", c.target, c.name, c.start, c.values, s.Name, s.Start, s.Values)
+		}
+	}
+
+	// The series are read from earlier when they are shifted, or fill a window of time.
+	fetched = nil
+	Evaluate("timeShift(movingAverage(a, '1min'), '1h')", 100, 120, fetch)
+	if !reflect.DeepEqual(fetched, []int64{100 - 3600 - 60, 120 - 3600}) {
+		t.Errorf("Wrong range read: %v", fetched)
+	}
+
+	for _, bad := range []string{"scale(c)", "timeShift(c, 'soon')", "movingAverage(c, 0)", "movingAverage(c)"} {
+		if _, err := Evaluate(bad, 100, 120, counter); err == nil {
+			t.Errorf("Expected %q to fail", bad)
+		}
+	}
+}
+
+func TestParseInterval(t *testing.T) {
+	cases := map[string]int64{
+		"30s": 30, "5min": 300, "5m": 300, "2hours": 7200, "-1d": -86400, "+1w": 604800, "1mon": 2592000, "1y": 31536000,
+	}
+	for interval, expected := range cases {
+		if got, err := parseInterval(interval); err != nil || got != expected {
+			t.Errorf("%s: expected %d, got %d %v", interval, expected, got, err)
+		}
+	}
+	for _, bad := range []string{"", "d", "5", "5ms", "-"} {
+		if _, err := parseInterval(bad); err == nil {
+			t.Errorf("Expected %q to fail", bad)
+		}
+	}
+}
+
+func TestFilter(t *testing.T) {
+
+	nan := math.NaN()
+	fetch := testFetcher(map[string][]*Series{
+		"web*.load": {
+			{"web1.load", 100, 10, []float64{1, 9, 1}, ""},
+			{"web2.load", 100, 10, []float64{4, 4, 4}, ""},
+			{"web3.load", 100, 10, []float64{nan, nan, nan}, ""},
+			{"web10.load", 100, 10, []float64{2, 3, nan}, ""},
+		},
+	})
+
+	cases := map[string][]string{
+		"highestMax(web*.load, 2)":       {"web1.load", "web2.load"},
+		"highestAverage(web*.load, 2)":   {"web2.load", "web1.load"},
+		"highestAverage(web*.load, 9)":   {"web2.load", "web1.load", "web10.load", "web3.load"},
+		"exclude(web*.load, 'web1')":     {"web2.load", "web3.load"},
+		"grep(web*.load, '^web[12]\\.')": {"web1.load", "web2.load"},
+		"limit(web*.load, 3)":            {"web1.load", "web2.load", "web3.load"},
+		"limit(web*.load, 0)":            {},
+	}
+	for target, expected := range cases {
+		list, err := Evaluate(target, 100, 120, fetch)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", target, err)
+			continue
+		}
+		names := []string{}
+		for _, s := range list {
+			names = append(names, s.Name)
+		}
+		if !reflect.DeepEqual(names, expected) {
+			t.Errorf("%s: expected %v, got %v", target, expected, names)
+		}
+	}
+
+	for _, bad := range []string{"limit(web*.load, -1)", "grep(web*.load, '(')", "highestMax(web*.load)", "exclude(web*.load, 1)"} {
+		if _, err := Evaluate(bad, 100, 120, fetch); err == nil {
+			t.Errorf("Expected %q to fail", bad)
+		}
+	}
+}
+
+func TestEncode(t *testing.T) {
+
+	if got := string(Pickle(nil)); got != "\x80\x02]." {
+		t.Errorf("Wrong empty pickle: %q", got)
+	}
+	list := []*Series{{"a", 10, 10, []float64{math.NaN(), 0.5}, ""}}
+
+	str := func(s string) string { return "X" + string([]byte{byte(len(s)), 0, 0, 0}) + s }
+	num := func(n byte) string { return "J" + string([]byte{n, 0, 0, 0}) }
+	expected := "\x80\x02](}(" + str("name") + str("a") + str("pathExpression") + str("a") +
+		str("start") + num(10) + str("end") + num(30) + str("step") + num(10) +
+		str("values") + "](NG\x3f\xe0\x00\x00\x00\x00\x00\x00eue."
+	if got := string(Pickle(list)); got != expected {
+		t.Errorf("Wrong pickle:\n%q, expected\n%q", got, expected)
+	}
+
+	str = func(s string) string { return string([]byte{0xa0 | byte(len(s))}) + s }
+	num = func(n byte) string { return "\xd3\x00\x00\x00\x00\x00\x00\x00" + string([]byte{n}) }
+	expected = "\x91\x86" + str("name") + str("a") + str("pathExpression") + str("a") +
+		str("start") + num(10) + str("end") + num(30) + str("step") + num(10) +
+		str("values") + "\x92\xc0\xcb\x3f\xe0\x00\x00\x00\x00\x00\x00"
+	if got := string(Msgpack(list)); got != expected {
+		t.Errorf("Wrong msgpack:\n%q, expected\n%q", got, expected)
+	}
+
+	list = append(list, &Series{"b,c", 60, 60, []float64{2}, ""})
+	expected = "a,1970-01-01 00:00:10,\na,1970-01-01 00:00:20,0.5\n\"b,c\",1970-01-01 00:01:00,2\n"
+	if got := string(CSV(list)); got != expected {
+		t.Errorf("Wrong CSV:\n%q, expected\n%q", got, expected)
+	}
+}
+
+func TestConsolidate(t *testing.T) {
+	s := &Series{"a", 10, 10, []float64{1, 2, 3, 4, 5, 6}, "a.*"}
+	if c := Consolidate(s, 6); c != s {
+		t.Errorf("A short enough series was consolidated: %v", c.Values)
+	}
+	// Intervals of 20s would begin at 0, 20, 40 and 60, which is one too many.
+	c := Consolidate(s, 3)
+	if c.Start != 0 || c.Step != 30 || !reflect.DeepEqual(c.Values, []float64{1.5, 4, 6}) || c.PathExpression != "a.*" {
+		t.Errorf("Wrong consolidation: start %d step %d values %v", c.Start, c.Step, c.Values)
+	}
+}
+
+func TestParseTime(t *testing.T) {
+	now := time.Date(2015, 6, 10, 14, 30, 15, 0, time.UTC) // A Wednesday
+	at := func(month time.Month, day, hour, minute int) int64 {
+		return time.Date(2015, month, day, hour, minute, 0, 0, time.UTC).Unix()
+	}
+	cases := map[string]int64{
+		"1450000000":     1450000000,
+		"now":            now.Unix(),
+		"":               now.Unix(),
+		"-1h":            now.Unix() - 3600,
+		"now-7d":         now.Unix() - 7*86400,
+		"-1h30min":       now.Unix() - 5400,
+		"+5m":            now.Unix() + 300,
+		"midnight":       at(6, 10, 0, 0),
+		"noon yesterday": at(6, 9, 12, 0),
+		"teatime":        at(6, 10, 16, 0),
+		"9:15pm":         at(6, 10, 21, 15),
+		"04:00_20150101": at(1, 1, 4, 0),
+		"20150101":       at(1, 1, 0, 0),
+		"12/31/14":       time.Date(2014, 12, 31, 0, 0, 0, 0, time.UTC).Unix(),
+		"jan15":          at(1, 15, 0, 0),
+		"monday":         at(6, 8, 0, 0),
+		"wednesday":      at(6, 10, 0, 0),
+		"tomorrow-1h":    at(6, 10, 23, 0),
+	}
+	for s, expected := range cases {
+		if got, err := ParseTime(s, now); err != nil || got != expected {
+			t.Errorf("%q: expected %d, got %d %v", s, expected, got, err)
+		}
+	}
+	for _, bad := range []string{"soon", "-1", "-1fortnight", "20150230", "feb30", "25:00", "now-"} {
+		if _, err := ParseTime(bad, now); err == nil {
+			t.Errorf("Expected %q to fail", bad)
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package render
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+func init() {
+	functions["derivative"] = derivative
+	functions["nonNegativeDerivative"] = nonNegativeDerivative
+	functions["scale"] = scale
+	functions["offset"] = offset
+	functions["timeShift"] = timeShift
+	functions["movingAverage"] = movingAverage
+}
+
+// derivative(seriesList) replaces each value with its change from the one before.
+func derivative(ctx *context, call *expr) ([]*Series, error) {
+	list, err := ctx.seriesArg(call, 0)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range list {
+		prev := math.NaN()
+		for i, v := range s.Values {
+			s.Values[i], prev = v-prev, v
+		}
+		s.Name = fmt.Sprintf("derivative(%s)", s.Name)
+	}
+	return list, nil
+}
+
+// nonNegativeDerivative(seriesList, maxValue=None) replaces each value of a counter with its increase from
+// the one before. Where the counter decreases, it has wrapped at maxValue if given, or else been reset,
+// in which case the change is missing.
+func nonNegativeDerivative(ctx *context, call *expr) ([]*Series, error) {
+	list, err := ctx.seriesArg(call, 0)
+	if err != nil {
+		return nil, err
+	}
+	maxValue := math.NaN()
+	if len(call.args) > 1 {
+		if maxValue, err = numberArg(call, 1); err != nil {
+			return nil, err
+		}
+	}
+	for _, s := range list {
+		prev := math.NaN()
+		for i, v := range s.Values {
+			delta := v - prev
+			if delta < 0 {
+				if !math.IsNaN(maxValue) && prev <= maxValue {
+					delta = maxValue - prev + v + 1
+				} else {
+					delta = math.NaN()
+				}
+			}
+			s.Values[i] = delta
+			if !math.IsNaN(v) {
+				prev = v
+			}
+		}
+		s.Name = fmt.Sprintf("nonNegativeDerivative(%s)", s.Name)
+	}
+	return list, nil
+}
+
+// scale(seriesList, factor) multiplies every value by a factor.
+func scale(ctx *context, call *expr) ([]*Series, error) {
+	return mapValues(ctx, call, func(v, factor float64) float64 { return v * factor })
+}
+
+// offset(seriesList, factor) adds a factor to every value.
+func offset(ctx *context, call *expr) ([]*Series, error) {
+	return mapValues(ctx, call, func(v, factor float64) float64 { return v + factor })
+}
+
+// mapValues applies an operation to every value, given the number that is the second argument of the call.
+func mapValues(ctx *context, call *expr, op func(v, factor float64) float64) ([]*Series, error) {
+	list, err := ctx.seriesArg(call, 0)
+	if err != nil {
+		return nil, err
+	}
+	factor, err := numberArg(call, 1)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range list {
+		for i, v := range s.Values {
+			s.Values[i] = op(v, factor)
+		}
+		s.Name = fmt.Sprintf("%s(%s,%s)", call.name, s.Name, call.args[1].text)
+	}
+	return list, nil
+}
+
+// timeShift(seriesList, timeShift) draws the series as they were an interval earlier, such as "1d", or
+// later, such as "+1h". An interval without a sign is into the past.
+func timeShift(ctx *context, call *expr) ([]*Series, error) {
+	shift, err := stringArg(call, 1)
+	if err != nil {
+		return nil, err
+	}
+	interval := shift
+	if !strings.HasPrefix(shift, "+") && !strings.HasPrefix(shift, "-") {
+		interval = "-" + shift
+	}
+	delta, err := parseInterval(interval)
+	if err != nil {
+		return nil, targetError("%s: %s", call.name, err.Error())
+	}
+	shifted := &context{ctx.from + delta, ctx.to + delta, ctx.fetch}
+	list, err := shifted.seriesArg(call, 0)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range list {
+		s.Start -= delta
+		s.Name = fmt.Sprintf("timeShift(%s, %q)", s.Name, shift)
+	}
+	return list, nil
+}
+
+// movingAverage(seriesList, windowSize) replaces each value with the average of those in a window ending
+// with it: a number of values, or an interval such as "5min". For an interval, the series are read from
+// that much earlier, so that the first values are averaged over a whole window too.
+func movingAverage(ctx *context, call *expr) ([]*Series, error) {
+	if len(call.args) < 2 {
+		return nil, targetError("%s: missing window size", call.name)
+	}
+	var points int
+	var window int64
+	var err error
+	if call.args[1].kind == exprString {
+		if window, err = parseInterval(call.args[1].str); err != nil || window <= 0 {
+			return nil, targetError("%s: invalid window size %s", call.name, call.args[1].text)
+		}
+	} else if points, err = intArg(call, 1); err != nil || points <= 0 {
+		return nil, targetError("%s: window size must be a positive number of values", call.name)
+	}
+
+	bootstrap := &context{ctx.from - window, ctx.to, ctx.fetch}
+	list, err := bootstrap.seriesArg(call, 0)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range list {
+		n := points
+		if window > 0 && s.Step > 0 {
+			n = int(window / s.Step)
+			if n < 1 {
+				n = 1
+			}
+		}
+		averaged := make([]float64, len(s.Values))
+		for i := range s.Values {
+			lo := i - n + 1
+			if lo < 0 {
+				lo = 0
+			}
+			averaged[i] = aggregateAverage(s.Values[lo : i+1])
+		}
+
+		// Drop the values read only to fill the first window.
+		skip := 0
+		for skip < len(averaged) && s.Start+int64(skip+1)*s.Step <= ctx.from {
+			skip++
+		}
+		s.Values = averaged[skip:]
+		s.Start += int64(skip) * s.Step
+		s.Name = fmt.Sprintf("movingAverage(%s,%s)", s.Name, call.args[1].text)
+	}
+	return list, nil
+}
+
+// The length of each unit in which an interval may be given, in seconds.
+var intervalUnits = []struct {
+	prefix  string
+	seconds int64
+}{
+	{"s", 1},
+	{"min", 60},
+	{"h", 3600},
+	{"d", 86400},
+	{"w", 7 * 86400},
+	{"mon", 30 * 86400},
+	{"y", 365 * 86400},
+}
+
+// parseInterval returns the seconds in an interval such as "5min" or "-1d", as graphite-web writes them.
+// A unit may be written in full, as in "2hours"; "m" is minutes, while months must be at least "mon".
+func parseInterval(interval string) (int64, error) {
+	s := strings.TrimSpace(interval)
+	sign := int64(1)
+	if strings.HasPrefix(s, "-") {
+		sign, s = -1, s[1:]
+	} else {
+		s = strings.TrimPrefix(s, "+")
+	}
+	digits := strings.IndexFunc(s, func(r rune) bool { return r < '0' || r > '9' })
+	if digits <= 0 {
+		return 0, fmt.Errorf("invalid interval %q", interval)
+	}
+	n, _ := strconv.ParseInt(s[:digits], 10, 64)
+	unit := s[digits:]
+	if unit == "m" {
+		unit = "min"
+	}
+	for i := len(intervalUnits) - 1; i >= 0; i-- {
+		if strings.HasPrefix(unit, intervalUnits[i].prefix) {
+			return sign * n * intervalUnits[i].seconds, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid interval %q", interval)
+}
@@ -0,0 +1,222 @@
+/**
+ * Reader for the whisper files written by Graphite's carbon daemon.
+ *
+ * See: http://graphite.readthedocs.io/en/latest/whisper.html
+ */
+package whisper
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"time"
+)
+
+// The sizes, in bytes, of the parts of a whisper file.
+const (
+	metadataSize    = 16 // aggregationType, maxRetention, xFilesFactor, archiveCount
+	archiveInfoSize = 12 // offset, secondsPerPoint, points
+	pointSize       = 12 // interval, value
+)
+
+// The aggregation methods recorded in a whisper file's metadata.
+const (
+	Average = 1 + iota
+	Sum
+	Last
+	Max
+	Min
+)
+
+// Archive describes one of the ring buffers of points in a whisper file, finest first.
+type Archive struct {
+	Offset          uint32 // Byte offset of the first point in the file
+	SecondsPerPoint uint32 // Precision of the archive
+	Points          uint32 // Number of points the archive holds
+}
+
+// Retention returns how far back the archive holds points.
+func (a Archive) Retention() time.Duration {
+	return time.Duration(a.SecondsPerPoint) * time.Duration(a.Points) * time.Second
+}
+
+// Point is one data point, stored at the start of its interval.
+type Point struct {
+	Timestamp uint32
+	Value     float64
+}
+
+// File is an open whisper file.
+type File struct {
+	AggregationMethod uint32
+	MaxRetention      uint32
+	XFilesFactor      float32
+	Archives          []Archive
+	r                 io.ReaderAt
+	c                 io.Closer
+}
+
+// Open reads the header of a whisper file, leaving it open for reading points.
+func Open(filename string) (*File, error) {
+	fp, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	f, err := Read(fp)
+	if err != nil {
+		fp.Close()
+		return nil, fmt.Errorf("%s: %s", filename, err.Error())
+	}
+	f.c = fp
+	return f, nil
+}
+
+// Read reads the header of a whisper file from any source.
+func Read(r io.ReaderAt) (*File, error) {
+	header := make([]byte, metadataSize)
+	if _, err := r.ReadAt(header, 0); err != nil {
+		return nil, fmt.Errorf("reading metadata: %s", err.Error())
+	}
+	f := &File{r: r}
+	f.AggregationMethod = binary.BigEndian.Uint32(header[0:4])
+	f.MaxRetention = binary.BigEndian.Uint32(header[4:8])
+	f.XFilesFactor = math.Float32frombits(binary.BigEndian.Uint32(header[8:12]))
+	count := binary.BigEndian.Uint32(header[12:16])
+	if count == 0 || count > 64 {
+		return nil, fmt.Errorf("implausible archive count %d", count)
+	}
+
+	info := make([]byte, archiveInfoSize*int(count))
+	if _, err := r.ReadAt(info, metadataSize); err != nil {
+		return nil, fmt.Errorf("reading archive info: %s", err.Error())
+	}
+	for i := 0; i < int(count); i++ {
+		b := info[i*archiveInfoSize:]
+		a := Archive{binary.BigEndian.Uint32(b[0:4]), binary.BigEndian.Uint32(b[4:8]), binary.BigEndian.Uint32(b[8:12])}
+		if a.SecondsPerPoint == 0 || a.Points == 0 {
+			return nil, fmt.Errorf("archive %d is empty", i)
+		}
+		f.Archives = append(f.Archives, a)
+	}
+	return f, nil
+}
+
+// Close closes the underlying file, if it was opened by Open.
+func (f *File) Close() error {
+	if f.c != nil {
+		return f.c.Close()
+	}
+	return nil
+}
+
+// ArchiveFor returns the index of the archive best suited to supplying points at the supplied precision:
+// the coarsest that is at least as fine, which holds the most history, or else the finest there is.
+func (f *File) ArchiveFor(precision time.Duration) int {
+	best := 0
+	for i, a := range f.Archives {
+		if time.Duration(a.SecondsPerPoint)*time.Second <= precision {
+			best = i
+		}
+	}
+	return best
+}
+
+// Points returns the points of an archive that are still within its retention at the supplied time,
+// in time order. Slots that were never written, or that hold points since overwritten, are omitted.
+func (f *File) Points(archive int, now time.Time) ([]Point, error) {
+	a := f.Archives[archive]
+	buf := make([]byte, pointSize*int(a.Points))
+	if _, err := f.r.ReadAt(buf, int64(a.Offset)); err != nil {
+		return nil, fmt.Errorf("reading archive %d: %s", archive, err.Error())
+	}
+	oldest := now.Add(-a.Retention()).Unix()
+	var points []Point
+	for i := 0; i < int(a.Points); i++ {
+		b := buf[i*pointSize:]
+		p := Point{binary.BigEndian.Uint32(b[0:4]), math.Float64frombits(binary.BigEndian.Uint64(b[4:12]))}
+		if p.Timestamp != 0 && int64(p.Timestamp) > oldest {
+			points = append(points, p)
+		}
+	}
+	sort.Sort(byTimestamp(points))
+	return points, nil
+}
+
+// byTimestamp sorts points into time order.
+type byTimestamp []Point
+
+// Implementation of sort.Interface.
+func (p byTimestamp) Len() int {
+	return len(p)
+}
+func (p byTimestamp) Swap(i, j int) {
+	p[i], p[j] = p[j], p[i]
+}
+func (p byTimestamp) Less(i, j int) bool {
+	return p[i].Timestamp < p[j].Timestamp
+}
+
+// Create writes a new whisper file with archives of the supplied precisions and sizes, finest first,
+// and leaves it open for writing points.
+func Create(filename string, method uint32, xff float32, archives []Archive) (*File, error) {
+	fp, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, err
+	}
+	f := &File{AggregationMethod: method, XFilesFactor: xff, r: fp, c: fp}
+	offset := uint32(metadataSize + archiveInfoSize*len(archives))
+	for _, a := range archives {
+		a.Offset = offset
+		offset += pointSize * a.Points
+		if retention := a.SecondsPerPoint * a.Points; retention > f.MaxRetention {
+			f.MaxRetention = retention
+		}
+		f.Archives = append(f.Archives, a)
+	}
+
+	header := make([]byte, offset)
+	binary.BigEndian.PutUint32(header[0:4], f.AggregationMethod)
+	binary.BigEndian.PutUint32(header[4:8], f.MaxRetention)
+	binary.BigEndian.PutUint32(header[8:12], math.Float32bits(f.XFilesFactor))
+	binary.BigEndian.PutUint32(header[12:16], uint32(len(f.Archives)))
+	for i, a := range f.Archives {
+		b := header[metadataSize+i*archiveInfoSize:]
+		binary.BigEndian.PutUint32(b[0:4], a.Offset)
+		binary.BigEndian.PutUint32(b[4:8], a.SecondsPerPoint)
+		binary.BigEndian.PutUint32(b[8:12], a.Points)
+	}
+	if _, err := fp.WriteAt(header, 0); err != nil {
+		fp.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// WriteArchive replaces the contents of an archive with the supplied points, which must be in time order.
+// Timestamps are aligned to the archive's precision, and only the most recent points that fit are kept.
+func (f *File) WriteArchive(archive int, points []Point) error {
+	w, ok := f.r.(io.WriterAt)
+	if !ok {
+		return fmt.Errorf("file is not writable")
+	}
+	a := f.Archives[archive]
+	if len(points) > int(a.Points) {
+		points = points[len(points)-int(a.Points):]
+	}
+	buf := make([]byte, pointSize*int(a.Points))
+	if len(points) > 0 {
+		// The slot of each point is its offset from the first, which is written to slot zero.
+		base := points[0].Timestamp - points[0].Timestamp%a.SecondsPerPoint
+		for _, p := range points {
+			ts := p.Timestamp - p.Timestamp%a.SecondsPerPoint
+			b := buf[((ts-base)/a.SecondsPerPoint%a.Points)*pointSize:]
+			binary.BigEndian.PutUint32(b[0:4], ts)
+			binary.BigEndian.PutUint64(b[4:12], math.Float64bits(p.Value))
+		}
+	}
+	_, err := w.WriteAt(buf, int64(a.Offset))
+	return err
+}
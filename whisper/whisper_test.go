@@ -0,0 +1,122 @@
+package whisper
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// build assembles a whisper file with 5 points of 10 seconds, and 5 of 60 seconds.
+func build(points [][]Point) []byte {
+	var buf bytes.Buffer
+	w := func(v interface{}) { binary.Write(&buf, binary.BigEndian, v) }
+	w(uint32(Average))
+	w(uint32(300))
+	w(math.Float32bits(0.5))
+	w(uint32(2))
+	offset := uint32(metadataSize + 2*archiveInfoSize)
+	for _, spp := range []uint32{10, 60} {
+		w(offset)
+		w(spp)
+		w(uint32(5))
+		offset += 5 * pointSize
+	}
+	for _, archive := range points {
+		for i := 0; i < 5; i++ {
+			if i < len(archive) {
+				w(archive[i].Timestamp)
+				w(math.Float64bits(archive[i].Value))
+			} else {
+				w(uint32(0))
+				w(uint64(0))
+			}
+		}
+	}
+	return buf.Bytes()
+}
+
+func TestRead(t *testing.T) {
+	now := time.Unix(1000, 0)
+	data := build([][]Point{
+		{{1000, 3}, {960, 1}, {970, 2}, {900, 9}}, // Out of order, as in a ring buffer; 900 has expired
+		{{960, 4}},
+	})
+	f, err := Read(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Read failed: %s", err.Error())
+	}
+	if f.AggregationMethod != Average || f.XFilesFactor != 0.5 || len(f.Archives) != 2 {
+		t.Errorf("Unexpected metadata: %+v", f)
+	}
+
+	points, err := f.Points(0, now)
+	if err != nil {
+		t.Fatalf("Points failed: %s", err.Error())
+	}
+	expected := []Point{{960, 1}, {970, 2}, {1000, 3}}
+	if len(points) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, points)
+	}
+	for i := range points {
+		if points[i] != expected[i] {
+			t.Errorf("Expected %v, got %v", expected, points)
+		}
+	}
+
+	tests := []struct {
+		precision time.Duration
+		archive   int
+	}{
+		{time.Second, 0},
+		{10 * time.Second, 0},
+		{time.Minute, 1},
+		{time.Hour, 1},
+	}
+	for _, test := range tests {
+		if archive := f.ArchiveFor(test.precision); archive != test.archive {
+			t.Errorf("ArchiveFor(%v) = %d, expected %d", test.precision, archive, test.archive)
+		}
+	}
+
+	if _, err := Read(bytes.NewReader(data[:10])); err == nil {
+		t.Errorf("Expected an error reading a truncated file")
+	}
+}
+
+func TestCreate(t *testing.T) {
+	filename := filepath.Join(os.TempDir(), fmt.Sprintf("whisper_test_%d.wsp", os.Getpid()))
+	defer os.Remove(filename)
+
+	f, err := Create(filename, Max, 0, []Archive{{0, 10, 3}, {0, 60, 2}})
+	if err != nil {
+		t.Fatalf("Create failed: %s", err.Error())
+	}
+	if err := f.WriteArchive(0, []Point{{905, 1}, {910, 2}, {920, 3}, {930, 4}}); err != nil {
+		t.Fatalf("WriteArchive failed: %s", err.Error())
+	}
+	f.Close()
+
+	f, err = Open(filename)
+	if err != nil {
+		t.Fatalf("Open failed: %s", err.Error())
+	}
+	defer f.Close()
+	if f.AggregationMethod != Max || f.MaxRetention != 120 || f.Archives[1].Offset != 76 {
+		t.Errorf("Unexpected header: %+v", f)
+	}
+	points, _ := f.Points(0, time.Unix(935, 0))
+	expected := []Point{{910, 2}, {920, 3}, {930, 4}}
+	if len(points) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, points)
+	}
+	for i := range points {
+		if points[i] != expected[i] {
+			t.Errorf("Expected %v, got %v", expected, points)
+		}
+	}
+}